@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/auth"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+	"github.com/stretchr/testify/assert"
+)
+
+// allowedRoles lists, for every access token route, the roles allowed to use it. A route added to accessTokenRoutes
+// must be added here as well.
+var allowedRoles = map[string][]string{
+	"GET /ping":                  {"user", "publisher", "admin", "none"},
+	"GET /api-keys":              {"user", "admin"},
+	"POST /api-keys":             {"user", "admin"},
+	"GET /integrations":          {"user", "admin"},
+	"POST /integrations":         {"user", "admin"},
+	"POST /integrations/dry-run": {"user", "admin"},
+	"GET /alerts":                {"user", "admin"},
+	"GET /alerts/:id":            {"user", "admin"},
+	"POST /alerts/:id":           {"user", "admin"},
+	"GET /alerts/:id/history":    {"user", "admin"},
+	"POST /alerts/:id/notified":  {"user", "admin"},
+	"POST /bulk/alerts":          {"user", "admin"},
+	"GET /events":                {"user", "admin"},
+	"GET /heartbeats":            {"user", "admin"},
+	"GET /accounts":              {"admin"},
+	"PUT /accounts/:id/roles":    {"admin"},
+	"GET /renewals":              {"admin"},
+	"GET /tokens":                {"admin"},
+}
+
+func accessToken(t *testing.T, sharedKey []byte, roles ...string) string {
+	token := auth.Token{
+		IssueTime: time.Now().Unix(),
+		ID:        "Id",
+		AccountID: "AccountID",
+		Type:      "access_token",
+		Scope:     auth.Scope{Roles: roles, Capabilities: []string{}},
+	}
+
+	str, err := auth.EncryptAccessToken(&token, sharedKey)
+	assert.NoError(t, err)
+	return str
+}
+
+func TestAccessTokenRoutePermissions(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		var sharedKey = []byte("shared key123456")
+		policy := auth.DefaultPolicy()
+
+		// the real handlers are replaced, only the authorization is tested
+		routes := accessTokenRoutes(db, newEventStream(), policy)
+		for i := range routes {
+			routes[i].handler = func(c *gin.Context) {
+				accountID, _ := c.Get("accountID")
+				assert.Equal("AccountID", accountID)
+				c.Status(http.StatusNoContent)
+			}
+		}
+		assert.Len(routes, len(allowedRoles))
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		registerAccessTokenRoutes(router.Group("/api/v1"), routes, policy, sharedKey)
+
+		tokens := map[string]string{
+			"user":      accessToken(t, sharedKey, "user"),
+			"publisher": accessToken(t, sharedKey, "publisher"),
+			"admin":     accessToken(t, sharedKey, "admin"),
+			"none":      accessToken(t, sharedKey),
+		}
+
+		for _, route := range routes {
+			name := route.method + " " + route.path
+			allowed, ok := allowedRoles[name]
+			if !assert.True(ok, "no expected roles for %s", name) {
+				continue
+			}
+
+			for role, token := range tokens {
+				req, _ := http.NewRequest(route.method, "/api/v1"+route.path, nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				res := httptest.NewRecorder()
+				router.ServeHTTP(res, req)
+
+				expected := http.StatusForbidden
+				for _, r := range allowed {
+					if r == role {
+						expected = http.StatusNoContent
+					}
+				}
+				assert.Equal(expected, res.Code, "%s with role %s", name, role)
+			}
+
+			// without a token
+			req, _ := http.NewRequest(route.method, "/api/v1"+route.path, nil)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			assert.Equal(http.StatusUnauthorized, res.Code, name)
+		}
+	})
+}
+
+func TestAccessTokenRoutesUseCurrentRoles(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		var sharedKey = []byte("shared key123456")
+		policy := auth.DefaultPolicy()
+		policy.AccountRoles = currentAccountRoles(db, auth.UserRole)
+
+		account := model.NewAccount()
+		account.GrantRole(auth.AdminRole)
+		assert.NoError(account.Save(db))
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.GET("/accounts", auth.ValidateAccessToken(policy.Require(auth.AdminCapability), sharedKey), func(c *gin.Context) {
+			c.Status(http.StatusNoContent)
+		})
+
+		serve := func(accountID string) *httptest.ResponseRecorder {
+			token := auth.Token{ID: "Id", AccountID: accountID, Type: "access_token", Scope: auth.Scope{Roles: []string{auth.AdminRole}}}
+			str, err := auth.EncryptAccessToken(&token, sharedKey)
+			assert.NoError(err)
+
+			req, _ := http.NewRequest("GET", "/accounts", nil)
+			req.Header.Set("Authorization", "Bearer "+str)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			return res
+		}
+
+		assert.Equal(http.StatusNoContent, serve(account.ID).Code)
+
+		// the admin token is refused as soon as the role is revoked
+		account.RevokeRole(auth.AdminRole)
+		assert.NoError(account.Save(db))
+		assertProblem(t, serve(account.ID), http.StatusForbidden, problem.Forbidden)
+
+		// accounts that are gone have no roles
+		assertProblem(t, serve("nosuchaccount"), http.StatusForbidden, problem.Forbidden)
+
+		// accounts that can not be read fail the request
+		assert.NoError(db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("Accounts")).Put([]byte("broken"), []byte("garbage"))
+		}))
+		assertProblem(t, serve("broken"), http.StatusInternalServerError, problem.InternalError)
+	})
+}
+
+func TestSetupRoutesRegistersAccessTokenRoutes(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		assert.NoError(err)
+
+		cfg := defaultConfig()
+		cfg.Tokens.AccessKey = "shared key123456"
+
+		gin.SetMode(gin.TestMode)
+		r := setupRoutes(db, newEventStream(), cfg, key, newHealthChecker(db, cfg.Health, nil))
+
+		registered := map[string]bool{}
+		for _, route := range r.Routes() {
+			registered[route.Method+" "+route.Path] = true
+		}
+
+		for name := range allowedRoles {
+			parts := strings.SplitN(name, " ", 2)
+			assert.True(registered[parts[0]+" /api/v1"+parts[1]], "%s is not registered", name)
+		}
+	})
+}
+
+func TestSetupRoutesAnswersProblems(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		assert.NoError(err)
+
+		cfg := defaultConfig()
+		cfg.Tokens.AccessKey = "shared key123456"
+
+		gin.SetMode(gin.TestMode)
+		r := setupRoutes(db, newEventStream(), cfg, key, newHealthChecker(db, cfg.Health, nil))
+
+		serve := func(method string, path string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest(method, path, strings.NewReader("{}"))
+			req.Header.Set("X-Request-ID", "test-1")
+			res := httptest.NewRecorder()
+			r.ServeHTTP(res, req)
+			return res
+		}
+
+		p := assertProblem(t, serve("GET", "/api/v1/nothing"), http.StatusNotFound, problem.NotFound)
+		assert.Equal("/api/v1/nothing", p.Instance)
+		assert.Equal("test-1", p.RequestID)
+
+		assertProblem(t, serve("POST", "/api/v1/alerts"), http.StatusUnauthorized, problem.MissingAPIKey)
+		assertProblem(t, serve("GET", "/api/v1/alerts"), http.StatusUnauthorized, problem.MissingToken)
+	})
+}
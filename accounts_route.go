@@ -1,10 +1,15 @@
 package main
 
 import (
+	"net/http"
+	"strings"
+
 	"github.com/boltdb/bolt"
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
+	"github.com/joakim666/wip_alerts/auth"
+	"github.com/joakim666/wip_alerts/logging"
 	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
 )
 
 type NewAccountDTO struct {
@@ -15,9 +20,15 @@ type NewAccountDTO struct {
 
 type AccountDTO struct {
 	ID      string      `json:"id"` // uuid
+	Roles   []string    `json:"roles"`
 	Devices []DeviceDTO `json:"devices"`
 }
 
+// AccountRolesDTO sets the roles of an account
+type AccountRolesDTO struct {
+	Roles []string `json:"roles"`
+}
+
 type DeviceDTO struct {
 	ID         string `json:"id"` // uuid
 	DeviceID   string `json:"device_id"`
@@ -27,18 +38,20 @@ type DeviceDTO struct {
 }
 
 func ListAccounts(db *bolt.DB) gin.HandlerFunc {
-	glog.Infof("listAccounts")
+	logging.Debugf("listAccounts")
 
 	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
 		accounts, err := model.ListAccounts(db)
 		if err != nil {
-			glog.Errorf("ListAccounts failed: %s", err)
-			c.Status(500)
+			logger.Errorf("ListAccounts failed: %s", err)
+			problem.Abort(c, problem.Internal())
 		} else {
 			accountDTOs, err := makeAccountDTOs(db, accounts)
 			if err != nil {
-				glog.Errorf("Failed to transform accounts into dtos: %s", err)
-				c.Status(500)
+				logger.Errorf("Failed to transform accounts into dtos: %s", err)
+				problem.Abort(c, problem.Internal())
 			}
 
 			c.JSON(200, accountDTOs)
@@ -48,35 +61,102 @@ func ListAccounts(db *bolt.DB) gin.HandlerFunc {
 
 func PostAccounts(db *bolt.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
 		var json NewAccountDTO
 
-		if c.BindJSON(&json) == nil {
+		err := c.ShouldBindJSON(&json)
+		if err != nil {
+			logger.Infof("Binding failed: %s", err)
+			problem.Abort(c, problem.Binding(err))
+			return
+		}
 
-			account := model.NewAccount()
+		account := model.NewAccount()
 
-			err := account.Save(db)
-			if err != nil {
-				glog.Errorf("Failed to save account in db: %s", err)
-				c.Status(500)
-				return
-			}
+		err = account.Save(db)
+		if err != nil {
+			logger.Errorf("Failed to save account in db: %s", err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
 
-			device := newDeviceFromDTO(&json)
+		device := newDeviceFromDTO(&json)
 
-			devices := make(map[string]model.Device)
-			devices[device.ID] = *device
+		devices := make(map[string]model.Device)
+		devices[device.ID] = *device
 
-			err = model.SaveDevices(db, account.ID, &devices)
-			if err != nil {
-				glog.Errorf("Failed to save devices for account in db: %s", err)
-				c.Status(500)
+		err = model.SaveDevices(db, account.ID, &devices)
+		if err != nil {
+			logger.Errorf("Failed to save devices for account in db: %s", err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		c.JSON(201, gin.H{
+			"account_id": account.ID,
+		})
+	}
+}
+
+// UpdateAccountRolesRoute replaces the roles granted to an account. An account without roles gets the default role.
+// Tokens already issued to the account are checked against the new roles from their next request.
+func UpdateAccountRolesRoute(db *bolt.DB, policy *auth.Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		adminID, _ := c.Get("accountID")
+
+		var json AccountRolesDTO
+		err := c.ShouldBindJSON(&json)
+		if err != nil {
+			logger.Infof("Binding failed: %s", err)
+			problem.Abort(c, problem.Binding(err))
+			return
+		}
+
+		for _, role := range json.Roles {
+			if !policy.HasRole(role) {
+				logger.Errorf("Unknown role %s", role)
+				problem.Abort(c, problem.Invalid("roles", "oneof", "unknown role %s, must be one of %s", role, strings.Join(policy.Roles(), ", ")))
 				return
 			}
+		}
+
+		account, err := model.GetAccount(db, c.Param("id"))
+		if err != nil {
+			logger.Errorf("Failed to get account %s: %s", c.Param("id"), err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+		if account == nil {
+			logger.Infof("No account %s", c.Param("id"))
+			problem.Abort(c, problem.New(http.StatusNotFound, problem.NotFound, "No account with id %s", c.Param("id")))
+			return
+		}
 
-			c.JSON(201, gin.H{
-				"account_id": account.ID,
-			})
+		account.Roles = nil
+		for _, role := range json.Roles {
+			account.GrantRole(role)
 		}
+
+		err = account.Save(db)
+		if err != nil {
+			logger.Errorf("Failed to save account %s: %s", account.ID, err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		logger.Infof("Account %s set the roles of account %s to %s", adminID, account.ID, strings.Join(account.Roles, ","))
+
+		devices, err := model.ListDevices(db, account.ID)
+		if err != nil {
+			logger.Errorf("Failed to get devices of account %s: %s", account.ID, err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		c.JSON(200, makeAccountDTO(*account, devices))
 	}
 }
 
@@ -90,7 +170,7 @@ func newDeviceFromDTO(dto *NewAccountDTO) *model.Device {
 }
 
 func makeAccountDTOs(db *bolt.DB, accounts *map[string]model.Account) (*[]AccountDTO, error) {
-	glog.Infof("makeAccountDTOs. Size=%d", len(*accounts))
+	logging.Infof("makeAccountDTOs. Size=%d", len(*accounts))
 	var dtos []AccountDTO
 
 	if len(*accounts) > 0 {
@@ -109,17 +189,21 @@ func makeAccountDTOs(db *bolt.DB, accounts *map[string]model.Account) (*[]Accoun
 }
 
 func makeAccountDTO(account model.Account, devices *map[string]model.Device) AccountDTO { // TODO pointers?
-	glog.Infof("makeAccountDTO")
+	logging.Debugf("makeAccountDTO")
 	var dto AccountDTO
 
 	dto.ID = account.ID
+	dto.Roles = account.Roles
+	if dto.Roles == nil {
+		dto.Roles = make([]string, 0)
+	}
 	dto.Devices = *makeDeviceDTOs(devices)
 
 	return dto
 }
 
 func makeDeviceDTOs(devices *map[string]model.Device) *[]DeviceDTO {
-	glog.Infof("makeDeviceDTOs. Size=%d", len(*devices))
+	logging.Infof("makeDeviceDTOs. Size=%d", len(*devices))
 	var dtos []DeviceDTO
 
 	for _, v := range *devices {
@@ -130,7 +214,7 @@ func makeDeviceDTOs(devices *map[string]model.Device) *[]DeviceDTO {
 }
 
 func makeDeviceDTO(device model.Device) DeviceDTO { // TODO pointers?
-	glog.Infof("makeDeviceDTO")
+	logging.Debugf("makeDeviceDTO")
 	var dto DeviceDTO
 
 	dto.ID = device.ID
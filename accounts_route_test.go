@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/auth"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateAccountRoles(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		account := model.NewAccount()
+		assert.NoError(account.Save(db))
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.PUT("/accounts/:id/roles", UpdateAccountRolesRoute(db, auth.DefaultPolicy()))
+
+		req, _ := http.NewRequest("PUT", "/accounts/"+account.ID+"/roles", strings.NewReader(`{"roles": ["admin", "user", "admin"]}`))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(200, res.Code)
+
+		var dto AccountDTO
+		assert.NoError(json.Unmarshal(res.Body.Bytes(), &dto))
+		assert.Equal([]string{"admin", "user"}, dto.Roles)
+
+		saved, err := model.GetAccount(db, account.ID)
+		assert.NoError(err)
+		assert.Equal([]string{"admin", "user"}, saved.Roles)
+
+		// unknown roles are rejected and nothing is changed
+		req, _ = http.NewRequest("PUT", "/accounts/"+account.ID+"/roles", strings.NewReader(`{"roles": ["root"]}`))
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		p := assertProblem(t, res, 400, problem.ValidationFailed)
+		assert.Equal("roles", p.Errors[0].Field)
+		assert.Contains(p.Errors[0].Detail, "unknown role root")
+
+		saved, err = model.GetAccount(db, account.ID)
+		assert.NoError(err)
+		assert.Equal([]string{"admin", "user"}, saved.Roles)
+
+		req, _ = http.NewRequest("PUT", "/accounts/nosuchaccount/roles", strings.NewReader(`{"roles": []}`))
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assertProblem(t, res, 404, problem.NotFound)
+
+		// an account that can not be read is a failure of the server
+		assert.NoError(db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("Accounts")).Put([]byte("broken"), []byte("garbage"))
+		}))
+		req, _ = http.NewRequest("PUT", "/accounts/broken/roles", strings.NewReader(`{"roles": []}`))
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assertProblem(t, res, 500, problem.InternalError)
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+)
+
+// alertmanagerWebhookDTO is the payload sent by the Prometheus Alertmanager webhook receiver
+type alertmanagerWebhookDTO struct {
+	Version           string              `json:"version"`
+	GroupKey          string              `json:"groupKey"`
+	Status            string              `json:"status"`
+	Receiver          string              `json:"receiver"`
+	GroupLabels       map[string]string   `json:"groupLabels"`
+	CommonLabels      map[string]string   `json:"commonLabels"`
+	CommonAnnotations map[string]string   `json:"commonAnnotations"`
+	ExternalURL       string              `json:"externalURL"`
+	Alerts            []alertmanagerAlert `json:"alerts" binding:"required"`
+}
+
+type alertmanagerAlert struct {
+	Status       string            `json:"status"` // "firing" or "resolved"
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"` // not sent by Alertmanager versions before 0.19
+}
+
+type ingestResultDTO struct {
+	Fingerprint string           `json:"fingerprint"`
+	ID          string           `json:"id,omitempty"`
+	Action      ingestAction     `json:"action"`
+	Error       *problem.Problem `json:"error,omitempty"` // why the alert was rejected
+}
+
+// AlertmanagerWebhookRoute receives alerts from the Prometheus Alertmanager. Firing alerts create a new alert, or
+// update the open alert with the same fingerprint, and resolved alerts resolve the open alert with the same
+// fingerprint. Firing alerts are validated against the limits and an invalid alert is rejected without stopping the
+// others.
+func AlertmanagerWebhookRoute(db *bolt.DB, stream *eventStream, limits configValidation) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("AlertmanagerWebhookRoute")
+
+		accountIDInterface, exists := c.Get("accountID")
+		if exists == false {
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+		apiKeyID, exists := c.Get("apiKeyID")
+		if exists == false {
+			logger.Infof("No apiKeyID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		accountID, ok := accountIDInterface.(string)
+		if ok == false {
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		var json alertmanagerWebhookDTO
+
+		err := c.ShouldBindJSON(&json)
+		if err != nil {
+			logger.Infof("Binding failed: %s", err)
+			problem.Abort(c, problem.Binding(err))
+			return
+		}
+
+		defaultLabels, err := apiKeyDefaultLabels(db, apiKeyID.(string))
+		if err != nil {
+			logger.Errorf("Failed to get api key: %s", err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		actor := actorFromContext(c, accountID)
+
+		now := time.Now()
+
+		results := make([]ingestResultDTO, 0, len(json.Alerts))
+		for _, a := range json.Alerts {
+			fingerprint := a.Fingerprint
+			if fingerprint == "" {
+				fingerprint = alertmanagerFingerprint(a.Labels)
+			}
+
+			var alert *model.Alert
+			var action ingestAction
+
+			if a.Status == "resolved" {
+				alert, action, err = resolveIngestedAlert(db, stream, accountID, actor, fingerprint)
+			} else {
+				alert = makeAlertmanagerAlert(apiKeyID.(string), a)
+				p := validateIngestedAlert(alert, a.Labels, limits, now)
+				if p != nil {
+					logger.Infof("Rejected alert with fingerprint %s: %s", fingerprint, p)
+					results = append(results, ingestResultDTO{Fingerprint: fingerprint, Action: ingestRejected, Error: p})
+					continue
+				}
+				alert.Fingerprint = fingerprint
+				alert.Labels = model.MergeLabels(defaultLabels, a.Labels)
+				alert, action, err = ingestAlert(db, stream, accountID, actor, alert)
+			}
+			if err != nil {
+				logger.Errorf("Failed to ingest alert with fingerprint %s: %s", fingerprint, err)
+				problem.Abort(c, problem.Internal())
+				return
+			}
+
+			res := ingestResultDTO{Fingerprint: fingerprint, Action: action}
+			if alert != nil {
+				res.ID = alert.ID
+			}
+			results = append(results, res)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"results": results})
+	}
+}
+
+// makeAlertmanagerAlert maps an Alertmanager alert to a new alert. The alertname label becomes the title and the
+// summary and description annotations the descriptions.
+func makeAlertmanagerAlert(apiKeyID string, a alertmanagerAlert) *model.Alert {
+	alert := model.NewAlert(apiKeyID)
+
+	alert.Title = a.Labels["alertname"]
+	if alert.Title == "" {
+		alert.Title = a.Annotations["summary"]
+	}
+
+	alert.ShortDescription = a.Annotations["summary"]
+	if alert.ShortDescription == "" {
+		alert.ShortDescription = alert.Title
+	}
+
+	alert.LongDescription = a.Annotations["description"]
+	if alert.LongDescription == "" {
+		alert.LongDescription = alert.ShortDescription
+	}
+	if a.GeneratorURL != "" {
+		alert.LongDescription += "\n\n" + a.GeneratorURL
+	}
+
+	alert.Priority = model.PriorityFromSeverity(a.Labels["severity"])
+
+	alert.TriggeredAt = a.StartsAt
+	if alert.TriggeredAt.IsZero() {
+		alert.TriggeredAt = alert.CreatedAt
+	}
+
+	return alert
+}
+
+// alertmanagerFingerprint computes a fingerprint from the labels for Alertmanager versions not sending one
+func alertmanagerFingerprint(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(labels[k]))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
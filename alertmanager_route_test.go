@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/stretchr/testify/assert"
+)
+
+const firingAlertmanagerBody = `
+	{
+		"version": "4",
+		"groupKey": "{}:{alertname=\"DiskFull\"}",
+		"status": "firing",
+		"receiver": "wip",
+		"groupLabels": {"alertname": "DiskFull"},
+		"commonLabels": {"alertname": "DiskFull", "severity": "critical"},
+		"commonAnnotations": {},
+		"externalURL": "http://alertmanager:9093",
+		"alerts": [
+			{
+				"status": "firing",
+				"labels": {"alertname": "DiskFull", "severity": "critical", "instance": "web1"},
+				"annotations": {"summary": "Disk is full on web1", "description": "Less than 1% left on /"},
+				"startsAt": "2017-01-02T15:04:05Z",
+				"endsAt": "0001-01-01T00:00:00Z",
+				"generatorURL": "http://prometheus:9090/graph",
+				"fingerprint": "aaaabbbbccccdddd"
+			}
+		]
+	}
+`
+
+const resolvedAlertmanagerBody = `
+	{
+		"version": "4",
+		"status": "resolved",
+		"alerts": [
+			{
+				"status": "resolved",
+				"labels": {"alertname": "DiskFull", "severity": "critical", "instance": "web1"},
+				"annotations": {"summary": "Disk is full on web1"},
+				"startsAt": "2017-01-02T15:04:05Z",
+				"endsAt": "2017-01-02T16:04:05Z",
+				"fingerprint": "aaaabbbbccccdddd"
+			}
+		]
+	}
+`
+
+func TestAlertmanagerWebhookRoute(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", "apiKey1")
+		})
+
+		router.POST("/integrations/alertmanager", AlertmanagerWebhookRoute(db, nil, defaultConfig().Validation))
+
+		post := func(body string) map[string][]ingestResultDTO {
+			req, _ := http.NewRequest("POST", "/integrations/alertmanager", strings.NewReader(body))
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+			assert.Equal(http.StatusOK, res.Code)
+
+			var resMap map[string][]ingestResultDTO
+			err := json.Unmarshal(res.Body.Bytes(), &resMap)
+			assert.NoError(err)
+			return resMap
+		}
+
+		// 1. a firing alert creates an alert
+		resMap := post(firingAlertmanagerBody)
+		assert.Equal(1, len(resMap["results"]))
+		assert.Equal(ingestCreated, resMap["results"][0].Action)
+		assert.Equal("aaaabbbbccccdddd", resMap["results"][0].Fingerprint)
+
+		alerts, err := model.ListAlerts(db, "55")
+		assert.NoError(err)
+		assert.Equal(1, len(*alerts))
+
+		alert := (*alerts)[resMap["results"][0].ID]
+		assert.Equal("DiskFull", alert.Title)
+		assert.Equal("Disk is full on web1", alert.ShortDescription)
+		assert.True(strings.HasPrefix(alert.LongDescription, "Less than 1% left on /"))
+		assert.Equal(model.HighPriority, alert.Priority)
+		assert.Equal(model.NewStatus, alert.Status)
+		assert.Equal("web1", alert.Labels["instance"])
+		assert.Equal("aaaabbbbccccdddd", alert.Fingerprint)
+		assert.Equal(2017, alert.TriggeredAt.Year())
+
+		// 2. repeated notifications update the open alert
+		resMap = post(firingAlertmanagerBody)
+		assert.Equal(ingestUpdated, resMap["results"][0].Action)
+		assert.Equal(alert.ID, resMap["results"][0].ID)
+
+		alerts, err = model.ListAlerts(db, "55")
+		assert.NoError(err)
+		assert.Equal(1, len(*alerts))
+
+		// 3. resolving resolves the alert
+		resMap = post(resolvedAlertmanagerBody)
+		assert.Equal(ingestResolved, resMap["results"][0].Action)
+		assert.Equal(alert.ID, resMap["results"][0].ID)
+
+		a, _, err := model.GetAlert(db, alert.ID)
+		assert.NoError(err)
+		assert.Equal(model.ResolvedStatus, a.Status)
+
+		events, err := model.ListAlertEvents(db, alert.ID)
+		assert.NoError(err)
+		assert.Equal(3, len(events))
+
+		// 4. resolving again does nothing
+		resMap = post(resolvedAlertmanagerBody)
+		assert.Equal(ingestIgnored, resMap["results"][0].Action)
+		assert.Equal("", resMap["results"][0].ID)
+
+		// 5. firing again after being resolved creates a new alert
+		resMap = post(firingAlertmanagerBody)
+		assert.Equal(ingestCreated, resMap["results"][0].Action)
+		assert.NotEqual(alert.ID, resMap["results"][0].ID)
+	})
+}
+
+func TestAlertmanagerWebhookRouteWithInvalidData(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", "apiKey1")
+		})
+
+		router.POST("/integrations/alertmanager", AlertmanagerWebhookRoute(db, nil, defaultConfig().Validation))
+
+		for _, body := range []string{"", "{}", "{\"alerts\": 5}"} {
+			req, _ := http.NewRequest("POST", "/integrations/alertmanager", strings.NewReader(body))
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+			assert.Equal(http.StatusBadRequest, res.Code, body)
+		}
+	})
+}
+
+func TestAlertmanagerWebhookRouteRejectsInvalidAlerts(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", "apiKey1")
+		})
+
+		router.POST("/integrations/alertmanager", AlertmanagerWebhookRoute(db, nil, defaultConfig().Validation))
+
+		body := `
+			{
+				"version": "4",
+				"status": "firing",
+				"alerts": [
+					{"status": "firing", "labels": {"alertname": "` + strings.Repeat("x", 201) + `"}, "fingerprint": "long"},
+					{"status": "firing", "labels": {"alertname": "DiskFull", "bad:key": "x"}, "fingerprint": "labels"},
+					{"status": "firing", "labels": {"alertname": "DiskFull"}, "fingerprint": "valid"}
+				]
+			}
+		`
+		req, _ := http.NewRequest("POST", "/integrations/alertmanager", strings.NewReader(body))
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var resMap map[string][]ingestResultDTO
+		err := json.Unmarshal(res.Body.Bytes(), &resMap)
+		assert.NoError(err)
+		results := resMap["results"]
+		assert.Equal(3, len(results))
+
+		// the invalid alerts are rejected with the errors of their fields, without stopping the valid one
+		assert.Equal(ingestRejected, results[0].Action)
+		assert.Equal("", results[0].ID)
+		if assert.NotNil(results[0].Error) {
+			assert.Equal("title", results[0].Error.Errors[0].Field)
+			assert.Equal("max", results[0].Error.Errors[0].Reason)
+		}
+		assert.Equal(ingestRejected, results[1].Action)
+		if assert.NotNil(results[1].Error) {
+			assert.Equal("labels", results[1].Error.Errors[0].Field)
+		}
+		assert.Equal(ingestCreated, results[2].Action)
+		assert.Nil(results[2].Error)
+
+		alerts, err := model.ListAlerts(db, "55")
+		assert.NoError(err)
+		assert.Equal(1, len(*alerts))
+	})
+}
+
+func TestAlertmanagerFingerprint(t *testing.T) {
+	assert := assert.New(t)
+
+	fp := alertmanagerFingerprint(map[string]string{"alertname": "DiskFull", "instance": "web1"})
+	assert.Equal(16, len(fp))
+	assert.Equal(fp, alertmanagerFingerprint(map[string]string{"instance": "web1", "alertname": "DiskFull"}))
+	assert.NotEqual(fp, alertmanagerFingerprint(map[string]string{"alertname": "DiskFull", "instance": "web2"}))
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/boltdb/bolt"
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
+	"github.com/joakim666/wip_alerts/logging"
 	"time"
 	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
 	"net/http"
 )
 
@@ -13,113 +18,217 @@ type createAlertDTO struct {
 	Title            string                `json:"title" binding:"required"`
 	ShortDescription string                `json:"short_description" binding:"required"`
 	LongDescription  string                `json:"long_description" binding:"required"`
-	Priority         model.AlertPriority   `json:"priority" binding:"required"`
+	Priority         model.AlertPriority   `json:"priority" binding:"required,oneof=high normal low"`
 	TriggeredAt      time.Time             `json:"triggered_at" binding:"required"`
+	Labels           map[string]string     `json:"labels"`
 }
 
 type alertDTO struct {
-	ID               string                `json:"id"`
-	Title            string                `json:"title"`
-	ShortDescription string                `json:"short_description"`
-	LongDescription  string                `json:"long_description"`
-	Priority         model.AlertPriority   `json:"priority"`
-	Status           model.AlertStatus     `json:"status"`
-	TriggeredAt      time.Time             `json:"triggered_at"`
-	CreatedAt        time.Time             `json:"created_at"`
-	UpdatedAt        time.Time             `json:"updated_at"`
+	ID                 string              `json:"id"`
+	Title              string              `json:"title"`
+	ShortDescription   string              `json:"short_description"`
+	LongDescription    string              `json:"long_description"`
+	Priority           model.AlertPriority `json:"priority"`
+	Status             model.AlertStatus   `json:"status"`
+	Labels             map[string]string   `json:"labels"`
+	Fingerprint        string              `json:"fingerprint,omitempty"`
+	SnoozedUntil       *time.Time          `json:"snoozed_until,omitempty"`
+	AllowedTransitions []model.AlertStatus `json:"allowed_transitions"`
+	TriggeredAt        time.Time           `json:"triggered_at"`
+	CreatedAt          time.Time           `json:"created_at"`
+	UpdatedAt          time.Time           `json:"updated_at"`
 }
 
 type updateAlertDTO struct {
-	Status model.AlertStatus        `json:"status" binding:"required"`
+	Status       model.AlertStatus `json:"status" binding:"required"`
+	SnoozedUntil *time.Time        `json:"snoozed_until"` // mandatory when status is "snoozed"
+}
+
+type bulkUpdateAlertsDTO struct {
+	Status       model.AlertStatus `json:"status" binding:"required"`
+	SnoozedUntil *time.Time        `json:"snoozed_until"`
+	IDs          []string          `json:"ids"`    // either ids or filter must be given
+	Filter       *alertFilterDTO   `json:"filter"` // either ids or filter must be given
+}
+
+type alertFilterDTO struct {
+	Priority  model.AlertPriority `json:"priority"`
+	APIKeyID  string              `json:"api_key_id"`
+	Labels    map[string]string   `json:"labels"`
+	OlderThan *time.Time          `json:"older_than"`
+}
+
+type bulkResultDTO struct {
+	ID      string    `json:"id"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	Alert   *alertDTO `json:"alert,omitempty"`
+}
+
+type alertEventDTO struct {
+	ID         string               `json:"id"`
+	Type       model.AlertEventType `json:"type"`
+	FromStatus model.AlertStatus    `json:"from_status,omitempty"`
+	ToStatus   model.AlertStatus    `json:"to_status"`
+	ActorType  model.ActorType      `json:"actor_type"`
+	ActorID    string               `json:"actor_id,omitempty"`
+	CreatedAt  time.Time            `json:"created_at"`
 }
 
 // CreateAlertRoute creates and saves a new alert
-func CreateAlertRoute(db *bolt.DB) gin.HandlerFunc {
+func CreateAlertRoute(db *bolt.DB, stream *eventStream, limits configValidation) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		glog.Infof("CreateAlertRoute")
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("CreateAlertRoute")
 
 		accountIDInterface, exists := c.Get("accountID")
 		if exists == false {
-			glog.Infof("No accountID set")
-			c.Status(401) // => Unauthorized
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 		apiKeyID, exists := c.Get("apiKeyID")
 		if exists == false {
-			glog.Infof("No apiKeyID set")
-			c.Status(401) // => Unauthorized
+			logger.Infof("No apiKeyID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
 		accountID, ok := accountIDInterface.(string)
 		if ok == false {
-			glog.Infof("AccountID in context is not a string")
-			c.Status(401) // => Unauthorized
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
 		var json createAlertDTO
 
-		err := c.BindJSON(&json)
-		if err != nil {
-			glog.Infof("Binding failed: %s", err)
-			c.Status(400) // => Bad Request
+		p := bindPayload(c, &json)
+		if p == nil {
+			p = validateAlert(&json, limits, time.Now())
+		}
+		if p != nil {
+			logger.Infof("Invalid alert: %s", p)
+			problem.Abort(c, p)
 			return
 		}
 
-		glog.Infof("Json: %s", json)
+		// the labels of the alert are added on top of the default labels of the api key
+		defaultLabels, err := apiKeyDefaultLabels(db, apiKeyID.(string))
+		if err != nil {
+			logger.Errorf("Failed to get api key: %s", err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
 
-		alert := model.NewAlert(apiKeyID.(string))
-		alert.Title = json.Title
-		alert.ShortDescription = json.ShortDescription
-		alert.LongDescription = json.LongDescription
-		alert.Priority = json.Priority
-		alert.TriggeredAt = json.TriggeredAt
+		alert := newAlertFromPayload(apiKeyID.(string), defaultLabels, &json)
 
-		err = alert.Save(db, accountID)
+		err = alert.SaveWithEvent(db, accountID, model.NewAlertEvent(alert, model.AlertCreatedEvent, actorFromContext(c, accountID)))
 		if err != nil {
-			glog.Errorf("Failed to save created alert: %s", err)
-			c.Status(500) // => Internal Server error
+			logger.Errorf("Failed to save created alert: %s", err)
+			problem.Abort(c, problem.Internal())
 			return
 		}
 
+		alertsCreated.WithLabelValues(string(alert.Priority)).Inc()
+
+		stream.Notify(accountID)
+
 		dto := makeAlertDTO(alert)
 
 		c.JSON(http.StatusCreated, dto)
 	}
 }
 
-// ListAlertsRoute lists all alerts with status not "archived"
-func ListAlertsRoute(db *bolt.DB) gin.HandlerFunc {
+// maxAlertsWait is the longest time ListAlertsRoute holds a request waiting for changes
+const maxAlertsWait = 60 * time.Second
+
+// ListAlertsRoute lists all alerts with status not "archived". The alerts can be filtered on labels with one or
+// more query parameters on the form label=key:value.
+//
+// The response has an ETag based on the alert version of the account and a request with a matching If-None-Match
+// header gets a 304 Not Modified answer. With the wait parameter, in seconds, the request is held open until an
+// alert of the account changes or the time has passed.
+func ListAlertsRoute(db *bolt.DB, stream *eventStream) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		glog.Infof("ListAlertsRoute")
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("ListAlertsRoute")
 
 		accountIDInterface, exists := c.Get("accountID")
 		if exists == false {
-			glog.Infof("No accountID set")
-			c.Status(401) // => Unauthorized
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
 		accountID, ok := accountIDInterface.(string)
 		if ok == false {
-			glog.Infof("AccountID in context is not a string")
-			c.Status(401) // => Unauthorized
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		labels, err := parseLabelFilter(c.Request.URL.Query()["label"])
+		if err != nil {
+			logger.Infof("Invalid label filter: %s", err)
+			problem.Abort(c, problem.New(http.StatusBadRequest, problem.InvalidParameter, "%s", err))
+			return
+		}
+
+		wait, err := parseWait(c.Query("wait"))
+		if err != nil {
+			logger.Infof("Invalid wait: %s", err)
+			problem.Abort(c, problem.New(http.StatusBadRequest, problem.InvalidParameter, "%s", err))
 			return
 		}
 
-		glog.Infof("Listing alerts for account id: %s", accountID)
+		version, err := model.AlertVersion(db, accountID)
+		if err != nil {
+			logger.Errorf("%s", err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+		etag := alertsETag(version)
+
+		ifNoneMatch := c.Request.Header.Get("If-None-Match")
+		if wait > 0 && (ifNoneMatch == "" || etagMatches(ifNoneMatch, etag)) {
+			logger.Infof("Waiting up to %s for alert changes for account id: %s", wait, accountID)
+
+			// the wait may be longer than the write timeout of the server, which would otherwise cut the answer off
+			http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+			version, err = waitForAlertChange(c, db, stream, accountID, version, wait)
+			if err != nil {
+				logger.Errorf("%s", err)
+				problem.Abort(c, problem.Internal())
+				return
+			}
+			etag = alertsETag(version)
+		}
+
+		c.Writer.Header().Set("ETag", etag)
+		if etagMatches(ifNoneMatch, etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		logger.Infof("Listing alerts for account id: %s", accountID)
 
 		alerts, err := model.ListNonArchivedAlerts(db, accountID)
 		if err != nil {
-			glog.Infof("No account for account id=%s", accountID)
-			c.Status(400) // => Bad Request
+			logger.Errorf("Failed to list alerts of account %s: %s", accountID, err)
+			problem.Abort(c, problem.Internal())
 			return
 		}
 
 		dtos := make(map[string]alertDTO, 0)
 
 		for _, v := range *alerts {
+			if !v.HasLabels(labels) {
+				continue
+			}
 			dto := makeAlertDTO(&v)
 			dtos[dto.ID] = dto
 		}
@@ -128,86 +237,417 @@ func ListAlertsRoute(db *bolt.DB) gin.HandlerFunc {
 	}
 }
 
-// UpdateAlertRoute updates the status of the alert. Allowed status transitions are:
-//  * NewStatus -> SeenStatus
-//  * NewStatus -> ArchivedStatus
-//  * SeenStatus -> ArchivedStatus
-func UpdateAlertRoute(db *bolt.DB) gin.HandlerFunc {
+// waitForAlertChange waits until the alert version of the account is larger than 'version', the timeout has passed,
+// the client has gone away or the server is shutting down. Returns the current alert version.
+func waitForAlertChange(c *gin.Context, db *bolt.DB, stream *eventStream, accountID string, version uint64, timeout time.Duration) (uint64, error) {
+	// subscribe before checking the version so that no change is missed
+	ch := stream.Subscribe(accountID)
+	defer stream.Unsubscribe(accountID, ch)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		current, err := model.AlertVersion(db, accountID)
+		if err != nil {
+			return 0, err
+		}
+		if current > version {
+			return current, nil
+		}
+
+		select {
+		case <-ch:
+			// something happened for the account, check the version again
+		case <-timer.C:
+			return current, nil
+		case <-c.Request.Context().Done():
+			return current, nil
+		case <-stream.Done():
+			return current, nil
+		}
+	}
+}
+
+func alertsETag(version uint64) string {
+	return fmt.Sprintf(`"alerts-%d"`, version)
+}
+
+// etagMatches checks if the If-None-Match header contains the etag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseWait parses the wait parameter given in seconds. The wait is capped at maxAlertsWait.
+func parseWait(wait string) (time.Duration, error) {
+	if wait == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.Atoi(wait)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("Wait %s is not a number of seconds", wait)
+	}
+
+	d := time.Duration(seconds) * time.Second
+	if d > maxAlertsWait {
+		d = maxAlertsWait
+	}
+
+	return d, nil
+}
+
+// UpdateAlertRoute updates the status of the alert. The allowed status transitions are defined by
+// model.AllowedTransitions and are also returned for each alert in "allowed_transitions".
+func UpdateAlertRoute(db *bolt.DB, stream *eventStream) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("UpdateAlertRoute")
+
+		accountIDInterface, exists := c.Get("accountID")
+		if exists == false {
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		accountID, ok := accountIDInterface.(string)
+		if ok == false {
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		logger.Infof("Update alert with id %s for account id: %s", c.Param("id"), accountID)
+
+		alert := getAccountAlert(c, db, accountID)
+		if alert == nil {
+			return
+		}
+
+		var json updateAlertDTO
+
+		err := c.ShouldBindJSON(&json)
+		if err != nil {
+			logger.Infof("Binding failed: %s", err)
+			problem.Abort(c, problem.Binding(err))
+			return
+		}
+
+		actor, ok := accountActor(c, db, accountID)
+		if !ok {
+			return
+		}
+
+		from := alert.Status
+		err = alert.Transition(json.Status, json.SnoozedUntil, time.Now())
+		if err != nil {
+			logger.Infof("Trying to do state transition from %s to %s: %s", alert.Status, json.Status, err)
+			problem.Abort(c, problem.New(http.StatusBadRequest, problem.InvalidTransition, "%s", err))
+			return
+		}
+
+		err = alert.SaveWithEvent(db, accountID, model.NewStatusEvent(alert, from, actor))
+		if err != nil {
+			logger.Errorf("Failed to save updated alert: %s", err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		stream.Notify(accountID)
+
+		dto := makeAlertDTO(alert)
+
+		c.JSON(http.StatusOK, dto)
+	}
+}
+
+// BulkUpdateAlertsRoute updates the status of several alerts in one go, either given by their ids or by a filter.
+// The same transition rules as in UpdateAlertRoute apply and the result is reported per alert.
+func BulkUpdateAlertsRoute(db *bolt.DB, stream *eventStream) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		glog.Infof("UpdateAlertRoute")
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("BulkUpdateAlertsRoute")
 
 		accountIDInterface, exists := c.Get("accountID")
 		if exists == false {
-			glog.Infof("No accountID set")
-			c.Status(http.StatusUnauthorized) // => Unauthorized
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
 		accountID, ok := accountIDInterface.(string)
 		if ok == false {
-			glog.Infof("AccountID in context is not a string")
-			c.Status(http.StatusUnauthorized) // => Unauthorized
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		var json bulkUpdateAlertsDTO
+
+		err := c.ShouldBindJSON(&json)
+		if err != nil {
+			logger.Infof("Binding failed: %s", err)
+			problem.Abort(c, problem.Binding(err))
 			return
 		}
 
-		alertID := c.Param("id")
+		if (len(json.IDs) == 0) == (json.Filter == nil) {
+			logger.Infof("Exactly one of ids and filter must be given")
+			problem.Abort(c, problem.Invalid("ids", "required_without", "exactly one of ids and filter must be given"))
+			return
+		}
 
-		glog.Infof("Update alert with id %s for account id: %s", alertID, accountID)
+		var filter *model.AlertFilter
+		if json.Filter != nil {
+			filter = &model.AlertFilter{
+				Priority:  json.Filter.Priority,
+				APIKeyID:  json.Filter.APIKeyID,
+				Labels:    json.Filter.Labels,
+				OlderThan: json.Filter.OlderThan,
+			}
+		}
 
-		alert, accId, err := model.GetAlert(db, alertID)
+		actor, ok := accountActor(c, db, accountID)
+		if !ok {
+			return
+		}
+
+		results, err := model.BulkTransitionAlerts(c.Request.Context(), db, accountID, json.IDs, filter, json.Status, json.SnoozedUntil, actor)
 		if err != nil {
-			glog.Errorf("Error search for alert with id %s", alertID, err)
-			c.Status(http.StatusNotFound)
+			logger.Errorf("Bulk update failed: %s", err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		dtos := make([]bulkResultDTO, 0, len(results))
+		for _, v := range results {
+			dto := bulkResultDTO{ID: v.AlertID, Success: v.Err == nil}
+			if v.Err != nil {
+				dto.Error = v.Err.Error()
+			} else {
+				alertDTO := makeAlertDTO(v.Alert)
+				dto.Alert = &alertDTO
+			}
+			dtos = append(dtos, dto)
+		}
+
+		stream.Notify(accountID)
+
+		c.JSON(http.StatusOK, gin.H{
+			"results": dtos,
+		})
+	}
+}
+
+// GetAlertRoute returns a single alert
+func GetAlertRoute(db *bolt.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("GetAlertRoute")
+
+		accountIDInterface, exists := c.Get("accountID")
+		if exists == false {
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		accountID, ok := accountIDInterface.(string)
+		if ok == false {
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
+
+		alert := getAccountAlert(c, db, accountID)
 		if alert == nil {
-			glog.Errorf("Could not find alert with id %s", alertID)
-			c.Status(http.StatusNotFound)
 			return
 		}
 
-		if accountID != *accId {
-			glog.Errorf("Authorized with account id %s but trying to access alert %s beloging to account %s", accountID, alertID, accId)
-			c.Status(http.StatusUnauthorized) // => Unauthorized
+		c.JSON(http.StatusOK, makeAlertDTO(alert))
+	}
+}
+
+// AlertHistoryRoute returns the history of an alert ordered from oldest to newest event
+func AlertHistoryRoute(db *bolt.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("AlertHistoryRoute")
+
+		accountIDInterface, exists := c.Get("accountID")
+		if exists == false {
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
-		var json updateAlertDTO
+		accountID, ok := accountIDInterface.(string)
+		if ok == false {
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
 
-		err = c.BindJSON(&json)
+		alert := getAccountAlert(c, db, accountID)
+		if alert == nil {
+			return
+		}
+
+		events, err := model.ListAlertEvents(db, alert.ID)
 		if err != nil {
-			glog.Infof("Binding failed: %s", err)
-			c.Status(400) // => Bad Request
+			logger.Errorf("Failed to get history for alert %s: %s", alert.ID, err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		dtos := make([]alertEventDTO, 0, len(events))
+		for _, v := range events {
+			dtos = append(dtos, makeAlertEventDTO(&v))
+		}
+
+		c.JSON(http.StatusOK, dtos)
+	}
+}
+
+// NotifiedAlertRoute records that a device of the account notified its user about the alert. The device is given by
+// the X-Device-ID header, the account is recorded as notified without it.
+func NotifiedAlertRoute(db *bolt.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("NotifiedAlertRoute")
+
+		accountIDInterface, exists := c.Get("accountID")
+		if exists == false {
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
-		glog.Infof("Json: %s", json)
+		accountID, ok := accountIDInterface.(string)
+		if ok == false {
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
 
-		if alert.Status == model.NewStatus && json.Status == model.SeenStatus {
-			alert.Status = model.SeenStatus
-		} else if alert.Status == model.NewStatus && json.Status == model.ArchivedStatus {
-			alert.Status = model.ArchivedStatus
-		} else if alert.Status == model.SeenStatus && json.Status == model.ArchivedStatus {
-			alert.Status = model.ArchivedStatus
-		} else {
-			glog.Infof("Trying to do state transition from %s to %s", alert.Status, json.Status)
-			c.Status(http.StatusBadRequest) // => BadRequest
+		alert := getAccountAlert(c, db, accountID)
+		if alert == nil {
 			return
 		}
 
-		alert.UpdatedAt = time.Now(); // update the updated time
+		actor, ok := accountActor(c, db, accountID)
+		if !ok {
+			return
+		}
 
-		err = alert.Save(db, accountID)
+		event := model.NewAlertEvent(alert, model.AlertNotifiedEvent, actor)
+		err := event.Save(db)
 		if err != nil {
-			glog.Errorf("Failed to save updated alert: %s", err)
-			c.Status(500) // => Internal Server error
+			logger.Errorf("Failed to save notified event of alert %s: %s", alert.ID, err)
+			problem.Abort(c, problem.Internal())
 			return
 		}
 
-		dto := makeAlertDTO(alert)
+		c.JSON(http.StatusCreated, makeAlertEventDTO(event))
+	}
+}
 
-		c.JSON(http.StatusOK, dto)
+// getAccountAlert returns the alert given by the id parameter if it belongs to the account. If not the request is
+// answered with a problem and nil is returned.
+func getAccountAlert(c *gin.Context, db *bolt.DB, accountID string) *model.Alert {
+	logger := logging.FromContext(c.Request.Context())
+
+	alertID := c.Param("id")
+
+	alert, accId, err := model.GetAlert(db, alertID)
+	if err != nil {
+		logger.Errorf("Error search for alert with id %s: %s", alertID, err)
+		problem.Abort(c, problem.Internal())
+		return nil
+	}
+	if alert == nil {
+		logger.Errorf("Could not find alert with id %s", alertID)
+		problem.Abort(c, problem.New(http.StatusNotFound, problem.NotFound, "No alert with id %s", alertID))
+		return nil
+	}
+
+	if accountID != *accId {
+		// answered like an unknown alert so that the ids of other accounts can not be probed
+		logger.Errorf("Authorized with account id %s but trying to access alert %s beloging to account %s", accountID, alertID, *accId)
+		problem.Abort(c, problem.New(http.StatusNotFound, problem.NotFound, "No alert with id %s", alertID))
+		return nil
+	}
+
+	return alert
+}
+
+// deviceIDHeader names the registered device of the account making the request, so that its changes of alerts are
+// recorded as made by the device
+const deviceIDHeader = "X-Device-ID"
+
+// actorFromContext returns the api key if the request was authorized with one and the account otherwise
+func actorFromContext(c *gin.Context, accountID string) model.Actor {
+	apiKeyID, exists := c.Get("apiKeyID")
+	if exists {
+		if id, ok := apiKeyID.(string); ok {
+			return model.Actor{Type: model.APIKeyActor, ID: id}
+		}
+	}
+
+	return model.Actor{Type: model.AccountActor, ID: accountID}
+}
+
+// accountActor returns the device named by the X-Device-ID header of a request authorized with an access token, and
+// the account otherwise. If the header names no device of the account the request is answered with a problem and
+// false is returned.
+func accountActor(c *gin.Context, db *bolt.DB, accountID string) (model.Actor, bool) {
+	logger := logging.FromContext(c.Request.Context())
+
+	deviceID := c.GetHeader(deviceIDHeader)
+	if deviceID == "" {
+		return model.Actor{Type: model.AccountActor, ID: accountID}, true
+	}
+
+	device, err := model.FindDevice(db, accountID, deviceID)
+	if err != nil {
+		logger.Errorf("Failed to get devices: %s", err)
+		problem.Abort(c, problem.Internal())
+		return model.Actor{}, false
+	}
+	if device == nil {
+		logger.Infof("Unknown device %s", deviceID)
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.InvalidParameter, "No device %s is registered with the account", deviceID))
+		return model.Actor{}, false
 	}
+
+	return model.Actor{Type: model.DeviceActor, ID: device.ID}, true
+}
+
+func makeAlertEventDTO(event *model.AlertEvent) alertEventDTO {
+	var dto alertEventDTO
+
+	dto.ID = event.ID
+	dto.Type = event.Type
+	dto.FromStatus = event.FromStatus
+	dto.ToStatus = event.ToStatus
+	dto.ActorType = event.Actor.Type
+	dto.ActorID = event.Actor.ID
+	dto.CreatedAt = event.CreatedAt
+
+	return dto
 }
 
 func makeAlertDTO(alert *model.Alert) alertDTO {
@@ -219,9 +659,31 @@ func makeAlertDTO(alert *model.Alert) alertDTO {
 	dto.LongDescription = alert.LongDescription
 	dto.Priority = alert.Priority
 	dto.Status = alert.Status
+	dto.Labels = alert.Labels
+	if dto.Labels == nil {
+		dto.Labels = make(map[string]string)
+	}
+	dto.Fingerprint = alert.Fingerprint
+	dto.SnoozedUntil = alert.SnoozedUntil
+	dto.AllowedTransitions = model.AllowedTransitions(alert.Status)
 	dto.TriggeredAt = alert.TriggeredAt
 	dto.CreatedAt = alert.CreatedAt
 	dto.UpdatedAt = alert.UpdatedAt
 
 	return dto
 }
+
+// parseLabelFilter parses label filters on the form key:value into a map
+func parseLabelFilter(filters []string) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	for _, f := range filters {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Label filter %s is not on the form key:value", f)
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	return labels, nil
+}
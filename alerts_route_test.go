@@ -2,7 +2,6 @@ package main
 
 import (
 	"testing"
-	"flag"
 	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/assert"
 	"github.com/gin-gonic/gin"
@@ -13,10 +12,11 @@ import (
 	"encoding/json"
 	"github.com/joakim666/wip_alerts/model"
 	"time"
+	"fmt"
+	"github.com/joakim666/wip_alerts/problem"
 )
 
 func TestCreateAlertRouteWithMissingAccountID(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -24,7 +24,7 @@ func TestCreateAlertRouteWithMissingAccountID(t *testing.T) {
 		gin.SetMode(gin.TestMode)
 		router := gin.New()
 
-		router.POST("/alerts", CreateAlertRoute(db))
+		router.POST("/alerts", CreateAlertRoute(db, nil, defaultConfig().Validation))
 
 		req, _ := http.NewRequest("POST", "/alerts", nil)
 		res := httptest.NewRecorder()
@@ -35,7 +35,6 @@ func TestCreateAlertRouteWithMissingAccountID(t *testing.T) {
 }
 
 func TestCreateAlertRouteWithMissingAPIKeyID(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -47,7 +46,7 @@ func TestCreateAlertRouteWithMissingAPIKeyID(t *testing.T) {
 			c.Set("accountID", "55")
 		})
 
-		router.POST("/alerts", CreateAlertRoute(db))
+		router.POST("/alerts", CreateAlertRoute(db, nil, defaultConfig().Validation))
 
 		req, _ := http.NewRequest("POST", "/alerts", nil)
 		res := httptest.NewRecorder()
@@ -58,7 +57,6 @@ func TestCreateAlertRouteWithMissingAPIKeyID(t *testing.T) {
 }
 
 func TestCreateAlertRouteWithMissingData(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -71,7 +69,7 @@ func TestCreateAlertRouteWithMissingData(t *testing.T) {
 			c.Set("apiKeyID", "55")
 		})
 
-		router.POST("/alerts", CreateAlertRoute(db))
+		router.POST("/alerts", CreateAlertRoute(db, nil, defaultConfig().Validation))
 
 		var bodies []string
 
@@ -123,7 +121,6 @@ func TestCreateAlertRouteWithMissingData(t *testing.T) {
 }
 
 func TestCreateAlertRouteWithValidData(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -136,7 +133,7 @@ func TestCreateAlertRouteWithValidData(t *testing.T) {
 			c.Set("apiKeyID", "55")
 		})
 
-		router.POST("/alerts", CreateAlertRoute(db))
+		router.POST("/alerts", CreateAlertRoute(db, nil, defaultConfig().Validation))
 
 		body := `
 			{
@@ -174,7 +171,6 @@ func TestCreateAlertRouteWithValidData(t *testing.T) {
 }
 
 func TestListAlertsWithoutAccountID(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -182,7 +178,7 @@ func TestListAlertsWithoutAccountID(t *testing.T) {
 		gin.SetMode(gin.TestMode)
 		router := gin.New()
 
-		router.GET("/alerts", ListAlertsRoute(db))
+		router.GET("/alerts", ListAlertsRoute(db, nil))
 
 		req, _ := http.NewRequest("GET", "/alerts", nil)
 		res := httptest.NewRecorder()
@@ -192,8 +188,40 @@ func TestListAlertsWithoutAccountID(t *testing.T) {
 	})
 }
 
+func TestListAlertsWithUnreadableAlert(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.GET("/alerts", ListAlertsRoute(db, nil))
+
+		putGarbage(t, db, "Alerts", "55")
+
+		req, _ := http.NewRequest("GET", "/alerts", nil)
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assertProblem(t, res, http.StatusInternalServerError, problem.InternalError)
+	})
+}
+
+// putGarbage saves an object that can not be read in the nested bucket of the account
+func putGarbage(t *testing.T, db *bolt.DB, bucketName string, accountID string) {
+	assert.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		nb, err := tx.Bucket([]byte(bucketName)).CreateBucketIfNotExists([]byte(accountID))
+		if err != nil {
+			return err
+		}
+		return nb.Put([]byte("broken"), []byte("garbage"))
+	}))
+}
+
 func TestListAlerts(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -205,7 +233,7 @@ func TestListAlerts(t *testing.T) {
 			c.Set("accountID", "55")
 		})
 
-		router.GET("/alerts", ListAlertsRoute(db))
+		router.GET("/alerts", ListAlertsRoute(db, nil))
 
 		req, _ := http.NewRequest("GET", "/alerts", nil)
 		res := httptest.NewRecorder()
@@ -369,7 +397,6 @@ func TestListAlerts(t *testing.T) {
 }
 
 func TestUpdateAlertRouteWithMissingAccountID(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -377,7 +404,7 @@ func TestUpdateAlertRouteWithMissingAccountID(t *testing.T) {
 		gin.SetMode(gin.TestMode)
 		router := gin.New()
 
-		router.POST("/alerts/:id", UpdateAlertRoute(db))
+		router.POST("/alerts/:id", UpdateAlertRoute(db, nil))
 
 		req, _ := http.NewRequest("POST", "/alerts/123", nil)
 		res := httptest.NewRecorder()
@@ -388,7 +415,6 @@ func TestUpdateAlertRouteWithMissingAccountID(t *testing.T) {
 }
 
 func TestUpdateAlertRouteWithBadInput(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -400,7 +426,7 @@ func TestUpdateAlertRouteWithBadInput(t *testing.T) {
 			c.Set("accountID", "55")
 		})
 
-		router.POST("/alerts/:id", UpdateAlertRoute(db))
+		router.POST("/alerts/:id", UpdateAlertRoute(db, nil))
 
 		apiKey1 := model.NewAPIKey()
 		apiKey1.Description = "my description"
@@ -431,7 +457,6 @@ func TestUpdateAlertRouteWithBadInput(t *testing.T) {
 }
 
 func TestUpdateAlertRoute(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -443,7 +468,7 @@ func TestUpdateAlertRoute(t *testing.T) {
 			c.Set("accountID", "55")
 		})
 
-		router.POST("/alerts/:id", UpdateAlertRoute(db))
+		router.POST("/alerts/:id", UpdateAlertRoute(db, nil))
 
 		apiKey1 := model.NewAPIKey()
 		apiKey1.Description = "my description"
@@ -538,3 +563,786 @@ func TestUpdateAlertRoute(t *testing.T) {
 		assert.NotEqual(resMap["created_at"], resMap["updated_at"])
 	})
 }
+
+func TestCreateAlertRouteWithLabels(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		apiKey1 := model.NewAPIKey()
+		apiKey1.Description = "my description"
+		apiKey1.DefaultLabels = map[string]string{"env": "prod", "team": "ops"}
+		apiKey1.Save(db, "55")
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", apiKey1.ID)
+		})
+
+		router.POST("/alerts", CreateAlertRoute(db, nil, defaultConfig().Validation))
+
+		body := `
+			{
+				"title": "title1",
+				"short_description": "short_description1",
+				"long_description": "long_description1",
+				"priority": "high",
+				"triggered_at": "2012-04-23T18:25:43.511Z",
+				"labels": {"env": "staging", "host": "web1"}
+			}
+		`
+
+		req, _ := http.NewRequest("POST", "/alerts", strings.NewReader(body))
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(201, res.Code)
+
+		resBody, err := ioutil.ReadAll(res.Body)
+		assert.NoError(err)
+
+		var resMap map[string]interface{}
+		err = json.Unmarshal(resBody, &resMap)
+		assert.NoError(err)
+
+		// the labels of the alert override the default labels of the api key
+		labels := resMap["labels"].(map[string]interface{})
+		assert.Equal(3, len(labels))
+		assert.Equal("staging", labels["env"])
+		assert.Equal("ops", labels["team"])
+		assert.Equal("web1", labels["host"])
+
+		// invalid label key
+		body = `
+			{
+				"title": "title1",
+				"short_description": "short_description1",
+				"long_description": "long_description1",
+				"priority": "high",
+				"triggered_at": "2012-04-23T18:25:43.511Z",
+				"labels": {"": "web1"}
+			}
+		`
+
+		req, _ = http.NewRequest("POST", "/alerts", strings.NewReader(body))
+		res = httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(400, res.Code)
+	})
+}
+
+func TestListAlertsWithLabelFilter(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.GET("/alerts", ListAlertsRoute(db, nil))
+
+		a1 := model.NewAlert("apiKey1")
+		a1.Title = "title1"
+		a1.Priority = model.HighPriority
+		a1.Labels = map[string]string{"env": "prod", "host": "web1"}
+		a1.Save(db, "55")
+
+		a2 := model.NewAlert("apiKey1")
+		a2.Title = "title2"
+		a2.Priority = model.HighPriority
+		a2.Labels = map[string]string{"env": "prod", "host": "web2"}
+		a2.Save(db, "55")
+
+		a3 := model.NewAlert("apiKey1")
+		a3.Title = "title3"
+		a3.Priority = model.HighPriority
+		a3.Save(db, "55")
+
+		cases := map[string][]string{
+			"/alerts":                                {a1.ID, a2.ID, a3.ID},
+			"/alerts?label=env:prod":                 {a1.ID, a2.ID},
+			"/alerts?label=env:prod&label=host:web2": {a2.ID},
+			"/alerts?label=env:test":                 {},
+		}
+
+		for url, ids := range cases {
+			req, _ := http.NewRequest("GET", url, nil)
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+			assert.Equal(200, res.Code)
+
+			resBody, err := ioutil.ReadAll(res.Body)
+			assert.NoError(err)
+
+			var resMap map[string]interface{}
+			err = json.Unmarshal(resBody, &resMap)
+			assert.NoError(err)
+
+			assert.Equal(len(ids), len(resMap), url)
+			for _, id := range ids {
+				assert.NotNil(resMap[id], url)
+			}
+		}
+
+		// malformed filter
+		req, _ := http.NewRequest("GET", "/alerts?label=env", nil)
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(400, res.Code)
+	})
+}
+
+func TestUpdateAlertRouteSnoozeAndUnarchive(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.POST("/alerts/:id", UpdateAlertRoute(db, nil))
+
+		a1 := model.NewAlert("apiKey1")
+		a1.Title = "title1"
+		a1.Priority = model.HighPriority
+		a1.TriggeredAt = time.Now()
+		a1.Save(db, "55")
+
+		update := func(body string) (int, map[string]interface{}) {
+			req, _ := http.NewRequest("POST", "/alerts/"+a1.ID, strings.NewReader(body))
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+
+			var resMap map[string]interface{}
+			json.Unmarshal(res.Body.Bytes(), &resMap)
+			return res.Code, resMap
+		}
+
+		// snoozing without a time is not allowed
+		code, _ := update(`{"status": "snoozed"}`)
+		assert.Equal(http.StatusBadRequest, code)
+
+		until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		code, resMap := update(`{"status": "snoozed", "snoozed_until": "` + until + `"}`)
+		assert.Equal(http.StatusOK, code)
+		assert.Equal("snoozed", resMap["status"])
+		assert.Equal(until, resMap["snoozed_until"])
+		assert.Equal([]interface{}{"new", "acknowledged", "resolved", "archived"}, resMap["allowed_transitions"])
+
+		code, resMap = update(`{"status": "archived"}`)
+		assert.Equal(http.StatusOK, code)
+		assert.Equal("archived", resMap["status"])
+		assert.Nil(resMap["snoozed_until"])
+		assert.Equal([]interface{}{"new"}, resMap["allowed_transitions"])
+
+		// un-archive
+		code, resMap = update(`{"status": "new"}`)
+		assert.Equal(http.StatusOK, code)
+		assert.Equal("new", resMap["status"])
+	})
+}
+
+func TestGetAlertRoute(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.GET("/alerts/:id", GetAlertRoute(db))
+
+		a1 := model.NewAlert("apiKey1")
+		a1.Title = "title1"
+		a1.Priority = model.HighPriority
+		a1.Save(db, "55")
+
+		a2 := model.NewAlert("apiKey2")
+		a2.Title = "title2"
+		a2.Save(db, "66")
+
+		req, _ := http.NewRequest("GET", "/alerts/"+a1.ID, nil)
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var resMap map[string]interface{}
+		err := json.Unmarshal(res.Body.Bytes(), &resMap)
+		assert.NoError(err)
+		assert.Equal(a1.ID, resMap["id"])
+		assert.Equal("title1", resMap["title"])
+		assert.Equal("new", resMap["status"])
+
+		// alert belonging to another account is not found
+		req, _ = http.NewRequest("GET", "/alerts/"+a2.ID, nil)
+		res = httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assertProblem(t, res, http.StatusNotFound, problem.NotFound)
+
+		req, _ = http.NewRequest("GET", "/alerts/unknown", nil)
+		res = httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusNotFound, res.Code)
+	})
+}
+
+func TestAlertHistoryRoute(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+
+		// the alert is created with an api key
+		apiRouter := gin.New()
+		apiRouter.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", "apiKey1")
+		})
+		apiRouter.POST("/alerts", CreateAlertRoute(db, nil, defaultConfig().Validation))
+
+		// and then handled with an access token
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+		router.POST("/alerts/:id", UpdateAlertRoute(db, nil))
+		router.GET("/alerts/:id/history", AlertHistoryRoute(db))
+
+		body := `
+			{
+				"title": "title1",
+				"short_description": "short_description1",
+				"long_description": "long_description1",
+				"priority": "high",
+				"triggered_at": "2012-04-23T18:25:43.511Z"
+			}
+		`
+		req, _ := http.NewRequest("POST", "/alerts", strings.NewReader(body))
+		res := httptest.NewRecorder()
+		apiRouter.ServeHTTP(res, req)
+		assert.Equal(http.StatusCreated, res.Code)
+
+		var alert map[string]interface{}
+		json.Unmarshal(res.Body.Bytes(), &alert)
+		alertID := alert["id"].(string)
+
+		for _, status := range []string{"seen", "archived"} {
+			req, _ = http.NewRequest("POST", "/alerts/"+alertID, strings.NewReader(`{"status": "`+status+`"}`))
+			res = httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			assert.Equal(http.StatusOK, res.Code)
+		}
+
+		req, _ = http.NewRequest("GET", "/alerts/"+alertID+"/history", nil)
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var events []map[string]interface{}
+		err := json.Unmarshal(res.Body.Bytes(), &events)
+		assert.NoError(err)
+		assert.Equal(3, len(events))
+
+		assert.Equal("created", events[0]["type"])
+		assert.Equal("new", events[0]["to_status"])
+		assert.Equal("api_key", events[0]["actor_type"])
+		assert.Equal("apiKey1", events[0]["actor_id"])
+
+		assert.Equal("seen", events[1]["type"])
+		assert.Equal("new", events[1]["from_status"])
+		assert.Equal("seen", events[1]["to_status"])
+		assert.Equal("account", events[1]["actor_type"])
+		assert.Equal("55", events[1]["actor_id"])
+
+		assert.Equal("archived", events[2]["type"])
+		assert.Equal("seen", events[2]["from_status"])
+		assert.Equal("archived", events[2]["to_status"])
+	})
+}
+
+func TestAlertHistoryOfDevices(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+
+		device := model.NewDevice()
+		device.DeviceID = "phone1"
+		assert.NoError(model.SaveDevices(db, "55", &map[string]model.Device{device.ID: *device}))
+
+		alert := model.NewAlert("apiKey1")
+		assert.NoError(alert.Save(db, "55"))
+
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+		router.POST("/alerts/:id", UpdateAlertRoute(db, nil))
+		router.POST("/alerts/:id/notified", NotifiedAlertRoute(db))
+
+		post := func(path string, deviceID string, body string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+			if deviceID != "" {
+				req.Header.Set(deviceIDHeader, deviceID)
+			}
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			return res
+		}
+
+		res := post("/alerts/"+alert.ID+"/notified", "phone1", "")
+		assert.Equal(http.StatusCreated, res.Code)
+		var event map[string]interface{}
+		assert.NoError(json.Unmarshal(res.Body.Bytes(), &event))
+		assert.Equal("notified", event["type"])
+		assert.Equal("new", event["to_status"])
+
+		assert.Equal(http.StatusOK, post("/alerts/"+alert.ID, "phone1", `{"status": "seen"}`).Code)
+		assert.Equal(http.StatusCreated, post("/alerts/"+alert.ID+"/notified", "", "").Code)
+
+		// a device that is not registered with the account is refused
+		assertProblem(t, post("/alerts/"+alert.ID, "phone2", `{"status": "archived"}`), http.StatusBadRequest, problem.InvalidParameter)
+
+		events, err := model.ListAlertEvents(db, alert.ID)
+		assert.NoError(err)
+		if assert.Len(events, 3) {
+			assert.Equal(model.AlertNotifiedEvent, events[0].Type)
+			assert.Equal(model.Actor{Type: model.DeviceActor, ID: device.ID}, events[0].Actor)
+			assert.Equal(model.AlertSeenEvent, events[1].Type)
+			assert.Equal(model.Actor{Type: model.DeviceActor, ID: device.ID}, events[1].Actor)
+			assert.Equal(model.AlertNotifiedEvent, events[2].Type)
+			assert.Equal(model.Actor{Type: model.AccountActor, ID: "55"}, events[2].Actor)
+		}
+
+		a, _, err := model.GetAlert(db, alert.ID)
+		assert.NoError(err)
+		assert.Equal(model.SeenStatus, a.Status)
+	})
+}
+
+func TestBulkUpdateAlertsRoute(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.POST("/bulk/alerts", BulkUpdateAlertsRoute(db, nil))
+
+		a1 := model.NewAlert("apiKey1")
+		a1.Priority = model.HighPriority
+		a1.Labels = map[string]string{"env": "prod"}
+		a1.Save(db, "55")
+
+		a2 := model.NewAlert("apiKey1")
+		a2.Priority = model.HighPriority
+		a2.Save(db, "55")
+
+		a3 := model.NewAlert("apiKey2")
+		a3.Priority = model.LowPriority
+		a3.Save(db, "55")
+
+		// both or none of ids and filter is a bad request
+		for _, body := range []string{
+			`{"status": "archived"}`,
+			`{"status": "archived", "ids": ["` + a1.ID + `"], "filter": {}}`,
+		} {
+			req, _ := http.NewRequest("POST", "/bulk/alerts", strings.NewReader(body))
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+			assert.Equal(http.StatusBadRequest, res.Code)
+		}
+
+		body := `{"status": "seen", "ids": ["` + a1.ID + `", "unknown"]}`
+		req, _ := http.NewRequest("POST", "/bulk/alerts", strings.NewReader(body))
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var resMap map[string][]map[string]interface{}
+		err := json.Unmarshal(res.Body.Bytes(), &resMap)
+		assert.NoError(err)
+
+		results := resMap["results"]
+		assert.Equal(2, len(results))
+		assert.Equal(a1.ID, results[0]["id"])
+		assert.Equal(true, results[0]["success"])
+		assert.Equal("seen", results[0]["alert"].(map[string]interface{})["status"])
+		assert.Equal("unknown", results[1]["id"])
+		assert.Equal(false, results[1]["success"])
+		assert.NotEmpty(results[1]["error"])
+
+		body = `{"status": "archived", "filter": {"priority": "high", "api_key_id": "apiKey1"}}`
+		req, _ = http.NewRequest("POST", "/bulk/alerts", strings.NewReader(body))
+		res = httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		err = json.Unmarshal(res.Body.Bytes(), &resMap)
+		assert.NoError(err)
+		assert.Equal(2, len(resMap["results"]))
+
+		alerts, err := model.ListNonArchivedAlerts(db, "55")
+		assert.NoError(err)
+		assert.Equal(1, len(*alerts))
+		assert.Equal(a3.ID, (*alerts)[a3.ID].ID)
+	})
+}
+
+func TestListAlertsConditionalGet(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.GET("/alerts", ListAlertsRoute(db, nil))
+
+		req, _ := http.NewRequest("GET", "/alerts", nil)
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusOK, res.Code)
+		etag := res.Header().Get("ETag")
+		assert.NotEmpty(etag)
+
+		// nothing changed
+		req, _ = http.NewRequest("GET", "/alerts", nil)
+		req.Header.Set("If-None-Match", etag)
+		res = httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusNotModified, res.Code)
+		assert.Equal(0, res.Body.Len())
+
+		a1 := model.NewAlert("apiKey1")
+		a1.Save(db, "55")
+
+		req, _ = http.NewRequest("GET", "/alerts", nil)
+		req.Header.Set("If-None-Match", etag)
+		res = httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusOK, res.Code)
+		assert.NotEqual(etag, res.Header().Get("ETag"))
+
+		// waiting without changes times out with a 304
+		req, _ = http.NewRequest("GET", "/alerts?wait=1", nil)
+		req.Header.Set("If-None-Match", res.Header().Get("ETag"))
+		res = httptest.NewRecorder()
+
+		start := time.Now()
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusNotModified, res.Code)
+		assert.True(time.Since(start) >= time.Second)
+
+		req, _ = http.NewRequest("GET", "/alerts?wait=abc", nil)
+		res = httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusBadRequest, res.Code)
+	})
+}
+
+func TestListAlertsLongPoll(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		stream := newEventStream()
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", "apiKey1")
+		})
+
+		router.GET("/alerts", ListAlertsRoute(db, stream))
+		router.POST("/alerts", CreateAlertRoute(db, stream, defaultConfig().Validation))
+
+		req, _ := http.NewRequest("GET", "/alerts?wait=30", nil)
+		res := httptest.NewRecorder()
+
+		done := make(chan bool)
+		go func() {
+			router.ServeHTTP(res, req)
+			done <- true
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+
+		body := `
+			{
+				"title": "title1",
+				"short_description": "short_description1",
+				"long_description": "long_description1",
+				"priority": "high",
+				"triggered_at": "2012-04-23T18:25:43.511Z"
+			}
+		`
+		postReq, _ := http.NewRequest("POST", "/alerts", strings.NewReader(body))
+		postRes := httptest.NewRecorder()
+		router.ServeHTTP(postRes, postReq)
+		assert.Equal(http.StatusCreated, postRes.Code)
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			assert.Fail("long poll did not return when an alert was created")
+			return
+		}
+
+		assert.Equal(http.StatusOK, res.Code)
+
+		var resMap map[string]interface{}
+		err := json.Unmarshal(res.Body.Bytes(), &resMap)
+		assert.NoError(err)
+		assert.Equal(1, len(resMap))
+	})
+}
+
+func TestListAlertsLongPollIgnoresHeartbeats(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		stream := newEventStream()
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+		router.GET("/alerts", ListAlertsRoute(db, stream))
+
+		req, _ := http.NewRequest("GET", "/alerts?wait=30", nil)
+		res := httptest.NewRecorder()
+
+		done := make(chan bool)
+		go func() {
+			router.ServeHTTP(res, req)
+			done <- true
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+
+		// heartbeats notify the poll without changing the alerts
+		for i := 0; i < 100; i++ {
+			assert.NoError(model.NewHeartbeat("apiKey1").Save(db, "55"))
+			stream.Notify("55")
+		}
+
+		select {
+		case <-done:
+			assert.Fail("long poll returned without an alert change")
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		alert := model.NewAlert("apiKey1")
+		assert.NoError(model.SaveNewAlerts(db, []model.NewAccountAlert{{AccountUUID: "55", Alert: alert, Actor: model.Actor{Type: model.SystemActor}}}))
+		stream.Notify("55")
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			assert.Fail("long poll did not return when an alert was created")
+			return
+		}
+		assert.Equal(http.StatusOK, res.Code)
+		assert.Contains(res.Body.String(), alert.ID)
+	})
+}
+
+func TestListAlertsLongPollOutlastsWriteTimeout(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.GET("/alerts", ListAlertsRoute(db, newEventStream()))
+
+		s := httptest.NewUnstartedServer(router)
+		s.Config.WriteTimeout = 200 * time.Millisecond
+		s.Start()
+		defer s.Close()
+
+		res, err := http.Get(s.URL + "/alerts?wait=1")
+		if assert.NoError(err) {
+			defer res.Body.Close()
+			assert.Equal(http.StatusOK, res.StatusCode)
+		}
+	})
+}
+
+func TestListAlertsLongPollEndsOnShutdown(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		stream := newEventStream()
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.GET("/alerts", ListAlertsRoute(db, stream))
+
+		req, _ := http.NewRequest("GET", "/alerts?wait=30", nil)
+		res := httptest.NewRecorder()
+
+		done := make(chan bool)
+		go func() {
+			router.ServeHTTP(res, req)
+			done <- true
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		stream.Close()
+
+		select {
+		case <-done:
+			assert.Equal(http.StatusOK, res.Code)
+		case <-time.After(5 * time.Second):
+			assert.Fail("long poll did not return when the server shut down")
+		}
+	})
+}
+
+func TestCreateAlertRouteWithInvalidFields(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", "55")
+		})
+
+		limits := defaultConfig().Validation
+		limits.MaxTitleLength = 10
+		limits.MaxLabels = 2
+		limits.MaxAge = 24 * time.Hour
+
+		router.POST("/alerts", CreateAlertRoute(db, nil, limits))
+
+		now := time.Now().UTC()
+
+		tests := []struct {
+			body   string
+			field  string
+			reason string
+		}{
+			{fmt.Sprintf(`{"title": "t", "short_description": "s", "long_description": "l", "priority": "urgent", "triggered_at": %q}`, now.Format(time.RFC3339)), "priority", "oneof"},
+			{fmt.Sprintf(`{"title": "title is too long", "short_description": "s", "long_description": "l", "priority": "high", "triggered_at": %q}`, now.Format(time.RFC3339)), "title", "max"},
+			{fmt.Sprintf(`{"title": "åäöåäöåäöå", "short_description": "s", "long_description": "l", "priority": "high", "triggered_at": %q}`, now.Format(time.RFC3339)), "", ""},
+			{fmt.Sprintf(`{"title": "t\nt", "short_description": "s", "long_description": "l", "priority": "high", "triggered_at": %q}`, now.Format(time.RFC3339)), "title", "control_character"},
+			{fmt.Sprintf(`{"title": "t", "short_description": "s\u0007", "long_description": "l", "priority": "high", "triggered_at": %q}`, now.Format(time.RFC3339)), "short_description", "control_character"},
+			{fmt.Sprintf(`{"title": "t", "short_description": "s", "long_description": "l\n\tl", "priority": "high", "triggered_at": %q}`, now.Format(time.RFC3339)), "", ""},
+			{fmt.Sprintf(`{"title": "t", "short_description": "s", "long_description": "l", "priority": "high", "triggered_at": %q}`, now.Add(time.Hour).Format(time.RFC3339)), "triggered_at", "in_future"},
+			{fmt.Sprintf(`{"title": "t", "short_description": "s", "long_description": "l", "priority": "high", "triggered_at": %q}`, now.Add(-48*time.Hour).Format(time.RFC3339)), "triggered_at", "too_old"},
+			{fmt.Sprintf(`{"title": "t", "short_description": "s", "long_description": "l", "priority": "high", "triggered_at": %q, "labels": {"a": "1", "b": "2", "c": "3"}}`, now.Format(time.RFC3339)), "labels", "max"},
+			{fmt.Sprintf(`{"title": "t", "short_description": "s", "long_description": "l", "priority": "high", "triggered_at": %q, "labels": {"a": "1\t"}}`, now.Format(time.RFC3339)), "labels.a", "control_character"},
+		}
+
+		for _, tt := range tests {
+			req, _ := http.NewRequest("POST", "/alerts", strings.NewReader(tt.body))
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+			if tt.field == "" {
+				assert.Equal(201, res.Code, tt.body)
+				continue
+			}
+
+			p := assertProblem(t, res, 400, problem.ValidationFailed)
+			if assert.Len(p.Errors, 1, tt.body) {
+				assert.Equal(tt.field, p.Errors[0].Field)
+				assert.Equal(tt.reason, p.Errors[0].Reason)
+			}
+		}
+
+		// all invalid fields are reported at once
+		body := `{"title": "title is too long", "short_description": "s", "long_description": "l", "priority": "low", "triggered_at": "2100-01-01T00:00:00Z"}`
+		req, _ := http.NewRequest("POST", "/alerts", strings.NewReader(body))
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		p := assertProblem(t, res, 400, problem.ValidationFailed)
+		assert.Len(p.Errors, 2)
+	})
+}
+
+func TestCreateAlertRouteWithInvalidUTF8(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", "55")
+		})
+
+		router.POST("/alerts", CreateAlertRoute(db, nil, defaultConfig().Validation))
+
+		body := "{\"title\": \"t\xff\", \"short_description\": \"s\", \"long_description\": \"l\", \"priority\": \"high\", \"triggered_at\": \"2012-04-23T18:25:43.511Z\"}"
+
+		req, _ := http.NewRequest("POST", "/alerts", strings.NewReader(body))
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assertProblem(t, res, 400, problem.InvalidBody)
+	})
+}
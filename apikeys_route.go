@@ -5,57 +5,78 @@ import (
 
 	"github.com/boltdb/bolt"
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
+	"github.com/joakim666/wip_alerts/logging"
 	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
 )
 
 type createAPIKeyDTO struct {
-	Description string `json:"description" binding:"required"`
+	Description   string            `json:"description" binding:"required"`
+	AllowedCIDRs  []string          `json:"allowed_cidrs"`  // optional allowlist of networks in CIDR notation
+	DefaultLabels map[string]string `json:"default_labels"` // optional labels added to all alerts sent with the key
 }
 
 type apiKeyDTO struct {
-	ID          string             `json:"id"`
-	Description string             `json:"description"`
-	IssuedAt    time.Time          `json:"issued_at"`
-	Status      model.APIKeyStatus `json:"status"`
+	ID            string             `json:"id"`
+	Description   string             `json:"description"`
+	IssuedAt      time.Time          `json:"issued_at"`
+	Status        model.APIKeyStatus `json:"status"`
+	AllowedCIDRs  []string           `json:"allowed_cidrs,omitempty"`
+	DefaultLabels map[string]string  `json:"default_labels,omitempty"`
 }
 
 func CreateAPIKeyRoute(db *bolt.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		glog.Infof("CreateAPIKeyRoute")
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("CreateAPIKeyRoute")
 
 		accountIDInterface, exists := c.Get("accountID")
 		if exists == false {
-			glog.Infof("No accountID set")
-			c.Status(401) // => Unauthorized
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
 		accountID, ok := accountIDInterface.(string)
 		if ok == false {
-			glog.Infof("AccountID in context is not a string")
-			c.Status(401) // => Unauthorized
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
 		var json createAPIKeyDTO
 
-		err := c.BindJSON(&json)
+		err := c.ShouldBindJSON(&json)
 		if err != nil {
-			glog.Infof("Binding failed: %s", err)
-			c.Status(400) // => Bad Request
+			logger.Infof("Binding failed: %s", err)
+			problem.Abort(c, problem.Binding(err))
 			return
 		}
 
-		glog.Infof("Json: %s", json)
+		_, err = model.ParseCIDRs(json.AllowedCIDRs)
+		if err != nil {
+			logger.Infof("Invalid allowlist: %s", err)
+			problem.Abort(c, problem.Invalid("allowed_cidrs", "invalid", "%s", err))
+			return
+		}
+
+		err = model.ValidateLabels(json.DefaultLabels)
+		if err != nil {
+			logger.Infof("Invalid default labels: %s", err)
+			problem.Abort(c, problem.Invalid("default_labels", "invalid", "%s", err))
+			return
+		}
 
 		apiKey := model.NewAPIKey()
 		apiKey.Description = json.Description
+		apiKey.AllowedCIDRs = json.AllowedCIDRs
+		apiKey.DefaultLabels = json.DefaultLabels
 
 		err = apiKey.Save(db, accountID)
 		if err != nil {
-			glog.Errorf("Failed to save created API key: %s", err)
-			c.Status(500) // => Internal Server error
+			logger.Errorf("Failed to save created API key: %s", err)
+			problem.Abort(c, problem.Internal())
 			return
 		}
 
@@ -67,28 +88,30 @@ func CreateAPIKeyRoute(db *bolt.DB) gin.HandlerFunc {
 
 func ListAPIKeyRoute(db *bolt.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		glog.Infof("ListAPIKeyRoute")
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("ListAPIKeyRoute")
 
 		accountIDInterface, exists := c.Get("accountID")
 		if exists == false {
-			glog.Infof("No accountID set")
-			c.Status(401) // => Unauthorized
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
 		accountID, ok := accountIDInterface.(string)
 		if ok == false {
-			glog.Infof("AccountID in context is not a string")
-			c.Status(401) // => Unauthorized
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
-		glog.Infof("Listing APIKeys for account id: %s", accountID)
+		logger.Infof("Listing APIKeys for account id: %s", accountID)
 
 		apiKeys, err := model.ListAPIKeys(db, accountID)
 		if err != nil {
-			glog.Infof("No account for account id=%s", accountID)
-			c.Status(400) // => Bad Request
+			logger.Errorf("Failed to list api keys of account %s: %s", accountID, err)
+			problem.Abort(c, problem.Internal())
 			return
 		}
 
@@ -110,6 +133,8 @@ func makeDTO(apiKey *model.APIKey) apiKeyDTO {
 	dto.Description = apiKey.Description
 	dto.IssuedAt = apiKey.CreatedAt
 	dto.Status = apiKey.Status
+	dto.AllowedCIDRs = apiKey.AllowedCIDRs
+	dto.DefaultLabels = apiKey.DefaultLabels
 
 	return dto
 }
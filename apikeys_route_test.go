@@ -9,14 +9,12 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
-	"flag"
 	"io/ioutil"
 	"encoding/json"
 	"github.com/joakim666/wip_alerts/model"
 )
 
 func TestCreateAPIKeyWithInvalidData(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -51,7 +49,6 @@ func TestCreateAPIKeyWithInvalidData(t *testing.T) {
 }
 
 func TestCreateAPIKey(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -95,7 +92,6 @@ func TestCreateAPIKey(t *testing.T) {
 }
 
 func TestListAPIKeyWithNoAPIKeysPresent(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -128,7 +124,6 @@ func TestListAPIKeyWithNoAPIKeysPresent(t *testing.T) {
 }
 
 func TestListAPIKey(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -174,3 +169,59 @@ func TestListAPIKey(t *testing.T) {
 		apiKey2.Save(db, "55")
 	})
 }
+
+func TestCreateAPIKeyWithAllowlist(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.POST("/api-keys", CreateAPIKeyRoute(db))
+
+		// invalid network
+		var body = `
+			{
+				"description": "new shiny api key",
+				"allowed_cidrs": ["10.0.0.0/8", "not a network"]
+			}
+		`
+
+		req, _ := http.NewRequest("POST", "/api-keys", strings.NewReader(body))
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(400, res.Code)
+
+		body = `
+			{
+				"description": "new shiny api key",
+				"allowed_cidrs": ["10.0.0.0/8", "2001:db8::/32"]
+			}
+		`
+
+		req, _ = http.NewRequest("POST", "/api-keys", strings.NewReader(body))
+		res = httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(201, res.Code)
+
+		resBody, err := ioutil.ReadAll(res.Body)
+		assert.NoError(err)
+
+		var resJson map[string]interface{}
+		err = json.Unmarshal(resBody, &resJson)
+		assert.NoError(err)
+
+		assert.Equal([]interface{}{"10.0.0.0/8", "2001:db8::/32"}, resJson["allowed_cidrs"])
+
+		apiKey, _, err := model.GetAPIKey(db, resJson["id"].(string))
+		assert.NoError(err)
+		assert.Equal([]string{"10.0.0.0/8", "2001:db8::/32"}, apiKey.AllowedCIDRs)
+	})
+}
@@ -6,44 +6,61 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/problem"
 )
 
-// ValidateAccessToken extracts an access token from the headers, checks that it's valid and then passes it on to the check-function
+// FailureObserver, if set, is called with the reason each time a request is refused by ValidateAccessToken: one of
+// "missing_token", "bad_token", "invalid_token" and "forbidden"
+var FailureObserver func(reason string)
+
+func observeFailure(reason string) {
+	if FailureObserver != nil {
+		FailureObserver(reason)
+	}
+}
+
+// ValidateAccessToken extracts an access token from the headers, checks that it's valid and then passes it on to the check-function. Requests without a valid token are answered with 401 Unauthorized, and requests failing the check with 403 Forbidden.
 func ValidateAccessToken(check func(token *Token, ctx *gin.Context) bool, encryptionKey interface{}) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
 		var serializedToken string
 		var err error
 
 		if serializedToken, err = extractToken(c.Request); err != nil {
-			glog.Errorf("Can not extract token, caused by: %s", err)
-			c.AbortWithError(http.StatusUnauthorized, errors.New("No token supplied"))
+			logger.Errorf("Can not extract token, caused by: %s", err)
+			observeFailure("missing_token")
+			problem.Abort(c, problem.New(http.StatusUnauthorized, problem.MissingToken, "An access token must be given in the Authorization header"))
 			return
 		}
 
 		token, err := DecryptAccessToken(serializedToken, encryptionKey)
 		if err != nil {
-			glog.Errorf("Can not deserialize token, caused by: %s", err)
-			c.AbortWithError(http.StatusUnauthorized, errors.New("Token error"))
+			logger.Errorf("Can not deserialize token, caused by: %s", err)
+			observeFailure("bad_token")
+			problem.Abort(c, problem.New(http.StatusUnauthorized, problem.InvalidToken, "The access token can not be read"))
 			return
 		}
 
 		if !token.Valid() {
-			glog.Error("Token not valid")
-			c.AbortWithError(http.StatusUnauthorized, errors.New("Invalid token"))
+			logger.Error("Token not valid")
+			observeFailure("invalid_token")
+			problem.Abort(c, problem.New(http.StatusUnauthorized, problem.InvalidToken, "The token is not an access token"))
 			return
 		}
 
 		if !check(token, c) {
-			glog.Errorf("Authorization check failed")
-			c.AbortWithError(http.StatusUnauthorized, errors.New("Authorization check failed"))
+			if c.IsAborted() {
+				return // the check answered the request itself
+			}
+			logger.Errorf("Authorization check failed for %s with roles: %s", token.AccountID, strings.Join(token.Scope.Roles, ","))
+			observeFailure("forbidden")
+			problem.Abort(c, problem.New(http.StatusForbidden, problem.Forbidden, "The access token does not give access to %s %s", c.Request.Method, c.FullPath()))
 			return
 		}
 
-		glog.Infof("Granting access to %s with roles: %s", token.AccountID, strings.Join(token.Scope.Roles, ","))
-
-		// access granted
-		c.Writer.Header().Set("Bearer", serializedToken)
+		logger.Infof("Granting access to %s with roles: %s", token.AccountID, strings.Join(token.Scope.Roles, ","))
 	}
 }
 
@@ -90,3 +90,36 @@ func TestValidateAccessTokenHeader(t *testing.T) {
 	assert.True(called)
 	assert.Equal(200, w.Code)
 }
+
+func TestValidateAccessTokenFailureObserver(t *testing.T) {
+	assert := assert.New(t)
+
+	var reasons []string
+	FailureObserver = func(reason string) { reasons = append(reasons, reason) }
+	defer func() { FailureObserver = nil }()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	deny := func(token *Token, ctx *gin.Context) bool {
+		return false
+	}
+	router.Use(ValidateAccessToken(deny, []byte("shared key123456")))
+	router.GET("/test", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	serializedToken, _, err := createEncryptedTestToken()
+	assert.NoError(err)
+
+	for _, hdr := range []string{"", "Bearer garbage", "Bearer " + serializedToken} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/test", nil)
+		if hdr != "" {
+			r.Header.Add("Authorization", hdr)
+		}
+		router.ServeHTTP(w, r)
+	}
+
+	assert.Equal([]string{"missing_token", "bad_token", "forbidden"}, reasons)
+}
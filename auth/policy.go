@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/problem"
+)
+
+// Capability is something the holder of an access token is allowed to do
+type Capability string
+
+const (
+	ReadAlertsCapability         Capability = "read_alerts"         // list alerts, their history and the event stream
+	UpdateAlertsCapability       Capability = "update_alerts"       // change the status of alerts
+	ReadHeartbeatsCapability     Capability = "read_heartbeats"     // list the latest heartbeats
+	ManageAPIKeysCapability      Capability = "manage_api_keys"     // list and create api keys
+	ManageIntegrationsCapability Capability = "manage_integrations" // list, create and dry-run integrations
+	AdminCapability              Capability = "admin"               // list all accounts, renewals and tokens
+	ManageRolesCapability        Capability = "manage_roles"        // grant and revoke roles of accounts
+
+	// NoCapability is required by routes open to any valid access token
+	NoCapability Capability = ""
+)
+
+const (
+	UserRole      = "user"      // the app of an account
+	PublisherRole = "publisher" // reporting applications that only publish, through api keys
+	AdminRole     = "admin"     // operators of the server
+)
+
+// Policy maps roles to the capabilities they imply. A token has the capabilities of its roles and, in addition, the
+// capabilities given to it explicitly.
+type Policy struct {
+	roles map[string][]Capability
+
+	// AccountRoles, if set, returns the roles the account has now. Require then checks them instead of the roles in
+	// the token, so that changed roles take effect on tokens already issued. An error denies access.
+	AccountRoles func(accountID string) ([]string, error)
+}
+
+// DefaultPolicy returns the policy of the server
+func DefaultPolicy() *Policy {
+	user := []Capability{
+		ReadAlertsCapability,
+		UpdateAlertsCapability,
+		ReadHeartbeatsCapability,
+		ManageAPIKeysCapability,
+		ManageIntegrationsCapability,
+	}
+
+	return &Policy{roles: map[string][]Capability{
+		UserRole:      user,
+		PublisherRole: {},
+		AdminRole:     append(append([]Capability{}, user...), AdminCapability, ManageRolesCapability),
+	}}
+}
+
+// HasRole checks if the role is known by the policy
+func (p *Policy) HasRole(role string) bool {
+	_, ok := p.roles[role]
+	return ok
+}
+
+// Roles returns the known roles, sorted
+func (p *Policy) Roles() []string {
+	roles := make([]string, 0, len(p.roles))
+	for r := range p.roles {
+		roles = append(roles, r)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Allows checks if the token has the capability, either through one of its roles or given explicitly
+func (p *Policy) Allows(token *Token, capability Capability) bool {
+	return p.allows(token, token.Scope.Roles, capability)
+}
+
+// allows checks if the token has the capability, either through one of the roles or given explicitly
+func (p *Policy) allows(token *Token, roles []string, capability Capability) bool {
+	if capability == NoCapability || token.HasCapability(string(capability)) {
+		return true
+	}
+
+	for _, role := range roles {
+		for _, c := range p.roles[role] {
+			if c == capability {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Require returns a check for ValidateAccessToken granting access to tokens with the capability. The account of the
+// token is set as "accountID" in the context.
+func (p *Policy) Require(capability Capability) func(*Token, *gin.Context) bool {
+	return func(token *Token, ctx *gin.Context) bool {
+		roles := token.Scope.Roles
+		if p.AccountRoles != nil {
+			var err error
+			roles, err = p.AccountRoles(token.AccountID)
+			if err != nil {
+				logging.FromContext(ctx.Request.Context()).Errorf("Failed to get the roles of account %s: %s", token.AccountID, err)
+				problem.Abort(ctx, problem.Internal())
+				return false
+			}
+		}
+
+		if !p.allows(token, roles, capability) {
+			return false
+		}
+
+		ctx.Set("accountID", token.AccountID)
+		return true
+	}
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	p := DefaultPolicy()
+	assert.Equal([]string{"admin", "publisher", "user"}, p.Roles())
+	assert.True(p.HasRole("user"))
+	assert.False(p.HasRole("role1"))
+
+	user := &Token{Scope: Scope{Roles: []string{UserRole}}}
+	assert.True(p.Allows(user, ReadAlertsCapability))
+	assert.True(p.Allows(user, ManageAPIKeysCapability))
+	assert.False(p.Allows(user, AdminCapability))
+	assert.False(p.Allows(user, ManageRolesCapability))
+
+	admin := &Token{Scope: Scope{Roles: []string{AdminRole}}}
+	assert.True(p.Allows(admin, ReadAlertsCapability))
+	assert.True(p.Allows(admin, AdminCapability))
+	assert.True(p.Allows(admin, ManageRolesCapability))
+
+	publisher := &Token{Scope: Scope{Roles: []string{PublisherRole}}}
+	assert.False(p.Allows(publisher, ReadAlertsCapability))
+	assert.True(p.Allows(publisher, NoCapability))
+
+	// unknown roles give nothing, explicit capabilities are given as is
+	unknown := &Token{Scope: Scope{Roles: []string{"role1"}, Capabilities: []string{"read_heartbeats"}}}
+	assert.False(p.Allows(unknown, ReadAlertsCapability))
+	assert.True(p.Allows(unknown, ReadHeartbeatsCapability))
+}
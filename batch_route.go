@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+)
+
+// Types of the items of a batch
+const (
+	batchAlert     = "alert"
+	batchHeartbeat = "heartbeat"
+)
+
+type batchItemDTO struct {
+	Type string `json:"type"` // alert or heartbeat, the other fields are those of createAlertDTO or createHeartbeatDTO
+}
+
+type batchResultDTO struct {
+	Index     int              `json:"index"` // of the item in the batch
+	Type      string           `json:"type,omitempty"`
+	Success   bool             `json:"success"`
+	Alert     *alertDTO        `json:"alert,omitempty"`
+	Heartbeat *heartbeatDTO    `json:"heartbeat,omitempty"`
+	Error     *problem.Problem `json:"error,omitempty"`
+}
+
+// CreateBatchRoute creates and saves the alerts and heartbeats of a batch, posted as a JSON array or as
+// newline-delimited JSON with one item per line. The items are validated as by CreateAlertRoute and
+// CreateHeartbeatRoute and the valid ones are saved in a single transaction. The result of each item is answered,
+// in the order of the batch.
+func CreateBatchRoute(db *bolt.DB, stream *eventStream, limits configValidation) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("CreateBatchRoute")
+
+		accountIDInterface, exists := c.Get("accountID")
+		if exists == false {
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+		apiKeyID, exists := c.Get("apiKeyID")
+		if exists == false {
+			logger.Infof("No apiKeyID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		accountID, ok := accountIDInterface.(string)
+		if ok == false {
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		var items []json.RawMessage
+
+		body, p := readPayload(c)
+		if p == nil {
+			items, p = splitBatch(body)
+		}
+		if p == nil && int64(len(items)) > limits.MaxBatchSize {
+			p = problem.New(http.StatusRequestEntityTooLarge, problem.BodyTooLarge, "The batch has %d items, more than %d", len(items), limits.MaxBatchSize)
+		}
+		if p != nil {
+			logger.Infof("Invalid batch: %s", p)
+			problem.Abort(c, p)
+			return
+		}
+
+		createBatch(c, db, stream, limits, accountID, apiKeyID.(string), items)
+	}
+}
+
+func createBatch(c *gin.Context, db *bolt.DB, stream *eventStream, limits configValidation, accountID string, apiKeyID string, items []json.RawMessage) {
+	logger := logging.FromContext(c.Request.Context())
+
+	// the labels of the alerts are added on top of the default labels of the api key
+	defaultLabels, err := apiKeyDefaultLabels(db, apiKeyID)
+	if err != nil {
+		logger.Errorf("Failed to get api key: %s", err)
+		problem.Abort(c, problem.Internal())
+		return
+	}
+
+	batch := newIngestBatch(apiKeyID, defaultLabels, limits)
+	results := make([]batchResultDTO, len(items))
+
+	for i, raw := range items {
+		results[i].Index = i
+
+		var item batchItemDTO
+		err := json.Unmarshal(raw, &item)
+		if err != nil {
+			results[i].Error = problem.Binding(err)
+			continue
+		}
+		results[i].Type = item.Type
+
+		switch item.Type {
+		case batchAlert:
+			var payload createAlertDTO
+			var alert *model.Alert
+			p := bindBatchItem(raw, &payload)
+			if p == nil {
+				alert, p = batch.addAlert(&payload)
+			}
+			if p != nil {
+				results[i].Error = p
+				continue
+			}
+
+			dto := makeAlertDTO(alert)
+			results[i].Alert = &dto
+
+		case batchHeartbeat:
+			var payload createHeartbeatDTO
+			var hb *model.Heartbeat
+			p := bindBatchItem(raw, &payload)
+			if p == nil {
+				hb, p = batch.addHeartbeat(&payload)
+			}
+			if p != nil {
+				results[i].Error = p
+				continue
+			}
+
+			dto := makeHeartbeatDTO(hb)
+			results[i].Heartbeat = &dto
+
+		default:
+			results[i].Error = problem.Invalid("type", "oneof", "must be one of %s %s", batchAlert, batchHeartbeat)
+			continue
+		}
+
+		results[i].Success = true
+	}
+
+	alerts, heartbeats := len(batch.alerts), len(batch.heartbeats)
+
+	err = batch.save(c.Request.Context(), db, stream, accountID, actorFromContext(c, accountID))
+	if err != nil {
+		logger.Errorf("Failed to save batch: %s", err)
+		problem.Abort(c, problem.Internal())
+		return
+	}
+
+	logger.Infof("Batch of %d items, %d alerts and %d heartbeats saved", len(items), alerts, heartbeats)
+
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+	})
+}
+
+// ingestBatch collects valid alerts and heartbeats of an api key to save them in a single transaction
+type ingestBatch struct {
+	apiKeyID      string
+	defaultLabels map[string]string // of the api key, the labels of the alerts are added on top of them
+	limits        configValidation
+	now           time.Time // the server time the items are validated against
+
+	alerts     []*model.Alert
+	heartbeats []*model.Heartbeat
+}
+
+func newIngestBatch(apiKeyID string, defaultLabels map[string]string, limits configValidation) *ingestBatch {
+	return &ingestBatch{apiKeyID: apiKeyID, defaultLabels: defaultLabels, limits: limits, now: time.Now()}
+}
+
+// len returns the number of collected items
+func (b *ingestBatch) len() int {
+	return len(b.alerts) + len(b.heartbeats)
+}
+
+// addAlert validates the bound payload and, if it is valid, adds the alert it describes to the batch
+func (b *ingestBatch) addAlert(payload *createAlertDTO) (*model.Alert, *problem.Problem) {
+	p := validateAlert(payload, b.limits, b.now)
+	if p != nil {
+		return nil, p
+	}
+
+	alert := newAlertFromPayload(b.apiKeyID, b.defaultLabels, payload)
+	b.alerts = append(b.alerts, alert)
+	return alert, nil
+}
+
+// addHeartbeat validates the bound payload and, if it is valid, adds the heartbeat it describes to the batch
+func (b *ingestBatch) addHeartbeat(payload *createHeartbeatDTO) (*model.Heartbeat, *problem.Problem) {
+	p := validateHeartbeat(payload, b.limits, b.now)
+	if p != nil {
+		return nil, p
+	}
+
+	hb := newHeartbeatFromPayload(b.apiKeyID, payload)
+	b.heartbeats = append(b.heartbeats, hb)
+	return hb, nil
+}
+
+// save saves the collected items in a single transaction, notifies the clients of the account and empties the batch
+func (b *ingestBatch) save(ctx context.Context, db *bolt.DB, stream *eventStream, accountID string, actor model.Actor) error {
+	err := model.SaveBatch(ctx, db, accountID, b.alerts, b.heartbeats, actor)
+	if err != nil {
+		return err
+	}
+
+	for _, alert := range b.alerts {
+		alertsCreated.WithLabelValues(string(alert.Priority)).Inc()
+	}
+	heartbeatsReceived.Add(float64(len(b.heartbeats)))
+
+	stream.Notify(accountID)
+
+	b.alerts = nil
+	b.heartbeats = nil
+	b.now = time.Now()
+
+	return nil
+}
+
+// splitBatch splits the body into its items, either the elements of a JSON array or the non-empty lines of
+// newline-delimited JSON. The lines are not parsed, so that an invalid line only fails its own item.
+func splitBatch(body []byte) ([]json.RawMessage, *problem.Problem) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, problem.New(http.StatusBadRequest, problem.InvalidBody, "The body is empty")
+	}
+
+	var items []json.RawMessage
+	if body[0] == '[' {
+		err := json.Unmarshal(body, &items)
+		if err != nil {
+			return nil, problem.Binding(err)
+		}
+		return items, nil
+	}
+
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			items = append(items, json.RawMessage(line))
+		}
+	}
+	return items, nil
+}
+
+// bindBatchItem binds an item of a batch as bindPayload binds a whole body. The field errors of the problem are
+// relative to the item.
+func bindBatchItem(raw json.RawMessage, obj interface{}) *problem.Problem {
+	err := binding.JSON.BindBody(raw, obj)
+	if err != nil {
+		return problem.Binding(err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+	"github.com/stretchr/testify/assert"
+)
+
+func newBatchRouter(db *bolt.DB, limits configValidation) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	router.Use(func(c *gin.Context) {
+		c.Set("accountID", "55")
+		c.Set("apiKeyID", "55")
+	})
+
+	router.POST("/batch", CreateBatchRoute(db, nil, limits))
+
+	return router
+}
+
+func TestCreateBatchRouteWithJSONArray(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		router := newBatchRouter(db, defaultConfig().Validation)
+
+		body := `[
+			{"type": "alert", "title": "title1", "short_description": "s", "long_description": "l", "priority": "high", "triggered_at": "2016-01-01T10:00:00Z"},
+			{"type": "heartbeat", "executed_at": "2016-01-01T10:00:00Z"},
+			{"type": "alert", "title": "title2", "short_description": "s", "long_description": "l", "priority": "urgent", "triggered_at": "2016-01-01T10:00:00Z"},
+			{"type": "incident"},
+			{"type": "heartbeat", "executed_at": "2100-01-01T10:00:00Z"},
+			{"type": "alert", "title": "title3", "short_description": "s", "long_description": "l", "priority": "low", "triggered_at": "2016-01-01T10:00:00Z"}
+		]`
+
+		req, _ := http.NewRequest("POST", "/batch", strings.NewReader(body))
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(200, res.Code)
+
+		var resJSON struct {
+			Results []batchResultDTO `json:"results"`
+		}
+		assert.NoError(json.Unmarshal(res.Body.Bytes(), &resJSON))
+
+		results := resJSON.Results
+		if assert.Len(results, 6) {
+			for i, r := range results {
+				assert.Equal(i, r.Index)
+			}
+
+			assert.True(results[0].Success)
+			assert.Equal("alert", results[0].Type)
+			if assert.NotNil(results[0].Alert) {
+				assert.Equal("title1", results[0].Alert.Title)
+			}
+
+			assert.True(results[1].Success)
+			assert.NotNil(results[1].Heartbeat)
+
+			assert.False(results[2].Success)
+			if assert.NotNil(results[2].Error) {
+				assert.Equal(problem.ValidationFailed, results[2].Error.Code)
+				assert.Equal("priority", results[2].Error.Errors[0].Field)
+			}
+
+			assert.False(results[3].Success)
+			if assert.NotNil(results[3].Error) {
+				assert.Equal("type", results[3].Error.Errors[0].Field)
+			}
+
+			assert.False(results[4].Success)
+			if assert.NotNil(results[4].Error) {
+				assert.Equal("in_future", results[4].Error.Errors[0].Reason)
+			}
+
+			assert.True(results[5].Success)
+		}
+
+		// only the valid items are saved
+		alerts, err := model.ListAlerts(db, "55")
+		assert.NoError(err)
+		assert.Equal(2, len(*alerts))
+		assert.Contains(*alerts, results[0].Alert.ID)
+		assert.Contains(*alerts, results[5].Alert.ID)
+
+		heartbeats, err := model.ListHeartbeats(db, "55")
+		assert.NoError(err)
+		assert.Equal(1, len(*heartbeats))
+	})
+}
+
+func TestCreateBatchRouteWithNDJSON(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		router := newBatchRouter(db, defaultConfig().Validation)
+
+		now := time.Now().UTC().Format(time.RFC3339)
+		body := `{"type": "heartbeat", "executed_at": "` + now + `"}` + "\n" +
+			"\n" +
+			`{"type": "heartbeat", "executed_at": ` + "\n" +
+			`{"type": "heartbeat", "executed_at": "` + now + `"}` + "\r\n"
+
+		req, _ := http.NewRequest("POST", "/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(200, res.Code)
+
+		var resJSON struct {
+			Results []batchResultDTO `json:"results"`
+		}
+		assert.NoError(json.Unmarshal(res.Body.Bytes(), &resJSON))
+
+		results := resJSON.Results
+		if assert.Len(results, 3) {
+			assert.True(results[0].Success)
+			assert.False(results[1].Success) // a broken line only fails its own item
+			if assert.NotNil(results[1].Error) {
+				assert.Equal(problem.InvalidBody, results[1].Error.Code)
+			}
+			assert.True(results[2].Success)
+		}
+
+		heartbeats, err := model.ListHeartbeats(db, "55")
+		assert.NoError(err)
+		assert.Equal(2, len(*heartbeats))
+	})
+}
+
+func TestCreateBatchRouteWithInvalidBatch(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		limits := defaultConfig().Validation
+		limits.MaxBatchSize = 2
+
+		router := newBatchRouter(db, limits)
+
+		for body, code := range map[string]problem.Code{
+			"":          problem.InvalidBody,
+			"  \n ":     problem.InvalidBody,
+			`[{"type":`: problem.InvalidBody,
+			`[{"type": "heartbeat"}, {"type": "heartbeat"}, {"type": "heartbeat"}]`: problem.BodyTooLarge,
+		} {
+			req, _ := http.NewRequest("POST", "/batch", strings.NewReader(body))
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+			p := assertProblem(t, res, res.Code, code)
+			assert.NotEqual(200, p.Status, body)
+		}
+
+		heartbeats, err := model.ListHeartbeats(db, "55")
+		assert.NoError(err)
+		assert.Equal(0, len(*heartbeats))
+	})
+}
@@ -0,0 +1,501 @@
+// Package client is a Go client for the alert server. Reporters use it to send alerts and heartbeats with an api key,
+// and apps use it to create an account and get the access tokens needed for reading the alerts.
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQueued is returned when an alert or heartbeat could not be sent because the server is unavailable and it was
+// put in the queue of the client instead
+var ErrQueued = errors.New("client: server unavailable, queued for later delivery")
+
+// ErrNoCredentials is returned when calling a method needing an access token before logging in
+var ErrNoCredentials = errors.New("client: no credentials, login first")
+
+// Error is returned when the server answers with an unexpected status
+type Error struct {
+	StatusCode int
+	Body       string
+	Code       string // the code of the problem answered by the server, e.g. "validation_failed", if any
+	Detail     string // the detail of the problem
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("client: unexpected status %d: %s: %s", e.StatusCode, e.Code, e.Detail)
+	}
+	return fmt.Sprintf("client: unexpected status %d: %s", e.StatusCode, e.Body)
+}
+
+// newError reads the code and detail of the problem answered by the server
+func newError(resp *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Body: string(body)}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/problem+json") {
+		var problem struct {
+			Code   string `json:"code"`
+			Detail string `json:"detail"`
+		}
+		if json.Unmarshal(body, &problem) == nil {
+			e.Code = problem.Code
+			e.Detail = problem.Detail
+		}
+	}
+
+	return e
+}
+
+// temporary checks if retrying the request later might succeed
+func (e *Error) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Credentials are what the app needs to save to keep using its account
+type Credentials struct {
+	AccountID    string `json:"account_id"`
+	RefreshToken string `json:"refresh_token"`
+	AccessToken  string `json:"access_token"`
+}
+
+// Client talks to the alert server. Set the exported fields before using the client.
+type Client struct {
+	BaseURL    string        // e.g. https://alerts.example.com/api/v1
+	APIKey     string        // used by SendAlert and SendHeartbeat
+	HTTPClient *http.Client  // defaults to http.DefaultClient
+	MaxRetries int           // retries of requests failing with network errors or 5xx answers, see do. Defaults to 3
+	Backoff    time.Duration // wait before the first retry, doubled for each retry. Defaults to 500 ms
+	Queue      *Queue        // if set alerts and heartbeats that can not be sent are queued here
+
+	DeviceType string // of the app, sent when renewing the access token
+	DeviceInfo string // of the app, sent when renewing the access token
+
+	// OnCredentials is called whenever the credentials change, e.g. after the access token was renewed, so the app
+	// can save them
+	OnCredentials func(Credentials)
+
+	mu          sync.Mutex
+	credentials *Credentials
+}
+
+// New creates a client for the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// SendAlert reports an alert. If the server is unavailable and the client has a queue the alert is queued and
+// ErrQueued returned. Before sending, any queued items are sent first. The alert is sent with an idempotency key, kept
+// when queued, so the server creates it only once however many times it is retried.
+func (c *Client) SendAlert(alert Alert) (*AlertInfo, error) {
+	c.flushBeforeSend()
+
+	key := newIdempotencyKey()
+
+	var info AlertInfo
+	err := c.do("POST", "/alerts", c.ingestHeader(key), alert, &info, http.StatusCreated)
+	if err != nil {
+		return nil, c.queueOnFailure(err, queuedAlert, key, alert)
+	}
+
+	return &info, nil
+}
+
+// SendHeartbeat reports a heartbeat. If the server is unavailable and the client has a queue the heartbeat is
+// queued and ErrQueued returned.
+func (c *Client) SendHeartbeat(heartbeat Heartbeat) error {
+	c.flushBeforeSend()
+
+	key := newIdempotencyKey()
+
+	err := c.do("POST", "/heartbeats", c.ingestHeader(key), heartbeat, nil, http.StatusCreated)
+	if err != nil {
+		return c.queueOnFailure(err, queuedHeartbeat, key, heartbeat)
+	}
+
+	return nil
+}
+
+// Flush sends the queued alerts and heartbeats in the order they were queued. Items the server rejects are dropped.
+// Returns the number of items sent and stops at the first item that can not be sent because the server is
+// unavailable.
+func (c *Client) Flush() (int, error) {
+	if c.Queue == nil {
+		return 0, nil
+	}
+
+	sent := 0
+	for {
+		item, err := c.Queue.peek()
+		if err != nil || item == nil {
+			return sent, err
+		}
+
+		var path string
+		switch item.Kind {
+		case queuedAlert:
+			path = "/alerts"
+		case queuedHeartbeat:
+			path = "/heartbeats"
+		}
+
+		// items of unknown kinds are dropped
+		if path != "" {
+			err = c.do("POST", path, c.ingestHeader(item.IdempotencyKey), item.Payload, nil, http.StatusCreated)
+			if err != nil && isTemporary(err) {
+				return sent, err
+			}
+			if err == nil {
+				sent++
+			}
+		}
+
+		err = c.Queue.remove(item)
+		if err != nil {
+			return sent, err
+		}
+	}
+}
+
+// CreateAccount creates a new account for the device and returns its id
+func (c *Client) CreateAccount(deviceID string, deviceType string, deviceInfo string) (string, error) {
+	body := newAccountDTO{DeviceID: deviceID, DeviceType: deviceType, DeviceInfo: deviceInfo}
+
+	var res struct {
+		AccountID string `json:"account_id"`
+	}
+	err := c.do("POST", "/accounts", nil, body, &res, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+
+	return res.AccountID, nil
+}
+
+// Login gets the refresh and access tokens of a newly created account. This can only be done once per account, save
+// the credentials and use SetCredentials afterwards. The request is sent with an idempotency key so that its retries
+// get the same tokens.
+func (c *Client) Login(accountID string) (*Credentials, error) {
+	body := newTokenDTO{GrantType: "account", AccountID: &accountID}
+
+	var res struct {
+		RefreshToken string `json:"refresh_token"`
+		AccessToken  string `json:"access_token"`
+	}
+	err := c.do("POST", "/tokens", idempotencyHeader(newIdempotencyKey()), body, &res, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := Credentials{AccountID: accountID, RefreshToken: res.RefreshToken, AccessToken: res.AccessToken}
+	c.setCredentials(creds, true)
+
+	return &creds, nil
+}
+
+// SetCredentials sets previously saved credentials
+func (c *Client) SetCredentials(creds Credentials) {
+	c.setCredentials(creds, false)
+}
+
+// Credentials returns the current credentials, or nil before logging in
+func (c *Client) Credentials() *Credentials {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credentials == nil {
+		return nil
+	}
+	creds := *c.credentials
+	return &creds
+}
+
+// RenewAccessToken gets a new access token using the refresh token. Creating the renewal is not retried, getting the
+// access token for it is.
+func (c *Client) RenewAccessToken() error {
+	creds := c.Credentials()
+	if creds == nil {
+		return ErrNoCredentials
+	}
+
+	var renewal struct {
+		RenewalID string `json:"renewal_id"`
+	}
+	body := newRenewalDTO{RefreshToken: creds.RefreshToken, DeviceType: c.DeviceType, DeviceInfo: c.DeviceInfo}
+	err := c.do("POST", "/renewals", nil, body, &renewal, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = c.do("POST", "/tokens", idempotencyHeader(newIdempotencyKey()), newTokenDTO{GrantType: "renewal", RenewalID: &renewal.RenewalID}, &token, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+
+	creds.AccessToken = token.AccessToken
+	c.setCredentials(*creds, true)
+
+	return nil
+}
+
+// Ping checks that the server is up and the access token valid
+func (c *Client) Ping() error {
+	return c.doAuthorized("GET", "/ping", nil, nil, http.StatusNoContent)
+}
+
+// ListAlerts returns the alerts of the account that are not archived, by id
+func (c *Client) ListAlerts() (map[string]AlertInfo, error) {
+	var alerts map[string]AlertInfo
+	err := c.doAuthorized("GET", "/alerts", nil, &alerts, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	return alerts, nil
+}
+
+// UpdateAlertStatus changes the status of an alert. 'snoozedUntil' is only used, and mandatory, when snoozing.
+func (c *Client) UpdateAlertStatus(alertID string, status string, snoozedUntil *time.Time) (*AlertInfo, error) {
+	body := updateAlertDTO{Status: status, SnoozedUntil: snoozedUntil}
+
+	var info AlertInfo
+	err := c.doAuthorized("POST", "/alerts/"+alertID, body, &info, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// doAuthorized does a request with the access token, renewing the token and retrying once if it is rejected
+func (c *Client) doAuthorized(method string, path string, body interface{}, res interface{}, expected int) error {
+	creds := c.Credentials()
+	if creds == nil {
+		return ErrNoCredentials
+	}
+
+	err := c.do(method, path, bearerHeader(creds.AccessToken), body, res, expected)
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusUnauthorized {
+		err = c.RenewAccessToken()
+		if err != nil {
+			return err
+		}
+		return c.do(method, path, bearerHeader(c.Credentials().AccessToken), body, res, expected)
+	}
+
+	return err
+}
+
+// do sends the request, retrying with backoff on network errors and temporary failures if the request is safe to
+// repeat: a GET, or a request with an idempotency key whose repeats the server answers with the first response. The
+// answer is decoded into res unless it is nil.
+func (c *Client) do(method string, path string, header http.Header, body interface{}, res interface{}, expected int) error {
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	backoff := c.Backoff
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+	retries := c.MaxRetries
+	if retries <= 0 {
+		retries = 3
+	}
+	if method != "GET" && header.Get("Idempotency-Key") == "" {
+		retries = 0
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = c.doOnce(method, path, header, b, res, expected)
+		if err == nil || !isTemporary(err) || attempt >= retries {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (c *Client) doOnce(method string, path string, header http.Header, body []byte, res interface{}, expected int) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+path, r)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != expected {
+		return newError(resp, b)
+	}
+
+	if res != nil && len(b) > 0 {
+		return json.Unmarshal(b, res)
+	}
+
+	return nil
+}
+
+func (c *Client) apiKeyHeader() http.Header {
+	h := make(http.Header)
+	h.Set("APIKey", c.APIKey)
+	return h
+}
+
+// ingestHeader is apiKeyHeader with the idempotency key, if any
+func (c *Client) ingestHeader(idempotencyKey string) http.Header {
+	h := c.apiKeyHeader()
+	if idempotencyKey != "" {
+		h.Set("Idempotency-Key", idempotencyKey)
+	}
+	return h
+}
+
+// idempotencyHeader has the idempotency key, if any
+func idempotencyHeader(idempotencyKey string) http.Header {
+	h := make(http.Header)
+	if idempotencyKey != "" {
+		h.Set("Idempotency-Key", idempotencyKey)
+	}
+	return h
+}
+
+// newIdempotencyKey returns a random key identifying a request across its retries, or "" in the unlikely case that
+// no random bytes can be read
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func bearerHeader(token string) http.Header {
+	h := make(http.Header)
+	h.Set("Authorization", "Bearer "+token)
+	return h
+}
+
+func (c *Client) setCredentials(creds Credentials, notify bool) {
+	c.mu.Lock()
+	c.credentials = &creds
+	c.mu.Unlock()
+
+	if notify && c.OnCredentials != nil {
+		c.OnCredentials(creds)
+	}
+}
+
+// flushBeforeSend sends queued items so they reach the server before newer ones
+func (c *Client) flushBeforeSend() {
+	if c.Queue == nil || c.Queue.Len() == 0 {
+		return
+	}
+	c.Flush()
+}
+
+// queueOnFailure queues the payload if the request failed because the server is unavailable
+func (c *Client) queueOnFailure(err error, kind string, idempotencyKey string, payload interface{}) error {
+	if c.Queue == nil || !isTemporary(err) {
+		return err
+	}
+
+	qerr := c.Queue.push(kind, idempotencyKey, payload)
+	if qerr != nil {
+		return fmt.Errorf("client: failed to queue after %s: %s", err, qerr)
+	}
+
+	return ErrQueued
+}
+
+// isTemporary checks if the error is a temporary failure of the server or a network error that may go away, like a
+// timeout or a refused or dropped connection. Failures of TLS, like an untrusted certificate, are not temporary.
+func isTemporary(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.temporary()
+	}
+
+	// http.Client.Do returns all network errors as *url.Error
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return false
+	}
+
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) || errors.As(err, &recordErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// dialing, reading or writing failed, e.g. the connection was refused or reset
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	// the server closed the connection before answering
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,356 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer records the requests it gets and answers with the statuses in 'statuses', then with 201
+type fakeServer struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, _ := ioutil.ReadAll(r.Body)
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, string(b))
+
+	status := http.StatusCreated
+	if len(f.statuses) > 0 {
+		status = f.statuses[0]
+		f.statuses = f.statuses[1:]
+	}
+
+	w.WriteHeader(status)
+	if status == http.StatusCreated && r.URL.Path == "/alerts" {
+		w.Write([]byte(`{"id": "alert1", "title": "title1", "status": "new"}`))
+	}
+}
+
+func TestSendAlert(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeServer{}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	c := New(s.URL + "/")
+	c.APIKey = "key1"
+
+	info, err := c.SendAlert(Alert{Title: "title1", ShortDescription: "short1", LongDescription: "long1", Priority: HighPriority, TriggeredAt: time.Now()})
+	assert.NoError(err)
+	assert.Equal("alert1", info.ID)
+	assert.Equal("new", info.Status)
+
+	assert.Equal(1, len(f.requests))
+	assert.Equal("POST", f.requests[0].Method)
+	assert.Equal("/alerts", f.requests[0].URL.Path)
+	assert.Equal("key1", f.requests[0].Header.Get("APIKey"))
+
+	var body map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(f.bodies[0]), &body))
+	assert.Equal("title1", body["title"])
+	assert.Equal("high", body["priority"])
+
+	err = c.SendHeartbeat(Heartbeat{ExecutedAt: time.Now()})
+	assert.NoError(err)
+	assert.Equal("/heartbeats", f.requests[1].URL.Path)
+}
+
+func TestRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeServer{statuses: []int{503, 500}}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	c := New(s.URL)
+	c.Backoff = time.Millisecond
+
+	err := c.SendHeartbeat(Heartbeat{ExecutedAt: time.Now()})
+	assert.NoError(err)
+	assert.Equal(3, len(f.requests))
+
+	// the retries have the idempotency key of the first request
+	key := f.requests[0].Header.Get("Idempotency-Key")
+	assert.Len(key, 32)
+	assert.Equal(key, f.requests[1].Header.Get("Idempotency-Key"))
+	assert.Equal(key, f.requests[2].Header.Get("Idempotency-Key"))
+
+	// client errors are not retried
+	f.statuses = []int{400}
+	err = c.SendHeartbeat(Heartbeat{ExecutedAt: time.Now()})
+	assert.Error(err)
+	assert.Equal(400, err.(*Error).StatusCode)
+	assert.Equal(4, len(f.requests))
+	assert.NotEqual(key, f.requests[3].Header.Get("Idempotency-Key"))
+
+	// give up after MaxRetries
+	c.MaxRetries = 2
+	f.statuses = []int{503, 503, 503, 503}
+	err = c.SendHeartbeat(Heartbeat{ExecutedAt: time.Now()})
+	assert.Error(err)
+	assert.Equal(7, len(f.requests))
+}
+
+func TestRetriesOnlyRequestsSafeToRepeat(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeServer{statuses: []int{503}}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	c := New(s.URL)
+	c.Backoff = time.Millisecond
+
+	// creating an account has no idempotency key, a repeat could create a second account
+	_, err := c.CreateAccount("device1", "ios", "{}")
+	assert.Error(err)
+	assert.Equal(503, err.(*Error).StatusCode)
+	assert.Equal(1, len(f.requests))
+
+	// the tokens are requested with an idempotency key, so a repeat gets the same tokens
+	f.statuses = []int{503}
+	_, err = c.Login("account1")
+	assert.NoError(err)
+	assert.Equal(3, len(f.requests))
+	key := f.requests[1].Header.Get("Idempotency-Key")
+	assert.Len(key, 32)
+	assert.Equal(key, f.requests[2].Header.Get("Idempotency-Key"))
+}
+
+func TestTLSFailuresAreNotRetried(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeServer{}
+	s := httptest.NewTLSServer(f)
+	defer s.Close()
+
+	// the certificate of the test server is not trusted by the default client
+	c := New(s.URL)
+	c.Backoff = time.Millisecond
+
+	err := c.SendHeartbeat(Heartbeat{ExecutedAt: time.Now()})
+	assert.Error(err)
+	assert.False(isTemporary(err))
+
+	// while a server that is down may come back
+	c.HTTPClient = s.Client() // trusts the certificate
+	s.Close()
+	err = c.SendHeartbeat(Heartbeat{ExecutedAt: time.Now()})
+	assert.Error(err)
+	assert.True(isTemporary(err))
+}
+
+func TestQueueWhenServerUnavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "queue")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewQueue(dir)
+	assert.NoError(err)
+
+	f := &fakeServer{}
+	s := httptest.NewServer(f)
+	url := s.URL
+	s.Close() // the server is down
+
+	c := New(url)
+	c.Backoff = time.Millisecond
+	c.MaxRetries = 1
+	c.Queue = q
+
+	_, err = c.SendAlert(Alert{Title: "first"})
+	assert.Equal(ErrQueued, err)
+	err = c.SendHeartbeat(Heartbeat{ExecutedAt: time.Now()})
+	assert.Equal(ErrQueued, err)
+	assert.Equal(2, q.Len())
+
+	// the server is up again, the queue is sent before the new alert
+	s = httptest.NewUnstartedServer(f)
+	s.Listener.Close()
+	s.Listener = mustListen(t, url)
+	s.Start()
+	defer s.Close()
+
+	_, err = c.SendAlert(Alert{Title: "second"})
+	assert.NoError(err)
+	assert.Equal(0, q.Len())
+
+	assert.Equal(3, len(f.requests))
+	assert.Equal("/alerts", f.requests[0].URL.Path)
+	assert.Contains(f.bodies[0], "first")
+	assert.Equal("/heartbeats", f.requests[1].URL.Path)
+	assert.Contains(f.bodies[2], "second")
+
+	// the queued items are flushed with the idempotency keys they were first sent with
+	assert.NotEmpty(f.requests[0].Header.Get("Idempotency-Key"))
+	assert.NotEmpty(f.requests[1].Header.Get("Idempotency-Key"))
+	assert.NotEqual(f.requests[0].Header.Get("Idempotency-Key"), f.requests[1].Header.Get("Idempotency-Key"))
+}
+
+func TestFlushDropsRejectedItems(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "queue")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewQueue(dir)
+	assert.NoError(err)
+	assert.NoError(q.push(queuedAlert, "", Alert{Title: "rejected"}))
+	assert.NoError(q.push(queuedAlert, "", Alert{Title: "accepted"}))
+	assert.NoError(q.push(queuedAlert, "", Alert{Title: "unavailable"}))
+
+	f := &fakeServer{statuses: []int{400, 201, 503, 503}}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	c := New(s.URL)
+	c.Backoff = time.Millisecond
+	c.MaxRetries = 1
+	c.Queue = q
+
+	sent, err := c.Flush()
+	assert.Error(err)
+	assert.Equal(1, sent)
+	assert.Equal(1, q.Len())
+}
+
+func TestTokenFlow(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	accessToken := "access1"
+	var renewals int
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/accounts", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"account_id": "account1"}`))
+	})
+	mux.HandleFunc("/tokens", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+
+		w.WriteHeader(http.StatusCreated)
+		if body["grant_type"] == "account" {
+			w.Write([]byte(`{"refresh_token": "refresh1", "access_token": "access1"}`))
+		} else {
+			w.Write([]byte(`{"access_token": "access2"}`))
+		}
+	})
+	mux.HandleFunc("/renewals", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		assert.Equal("refresh1", body["refresh_token"])
+		assert.Equal("ios", body["device_type"])
+
+		mu.Lock()
+		renewals++
+		accessToken = "access2"
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"renewal_id": "renewal1"}`))
+	})
+	mux.HandleFunc("/alerts", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer "+accessToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"alert1": {"id": "alert1", "title": "title1"}}`))
+	})
+
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	c := New(s.URL)
+	c.DeviceType = "ios"
+	c.DeviceInfo = "{}"
+
+	var saved []Credentials
+	c.OnCredentials = func(creds Credentials) {
+		saved = append(saved, creds)
+	}
+
+	_, err := c.ListAlerts()
+	assert.Equal(ErrNoCredentials, err)
+
+	accountID, err := c.CreateAccount("device1", "ios", "{}")
+	assert.NoError(err)
+	assert.Equal("account1", accountID)
+
+	creds, err := c.Login(accountID)
+	assert.NoError(err)
+	assert.Equal(Credentials{AccountID: "account1", RefreshToken: "refresh1", AccessToken: "access1"}, *creds)
+
+	alerts, err := c.ListAlerts()
+	assert.NoError(err)
+	assert.Equal("title1", alerts["alert1"].Title)
+	assert.Equal(0, renewals)
+
+	// the server no longer accepts the access token, it is renewed and the request retried
+	mu.Lock()
+	accessToken = "expired"
+	mu.Unlock()
+
+	alerts, err = c.ListAlerts()
+	assert.NoError(err)
+	assert.Equal(1, len(alerts))
+	assert.Equal(1, renewals)
+	assert.Equal("access2", c.Credentials().AccessToken)
+
+	assert.Equal(2, len(saved))
+	assert.Equal("access2", saved[1].AccessToken)
+}
+
+// mustListen listens on the address of the url, used to restart a stopped test server
+func mustListen(t *testing.T, url string) net.Listener {
+	l, err := net.Listen("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestProblemError(t *testing.T) {
+	assert := assert.New(t)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status": 400, "code": "validation_failed", "detail": "The body has invalid fields"}`))
+	}))
+	defer s.Close()
+
+	c := New(s.URL)
+	c.APIKey = "key1"
+
+	_, err := c.SendAlert(Alert{Title: "title1", TriggeredAt: time.Now()})
+	assert.Error(err)
+	assert.Equal("validation_failed", err.(*Error).Code)
+	assert.Equal("The body has invalid fields", err.(*Error).Detail)
+	assert.Equal("client: unexpected status 400: validation_failed: The body has invalid fields", err.Error())
+}
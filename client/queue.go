@@ -0,0 +1,145 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queuedAlert     = "alert"
+	queuedHeartbeat = "heartbeat"
+)
+
+// Queue is an on-disk queue of alerts and heartbeats waiting to be sent. Each item is a file in the directory of the
+// queue, so queued items survive restarts of the reporter.
+type Queue struct {
+	dir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+type queueItem struct {
+	Kind           string          `json:"kind"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"` // sent again when the item is flushed
+	Payload        json.RawMessage `json:"payload"`
+
+	file string
+}
+
+// NewQueue opens the queue in the directory, creating the directory if needed
+func NewQueue(dir string) (*Queue, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Queue{dir: dir}, nil
+}
+
+// Len returns the number of queued items
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files, err := q.files()
+	if err != nil {
+		return 0
+	}
+	return len(files)
+}
+
+// push adds an item last in the queue
+func (q *Queue) push(kind string, idempotencyKey string, payload interface{}) error {
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(queueItem{Kind: kind, IdempotencyKey: idempotencyKey, Payload: p})
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// the names sort in the order the items were queued
+	q.seq++
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), q.seq%1000000)
+
+	// write to a temporary file first so a crash never leaves a half written item
+	tmp := filepath.Join(q.dir, name+".tmp")
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(q.dir, name))
+}
+
+// peek returns the first item of the queue, or nil if the queue is empty. Unreadable items are removed.
+func (q *Queue) peek() (*queueItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files, err := q.files()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		path := filepath.Join(q.dir, f)
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var item queueItem
+		err = json.Unmarshal(b, &item)
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+		item.file = path
+
+		return &item, nil
+	}
+
+	return nil, nil
+}
+
+// remove removes an item returned by peek
+func (q *Queue) remove(item *queueItem) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := os.Remove(item.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// files returns the names of the queued items in queue order
+func (q *Queue) files() ([]string, error) {
+	infos, err := ioutil.ReadDir(q.dir) // sorted by name
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, fi := range infos {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".json") {
+			files = append(files, fi.Name())
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "queue")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewQueue(filepath.Join(dir, "sub"))
+	assert.NoError(err)
+	assert.Equal(0, q.Len())
+
+	item, err := q.peek()
+	assert.NoError(err)
+	assert.Nil(item)
+
+	for _, title := range []string{"a", "b", "c"} {
+		assert.NoError(q.push(queuedAlert, "", Alert{Title: title}))
+	}
+	assert.Equal(3, q.Len())
+
+	// a queue opened again sees the same items
+	q2, err := NewQueue(filepath.Join(dir, "sub"))
+	assert.NoError(err)
+	assert.Equal(3, q2.Len())
+
+	for _, title := range []string{"a", "b", "c"} {
+		item, err = q.peek()
+		assert.NoError(err)
+		assert.Equal(queuedAlert, item.Kind)
+		assert.Contains(string(item.Payload), `"title":"`+title+`"`)
+		assert.NoError(q.remove(item))
+	}
+	assert.Equal(0, q.Len())
+
+	// unreadable items are dropped
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "sub", "0-broken.json"), []byte("{"), 0600))
+	assert.NoError(q.push(queuedHeartbeat, "key1", Heartbeat{}))
+	item, err = q.peek()
+	assert.NoError(err)
+	assert.Equal(queuedHeartbeat, item.Kind)
+	assert.Equal("key1", item.IdempotencyKey)
+	assert.Equal(1, q.Len())
+}
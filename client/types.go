@@ -0,0 +1,74 @@
+package client
+
+import (
+	"time"
+)
+
+// Priorities of alerts
+const (
+	HighPriority   = "high"
+	NormalPriority = "normal"
+	LowPriority    = "low"
+)
+
+// Statuses of heartbeats
+const (
+	HeartbeatStarted   = "started"
+	HeartbeatSucceeded = "succeeded"
+)
+
+// Alert is an alert to report, see SendAlert
+type Alert struct {
+	Title            string            `json:"title"`
+	ShortDescription string            `json:"short_description"`
+	LongDescription  string            `json:"long_description"`
+	Priority         string            `json:"priority"` // HighPriority, NormalPriority or LowPriority
+	TriggeredAt      time.Time         `json:"triggered_at"`
+	Labels           map[string]string `json:"labels,omitempty"`
+}
+
+// Heartbeat is a heartbeat to report, see SendHeartbeat
+type Heartbeat struct {
+	ExecutedAt time.Time `json:"executed_at"`
+	Status     string    `json:"status,omitempty"` // HeartbeatStarted, HeartbeatSucceeded or empty
+}
+
+// AlertInfo is an alert as returned by the server
+type AlertInfo struct {
+	ID                 string            `json:"id"`
+	Title              string            `json:"title"`
+	ShortDescription   string            `json:"short_description"`
+	LongDescription    string            `json:"long_description"`
+	Priority           string            `json:"priority"`
+	Status             string            `json:"status"`
+	Labels             map[string]string `json:"labels"`
+	Fingerprint        string            `json:"fingerprint,omitempty"`
+	SnoozedUntil       *time.Time        `json:"snoozed_until,omitempty"`
+	AllowedTransitions []string          `json:"allowed_transitions"`
+	TriggeredAt        time.Time         `json:"triggered_at"`
+	CreatedAt          time.Time         `json:"created_at"`
+	UpdatedAt          time.Time         `json:"updated_at"`
+}
+
+type newAccountDTO struct {
+	DeviceID   string `json:"device_id"`
+	DeviceType string `json:"device_type"`
+	DeviceInfo string `json:"device_info"`
+}
+
+type newTokenDTO struct {
+	GrantType string  `json:"grant_type"`
+	AccountID *string `json:"account_id,omitempty"`
+	RenewalID *string `json:"renewal_id,omitempty"`
+}
+
+type newRenewalDTO struct {
+	RefreshToken string `json:"refresh_token"`
+	DeviceType   string `json:"device_type"`
+	DeviceInfo   string `json:"device_info"`
+}
+
+type updateAlertDTO struct {
+	Status       string     `json:"status"`
+	SnoozedUntil *time.Time `json:"snoozed_until,omitempty"`
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/model"
+)
+
+// bucketTypes are the model types stored in each bucket
+var bucketTypes = map[string]reflect.Type{
+	"Accounts":     reflect.TypeOf(model.Account{}),
+	"Devices":      reflect.TypeOf(model.Device{}),
+	"Renewals":     reflect.TypeOf(model.Renewal{}),
+	"APIKeys":      reflect.TypeOf(model.APIKey{}),
+	"Heartbeats":   reflect.TypeOf(model.Heartbeat{}),
+	"Tokens":       reflect.TypeOf(model.Token{}),
+	"Alerts":       reflect.TypeOf(model.Alert{}),
+	"Audit":        reflect.TypeOf(model.AuditEntry{}),
+	"AlertEvents":  reflect.TypeOf(model.AlertEvent{}),
+	"StreamEvents": reflect.TypeOf(model.StreamEvent{}),
+	"Integrations": reflect.TypeOf(model.Integration{}),
+}
+
+// dumpBucket returns all objects of the bucket by key. Objects in nested buckets, e.g. the alerts of an account, are
+// returned in a map by the name of the nested bucket.
+func dumpBucket(db *bolt.DB, name string) (map[string]interface{}, error) {
+	t, ok := bucketTypes[name]
+	if !ok && name != "AlertVersions" {
+		return nil, fmt.Errorf("Unknown bucket %s, known buckets are %s", name, strings.Join(bucketNames(), ", "))
+	}
+
+	objs := make(map[string]interface{})
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			return fmt.Errorf("The database has no %s bucket", name)
+		}
+
+		return dumpObjects(b, name, t, objs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objs, nil
+}
+
+func dumpObjects(b *bolt.Bucket, name string, t reflect.Type, objs map[string]interface{}) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			// nested bucket
+			nested := make(map[string]interface{})
+			err := dumpObjects(b.Bucket(k), name, t, nested)
+			if err != nil {
+				return err
+			}
+			objs[string(k)] = nested
+			return nil
+		}
+
+		key, obj, err := decodeObject(name, t, k, v)
+		if err != nil {
+			return err
+		}
+		objs[key] = obj
+
+		return nil
+	})
+}
+
+// decodeObject decodes a value of the bucket. Returns the key as a readable string and the object.
+func decodeObject(name string, t reflect.Type, k []byte, v []byte) (string, interface{}, error) {
+	switch name {
+	case "AlertVersions":
+		if len(v) != 8 {
+			return "", nil, fmt.Errorf("Invalid alert version of %s", k)
+		}
+		return string(k), binary.BigEndian.Uint64(v), nil
+	case "StreamEvents":
+		// keyed by sequence number
+		if len(k) == 8 {
+			k = []byte(strconv.FormatUint(binary.BigEndian.Uint64(k), 10))
+		}
+	}
+
+	obj := reflect.New(t).Interface()
+	err := gob.NewDecoder(bytes.NewReader(v)).Decode(obj)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to decode %s/%s: %s", name, k, err)
+	}
+
+	return string(k), obj, nil
+}
+
+func bucketNames() []string {
+	names := []string{"AlertVersions"}
+	for name := range bucketTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
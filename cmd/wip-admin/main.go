@@ -0,0 +1,350 @@
+// Command wip-admin inspects and maintains the database of the alert server directly, without going through the
+// server. The server keeps the database locked while running, so stop it first.
+//
+// Usage:
+//
+//	wip-admin [-db my.db] [-json] command [args...]
+//
+// Commands:
+//
+//	accounts                    list the accounts
+//	devices <account id>        list the devices of an account
+//	apikeys <account id>        list the api keys of an account
+//	tokens <account id>         list the tokens of an account
+//	alerts <account id>         list the alerts of an account
+//	dump <bucket>               print all objects of a bucket as JSON
+//	deactivate-key <api key id> deactivate an api key
+//	delete-account <account id> delete an account and everything belonging to it
+//	grant-role <account id> <role>  grant a role to an account, e.g. to bootstrap the first admin
+//	revoke-role <account id> <role> revoke a role from an account
+//	verify                      check that all references between objects are valid
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/auth"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+)
+
+// command is a sub command of the tool
+type command struct {
+	args     string // description of the arguments for the usage
+	nargs    int
+	readOnly bool
+	run      func(db *bolt.DB, args []string, out io.Writer, asJSON bool) error
+}
+
+var commands = map[string]command{
+	"accounts":       {"", 0, true, listAccounts},
+	"devices":        {"<account id>", 1, true, listDevices},
+	"apikeys":        {"<account id>", 1, true, listAPIKeys},
+	"tokens":         {"<account id>", 1, true, listTokens},
+	"alerts":         {"<account id>", 1, true, listAlerts},
+	"dump":           {"<bucket>", 1, true, dumpCommand},
+	"deactivate-key": {"<api key id>", 1, false, deactivateKey},
+	"delete-account": {"<account id>", 1, false, deleteAccount},
+	"grant-role":     {"<account id> <role>", 2, false, grantRole},
+	"revoke-role":    {"<account id> <role>", 2, false, revokeRole},
+	"verify":         {"", 0, true, verifyCommand},
+}
+
+func main() {
+	flags := flag.NewFlagSet("wip-admin", flag.ExitOnError)
+	dbPath := flags.String("db", "my.db", "the database file of the server")
+	asJSON := flags.Bool("json", false, "print lists as JSON")
+	flags.Usage = usage(flags)
+	flags.Parse(os.Args[1:])
+
+	// only problems of the database are of interest next to the output of the commands
+	logging.Setup(os.Stderr, "text", "warn")
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok || flags.NArg()-1 != cmd.nargs {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dbPath, cmd.readOnly)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wip-admin: %s\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	err = cmd.run(db, flags.Args()[1:], os.Stdout, *asJSON)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wip-admin: %s\n", err)
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+func usage(flags *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Usage: wip-admin [flags] command [args...]\n\nCommands:\n")
+
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].args)
+		}
+
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+	}
+}
+
+// openDB opens an existing database. Bolt locks the file, so this fails after a second if the server is running.
+func openDB(path string, readOnly bool) (*bolt.DB, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is locked, stop the server first", path)
+	}
+
+	return db, err
+}
+
+func listAccounts(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	accounts, err := model.ListAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(*accounts))
+	for _, a := range *accounts {
+		roles := strings.Join(a.Roles, ",")
+		if roles == "" {
+			roles = "-"
+		}
+		rows = append(rows, []string{a.ID, roles, formatTime(a.CreatedAt)})
+	}
+
+	return printList(out, asJSON, *accounts, []string{"ID", "ROLES", "CREATED"}, rows)
+}
+
+func listDevices(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	devices, err := model.ListDevices(db, args[0])
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(*devices))
+	for _, d := range *devices {
+		rows = append(rows, []string{d.ID, d.DeviceType, d.DeviceInfo, formatTime(d.CreatedAt)})
+	}
+
+	return printList(out, asJSON, *devices, []string{"ID", "TYPE", "INFO", "CREATED"}, rows)
+}
+
+func listAPIKeys(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	keys, err := model.ListAPIKeys(db, args[0])
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(*keys))
+	for _, k := range *keys {
+		rows = append(rows, []string{k.ID, string(k.Status), k.Description, formatTime(k.CreatedAt)})
+	}
+
+	return printList(out, asJSON, *keys, []string{"ID", "STATUS", "DESCRIPTION", "CREATED"}, rows)
+}
+
+func listTokens(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	tokens, err := model.ListTokens(db, args[0])
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(*tokens))
+	for _, t := range *tokens {
+		rows = append(rows, []string{t.ID, t.Type, strings.Join(t.Scope.Roles, ","), formatTime(t.IssueTime)})
+	}
+
+	return printList(out, asJSON, *tokens, []string{"ID", "TYPE", "ROLES", "ISSUED"}, rows)
+}
+
+func listAlerts(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	alerts, err := model.ListAlerts(db, args[0])
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(*alerts))
+	for _, a := range *alerts {
+		rows = append(rows, []string{a.ID, string(a.Status), string(a.Priority), a.Title, formatTime(a.CreatedAt)})
+	}
+
+	return printList(out, asJSON, *alerts, []string{"ID", "STATUS", "PRIORITY", "TITLE", "CREATED"}, rows)
+}
+
+func deactivateKey(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	apiKey, accountID, err := model.GetAPIKey(db, args[0])
+	if err != nil {
+		return err
+	}
+	if apiKey == nil {
+		return fmt.Errorf("No api key with id %s", args[0])
+	}
+
+	apiKey.Status = model.APIKeyInactive
+	err = apiKey.Save(db, *accountID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Deactivated api key %s of account %s\n", apiKey.ID, *accountID)
+	return nil
+}
+
+func deleteAccount(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	err := model.DeleteAccount(db, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Deleted account %s\n", args[0])
+	return nil
+}
+
+func grantRole(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	return changeRole(db, args[0], args[1], out, true)
+}
+
+func revokeRole(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	return changeRole(db, args[0], args[1], out, false)
+}
+
+// changeRole grants or revokes a role. An account without roles gets the default role of the server when its tokens
+// are created or renewed.
+func changeRole(db *bolt.DB, accountID string, role string, out io.Writer, grant bool) error {
+	policy := auth.DefaultPolicy()
+	if !policy.HasRole(role) {
+		return fmt.Errorf("Unknown role %s, known roles are %s", role, strings.Join(policy.Roles(), ", "))
+	}
+
+	account, err := model.GetAccount(db, accountID)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return fmt.Errorf("No account with id %s", accountID)
+	}
+
+	var changed bool
+	if grant {
+		changed = account.GrantRole(role)
+	} else {
+		changed = account.RevokeRole(role)
+	}
+	if !changed {
+		fmt.Fprintf(out, "Account %s has roles %s, nothing to do\n", account.ID, strings.Join(account.Roles, ","))
+		return nil
+	}
+
+	err = account.Save(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Account %s now has roles %s, effective when its access token is renewed\n", account.ID, strings.Join(account.Roles, ","))
+	return nil
+}
+
+func dumpCommand(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	objs, err := dumpBucket(db, args[0])
+	if err != nil {
+		return err
+	}
+
+	return printJSON(out, objs)
+}
+
+func verifyCommand(db *bolt.DB, args []string, out io.Writer, asJSON bool) error {
+	problems, err := verify(db)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		err = printJSON(out, problems)
+	} else {
+		for _, p := range problems {
+			fmt.Fprintln(out, p)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Found %d problems", len(problems))
+	}
+
+	fmt.Fprintln(out, "No problems found")
+	return nil
+}
+
+// printList prints 'v' as JSON or the rows, sorted, as a table
+func printList(out io.Writer, asJSON bool, v interface{}, header []string, rows [][]string) error {
+	if asJSON {
+		return printJSON(out, v)
+	}
+
+	sort.Sort(byFirstColumn(rows))
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+
+	return w.Flush()
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "%s\n", b)
+	return err
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+type byFirstColumn [][]string
+
+func (r byFirstColumn) Len() int           { return len(r) }
+func (r byFirstColumn) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byFirstColumn) Less(i, j int) bool { return r[i][0] < r[j][0] }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	logging.Setup(ioutil.Discard, "text", "info")
+}
+
+func runInTestDb(t *testing.T, f func(t *testing.T, db *bolt.DB)) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "wip-admin")
+	assert.NoError(err)
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+
+	db, err := bolt.Open(path, 0600, nil)
+	assert.NoError(err)
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		buckets := []string{"Accounts", "Devices", "Renewals", "APIKeys", "Heartbeats", "Tokens", "Alerts", "Audit", "AlertEvents", "StreamEvents", "AlertVersions", "Integrations", "IdempotencyKeys"}
+		for _, b := range buckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(b))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(err)
+
+	f(t, db)
+}
+
+// testAccount saves an account with an api key, an alert with an event and a refresh token with a renewal
+func testAccount(t *testing.T, db *bolt.DB) (*model.Account, *model.APIKey, *model.Alert) {
+	assert := assert.New(t)
+
+	account := model.NewAccount()
+	assert.NoError(account.Save(db))
+
+	apiKey := model.NewAPIKey()
+	apiKey.Description = "backup server"
+	assert.NoError(apiKey.Save(db, account.ID))
+
+	alert := model.NewAlert(apiKey.ID)
+	alert.Title = "Backup failed"
+	// with its AlertCreatedEvent and stream event
+	assert.NoError(model.SaveNewAlerts(db, []model.NewAccountAlert{{AccountUUID: account.ID, Alert: alert, Actor: model.Actor{Type: model.APIKeyActor, ID: apiKey.ID}}}))
+
+	token := model.NewToken()
+	token.Type = "refresh_token"
+	assert.NoError(token.Save(db, account.ID))
+
+	renewal := model.NewRenewal()
+	renewal.RefreshTokenID = token.ID
+	assert.NoError(renewal.Save(db, account.ID))
+
+	return account, apiKey, alert
+}
+
+func TestListCommands(t *testing.T) {
+	runInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		account, apiKey, alert := testAccount(t, db)
+
+		var out bytes.Buffer
+		assert.NoError(listAccounts(db, nil, &out, false))
+		assert.Contains(out.String(), "ID")
+		assert.Contains(out.String(), account.ID)
+
+		out.Reset()
+		assert.NoError(listAPIKeys(db, []string{account.ID}, &out, false))
+		assert.Contains(out.String(), apiKey.ID)
+		assert.Contains(out.String(), "backup server")
+
+		out.Reset()
+		assert.NoError(listAlerts(db, []string{account.ID}, &out, true))
+		var alerts map[string]model.Alert
+		assert.NoError(json.Unmarshal(out.Bytes(), &alerts))
+		assert.Equal("Backup failed", alerts[alert.ID].Title)
+
+		out.Reset()
+		assert.NoError(listTokens(db, []string{account.ID}, &out, false))
+		assert.Contains(out.String(), "refresh_token")
+
+		out.Reset()
+		assert.NoError(listDevices(db, []string{account.ID}, &out, false))
+		assert.Contains(out.String(), "TYPE")
+	})
+}
+
+func TestDumpBucket(t *testing.T) {
+	runInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		account, apiKey, alert := testAccount(t, db)
+
+		objs, err := dumpBucket(db, "Alerts")
+		assert.NoError(err)
+		assert.Len(objs, 1)
+		alerts := objs[account.ID].(map[string]interface{})
+		assert.Equal(apiKey.ID, alerts[alert.ID].(*model.Alert).APIKeyID)
+
+		objs, err = dumpBucket(db, "StreamEvents")
+		assert.NoError(err)
+		events := objs[account.ID].(map[string]interface{})
+		assert.Equal(alert.ID, events["1"].(*model.StreamEvent).ObjectID)
+
+		objs, err = dumpBucket(db, "AlertVersions")
+		assert.NoError(err)
+		assert.Equal(uint64(1), objs[account.ID])
+
+		_, err = dumpBucket(db, "Foo")
+		assert.Error(err)
+
+		var out bytes.Buffer
+		assert.NoError(dumpCommand(db, []string{"Accounts"}, &out, false))
+		var accounts map[string]model.Account
+		assert.NoError(json.Unmarshal(out.Bytes(), &accounts))
+		assert.Equal(account.ID, accounts[account.ID].ID)
+	})
+}
+
+func TestDeactivateKey(t *testing.T) {
+	runInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		_, apiKey, _ := testAccount(t, db)
+
+		var out bytes.Buffer
+		assert.NoError(deactivateKey(db, []string{apiKey.ID}, &out, false))
+
+		saved, _, err := model.GetAPIKey(db, apiKey.ID)
+		assert.NoError(err)
+		assert.Equal(model.APIKeyStatus(model.APIKeyInactive), saved.Status)
+
+		assert.Error(deactivateKey(db, []string{"foo"}, &out, false))
+	})
+}
+
+func TestVerify(t *testing.T) {
+	runInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		account, apiKey, alert := testAccount(t, db)
+
+		problems, err := verify(db)
+		assert.NoError(err)
+		assert.Empty(problems)
+
+		// an alert referring to an api key of another account
+		other, _, _ := testAccount(t, db)
+		foreign := model.NewAlert(apiKey.ID)
+		assert.NoError(foreign.Save(db, other.ID))
+
+		// a heartbeat of an account that does not exist
+		heartbeat := model.NewHeartbeat(apiKey.ID)
+		assert.NoError(heartbeat.Save(db, "nosuchaccount"))
+
+		// events of an alert that does not exist
+		assert.NoError(model.NewAlertEvent(&model.Alert{ID: "nosuchalert"}, model.AlertCreatedEvent, model.Actor{Type: model.SystemActor}).Save(db))
+
+		problems, err = verify(db)
+		assert.NoError(err)
+		assert.Len(problems, 5)
+		assert.Contains(problems, "Alerts: "+foreign.ID+" of account "+other.ID+" refers to api key "+apiKey.ID+" of account "+account.ID)
+		assert.Contains(problems, "Heartbeats: objects of unknown account nosuchaccount")
+		assert.Contains(problems, "StreamEvents: objects of unknown account nosuchaccount") // saved with the heartbeat
+		assert.Contains(problems, "AlertEvents: events of unknown alert nosuchalert")
+		assert.Contains(problems, "Heartbeats: "+heartbeat.ID+" of account nosuchaccount refers to api key "+apiKey.ID+" of account "+account.ID)
+
+		var out bytes.Buffer
+		assert.Error(verifyCommand(db, nil, &out, false))
+
+		// after deleting the account its events are gone and the foreign alert refers to an unknown api key
+		assert.NoError(deleteAccount(db, []string{account.ID}, &out, false))
+		events, err := model.ListAlertEvents(db, alert.ID)
+		assert.NoError(err)
+		assert.Empty(events)
+
+		problems, err = verify(db)
+		assert.NoError(err)
+		assert.Contains(problems, "Alerts: "+foreign.ID+" of account "+other.ID+" refers to unknown api key "+apiKey.ID)
+	})
+}
+
+func TestGrantAndRevokeRole(t *testing.T) {
+	runInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		account, _, _ := testAccount(t, db)
+
+		var out bytes.Buffer
+		assert.NoError(grantRole(db, []string{account.ID, "admin"}, &out, false))
+		saved, err := model.GetAccount(db, account.ID)
+		assert.NoError(err)
+		assert.Equal([]string{"admin"}, saved.Roles)
+
+		assert.NoError(revokeRole(db, []string{account.ID, "admin"}, &out, false))
+		saved, err = model.GetAccount(db, account.ID)
+		assert.NoError(err)
+		assert.Empty(saved.Roles)
+
+		assert.Error(grantRole(db, []string{account.ID, "root"}, &out, false))
+		assert.Error(grantRole(db, []string{"nosuchaccount", "admin"}, &out, false))
+	})
+}
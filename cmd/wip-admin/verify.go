@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/model"
+)
+
+// verifier collects what it has seen of the database and the problems found
+type verifier struct {
+	accounts map[string]bool
+	apiKeys  map[string]string // api key id => account id
+	tokens   map[string]string // token id => account id
+	alerts   map[string]string // alert id => account id
+	problems []string
+}
+
+// verify checks that all objects can be decoded, that all objects belong to an existing account and that all
+// references between objects are valid. Returns the problems found, sorted.
+func verify(db *bolt.DB) ([]string, error) {
+	v := &verifier{
+		accounts: make(map[string]bool),
+		apiKeys:  make(map[string]string),
+		tokens:   make(map[string]string),
+		alerts:   make(map[string]string),
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		for _, name := range append([]string{"Accounts", "AlertEvents", "AlertVersions"}, model.AccountBuckets...) {
+			if tx.Bucket([]byte(name)) == nil {
+				v.report("The database has no %s bucket", name)
+			}
+		}
+		if len(v.problems) > 0 {
+			return nil
+		}
+
+		v.verifyAccounts(tx.Bucket([]byte("Accounts")))
+
+		// collect the objects others refer to first
+		for _, name := range []string{"APIKeys", "Tokens", "Alerts"} {
+			v.verifyAccountBucket(tx.Bucket([]byte(name)), name)
+		}
+		for _, name := range model.AccountBuckets {
+			if name != "APIKeys" && name != "Tokens" && name != "Alerts" {
+				v.verifyAccountBucket(tx.Bucket([]byte(name)), name)
+			}
+		}
+
+		v.verifyAlertEvents(tx.Bucket([]byte("AlertEvents")))
+
+		return tx.Bucket([]byte("AlertVersions")).ForEach(func(k, _ []byte) error {
+			if !v.accounts[string(k)] {
+				v.report("AlertVersions: version of unknown account %s", k)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(v.problems)
+	return v.problems, nil
+}
+
+func (v *verifier) report(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *verifier) verifyAccounts(b *bolt.Bucket) {
+	b.ForEach(func(k, val []byte) error {
+		if val == nil {
+			v.report("Accounts: unexpected nested bucket %s", k)
+			return nil
+		}
+
+		_, obj, err := decodeObject("Accounts", bucketTypes["Accounts"], k, val)
+		if err != nil {
+			v.report("Accounts: %s", err)
+			return nil
+		}
+		if a := obj.(*model.Account); a.ID != string(k) {
+			v.report("Accounts: account %s saved with key %s", a.ID, k)
+		}
+
+		v.accounts[string(k)] = true
+		return nil
+	})
+}
+
+// verifyAccountBucket checks a bucket with the objects of each account in a nested bucket
+func (v *verifier) verifyAccountBucket(b *bolt.Bucket, name string) {
+	b.ForEach(func(k, val []byte) error {
+		if val != nil {
+			v.report("%s: unexpected object %s outside of an account", name, k)
+			return nil
+		}
+
+		accountID := string(k)
+		if !v.accounts[accountID] {
+			v.report("%s: objects of unknown account %s", name, accountID)
+		}
+
+		return b.Bucket(k).ForEach(func(kk, vv []byte) error {
+			_, obj, err := decodeObject(name, bucketTypes[name], kk, vv)
+			if err != nil {
+				v.report("%s: %s", name, err)
+				return nil
+			}
+
+			// stream events are keyed by their sequence number
+			if p, ok := obj.(model.PersistanceID); ok && p.PersistanceID() != string(kk) {
+				v.report("%s: object %s saved with key %s", name, p.PersistanceID(), kk)
+			}
+
+			v.verifyObject(name, accountID, obj)
+			return nil
+		})
+	})
+}
+
+// verifyObject records the object and checks its references
+func (v *verifier) verifyObject(name string, accountID string, obj interface{}) {
+	switch o := obj.(type) {
+	case *model.APIKey:
+		v.apiKeys[o.ID] = accountID
+	case *model.Token:
+		v.tokens[o.ID] = accountID
+	case *model.Alert:
+		v.alerts[o.ID] = accountID
+		v.verifyAPIKeyRef(name, o.ID, accountID, o.APIKeyID)
+	case *model.Heartbeat:
+		v.verifyAPIKeyRef(name, o.ID, accountID, o.APIKeyID)
+	case *model.AuditEntry:
+		if o.APIKeyID != "" {
+			v.verifyAPIKeyRef(name, o.ID, accountID, o.APIKeyID)
+		}
+	case *model.Renewal:
+		if v.tokens[o.RefreshTokenID] != accountID {
+			v.report("Renewals: renewal %s of account %s refers to unknown refresh token %s", o.ID, accountID, o.RefreshTokenID)
+		}
+	}
+}
+
+func (v *verifier) verifyAPIKeyRef(name string, id string, accountID string, apiKeyID string) {
+	owner, ok := v.apiKeys[apiKeyID]
+	if !ok {
+		v.report("%s: %s of account %s refers to unknown api key %s", name, id, accountID, apiKeyID)
+	} else if owner != accountID {
+		v.report("%s: %s of account %s refers to api key %s of account %s", name, id, accountID, apiKeyID, owner)
+	}
+}
+
+// verifyAlertEvents checks that the events are saved in the bucket of an existing alert
+func (v *verifier) verifyAlertEvents(b *bolt.Bucket) {
+	b.ForEach(func(k, val []byte) error {
+		if val != nil {
+			v.report("AlertEvents: unexpected object %s outside of an alert", k)
+			return nil
+		}
+
+		alertID := string(k)
+		if _, ok := v.alerts[alertID]; !ok {
+			v.report("AlertEvents: events of unknown alert %s", alertID)
+		}
+
+		return b.Bucket(k).ForEach(func(kk, vv []byte) error {
+			_, obj, err := decodeObject("AlertEvents", bucketTypes["AlertEvents"], kk, vv)
+			if err != nil {
+				v.report("AlertEvents: %s", err)
+				return nil
+			}
+
+			if e := obj.(*model.AlertEvent); e.AlertID != alertID {
+				v.report("AlertEvents: event %s of alert %s saved with alert %s", e.ID, e.AlertID, alertID)
+			}
+			return nil
+		})
+	})
+}
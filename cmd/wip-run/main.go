@@ -0,0 +1,382 @@
+// Command wip-run wraps a job, e.g. in a crontab, and reports its outcome to the alert server. A heartbeat is sent
+// when the job starts and when it succeeds. When it fails an alert with the tail of its stderr is sent instead.
+//
+// Usage:
+//
+//	wip-run [flags] -- command [args...]
+//
+// The server url and api key are read from the flags, the WIP_SERVER_URL and WIP_API_KEY environment variables or
+// the config file, in that order of precedence. The config file has one "key = value" per line with the keys
+// server_url, api_key and queue_dir.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/joakim666/wip_alerts/client"
+)
+
+// runConfig is the configuration of a run
+type runConfig struct {
+	ServerURL string
+	APIKey    string
+	QueueDir  string // if set, reports that can not be sent are queued here and sent on a later run
+	Title     string // title of the alert, defaults to a title from the command
+	Priority  string
+	TailLines int // lines of stderr included in the alert
+	Timeout   time.Duration
+
+	backoff time.Duration // of the client, 0 uses the default
+}
+
+func main() {
+	flags := flag.NewFlagSet("wip-run", flag.ExitOnError)
+	configFile := flags.String("config", defaultConfigFile(), "config file")
+	serverURL := flags.String("server", "", "url of the server api, e.g. https://alerts.example.com/api/v1")
+	apiKey := flags.String("api-key", "", "api key to report with")
+	queueDir := flags.String("queue", "", "directory for reports that could not be sent")
+	title := flags.String("title", "", "title of the alert sent when the command fails")
+	priority := flags.String("priority", client.HighPriority, "priority of the alert sent when the command fails")
+	tailLines := flags.Int("tail", 20, "number of lines of stderr included in the alert")
+	timeout := flags.Duration("timeout", 0, "kill the command if it runs longer than this, e.g. 1h. 0 means no limit")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: wip-run [flags] -- command [args...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *tailLines < 0 {
+		fmt.Fprintf(os.Stderr, "wip-run: -tail must not be negative\n")
+		os.Exit(2)
+	}
+
+	cfg := runConfig{Title: *title, Priority: *priority, TailLines: *tailLines, Timeout: *timeout}
+
+	file, err := readConfigFile(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wip-run: %s\n", err)
+		os.Exit(2)
+	}
+	cfg.ServerURL = firstNonEmpty(*serverURL, os.Getenv("WIP_SERVER_URL"), file["server_url"])
+	cfg.APIKey = firstNonEmpty(*apiKey, os.Getenv("WIP_API_KEY"), file["api_key"])
+	cfg.QueueDir = firstNonEmpty(*queueDir, os.Getenv("WIP_QUEUE_DIR"), file["queue_dir"])
+
+	if cfg.ServerURL == "" || cfg.APIKey == "" {
+		fmt.Fprintf(os.Stderr, "wip-run: the server url and api key must be given\n")
+		os.Exit(2)
+	}
+
+	os.Exit(run(cfg, flags.Args(), os.Stdout, os.Stderr))
+}
+
+// run runs the command, reports the outcome and returns the exit status of the command. Failing to report never
+// changes the exit status, the problem is only written to stderr.
+func run(cfg runConfig, args []string, stdout io.Writer, stderr io.Writer) int {
+	c := client.New(cfg.ServerURL)
+	c.APIKey = cfg.APIKey
+	c.Backoff = cfg.backoff
+	if cfg.QueueDir != "" {
+		q, err := client.NewQueue(cfg.QueueDir)
+		if err != nil {
+			fmt.Fprintf(stderr, "wip-run: failed to open queue: %s\n", err)
+		} else {
+			c.Queue = q
+		}
+	}
+
+	report := func(err error) {
+		if err != nil && err != client.ErrQueued {
+			fmt.Fprintf(stderr, "wip-run: failed to report: %s\n", err)
+		}
+	}
+
+	start := time.Now()
+	report(c.SendHeartbeat(client.Heartbeat{ExecutedAt: start, Status: client.HeartbeatStarted}))
+
+	tail := newTailWriter(cfg.TailLines)
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(stderr, tail)
+
+	status, err := runCommand(cmd, cfg.Timeout)
+	duration := time.Since(start)
+
+	if err == nil && status == 0 {
+		report(c.SendHeartbeat(client.Heartbeat{ExecutedAt: time.Now(), Status: client.HeartbeatSucceeded}))
+		return 0
+	}
+
+	var outcome string
+	if err != nil {
+		outcome = err.Error()
+	} else {
+		outcome = fmt.Sprintf("exited with status %d", status)
+	}
+	commandLine := strings.Join(args, " ")
+
+	// the alert is cut to the limits of the server, as it would refuse the alert and the failure would go unreported
+	alert := client.Alert{
+		Title:            cfg.Title,
+		ShortDescription: truncate(cleanText(fmt.Sprintf("%s %s after %s", commandLine, outcome, duration), false), maxShortDescriptionLength),
+		Priority:         cfg.Priority,
+		TriggeredAt:      time.Now(),
+		Labels:           map[string]string{"command": truncate(cleanText(filepath.Base(args[0]), false), maxLabelLength)},
+	}
+	if alert.Title == "" {
+		alert.Title = "Job failed: " + filepath.Base(args[0])
+	}
+	alert.Title = truncate(cleanText(alert.Title, false), maxTitleLength)
+	if hostname, err := os.Hostname(); err == nil {
+		alert.Labels["host"] = truncate(cleanText(hostname, false), maxLabelLength)
+	}
+	alert.LongDescription = longDescription(alert.ShortDescription, tail.Lines())
+
+	_, err = c.SendAlert(alert)
+	report(err)
+
+	if status == 0 {
+		status = 1 // the command could not be run at all
+	}
+	return status
+}
+
+// runCommand runs the command and returns its exit status. An error is returned if the command could not be run or
+// was killed because of the timeout.
+func runCommand(cmd *exec.Cmd, timeout time.Duration) (int, error) {
+	err := cmd.Start()
+	if err != nil {
+		return 127, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+
+	select {
+	case err = <-done:
+	case <-timedOut:
+		cmd.Process.Kill()
+		<-done
+		return 124, fmt.Errorf("was killed after the timeout of %s", timeout)
+	}
+
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if ws.Signaled() {
+				return 128 + int(ws.Signal()), fmt.Errorf("was killed by signal %s", ws.Signal())
+			}
+			return ws.ExitStatus(), nil
+		}
+	}
+
+	return 1, err
+}
+
+// readConfigFile reads "key = value" lines. Empty lines and lines starting with # are ignored. A missing file gives
+// no values.
+func readConfigFile(path string) (map[string]string, error) {
+	values := make(map[string]string)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+
+	return values, s.Err()
+}
+
+func defaultConfigFile() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "/etc/wip-run.conf"
+	}
+	return filepath.Join(home, ".wip-run.conf")
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// the default limits of the server in characters
+const (
+	maxTitleLength            = 200
+	maxShortDescriptionLength = 1000
+	maxLongDescriptionLength  = 64 << 10
+	maxLabelLength            = 256
+
+	maxLineLength = 4096 // of the lines of stderr kept
+)
+
+// escapeSequence matches the escape sequences of terminals, e.g. colours
+var escapeSequence = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|[@-Z\\-_])`)
+
+// cleanText replaces invalid UTF-8 and removes escape sequences and control characters, except newlines and tabs
+// when 'multiline', which are replaced by spaces otherwise
+func cleanText(s string, multiline bool) string {
+	s = strings.ToValidUTF8(s, string(utf8.RuneError))
+	s = escapeSequence.ReplaceAllString(s, "")
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			if multiline {
+				return r
+			}
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// truncate cuts s to at most 'max' characters, ending it with an ellipsis when cut
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max-1]) + "…"
+}
+
+// truncateStart cuts s to its last 'max' characters, starting it with an ellipsis when cut
+func truncateStart(s string, max int) string {
+	n := utf8.RuneCountInString(s)
+	if n <= max {
+		return s
+	}
+	return "…" + string([]rune(s)[n-max+1:])
+}
+
+// longDescription is the description followed by as many of the last lines as fit in the limit of the server
+func longDescription(description string, lines []string) string {
+	size := utf8.RuneCountInString(description) + 100 // room for the heading of the lines
+	first := len(lines)
+	for first > 0 {
+		n := utf8.RuneCountInString(lines[first-1]) + 1
+		if size+n > maxLongDescriptionLength {
+			break
+		}
+		size += n
+		first--
+	}
+	lines = lines[first:]
+
+	if len(lines) == 0 {
+		return description
+	}
+	return fmt.Sprintf("%s\n\nLast %d lines of stderr:\n%s", description, len(lines), strings.Join(lines, "\n"))
+}
+
+// tailWriter keeps the last lines written to it, cleaned and cut to maxLineLength
+type tailWriter struct {
+	max   int
+	lines []string
+	part  string // the last line until it is ended by a newline
+}
+
+func newTailWriter(max int) *tailWriter {
+	return &tailWriter{max: max}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	s := t.part + string(p)
+	lines := strings.Split(s, "\n")
+
+	t.part = lines[len(lines)-1]
+	if max := maxLineLength * utf8.UTFMax; len(t.part) > max {
+		// never keep more than this of a single line, cut at the start of a character
+		cut := len(t.part) - max
+		for cut < len(t.part) && !utf8.RuneStart(t.part[cut]) {
+			cut++
+		}
+		t.part = "…" + t.part[cut:]
+	}
+
+	lines = lines[:len(lines)-1]
+	if len(lines) > t.max {
+		lines = lines[len(lines)-t.max:]
+	}
+	for _, line := range lines {
+		t.lines = append(t.lines, tailLine(line))
+	}
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+
+	return len(p), nil
+}
+
+// Lines returns the kept lines, including an unfinished last line
+func (t *tailWriter) Lines() []string {
+	lines := t.lines
+	if t.part != "" {
+		lines = append(lines[:len(lines):len(lines)], tailLine(t.part))
+		if len(lines) > t.max {
+			lines = lines[len(lines)-t.max:]
+		}
+	}
+
+	return lines
+}
+
+// tailLine is the line as kept
+func tailLine(line string) string {
+	return truncateStart(cleanText(line, true), maxLineLength)
+}
+
+// String returns the kept lines joined by newlines
+func (t *tailWriter) String() string {
+	return strings.Join(t.Lines(), "\n")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer records the paths and bodies of the requests it gets
+type fakeServer struct {
+	mu     sync.Mutex
+	paths  []string
+	bodies []string
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, _ := ioutil.ReadAll(r.Body)
+	f.paths = append(f.paths, r.URL.Path)
+	f.bodies = append(f.bodies, string(b))
+
+	w.WriteHeader(http.StatusCreated)
+	if r.URL.Path == "/alerts" {
+		w.Write([]byte(`{"id": "alert1"}`))
+	}
+}
+
+func TestRunSuccess(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeServer{}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	var stdout, stderr bytes.Buffer
+	status := run(runConfig{ServerURL: s.URL, APIKey: "key1", TailLines: 5}, []string{"sh", "-c", "echo hello"}, &stdout, &stderr)
+
+	assert.Equal(0, status)
+	assert.Equal("hello\n", stdout.String())
+	assert.Equal([]string{"/heartbeats", "/heartbeats"}, f.paths)
+	assert.Contains(f.bodies[0], `"status":"started"`)
+	assert.Contains(f.bodies[1], `"status":"succeeded"`)
+}
+
+func TestRunFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeServer{}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	var stdout, stderr bytes.Buffer
+	script := "for i in 1 2 3 4; do echo line$i >&2; done; exit 3"
+	status := run(runConfig{ServerURL: s.URL, APIKey: "key1", Priority: "high", TailLines: 2}, []string{"sh", "-c", script}, &stdout, &stderr)
+
+	assert.Equal(3, status)
+	assert.Equal("line1\nline2\nline3\nline4\n", stderr.String())
+	assert.Equal([]string{"/heartbeats", "/alerts"}, f.paths)
+
+	var alert map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(f.bodies[1]), &alert))
+	assert.Equal("Job failed: sh", alert["title"])
+	assert.Equal("high", alert["priority"])
+	assert.Contains(alert["short_description"], "exited with status 3")
+	assert.True(strings.HasSuffix(alert["long_description"].(string), "Last 2 lines of stderr:\nline3\nline4"))
+
+	// the number of lines actually written is given when it is less than the tail
+	f = &fakeServer{}
+	s2 := httptest.NewServer(f)
+	defer s2.Close()
+
+	status = run(runConfig{ServerURL: s2.URL, APIKey: "key1", TailLines: 5}, []string{"sh", "-c", "echo line1 >&2; exit 3"}, &stdout, &stderr)
+
+	assert.Equal(3, status)
+	assert.NoError(json.Unmarshal([]byte(f.bodies[1]), &alert))
+	assert.True(strings.HasSuffix(alert["long_description"].(string), "Last 1 lines of stderr:\nline1"))
+}
+
+func TestRunTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeServer{}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	var stdout, stderr bytes.Buffer
+	status := run(runConfig{ServerURL: s.URL, APIKey: "key1", TailLines: 2, Timeout: 50 * time.Millisecond}, []string{"sleep", "5"}, &stdout, &stderr)
+
+	assert.Equal(124, status)
+	assert.Equal([]string{"/heartbeats", "/alerts"}, f.paths)
+	assert.Contains(f.bodies[1], "was killed after the timeout")
+}
+
+func TestRunCommandNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeServer{}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	var stdout, stderr bytes.Buffer
+	status := run(runConfig{ServerURL: s.URL, APIKey: "key1", TailLines: 2}, []string{"/no/such/command"}, &stdout, &stderr)
+
+	assert.Equal(127, status)
+	assert.Equal([]string{"/heartbeats", "/alerts"}, f.paths)
+}
+
+func TestRunServerDown(t *testing.T) {
+	assert := assert.New(t)
+
+	s := httptest.NewServer(&fakeServer{})
+	s.Close()
+
+	var stdout, stderr bytes.Buffer
+	status := run(runConfig{ServerURL: s.URL, APIKey: "key1", TailLines: 2, backoff: time.Millisecond}, []string{"sh", "-c", "exit 2"}, &stdout, &stderr)
+
+	// the exit status of the command is kept even though nothing could be reported
+	assert.Equal(2, status)
+	assert.Contains(stderr.String(), "wip-run: failed to report")
+}
+
+func TestReadConfigFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "wip-run")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	values, err := readConfigFile(filepath.Join(dir, "missing.conf"))
+	assert.NoError(err)
+	assert.Empty(values)
+
+	path := filepath.Join(dir, "wip-run.conf")
+	ioutil.WriteFile(path, []byte("# comment\n\nserver_url = http://localhost/api/v1\napi_key=key1\n"), 0600)
+	values, err = readConfigFile(path)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"server_url": "http://localhost/api/v1", "api_key": "key1"}, values)
+
+	ioutil.WriteFile(path, []byte("server_url\n"), 0600)
+	_, err = readConfigFile(path)
+	assert.Error(err)
+}
+
+func TestTailWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	w := newTailWriter(2)
+	w.Write([]byte("a\nb"))
+	w.Write([]byte("c\nd\ne"))
+	assert.Equal("d\ne", w.String())
+
+	w.Write([]byte("f\n"))
+	assert.Equal("d\nef", w.String())
+	assert.Equal([]string{"d", "ef"}, w.Lines())
+
+	w = newTailWriter(0)
+	w.Write([]byte("a\nb"))
+	assert.Empty(w.Lines())
+
+	// colours and control characters are removed and invalid UTF-8 is replaced
+	w = newTailWriter(2)
+	w.Write([]byte("\x1b[31merror\x1b[0m:\tfailed\r\x07\n\xff"))
+	assert.Equal([]string{"error:\tfailed", "\uFFFD"}, w.Lines())
+
+	// long lines are cut to their end, also while unfinished, without splitting characters
+	w = newTailWriter(2)
+	w.Write([]byte(strings.Repeat("ö", 3*maxLineLength) + "end\n"))
+	w.Write([]byte(strings.Repeat("ö", 3*maxLineLength) + "part"))
+	for _, line := range w.Lines() {
+		assert.Equal(maxLineLength, utf8.RuneCountInString(line))
+		assert.True(utf8.ValidString(line))
+		assert.True(strings.HasPrefix(line, "…ö"))
+	}
+	assert.True(strings.HasSuffix(w.Lines()[0], "end"))
+	assert.True(strings.HasSuffix(w.Lines()[1], "part"))
+}
+
+func TestRunFailureWithColouredAndLongStderr(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeServer{}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	// 40 lines of 4000 characters are more than the server takes in the long description
+	script := `printf '\033[1;31mFATAL\033[0m bad\n' >&2; for i in $(seq 40); do printf "%04000d\n" $i >&2; done; exit 1`
+	var stdout, stderr bytes.Buffer
+	status := run(runConfig{ServerURL: s.URL, APIKey: "key1", TailLines: 100}, []string{"sh", "-c", script}, &stdout, &stderr)
+	assert.Equal(1, status)
+
+	var alert map[string]string
+	if assert.Len(f.bodies, 2) {
+		json.Unmarshal([]byte(f.bodies[1]), &alert)
+	}
+	long := alert["long_description"]
+	assert.True(utf8.RuneCountInString(long) <= maxLongDescriptionLength)
+	assert.True(strings.HasSuffix(long, "0040"))
+	assert.Contains(long, "Last 16 lines of stderr:")
+	assert.NotContains(long, "\x1b")
+	assert.NotContains(long, "FATAL bad") // the oldest line does not fit
+
+	// a short tail keeps the coloured line, without the colours
+	f = &fakeServer{}
+	s2 := httptest.NewServer(f)
+	defer s2.Close()
+
+	status = run(runConfig{ServerURL: s2.URL, APIKey: "key1", TailLines: 5}, []string{"sh", "-c", `printf '\033[1;31mFATAL\033[0m bad\n' >&2; exit 1`}, &stdout, &stderr)
+	assert.Equal(1, status)
+	if assert.Len(f.bodies, 2) {
+		json.Unmarshal([]byte(f.bodies[1]), &alert)
+	}
+	assert.True(strings.HasSuffix(alert["long_description"], "Last 1 lines of stderr:\nFATAL bad"))
+}
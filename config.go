@@ -0,0 +1,454 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joakim666/wip_alerts/auth"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"gopkg.in/yaml.v2"
+)
+
+// config holds all settings of the server. The settings are read from the defaults, the config file, the environment
+// and the command line flags, where later sources override earlier ones.
+type config struct {
+	DBPath         string           `yaml:"db_path"`
+	HTTP           configHTTP       `yaml:"http"`
+	Tokens         configTokens     `yaml:"tokens"`
+	TrustedProxies []string         `yaml:"trusted_proxies"` // proxies trusted to set the X-Forwarded-For header
+	SMTP           configSMTP       `yaml:"smtp"`
+	Syslog         configSyslog     `yaml:"syslog"`
+	GRPC           configGRPC       `yaml:"grpc"`
+	Health         configHealth     `yaml:"health"`
+	Metrics        configMetrics    `yaml:"metrics"`
+	Log            configLog        `yaml:"log"`
+	Validation     configValidation `yaml:"validation"`
+}
+
+type configHTTP struct {
+	Addr            string        `yaml:"addr"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`     // for reading a whole request, including the body
+	WriteTimeout    time.Duration `yaml:"write_timeout"`    // for writing a response, not applied to event streams and long polls
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`     // before closing an idle keep-alive connection
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // for in-flight requests to finish on SIGTERM and SIGINT
+	TLSCertFile     string        `yaml:"tls_cert_file"`    // PEM certificate chain, TLS is used when set
+	TLSKeyFile      string        `yaml:"tls_key_file"`     // PEM private key of the certificate
+	MaxBodySize     int64         `yaml:"max_body_size"`    // maximum size in bytes of requests to the ingest endpoints
+	IdempotencyTTL  time.Duration `yaml:"idempotency_ttl"`  // how long responses are replayed for an Idempotency-Key, 0 to ignore the keys
+}
+
+type configTokens struct {
+	AccessKey      string `yaml:"access_key"`       // 16 bytes shared key encrypting the access tokens
+	RefreshKeyFile string `yaml:"refresh_key_file"` // PEM file with the RSA private key encrypting the refresh tokens
+	Role           string `yaml:"role"`             // the role of the tokens of accounts without granted roles
+}
+
+type configSMTP struct {
+	Addr    string `yaml:"addr"`
+	Domain  string `yaml:"domain"`
+	MaxSize int64  `yaml:"max_size"`
+}
+
+type configSyslog struct {
+	UDPAddr   string `yaml:"udp_addr"`
+	TCPAddr   string `yaml:"tcp_addr"`
+	RulesFile string `yaml:"rules_file"`
+}
+
+type configGRPC struct {
+	Addr           string `yaml:"addr"`             // of the gRPC ingest api, served with the TLS certificate of the http api when set
+	MaxStreamItems int64  `yaml:"max_stream_items"` // items taken from one Ingest stream, whose results are held until it closes
+}
+
+type configHealth struct {
+	MinFreeDisk int64 `yaml:"min_free_disk"` // bytes that must be free next to the database for the server to be ready
+}
+
+type configMetrics struct {
+	HeartbeatOverdue time.Duration `yaml:"heartbeat_overdue"` // api keys whose latest heartbeat is older are overdue checks
+	CacheTTL         time.Duration `yaml:"cache_ttl"`         // how long the counts read from the database are reused
+}
+
+type configLog struct {
+	Format string `yaml:"format"` // text or json
+	Level  string `yaml:"level"`  // debug, info, warn or error
+}
+
+// configValidation limits the alerts and heartbeats posted to the api. Lengths are counted in characters.
+type configValidation struct {
+	MaxTitleLength            int64         `yaml:"max_title_length"`
+	MaxShortDescriptionLength int64         `yaml:"max_short_description_length"`
+	MaxLongDescriptionLength  int64         `yaml:"max_long_description_length"`
+	MaxLabels                 int64         `yaml:"max_labels"`
+	MaxLabelLength            int64         `yaml:"max_label_length"` // of both the key and the value
+	MaxClockSkew              time.Duration `yaml:"max_clock_skew"`   // how far after the server time a time may be
+	MaxAge                    time.Duration `yaml:"max_age"`          // how far before the server time a time may be, 0 for no limit
+	MaxBatchSize              int64         `yaml:"max_batch_size"`   // alerts and heartbeats posted in one batch
+}
+
+// defaultConfig returns the settings used when not set in any other way
+func defaultConfig() *config {
+	return &config{
+		DBPath: "my.db",
+		HTTP: configHTTP{
+			Addr:            ":8080",
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 30 * time.Second,
+			MaxBodySize:     1 << 20,
+			IdempotencyTTL:  24 * time.Hour,
+		},
+		Tokens:         configTokens{Role: "user"},
+		TrustedProxies: []string{"127.0.0.1/32", "::1/128"},
+		SMTP:           configSMTP{Domain: "alerts.example", MaxSize: 1 << 20},
+		Syslog:         configSyslog{RulesFile: "syslog.json"},
+		GRPC:           configGRPC{MaxStreamItems: 10000},
+		Health:         configHealth{MinFreeDisk: 100 << 20},
+		Metrics:        configMetrics{HeartbeatOverdue: 24 * time.Hour, CacheTTL: 30 * time.Second},
+		Log:            configLog{Format: "text", Level: "info"},
+		Validation: configValidation{
+			MaxTitleLength:            200,
+			MaxShortDescriptionLength: 1000,
+			MaxLongDescriptionLength:  64 << 10,
+			MaxLabels:                 50,
+			MaxLabelLength:            256,
+			MaxClockSkew:              5 * time.Minute,
+			MaxBatchSize:              500,
+		},
+	}
+}
+
+// setting describes how a config field is set from the environment and the command line
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	secret bool                        // never printed
+	field  func(c *config) interface{} // returns a pointer to the field: *string, *int64, *time.Duration or *[]string
+}
+
+var settings = []setting{
+	{"WIP_DB_PATH", "db", "the database file", false, func(c *config) interface{} { return &c.DBPath }},
+	{"WIP_HTTP_ADDR", "addr", "address of the api, e.g. :8080", false, func(c *config) interface{} { return &c.HTTP.Addr }},
+	{"WIP_HTTP_READ_TIMEOUT", "read-timeout", "timeout for reading a request, e.g. 15s", false, func(c *config) interface{} { return &c.HTTP.ReadTimeout }},
+	{"WIP_HTTP_WRITE_TIMEOUT", "write-timeout", "timeout for writing a response, not applied to event streams and long polls", false, func(c *config) interface{} { return &c.HTTP.WriteTimeout }},
+	{"WIP_HTTP_IDLE_TIMEOUT", "idle-timeout", "timeout before closing idle keep-alive connections", false, func(c *config) interface{} { return &c.HTTP.IdleTimeout }},
+	{"WIP_HTTP_SHUTDOWN_TIMEOUT", "shutdown-timeout", "time given to in-flight requests to finish when shutting down", false, func(c *config) interface{} { return &c.HTTP.ShutdownTimeout }},
+	{"WIP_TLS_CERT_FILE", "tls-cert-file", "PEM certificate chain, the api is served over TLS when set. Reloaded on SIGHUP", false, func(c *config) interface{} { return &c.HTTP.TLSCertFile }},
+	{"WIP_TLS_KEY_FILE", "tls-key-file", "PEM private key of the TLS certificate", false, func(c *config) interface{} { return &c.HTTP.TLSKeyFile }},
+	{"WIP_HTTP_MAX_BODY_SIZE", "max-body-size", "maximum size in bytes of requests to the ingest endpoints", false, func(c *config) interface{} { return &c.HTTP.MaxBodySize }},
+	{"WIP_IDEMPOTENCY_TTL", "idempotency-ttl", "how long the response to an Idempotency-Key is replayed, 0 to ignore the keys", false, func(c *config) interface{} { return &c.HTTP.IdempotencyTTL }},
+	{"WIP_ACCESS_KEY", "access-key", "16 bytes key encrypting the access tokens", true, func(c *config) interface{} { return &c.Tokens.AccessKey }},
+	{"WIP_REFRESH_KEY_FILE", "refresh-key-file", "PEM file with the RSA private key encrypting the refresh tokens", false, func(c *config) interface{} { return &c.Tokens.RefreshKeyFile }},
+	{"WIP_TOKEN_ROLE", "token-role", "role of the tokens of accounts without granted roles", false, func(c *config) interface{} { return &c.Tokens.Role }},
+	{"WIP_TRUSTED_PROXIES", "trusted-proxies", "comma separated networks of proxies trusted to set X-Forwarded-For", false, func(c *config) interface{} { return &c.TrustedProxies }},
+	{"WIP_SMTP_ADDR", "smtp-addr", "address of the embedded SMTP server receiving alerts by mail, e.g. :2525. Disabled when empty", false, func(c *config) interface{} { return &c.SMTP.Addr }},
+	{"WIP_SMTP_DOMAIN", "smtp-domain", "mail domain of the embedded SMTP server, alerts are sent to <api key>@<domain>", false, func(c *config) interface{} { return &c.SMTP.Domain }},
+	{"WIP_SMTP_MAX_SIZE", "smtp-max-size", "maximum size in bytes of mail received by the embedded SMTP server", false, func(c *config) interface{} { return &c.SMTP.MaxSize }},
+	{"WIP_SYSLOG_UDP_ADDR", "syslog-udp-addr", "UDP address of the syslog receiver, e.g. :514. Disabled when empty", false, func(c *config) interface{} { return &c.Syslog.UDPAddr }},
+	{"WIP_SYSLOG_TCP_ADDR", "syslog-tcp-addr", "TCP address of the syslog receiver, e.g. :514. Disabled when empty", false, func(c *config) interface{} { return &c.Syslog.TCPAddr }},
+	{"WIP_SYSLOG_CONFIG", "syslog-config", "file with the api key and rules of the syslog receiver", false, func(c *config) interface{} { return &c.Syslog.RulesFile }},
+	{"WIP_GRPC_ADDR", "grpc-addr", "address of the gRPC ingest api, e.g. :9090. Disabled when empty", false, func(c *config) interface{} { return &c.GRPC.Addr }},
+	{"WIP_GRPC_MAX_STREAM_ITEMS", "grpc-max-stream-items", "maximum number of alerts and heartbeats sent in one stream of the gRPC ingest api", false, func(c *config) interface{} { return &c.GRPC.MaxStreamItems }},
+	{"WIP_HEALTH_MIN_FREE_DISK", "min-free-disk", "bytes that must be free on the file system of the database for the server to be ready", false, func(c *config) interface{} { return &c.Health.MinFreeDisk }},
+	{"WIP_HEARTBEAT_OVERDUE", "heartbeat-overdue", "age of the latest heartbeat of an api key after which its check is counted as overdue", false, func(c *config) interface{} { return &c.Metrics.HeartbeatOverdue }},
+	{"WIP_METRICS_CACHE_TTL", "metrics-cache-ttl", "how long the counts of alerts and heartbeats read from the database are reused by scrapes", false, func(c *config) interface{} { return &c.Metrics.CacheTTL }},
+	{"WIP_LOG_FORMAT", "log-format", "format of the log written to stderr, text or json", false, func(c *config) interface{} { return &c.Log.Format }},
+	{"WIP_LOG_LEVEL", "log-level", "lowest level logged, debug, info, warn or error", false, func(c *config) interface{} { return &c.Log.Level }},
+	{"WIP_MAX_TITLE_LENGTH", "max-title-length", "maximum length in characters of the title of alerts", false, func(c *config) interface{} { return &c.Validation.MaxTitleLength }},
+	{"WIP_MAX_SHORT_DESCRIPTION_LENGTH", "max-short-description-length", "maximum length in characters of the short description of alerts", false, func(c *config) interface{} { return &c.Validation.MaxShortDescriptionLength }},
+	{"WIP_MAX_LONG_DESCRIPTION_LENGTH", "max-long-description-length", "maximum length in characters of the long description of alerts", false, func(c *config) interface{} { return &c.Validation.MaxLongDescriptionLength }},
+	{"WIP_MAX_LABELS", "max-labels", "maximum number of labels of alerts", false, func(c *config) interface{} { return &c.Validation.MaxLabels }},
+	{"WIP_MAX_LABEL_LENGTH", "max-label-length", "maximum length in characters of the keys and values of labels", false, func(c *config) interface{} { return &c.Validation.MaxLabelLength }},
+	{"WIP_MAX_CLOCK_SKEW", "max-clock-skew", "how far after the server time the times of alerts and heartbeats may be", false, func(c *config) interface{} { return &c.Validation.MaxClockSkew }},
+	{"WIP_MAX_AGE", "max-age", "how far before the server time the times of alerts and heartbeats may be, 0 for no limit", false, func(c *config) interface{} { return &c.Validation.MaxAge }},
+	{"WIP_MAX_BATCH_SIZE", "max-batch-size", "maximum number of alerts and heartbeats posted in one batch", false, func(c *config) interface{} { return &c.Validation.MaxBatchSize }},
+}
+
+// registerConfigFlags adds a flag for each setting and for the config file. The flags only override the other
+// sources when given.
+func registerConfigFlags(fs *flag.FlagSet) *string {
+	defaults := defaultConfig()
+	for _, s := range settings {
+		fs.String(s.flag, formatSetting(s.field(defaults)), s.usage)
+	}
+
+	return fs.String("config", os.Getenv("WIP_CONFIG"), "YAML config file, also given by WIP_CONFIG")
+}
+
+// loadConfig reads the config file, if any, and then applies the environment and the flags set on the command line
+func loadConfig(path string, getenv func(string) string, fs *flag.FlagSet) (*config, error) {
+	c := defaultConfig()
+
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read config file: %s", err)
+		}
+
+		err = yaml.UnmarshalStrict(b, c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config file %s: %s", path, err)
+		}
+	}
+
+	for _, s := range settings {
+		v := getenv(s.env)
+		if v == "" {
+			continue
+		}
+
+		err := parseSetting(s.field(c), v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", s.env, err)
+		}
+	}
+
+	var err error
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) {
+			for _, s := range settings {
+				if s.flag == f.Name && err == nil {
+					perr := parseSetting(s.field(c), f.Value.String())
+					if perr != nil {
+						err = fmt.Errorf("Invalid -%s: %s", s.flag, perr)
+					}
+				}
+			}
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func parseSetting(field interface{}, v string) error {
+	switch f := field.(type) {
+	case *string:
+		*f = v
+	case *int64:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s is not a number", v)
+		}
+		*f = n
+	case *time.Duration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s is not a duration", v)
+		}
+		*f = d
+	case *[]string:
+		*f = nil
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*f = append(*f, s)
+			}
+		}
+	}
+
+	return nil
+}
+
+func formatSetting(field interface{}) string {
+	switch f := field.(type) {
+	case *string:
+		return *f
+	case *int64:
+		return strconv.FormatInt(*f, 10)
+	case *time.Duration:
+		return f.String()
+	case *[]string:
+		return strings.Join(*f, ",")
+	}
+
+	return ""
+}
+
+// validate checks all settings and returns an error listing all problems found
+func (c *config) validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.DBPath == "" {
+		problem("db_path must be set")
+	}
+
+	if _, _, err := net.SplitHostPort(c.HTTP.Addr); err != nil {
+		problem("http.addr %q is not a valid address: %s", c.HTTP.Addr, err)
+	}
+	for name, d := range map[string]time.Duration{
+		"http.read_timeout":     c.HTTP.ReadTimeout,
+		"http.write_timeout":    c.HTTP.WriteTimeout,
+		"http.idle_timeout":     c.HTTP.IdleTimeout,
+		"http.shutdown_timeout": c.HTTP.ShutdownTimeout,
+		"http.idempotency_ttl":  c.HTTP.IdempotencyTTL,
+	} {
+		if d < 0 {
+			problem("%s must not be negative", name)
+		}
+	}
+	if (c.HTTP.TLSCertFile == "") != (c.HTTP.TLSKeyFile == "") {
+		problem("http.tls_cert_file and http.tls_key_file must be set together")
+	} else if c.HTTP.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.HTTP.TLSCertFile, c.HTTP.TLSKeyFile); err != nil {
+			problem("http.tls_cert_file: %s", err)
+		}
+	}
+	if c.HTTP.MaxBodySize <= 0 {
+		problem("http.max_body_size must be positive")
+	}
+
+	if len(c.Tokens.AccessKey) != 16 {
+		problem("tokens.access_key must be 16 bytes long, it is %d", len(c.Tokens.AccessKey))
+	}
+	if c.Tokens.RefreshKeyFile == "" {
+		problem("tokens.refresh_key_file must be set")
+	} else if _, err := loadRSAPrivateKey(c.Tokens.RefreshKeyFile); err != nil {
+		problem("tokens.refresh_key_file: %s", err)
+	}
+	if !auth.DefaultPolicy().HasRole(c.Tokens.Role) {
+		problem("tokens.role %q is not one of the roles %s", c.Tokens.Role, strings.Join(auth.DefaultPolicy().Roles(), ", "))
+	}
+
+	if _, err := model.ParseCIDRs(c.TrustedProxies); err != nil {
+		problem("trusted_proxies: %s", err)
+	}
+
+	if c.SMTP.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.SMTP.Addr); err != nil {
+			problem("smtp.addr %q is not a valid address: %s", c.SMTP.Addr, err)
+		}
+		if c.SMTP.Domain == "" {
+			problem("smtp.domain must be set when smtp.addr is set")
+		}
+		if c.SMTP.MaxSize <= 0 {
+			problem("smtp.max_size must be positive")
+		}
+	}
+
+	for name, addr := range map[string]string{"syslog.udp_addr": c.Syslog.UDPAddr, "syslog.tcp_addr": c.Syslog.TCPAddr} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			problem("%s %q is not a valid address: %s", name, addr, err)
+		}
+		if c.Syslog.RulesFile == "" {
+			problem("syslog.rules_file must be set when %s is set", name)
+		}
+	}
+
+	if c.GRPC.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.GRPC.Addr); err != nil {
+			problem("grpc.addr %q is not a valid address: %s", c.GRPC.Addr, err)
+		}
+	}
+	if c.GRPC.MaxStreamItems <= 0 {
+		problem("grpc.max_stream_items must be positive")
+	}
+
+	if c.Health.MinFreeDisk < 0 {
+		problem("health.min_free_disk must not be negative")
+	}
+
+	if c.Metrics.HeartbeatOverdue <= 0 {
+		problem("metrics.heartbeat_overdue must be positive")
+	}
+	if c.Metrics.CacheTTL < 0 {
+		problem("metrics.cache_ttl must not be negative")
+	}
+
+	if err := logging.Check(c.Log.Format, c.Log.Level); err != nil {
+		problem("log: %s", err)
+	}
+
+	for name, n := range map[string]int64{
+		"validation.max_title_length":             c.Validation.MaxTitleLength,
+		"validation.max_short_description_length": c.Validation.MaxShortDescriptionLength,
+		"validation.max_long_description_length":  c.Validation.MaxLongDescriptionLength,
+		"validation.max_labels":                   c.Validation.MaxLabels,
+		"validation.max_label_length":             c.Validation.MaxLabelLength,
+		"validation.max_batch_size":               c.Validation.MaxBatchSize,
+	} {
+		if n <= 0 {
+			problem("%s must be positive", name)
+		}
+	}
+	if c.Validation.MaxClockSkew < 0 {
+		problem("validation.max_clock_skew must not be negative")
+	}
+	if c.Validation.MaxAge < 0 {
+		problem("validation.max_age must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// print writes the config as YAML with the secrets redacted
+func (c *config) print(w io.Writer) error {
+	redacted := *c
+	for _, s := range settings {
+		if f, ok := s.field(&redacted).(*string); ok && s.secret && *f != "" {
+			*f = "<redacted>"
+		}
+	}
+
+	b, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// loadRSAPrivateKey reads a PEM encoded PKCS #1 or PKCS #8 RSA private key
+func loadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s has no PEM encoded key", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s has no RSA private key: %s", path, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s has no RSA private key", path)
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigFiles writes a config file with the given content and an RSA key file to a temp dir. Returns the dir,
+// which the caller must remove.
+func writeConfigFiles(t *testing.T, content string) string {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(err)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(err)
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "refresh.pem"), b, 0600))
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "config.yml"), []byte(content), 0600))
+
+	return dir
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := writeConfigFiles(t, `
+db_path: /var/lib/wip/alerts.db
+http:
+  addr: ":9000"
+  read_timeout: 5s
+tokens:
+  access_key: "file key 1234567"
+smtp:
+  addr: ":2525"
+  max_size: 1000
+`)
+	defer os.RemoveAll(dir)
+
+	env := map[string]string{
+		"WIP_HTTP_ADDR":         ":9001",
+		"WIP_SMTP_MAX_SIZE":     "2000",
+		"WIP_TRUSTED_PROXIES":   "10.0.0.0/8, 192.168.0.0/16",
+		"WIP_HTTP_IDLE_TIMEOUT": "1m30s",
+	}
+	getenv := func(k string) string { return env[k] }
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerConfigFlags(fs)
+	assert.NoError(fs.Parse([]string{"-smtp-max-size", "3000", "-db", "/tmp/other.db"}))
+
+	c, err := loadConfig(filepath.Join(dir, "config.yml"), getenv, fs)
+	assert.NoError(err)
+
+	assert.Equal("/tmp/other.db", c.DBPath)                                  // flag over file
+	assert.Equal(":9001", c.HTTP.Addr)                                       // env over file
+	assert.Equal(int64(3000), c.SMTP.MaxSize)                                // flag over env over file
+	assert.Equal("file key 1234567", c.Tokens.AccessKey)                     // file over default
+	assert.Equal("user", c.Tokens.Role)                                      // default
+	assert.Equal("alerts.example", c.SMTP.Domain)                            // default kept in a section of the file
+	assert.Equal([]string{"10.0.0.0/8", "192.168.0.0/16"}, c.TrustedProxies) // list from env
+	assert.Equal(5*time.Second, c.HTTP.ReadTimeout)                          // duration from file
+	assert.Equal(90*time.Second, c.HTTP.IdleTimeout)                         // duration from env
+	assert.Equal(30*time.Second, c.HTTP.WriteTimeout)                        // default kept in a section of the file
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := writeConfigFiles(t, "htp:\n  addr: \":9000\"\n")
+	defer os.RemoveAll(dir)
+
+	noenv := func(string) string { return "" }
+
+	// unknown keys are typos
+	_, err := loadConfig(filepath.Join(dir, "config.yml"), noenv, nil)
+	assert.Error(err)
+
+	_, err = loadConfig(filepath.Join(dir, "missing.yml"), noenv, nil)
+	assert.Error(err)
+
+	_, err = loadConfig("", func(k string) string {
+		if k == "WIP_SMTP_MAX_SIZE" {
+			return "big"
+		}
+		return ""
+	}, nil)
+	assert.EqualError(err, "Invalid WIP_SMTP_MAX_SIZE: big is not a number")
+}
+
+func TestValidateConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := writeConfigFiles(t, "")
+	defer os.RemoveAll(dir)
+
+	c := defaultConfig()
+	c.Tokens.AccessKey = "shared key123456"
+	c.Tokens.RefreshKeyFile = filepath.Join(dir, "refresh.pem")
+	assert.NoError(c.validate())
+
+	_, err := loadRSAPrivateKey(c.Tokens.RefreshKeyFile)
+	assert.NoError(err)
+
+	// the defaults alone are not enough, the keys must be given
+	err = defaultConfig().validate()
+	assert.Error(err)
+	assert.Contains(err.Error(), "tokens.access_key must be 16 bytes long, it is 0")
+	assert.Contains(err.Error(), "tokens.refresh_key_file must be set")
+
+	c.HTTP.Addr = "8080"
+	c.Tokens.RefreshKeyFile = filepath.Join(dir, "config.yml")
+	c.TrustedProxies = []string{"foo"}
+	c.Syslog.UDPAddr = ":514"
+	c.Syslog.RulesFile = ""
+	c.Tokens.Role = "role1"
+	c.HTTP.ReadTimeout = -time.Second
+	c.HTTP.TLSCertFile = "cert.pem"
+	c.HTTP.MaxBodySize = 0
+	c.Validation.MaxLabels = 0
+	c.Validation.MaxClockSkew = -time.Minute
+	c.GRPC.Addr = "9090"
+	c.GRPC.MaxStreamItems = 0
+	err = c.validate()
+	assert.Error(err)
+	assert.Contains(err.Error(), `http.addr "8080" is not a valid address`)
+	assert.Contains(err.Error(), "has no PEM encoded key")
+	assert.Contains(err.Error(), "trusted_proxies")
+	assert.Contains(err.Error(), "syslog.rules_file must be set when syslog.udp_addr is set")
+	assert.Contains(err.Error(), `tokens.role "role1" is not one of the roles admin, publisher, user`)
+	assert.Contains(err.Error(), "http.read_timeout must not be negative")
+	assert.Contains(err.Error(), "http.tls_cert_file and http.tls_key_file must be set together")
+	assert.Contains(err.Error(), "http.max_body_size must be positive")
+	assert.Contains(err.Error(), "validation.max_labels must be positive")
+	assert.Contains(err.Error(), "validation.max_clock_skew must not be negative")
+	assert.Contains(err.Error(), `grpc.addr "9090" is not a valid address`)
+	assert.Contains(err.Error(), "grpc.max_stream_items must be positive")
+	assert.NotContains(err.Error(), "when grpc.addr is set")
+}
+
+func TestConfigPrint(t *testing.T) {
+	assert := assert.New(t)
+
+	c := defaultConfig()
+	c.Tokens.AccessKey = "shared key123456"
+	c.Tokens.RefreshKeyFile = "/etc/wip/refresh.pem"
+
+	var out bytes.Buffer
+	assert.NoError(c.print(&out))
+	assert.Contains(out.String(), "access_key: <redacted>")
+	assert.Contains(out.String(), "refresh_key_file: /etc/wip/refresh.pem")
+	assert.NotContains(out.String(), "shared key123456")
+
+	// the config itself is unchanged
+	assert.Equal("shared key123456", c.Tokens.AccessKey)
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(1, runConfigCommand(c, []string{"config", "print"}, &stdout, &stderr))
+	assert.Contains(stdout.String(), "db_path: my.db")
+	assert.Contains(stdout.String(), "write_timeout: 30s")
+	assert.Contains(stderr.String(), "tokens.refresh_key_file")
+
+	assert.Equal(2, runConfigCommand(c, []string{"foo"}, &stdout, &stderr))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+)
+
+// keepAliveInterval is how often a comment is sent on idle streams to keep proxies from closing the connection
+var keepAliveInterval = 30 * time.Second
+
+// eventStream tells the connected clients of an account that there are new stream events. The events themselves are
+// saved by the model in the transaction of each change, so a client reads them from the database when notified. A nil
+// *eventStream notifies nobody.
+type eventStream struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]bool // account id => subscribers
+	closed      chan struct{}                     // closed when the server shuts down
+	closeOnce   sync.Once
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{
+		subscribers: make(map[string]map[chan struct{}]bool),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Close ends all connected streams, so that the server can shut down without waiting for the clients to disconnect
+func (s *eventStream) Close() {
+	if s == nil {
+		return
+	}
+
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+// Done returns a channel closed when the stream is closed. A nil *eventStream is never closed.
+func (s *eventStream) Done() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.closed
+}
+
+// Notify tells the connected clients of the account that there are new events, call it after the transaction saving
+// the events is committed. It never blocks, a client that has not yet handled an earlier notification reads all the
+// new events at once.
+func (s *eventStream) Notify(accountID string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch := range s.subscribers[accountID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// already notified
+		}
+	}
+}
+
+// Subscribe returns a channel receiving a value when there are new events for the account. Subscribing to a nil
+// *eventStream returns a channel that never receives anything.
+func (s *eventStream) Subscribe(accountID string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	if s == nil {
+		return ch
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subscribers[accountID] == nil {
+		s.subscribers[accountID] = make(map[chan struct{}]bool)
+	}
+	s.subscribers[accountID][ch] = true
+
+	return ch
+}
+
+// Unsubscribe stops notifying the channel
+func (s *eventStream) Unsubscribe(accountID string, ch chan struct{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscribers[accountID], ch)
+	if len(s.subscribers[accountID]) == 0 {
+		delete(s.subscribers, accountID)
+	}
+}
+
+// StreamEventsRoute streams the alert and heartbeat events of the account as Server-Sent Events. A client can resume
+// a stream by sending the id of the last event it received in the Last-Event-ID header (or the last_event_id query
+// parameter), the missed events are then sent first.
+func StreamEventsRoute(db *bolt.DB, stream *eventStream) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("StreamEventsRoute")
+
+		accountIDInterface, exists := c.Get("accountID")
+		if exists == false {
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		accountID, ok := accountIDInterface.(string)
+		if ok == false {
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		var lastSeq uint64
+		lastEventID := c.Request.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = c.Query("last_event_id")
+		}
+		if lastEventID != "" {
+			var err error
+			lastSeq, err = strconv.ParseUint(lastEventID, 10, 64)
+			if err != nil {
+				logger.Infof("Invalid Last-Event-ID %s", lastEventID)
+				problem.Abort(c, problem.New(http.StatusBadRequest, problem.InvalidParameter, "Last-Event-ID %s is not an event id", lastEventID))
+				return
+			}
+		}
+
+		// subscribe before reading the missed events so that nothing is lost in between
+		ch := stream.Subscribe(accountID)
+		defer stream.Unsubscribe(accountID, ch)
+
+		events, err := model.ListStreamEventsSince(db, accountID, lastSeq)
+		if err != nil {
+			logger.Errorf("Failed to get missed events for account %s: %s", accountID, err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		// the stream is open for as long as the client wants, so the write timeout of the server does not apply
+		http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+		c.Writer.Header().Set("Content-Type", "text/event-stream")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+		c.Status(http.StatusOK)
+
+		for _, e := range events {
+			writeStreamEvent(c.Writer, &e)
+			lastSeq = e.Seq
+		}
+		c.Writer.Flush()
+
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-ch:
+				events, err := model.ListStreamEventsSince(db, accountID, lastSeq)
+				if err != nil {
+					logger.Errorf("Failed to get new events for account %s: %s", accountID, err)
+					return
+				}
+				for _, e := range events {
+					writeStreamEvent(c.Writer, &e)
+					lastSeq = e.Seq
+				}
+				c.Writer.Flush()
+			case <-keepAlive.C:
+				fmt.Fprint(c.Writer, ": keep-alive\n\n")
+				c.Writer.Flush()
+			case <-c.Request.Context().Done():
+				logger.Infof("Event stream for account %s closed", accountID)
+				return
+			case <-stream.Done():
+				logger.Infof("Closing event stream for account %s, shutting down", accountID)
+				return
+			}
+		}
+	}
+}
+
+// writeStreamEvent writes the event with the json representation of its alert or heartbeat as data
+func writeStreamEvent(w http.ResponseWriter, e *model.StreamEvent) {
+	var obj interface{} = struct{}{}
+	if e.Alert != nil {
+		obj = makeAlertDTO(e.Alert)
+	} else if e.Heartbeat != nil {
+		obj = makeHeartbeatDTO(e.Heartbeat)
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		logging.Errorf("Failed to marshal %s event %d: %s", e.Type, e.Seq, err)
+		return
+	}
+
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+}
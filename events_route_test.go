@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamEventsWithoutAccountID(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.GET("/events", StreamEventsRoute(db, newEventStream()))
+
+		req, _ := http.NewRequest("GET", "/events", nil)
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(401, res.Code)
+	})
+}
+
+func TestStreamEvents(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		stream := newEventStream()
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.GET("/events", StreamEventsRoute(db, stream))
+
+		actor := model.Actor{Type: model.SystemActor}
+
+		a1 := model.NewAlert("apiKey1")
+		a1.Title = "title1"
+		assert.NoError(model.SaveNewAlerts(db, []model.NewAccountAlert{
+			{AccountUUID: "55", Alert: a1, Actor: actor},
+			{AccountUUID: "66", Alert: model.NewAlert("apiKey2"), Actor: actor}, // another account
+		}))
+
+		a1.Status = model.SeenStatus
+		assert.NoError(a1.SaveWithEvent(db, "55", model.NewStatusEvent(a1, model.NewStatus, actor)))
+
+		// resume after the first event and wait for a live event
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequest("GET", "/events", nil)
+		req = req.WithContext(ctx)
+		req.Header.Set("Last-Event-ID", "1")
+		res := httptest.NewRecorder()
+
+		done := make(chan bool)
+		go func() {
+			router.ServeHTTP(res, req)
+			done <- true
+		}()
+
+		// wait until the client has subscribed before publishing
+		for i := 0; i < 100; i++ {
+			stream.mu.Lock()
+			n := len(stream.subscribers["55"])
+			stream.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// both changes are sent on a single notification
+		a2 := model.NewAlert("apiKey1")
+		assert.NoError(model.SaveNewAlerts(db, []model.NewAccountAlert{{AccountUUID: "55", Alert: a2, Actor: actor}}))
+		hb := model.NewHeartbeat("apiKey1")
+		assert.NoError(hb.Save(db, "55"))
+		stream.Notify("55")
+
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+		<-done
+
+		assert.Equal(200, res.Code)
+		assert.Equal("text/event-stream", res.Header().Get("Content-Type"))
+
+		body := res.Body.String()
+		events := strings.Split(strings.TrimSpace(body), "\n\n")
+		assert.Equal(3, len(events))
+
+		assert.True(strings.HasPrefix(events[0], "id: 2\nevent: alert_updated\ndata: {"))
+		assert.Contains(events[0], `"id":"`+a1.ID+`"`)
+		assert.Contains(events[0], `"status":"seen"`)
+
+		assert.True(strings.HasPrefix(events[1], "id: 3\nevent: alert_created\ndata: {"))
+		assert.Contains(events[1], `"id":"`+a2.ID+`"`)
+
+		assert.True(strings.HasPrefix(events[2], "id: 4\nevent: heartbeat\ndata: {"))
+		assert.Contains(events[2], `"id":"`+hb.ID+`"`)
+
+		// the client should be unsubscribed
+		assert.Equal(0, len(stream.subscribers["55"]))
+	})
+}
+
+func TestStreamEventsWithInvalidLastEventID(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.GET("/events", StreamEventsRoute(db, newEventStream()))
+
+		req, _ := http.NewRequest("GET", "/events?last_event_id=abc", nil)
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(400, res.Code)
+	})
+}
+
+func TestEventStreamNotify(t *testing.T) {
+	assert := assert.New(t)
+
+	stream := newEventStream()
+	ch := stream.Subscribe("55")
+	other := stream.Subscribe("66")
+
+	// notifications of a subscriber that is not reading are coalesced instead of blocking
+	for i := 0; i < 100; i++ {
+		stream.Notify("55")
+	}
+	assert.Equal(1, len(ch))
+	assert.Equal(0, len(other))
+
+	<-ch
+	stream.Notify("55")
+	assert.Equal(1, len(ch))
+
+	stream.Unsubscribe("55", ch)
+	stream.Unsubscribe("66", other)
+	assert.Equal(0, len(stream.subscribers))
+
+	// notifying without subscribers or without a stream is harmless
+	stream.Notify("55")
+	var nilStream *eventStream
+	nilStream.Notify("55")
+}
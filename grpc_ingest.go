@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/joakim666/wip_alerts/ingestpb"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+	"github.com/twinj/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// apiKeyMetadata carries the api key of gRPC calls
+	apiKeyMetadata = "api-key"
+
+	// requestIDMetadata carries the id of a gRPC call, as the X-Request-ID header of http requests
+	requestIDMetadata = "x-request-id"
+)
+
+// grpcIngester is the gRPC ingest api. It shares the validation and the model layer with CreateAlertRoute,
+// CreateHeartbeatRoute and CreateBatchRoute.
+type grpcIngester struct {
+	ingestpb.UnimplementedIngestServer
+
+	db             *bolt.DB
+	stream         *eventStream
+	limits         configValidation
+	maxStreamItems int64
+}
+
+// grpcCaller is the authenticated api key of a call, set in the context by the interceptors
+type grpcCaller struct {
+	apiKeyID  string
+	accountID string
+}
+
+type grpcCallerKey struct{}
+
+func callerFromContext(ctx context.Context) grpcCaller {
+	caller, _ := ctx.Value(grpcCallerKey{}).(grpcCaller)
+	return caller
+}
+
+// SendAlert creates an alert as CreateAlertRoute does
+func (s *grpcIngester) SendAlert(ctx context.Context, in *ingestpb.Alert) (*ingestpb.AlertResult, error) {
+	logger := logging.FromContext(ctx)
+	caller := callerFromContext(ctx)
+
+	payload := alertPayload(in)
+	p := checkPayload(payload)
+	if p == nil {
+		p = validateAlert(payload, s.limits, time.Now())
+	}
+	if p != nil {
+		logger.Infof("Invalid alert: %s", p)
+		return nil, grpcError(p)
+	}
+
+	// the labels of the alert are added on top of the default labels of the api key
+	defaultLabels, err := apiKeyDefaultLabels(s.db, caller.apiKeyID)
+	if err != nil {
+		logger.Errorf("Failed to get api key: %s", err)
+		return nil, grpcError(problem.Internal())
+	}
+
+	alert := newAlertFromPayload(caller.apiKeyID, defaultLabels, payload)
+	actor := model.Actor{Type: model.APIKeyActor, ID: caller.apiKeyID}
+
+	_, _, err = ingestAlert(s.db, s.stream, caller.accountID, actor, alert)
+	if err != nil {
+		logger.Errorf("Failed to save alert: %s", err)
+		return nil, grpcError(problem.Internal())
+	}
+
+	logger.Infof("Created alert %s", alert.ID)
+
+	return &ingestpb.AlertResult{Id: alert.ID, CreatedAt: timestamppb.New(alert.CreatedAt)}, nil
+}
+
+// SendHeartbeat creates a heartbeat as CreateHeartbeatRoute does
+func (s *grpcIngester) SendHeartbeat(ctx context.Context, in *ingestpb.Heartbeat) (*ingestpb.HeartbeatResult, error) {
+	logger := logging.FromContext(ctx)
+	caller := callerFromContext(ctx)
+
+	payload := heartbeatPayload(in)
+	p := checkPayload(payload)
+	if p == nil {
+		p = validateHeartbeat(payload, s.limits, time.Now())
+	}
+	if p != nil {
+		logger.Infof("Invalid heartbeat: %s", p)
+		return nil, grpcError(p)
+	}
+
+	hb := newHeartbeatFromPayload(caller.apiKeyID, payload)
+
+	err := ingestHeartbeat(s.db, s.stream, caller.accountID, hb)
+	if err != nil {
+		logger.Errorf("Failed to save heartbeat: %s", err)
+		return nil, grpcError(problem.Internal())
+	}
+
+	return &ingestpb.HeartbeatResult{Id: hb.ID, CreatedAt: timestamppb.New(hb.CreatedAt)}, nil
+}
+
+// Ingest creates the alerts and heartbeats of a stream as CreateBatchRoute does. The valid items are saved each time
+// the maximum batch size is reached and when the client closes the stream. If saving or the stream fails the call
+// fails, and the items of the earlier batches stay saved. At the first item beyond the maximum items of a stream the
+// items taken are saved and the results returned, with that item failed as not taken.
+func (s *grpcIngester) Ingest(stream ingestpb.Ingest_IngestServer) error {
+	ctx := stream.Context()
+	logger := logging.FromContext(ctx)
+	caller := callerFromContext(ctx)
+	actor := model.Actor{Type: model.APIKeyActor, ID: caller.apiKeyID}
+
+	defaultLabels, err := apiKeyDefaultLabels(s.db, caller.apiKeyID)
+	if err != nil {
+		logger.Errorf("Failed to get api key: %s", err)
+		return grpcError(problem.Internal())
+	}
+
+	batch := newIngestBatch(caller.apiKeyID, defaultLabels, s.limits)
+	var results []*ingestpb.ItemResult
+	saved := 0
+
+	save := func() error {
+		if batch.len() == 0 {
+			return nil
+		}
+		n := batch.len()
+		err := batch.save(ctx, s.db, s.stream, caller.accountID, actor)
+		if err != nil {
+			logger.Errorf("Failed to save batch after %d items: %s", saved, err)
+			return grpcError(problem.Internal())
+		}
+		saved += n
+		return nil
+	}
+
+	for {
+		item, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Infof("Stream failed after %d items: %s", len(results), err)
+			return err
+		}
+
+		if int64(len(results)) >= s.maxStreamItems {
+			err := save()
+			if err != nil {
+				return err
+			}
+			logger.Infof("Stream exceeds %d items, %d saved", s.maxStreamItems, saved)
+
+			// the client learns which items were taken, this and the items it sends after have no result
+			p := problem.New(http.StatusRequestEntityTooLarge, problem.BodyTooLarge, "A stream may send at most %d items, this and the following items were not taken, send them in another stream", s.maxStreamItems)
+			results = append(results, &ingestpb.ItemResult{Index: uint32(len(results)), Error: problemPB(p)})
+			return stream.SendAndClose(&ingestpb.IngestResult{Results: results})
+		}
+
+		result := &ingestpb.ItemResult{Index: uint32(len(results))}
+		results = append(results, result)
+
+		// the stream may stay open for long, the items are validated against the time they are received
+		batch.now = time.Now()
+
+		var p *problem.Problem
+		switch x := item.Item.(type) {
+		case *ingestpb.IngestItem_Alert:
+			payload := alertPayload(x.Alert)
+			var alert *model.Alert
+			p = checkPayload(payload)
+			if p == nil {
+				alert, p = batch.addAlert(payload)
+			}
+			if p == nil {
+				result.Id = alert.ID
+			}
+
+		case *ingestpb.IngestItem_Heartbeat:
+			payload := heartbeatPayload(x.Heartbeat)
+			var hb *model.Heartbeat
+			p = checkPayload(payload)
+			if p == nil {
+				hb, p = batch.addHeartbeat(payload)
+			}
+			if p == nil {
+				result.Id = hb.ID
+			}
+
+		default:
+			p = problem.Invalid("item", "required", "must be an alert or a heartbeat")
+		}
+
+		if p != nil {
+			result.Error = problemPB(p)
+			continue
+		}
+		result.Success = true
+
+		if int64(batch.len()) >= s.limits.MaxBatchSize {
+			err := save()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = save()
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Stream of %d items, %d saved", len(results), saved)
+
+	return stream.SendAndClose(&ingestpb.IngestResult{Results: results})
+}
+
+// alertPayload converts the message to the payload of CreateAlertRoute, so that it is validated the same way
+func alertPayload(in *ingestpb.Alert) *createAlertDTO {
+	payload := &createAlertDTO{
+		Title:            in.GetTitle(),
+		ShortDescription: in.GetShortDescription(),
+		LongDescription:  in.GetLongDescription(),
+		Labels:           in.GetLabels(),
+	}
+
+	switch in.GetPriority() {
+	case ingestpb.Priority_PRIORITY_HIGH:
+		payload.Priority = model.HighPriority
+	case ingestpb.Priority_PRIORITY_NORMAL:
+		payload.Priority = model.NormalPriority
+	case ingestpb.Priority_PRIORITY_LOW:
+		payload.Priority = model.LowPriority
+	}
+
+	if in.GetTriggeredAt() != nil {
+		payload.TriggeredAt = in.GetTriggeredAt().AsTime()
+	}
+
+	return payload
+}
+
+// heartbeatPayload converts the message to the payload of CreateHeartbeatRoute
+func heartbeatPayload(in *ingestpb.Heartbeat) *createHeartbeatDTO {
+	payload := &createHeartbeatDTO{}
+	if in.GetExecutedAt() != nil {
+		payload.ExecutedAt = in.GetExecutedAt().AsTime()
+	}
+	return payload
+}
+
+// checkPayload checks the binding tags of the converted payload, as they are checked when a JSON body is bound.
+// Strings need no UTF-8 check as protobuf refuses messages with invalid UTF-8 strings.
+func checkPayload(obj interface{}) *problem.Problem {
+	err := binding.Validator.ValidateStruct(obj)
+	if err != nil {
+		return problem.Binding(err)
+	}
+	return nil
+}
+
+// problemPB converts a problem to the error of an item
+func problemPB(p *problem.Problem) *ingestpb.Error {
+	e := &ingestpb.Error{Code: string(p.Code), Detail: p.Detail}
+	for _, fe := range p.Errors {
+		e.Errors = append(e.Errors, &ingestpb.FieldError{Field: fe.Field, Reason: fe.Reason, Detail: fe.Detail})
+	}
+	return e
+}
+
+// grpcError converts a problem to a gRPC status with the code closest to the http status of the problem. The code of
+// the problem is the reason of a google.rpc.ErrorInfo detail, and the field errors become a google.rpc.BadRequest
+// detail.
+func grpcError(p *problem.Problem) error {
+	code := codes.Unknown
+	switch {
+	case p.Status == http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case p.Status == http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case p.Status == http.StatusForbidden:
+		code = codes.PermissionDenied
+	case p.Status == http.StatusRequestEntityTooLarge:
+		code = codes.ResourceExhausted
+	case p.Status >= 500:
+		code = codes.Internal
+	}
+
+	msg := p.Detail
+	if msg == "" {
+		msg = string(p.Code)
+	}
+
+	details := []*errdetails.BadRequest_FieldViolation{}
+	for _, fe := range p.Errors {
+		description := fe.Reason
+		if fe.Detail != "" {
+			description += ": " + fe.Detail
+		}
+		details = append(details, &errdetails.BadRequest_FieldViolation{Field: fe.Field, Description: description})
+	}
+
+	st := status.New(code, msg)
+	info := &errdetails.ErrorInfo{Reason: string(p.Code), Domain: "wip_alerts"}
+	var err error
+	if len(details) > 0 {
+		st, err = st.WithDetails(info, &errdetails.BadRequest{FieldViolations: details})
+	} else {
+		st, err = st.WithDetails(info)
+	}
+	if err != nil {
+		// the details are only a help, the code and message are enough
+		return status.Error(code, msg)
+	}
+	return st.Err()
+}
+
+// authenticate checks the api key in the metadata of the call and returns the context holding the caller and a
+// logger with the api key. The ip allowlist of the key is checked against the address of the peer, as there are no
+// proxies in front of the gRPC server.
+func (s *grpcIngester) authenticate(ctx context.Context, logger logging.Logger, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	keys := md.Get(apiKeyMetadata)
+	if len(keys) == 0 || keys[0] == "" {
+		logger.Errorf("Can not find api key in the metadata")
+		authFailures.WithLabelValues(missingAPIKeyFailure).Inc()
+		return nil, grpcError(problem.New(http.StatusUnauthorized, problem.MissingAPIKey, "An api key must be given in the %s metadata", apiKeyMetadata))
+	}
+	apiKeyID := keys[0]
+	logger = logger.With(logging.APIKeyAttr, apiKeyID)
+
+	var ip net.IP
+	if pr, ok := peer.FromContext(ctx); ok {
+		ip = addrIP(pr.Addr)
+	}
+
+	apiKey, accountID, p := authorizeAPIKey(s.db, logger, apiKeyID, ip, "gRPC "+method)
+	if p != nil {
+		return nil, grpcError(p)
+	}
+
+	logger.Infof("Granting api level access")
+	ctx = logging.NewContext(ctx, logger)
+	return context.WithValue(ctx, grpcCallerKey{}, grpcCaller{apiKeyID: apiKey.ID, accountID: accountID}), nil
+}
+
+// grpcRequestID returns the id of the call given by the client, or a new one
+func grpcRequestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ids := md.Get(requestIDMetadata); len(ids) > 0 && requestIDPattern.MatchString(ids[0]) {
+		return ids[0]
+	}
+	return uuid.NewV4().String()
+}
+
+// unaryInterceptor gives every call an id, returned in the x-request-id header, authenticates it and logs it when
+// it is done, as requestLogging and validateApiKey do for http requests
+func (s *grpcIngester) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+
+	id := grpcRequestID(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadata, id))
+	logger := logging.Default().With("request_id", id)
+
+	var resp interface{}
+	authCtx, err := s.authenticate(ctx, logger, info.FullMethod)
+	if err == nil {
+		resp, err = handler(authCtx, req)
+	}
+
+	logger.Info("Call", "method", info.FullMethod, "code", status.Code(err).String(), "duration", time.Since(start))
+	return resp, err
+}
+
+// streamInterceptor is the unaryInterceptor of streaming calls
+func (s *grpcIngester) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+
+	id := grpcRequestID(ss.Context())
+	ss.SetHeader(metadata.Pairs(requestIDMetadata, id))
+	logger := logging.Default().With("request_id", id)
+
+	authCtx, err := s.authenticate(ss.Context(), logger, info.FullMethod)
+	if err == nil {
+		err = handler(srv, &contextStream{ServerStream: ss, ctx: authCtx})
+	}
+
+	logger.Info("Call", "method", info.FullMethod, "code", status.Code(err).String(), "duration", time.Since(start))
+	return err
+}
+
+// contextStream is a server stream with another context
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// newGRPCServer returns the gRPC server of the ingest api, using the TLS certificate of the http api if 'certs' is
+// not nil. Messages are limited to the maximum body size of the ingest endpoints.
+func newGRPCServer(db *bolt.DB, stream *eventStream, cfg *config, certs *certReloader) *grpc.Server {
+	ingester := &grpcIngester{db: db, stream: stream, limits: cfg.Validation, maxStreamItems: cfg.GRPC.MaxStreamItems}
+
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(ingester.unaryInterceptor),
+		grpc.StreamInterceptor(ingester.streamInterceptor),
+		grpc.MaxRecvMsgSize(int(cfg.HTTP.MaxBodySize)),
+	}
+	if certs != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		})))
+	}
+
+	s := grpc.NewServer(opts...)
+	ingestpb.RegisterIngestServer(s, ingester)
+	return s
+}
+
+// serveGRPC starts the gRPC ingest api on the configured address
+func serveGRPC(db *bolt.DB, stream *eventStream, cfg *config, certs *certReloader, workers *workers) *grpc.Server {
+	l, err := net.Listen("tcp", cfg.GRPC.Addr)
+	if err != nil {
+		logging.Fatalf("Failed to listen on %s: %s", cfg.GRPC.Addr, err)
+	}
+
+	s := newGRPCServer(db, stream, cfg, certs)
+
+	logging.Infof("Serving the gRPC ingest api on %s, tls: %t", l.Addr(), certs != nil)
+	workers.start("grpc", 0)
+	go func() {
+		err := s.Serve(l)
+		if err != nil {
+			logging.Errorf("gRPC server failed: %s", err)
+		}
+		workers.stop("grpc", err)
+	}()
+
+	return s
+}
+
+// stopGRPC gives the calls in progress up to 'timeout' to finish before closing their connections
+func stopGRPC(s *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logging.Errorf("gRPC calls did not finish in %s, closing them", timeout)
+		s.Stop()
+	}
+}
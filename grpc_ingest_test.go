@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/ingestpb"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// startTestGRPC serves the gRPC ingest api on a local port and returns a client of it and the function stopping it
+func startTestGRPC(t *testing.T, db *bolt.DB, cfg *config) (ingestpb.IngestClient, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	s := newGRPCServer(db, nil, cfg, nil)
+	go s.Serve(l)
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+
+	return ingestpb.NewIngestClient(conn), func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func withAPIKey(apiKeyID string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), apiKeyMetadata, apiKeyID)
+}
+
+func TestGRPCAuthentication(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		inactive := model.NewAPIKey()
+		inactive.Status = model.APIKeyInactive
+		assert.NoError(inactive.Save(db, "55"))
+
+		remote := model.NewAPIKey()
+		remote.AllowedCIDRs = []string{"10.0.0.0/8"}
+		assert.NoError(remote.Save(db, "55"))
+
+		client, stop := startTestGRPC(t, db, defaultConfig())
+		defer stop()
+
+		hb := &ingestpb.Heartbeat{ExecutedAt: timestamppb.Now()}
+
+		_, err := client.SendHeartbeat(context.Background(), hb)
+		assert.Equal(codes.Unauthenticated, status.Code(err))
+		assert.Equal("missing_api_key", grpcReason(err))
+
+		_, err = client.SendHeartbeat(withAPIKey("missing"), hb)
+		assert.Equal(codes.Unauthenticated, status.Code(err))
+		assert.Equal("invalid_api_key", grpcReason(err))
+
+		_, err = client.SendHeartbeat(withAPIKey(inactive.ID), hb)
+		assert.Equal(codes.Unauthenticated, status.Code(err))
+
+		_, err = client.SendHeartbeat(withAPIKey(remote.ID), hb)
+		assert.Equal(codes.PermissionDenied, status.Code(err))
+		assert.Equal("forbidden_ip", grpcReason(err))
+
+		// streaming calls are authenticated too
+		stream, err := client.Ingest(withAPIKey("missing"))
+		assert.NoError(err)
+		_, err = stream.CloseAndRecv()
+		assert.Equal(codes.Unauthenticated, status.Code(err))
+
+		heartbeats, err := model.ListHeartbeats(db, "55")
+		assert.NoError(err)
+		assert.Equal(0, len(*heartbeats))
+	})
+}
+
+func TestGRPCSendAlert(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		apiKey := model.NewAPIKey()
+		apiKey.DefaultLabels = map[string]string{"site": "office"}
+		assert.NoError(apiKey.Save(db, "55"))
+
+		client, stop := startTestGRPC(t, db, defaultConfig())
+		defer stop()
+
+		// 1. a valid alert is created
+		var header metadata.MD
+		res, err := client.SendAlert(withAPIKey(apiKey.ID), &ingestpb.Alert{
+			Title:            "title1",
+			ShortDescription: "short",
+			LongDescription:  "long",
+			Priority:         ingestpb.Priority_PRIORITY_HIGH,
+			TriggeredAt:      timestamppb.New(time.Date(2016, 1, 1, 10, 0, 0, 0, time.UTC)),
+			Labels:           map[string]string{"host": "db1"},
+		}, grpc.Header(&header))
+		assert.NoError(err)
+		assert.NotEmpty(res.GetId())
+		assert.Len(header.Get(requestIDMetadata), 1)
+
+		alert, accountID, err := model.GetAlert(db, res.GetId())
+		assert.NoError(err)
+		assert.Equal("55", *accountID)
+		if assert.NotNil(alert) {
+			assert.Equal("title1", alert.Title)
+			assert.Equal(model.HighPriority, alert.Priority)
+			assert.Equal(apiKey.ID, alert.APIKeyID)
+			assert.Equal(map[string]string{"site": "office", "host": "db1"}, alert.Labels)
+			assert.Equal(2016, alert.TriggeredAt.Year())
+		}
+
+		// 2. invalid fields are answered with a violation each
+		_, err = client.SendAlert(withAPIKey(apiKey.ID), &ingestpb.Alert{
+			Title:            "title\x01",
+			ShortDescription: "short",
+			LongDescription:  "long",
+			TriggeredAt:      timestamppb.Now(),
+		})
+		assert.Equal(codes.InvalidArgument, status.Code(err))
+		assert.Equal("validation_failed", grpcReason(err))
+		assert.Equal([]string{"priority"}, grpcViolations(err))
+
+		_, err = client.SendAlert(withAPIKey(apiKey.ID), &ingestpb.Alert{
+			Title:            "title\x01",
+			ShortDescription: "short",
+			LongDescription:  "long",
+			Priority:         ingestpb.Priority_PRIORITY_LOW,
+			TriggeredAt:      timestamppb.New(time.Now().Add(time.Hour)),
+		})
+		assert.Equal(codes.InvalidArgument, status.Code(err))
+		assert.Equal([]string{"title", "triggered_at"}, grpcViolations(err))
+
+		alerts, err := model.ListAlerts(db, "55")
+		assert.NoError(err)
+		assert.Equal(1, len(*alerts))
+	})
+}
+
+func TestGRPCSendHeartbeat(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		apiKey := model.NewAPIKey()
+		assert.NoError(apiKey.Save(db, "55"))
+
+		client, stop := startTestGRPC(t, db, defaultConfig())
+		defer stop()
+
+		res, err := client.SendHeartbeat(withAPIKey(apiKey.ID), &ingestpb.Heartbeat{ExecutedAt: timestamppb.Now()})
+		assert.NoError(err)
+		assert.NotEmpty(res.GetId())
+
+		_, err = client.SendHeartbeat(withAPIKey(apiKey.ID), &ingestpb.Heartbeat{})
+		assert.Equal(codes.InvalidArgument, status.Code(err))
+		assert.Equal([]string{"executed_at"}, grpcViolations(err))
+
+		heartbeats, err := model.ListHeartbeats(db, "55")
+		assert.NoError(err)
+		if assert.Equal(1, len(*heartbeats)) {
+			_, ok := (*heartbeats)[res.GetId()]
+			assert.True(ok)
+		}
+	})
+}
+
+func TestGRPCIngest(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		apiKey := model.NewAPIKey()
+		assert.NoError(apiKey.Save(db, "55"))
+
+		// the items are saved in batches of two
+		cfg := defaultConfig()
+		cfg.Validation.MaxBatchSize = 2
+
+		client, stop := startTestGRPC(t, db, cfg)
+		defer stop()
+
+		triggered := timestamppb.New(time.Date(2016, 1, 1, 10, 0, 0, 0, time.UTC))
+		items := []*ingestpb.IngestItem{
+			{Item: &ingestpb.IngestItem_Alert{Alert: &ingestpb.Alert{Title: "title1", ShortDescription: "s", LongDescription: "l", Priority: ingestpb.Priority_PRIORITY_HIGH, TriggeredAt: triggered}}},
+			{Item: &ingestpb.IngestItem_Heartbeat{Heartbeat: &ingestpb.Heartbeat{ExecutedAt: triggered}}},
+			{Item: &ingestpb.IngestItem_Alert{Alert: &ingestpb.Alert{Title: "title2", ShortDescription: "s", LongDescription: "l", TriggeredAt: triggered}}},
+			{},
+			{Item: &ingestpb.IngestItem_Alert{Alert: &ingestpb.Alert{Title: "title3", ShortDescription: "s", LongDescription: "l", Priority: ingestpb.Priority_PRIORITY_LOW, TriggeredAt: triggered}}},
+		}
+
+		stream, err := client.Ingest(withAPIKey(apiKey.ID))
+		assert.NoError(err)
+		for _, item := range items {
+			assert.NoError(stream.Send(item))
+		}
+		res, err := stream.CloseAndRecv()
+		assert.NoError(err)
+
+		results := res.GetResults()
+		if assert.Len(results, 5) {
+			for i, r := range results {
+				assert.Equal(uint32(i), r.GetIndex())
+			}
+
+			assert.True(results[0].GetSuccess())
+			assert.NotEmpty(results[0].GetId())
+			assert.True(results[1].GetSuccess())
+
+			assert.False(results[2].GetSuccess())
+			assert.Empty(results[2].GetId())
+			assert.Equal("validation_failed", results[2].GetError().GetCode())
+			if assert.Len(results[2].GetError().GetErrors(), 1) {
+				assert.Equal("priority", results[2].GetError().GetErrors()[0].GetField())
+			}
+
+			assert.False(results[3].GetSuccess())
+			assert.Equal("item", results[3].GetError().GetErrors()[0].GetField())
+
+			assert.True(results[4].GetSuccess())
+		}
+
+		alerts, err := model.ListAlerts(db, "55")
+		assert.NoError(err)
+		assert.Equal(2, len(*alerts))
+
+		heartbeats, err := model.ListHeartbeats(db, "55")
+		assert.NoError(err)
+		assert.Equal(1, len(*heartbeats))
+	})
+}
+
+// grpcReason returns the problem code in the ErrorInfo detail of the status of err
+func grpcReason(err error) string {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info.GetReason()
+		}
+	}
+	return ""
+}
+
+// grpcViolations returns the fields of the BadRequest detail of the status of err
+func grpcViolations(err error) []string {
+	var fields []string
+	for _, d := range status.Convert(err).Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok {
+			for _, v := range br.GetFieldViolations() {
+				fields = append(fields, v.GetField())
+			}
+		}
+	}
+	return fields
+}
+
+func TestGRPCIngestMaxStreamItems(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		apiKey := model.NewAPIKey()
+		assert.NoError(apiKey.Save(db, "55"))
+
+		cfg := defaultConfig()
+		cfg.GRPC.MaxStreamItems = 3
+
+		client, stop := startTestGRPC(t, db, cfg)
+		defer stop()
+
+		stream, err := client.Ingest(withAPIKey(apiKey.ID))
+		assert.NoError(err)
+		executed := timestamppb.New(time.Now())
+		for i := 0; i < 5; i++ {
+			// the server may fail the stream before all items are sent
+			if stream.Send(&ingestpb.IngestItem{Item: &ingestpb.IngestItem_Heartbeat{Heartbeat: &ingestpb.Heartbeat{ExecutedAt: executed}}}) != nil {
+				break
+			}
+		}
+		res, err := stream.CloseAndRecv()
+		assert.NoError(err)
+
+		// the results tell which items were taken
+		if assert.Equal(4, len(res.Results)) {
+			for i := 0; i < 3; i++ {
+				assert.True(res.Results[i].Success)
+				assert.NotEmpty(res.Results[i].Id)
+			}
+			assert.False(res.Results[3].Success)
+			assert.Equal(uint32(3), res.Results[3].Index)
+			assert.Equal("body_too_large", res.Results[3].Error.GetCode())
+		}
+
+		// the items taken are saved
+		heartbeats, err := model.ListHeartbeats(db, "55")
+		assert.NoError(err)
+		assert.Equal(3, len(*heartbeats))
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/logging"
+)
+
+// Set when building, e.g. go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// buckets are the top level buckets of the database, created at startup
+var buckets = []string{"Accounts", "Devices", "Renewals", "APIKeys", "Heartbeats", "Tokens", "Alerts", "Audit", "AlertEvents", "StreamEvents", "AlertVersions", "Integrations", "IdempotencyKeys"}
+
+// workers tracks the background workers of the server for the readiness check. A nil *workers tracks nothing.
+type workers struct {
+	mu     sync.Mutex
+	status map[string]*workerStatus
+}
+
+type workerStatus struct {
+	interval time.Duration // how often the worker beats, 0 for workers that only report when they stop
+	lastBeat time.Time
+	stopped  bool
+	err      error
+}
+
+func newWorkers() *workers {
+	return &workers{status: make(map[string]*workerStatus)}
+}
+
+// start registers a running worker, which is expected to beat at least every 'interval'
+func (w *workers) start(name string, interval time.Duration) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status[name] = &workerStatus{interval: interval, lastBeat: time.Now()}
+}
+
+// beat tells that the worker is still running
+func (w *workers) beat(name string) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if s, ok := w.status[name]; ok {
+		s.lastBeat = time.Now()
+	}
+}
+
+// stop tells that the worker is no longer running, because of 'err'
+func (w *workers) stop(name string, err error) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if s, ok := w.status[name]; ok {
+		s.stopped = true
+		s.err = err
+	}
+}
+
+// problems returns, by worker name, the workers that have stopped or missed more than two beats
+func (w *workers) problems(now time.Time) map[string]string {
+	problems := make(map[string]string)
+	if w == nil {
+		return problems
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for name, s := range w.status {
+		if s.stopped {
+			problems[name] = "stopped: " + errorString(s.err)
+		} else if s.interval > 0 && now.Sub(s.lastBeat) > 2*s.interval {
+			problems[name] = "last ran " + now.Sub(s.lastBeat).String() + " ago"
+		}
+	}
+
+	return problems
+}
+
+func (w *workers) names() []string {
+	var names []string
+	if w == nil {
+		return names
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name := range w.status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return "no error"
+	}
+	return err.Error()
+}
+
+// healthChecker answers the liveness and readiness probes of load balancers and orchestrators
+type healthChecker struct {
+	db          *bolt.DB
+	dbDir       string // directory of the database file, whose file system must have free space
+	minFreeDisk int64
+	workers     *workers
+
+	mu           sync.Mutex
+	shuttingDown bool
+}
+
+func newHealthChecker(db *bolt.DB, cfg configHealth, workers *workers) *healthChecker {
+	return &healthChecker{
+		db:          db,
+		dbDir:       filepath.Dir(db.Path()),
+		minFreeDisk: cfg.MinFreeDisk,
+		workers:     workers,
+	}
+}
+
+// ShuttingDown makes the server not ready, so that no new requests are routed to it while it drains
+func (h *healthChecker) ShuttingDown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shuttingDown = true
+}
+
+// checkDTO is the result of one readiness check
+type checkDTO struct {
+	Status  string `json:"status"` // "ok" or "failed"
+	Message string `json:"message,omitempty"`
+}
+
+type readinessDTO struct {
+	Status string              `json:"status"` // "ok" or "unavailable"
+	Checks map[string]checkDTO `json:"checks"`
+}
+
+type buildInfoDTO struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// check runs all readiness checks
+func (h *healthChecker) check(now time.Time) readinessDTO {
+	checks := make(map[string]checkDTO)
+	result := func(name string, message string) {
+		if message == "" {
+			checks[name] = checkDTO{Status: "ok"}
+		} else {
+			checks[name] = checkDTO{Status: "failed", Message: message}
+		}
+	}
+
+	h.mu.Lock()
+	shuttingDown := h.shuttingDown
+	h.mu.Unlock()
+	if shuttingDown {
+		result("server", "shutting down")
+	} else {
+		result("server", "")
+	}
+
+	var missing []string
+	err := h.db.View(func(tx *bolt.Tx) error {
+		for _, b := range buckets {
+			if tx.Bucket([]byte(b)) == nil {
+				missing = append(missing, b)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		result("database", err.Error())
+	} else {
+		result("database", "")
+		if len(missing) > 0 {
+			result("buckets", "missing "+strings.Join(missing, ", "))
+		} else {
+			result("buckets", "")
+		}
+	}
+
+	problems := h.workers.problems(now)
+	for _, name := range h.workers.names() {
+		result("worker:"+name, problems[name])
+	}
+
+	free, err := freeDiskSpace(h.dbDir)
+	if err != nil {
+		result("disk", err.Error())
+	} else if free < h.minFreeDisk {
+		result("disk", fmt.Sprintf("%d bytes free, less than %d", free, h.minFreeDisk))
+	} else {
+		result("disk", "")
+	}
+
+	status := "ok"
+	for _, c := range checks {
+		if c.Status != "ok" {
+			status = "unavailable"
+		}
+	}
+
+	return readinessDTO{Status: status, Checks: checks}
+}
+
+// freeDiskSpace returns the bytes available to the server on the file system of 'dir'
+func freeDiskSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// LivenessRoute answers 200 as long as the process is able to serve requests
+func LivenessRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// ReadinessRoute answers 200 if the server is ready to serve requests and 503 Service Unavailable otherwise, with
+// the result of each check
+func ReadinessRoute(h *healthChecker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		result := h.check(time.Now())
+		if result.Status != "ok" {
+			logger.Errorf("Not ready: %v", result.Checks)
+			c.JSON(http.StatusServiceUnavailable, result)
+			return
+		}
+
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// BuildInfoRoute answers with the version of the server
+func BuildInfoRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, buildInfoDTO{
+			Version:   version,
+			Commit:    commit,
+			BuildDate: buildDate,
+			GoVersion: runtime.Version(),
+		})
+	}
+}
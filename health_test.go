@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthRoutes(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		workers := newWorkers()
+		workers.start("snooze", time.Minute)
+		workers.start("smtp", 0)
+		health := newHealthChecker(db, configHealth{MinFreeDisk: 1}, workers)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.GET("/healthz", LivenessRoute())
+		router.GET("/readyz", ReadinessRoute(health))
+		router.GET("/version", BuildInfoRoute())
+
+		readiness := func(expected int) readinessDTO {
+			req, _ := http.NewRequest("GET", "/readyz", nil)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			assert.Equal(expected, res.Code)
+
+			var dto readinessDTO
+			assert.NoError(json.Unmarshal(res.Body.Bytes(), &dto))
+			return dto
+		}
+
+		req, _ := http.NewRequest("GET", "/healthz", nil)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(200, res.Code)
+		assert.JSONEq(`{"status": "ok"}`, res.Body.String())
+
+		dto := readiness(200)
+		assert.Equal("ok", dto.Status)
+		for _, name := range []string{"server", "database", "buckets", "disk", "worker:snooze", "worker:smtp"} {
+			assert.Equal("ok", dto.Checks[name].Status, name)
+		}
+
+		// a stopped worker
+		workers.stop("smtp", errors.New("address in use"))
+		dto = readiness(503)
+		assert.Equal("unavailable", dto.Status)
+		assert.Equal(checkDTO{Status: "failed", Message: "stopped: address in use"}, dto.Checks["worker:smtp"])
+
+		// the disk is full
+		health.minFreeDisk = 1 << 62
+		health.workers = nil
+		dto = readiness(503)
+		assert.Equal("failed", dto.Checks["disk"].Status)
+
+		// a missing bucket
+		health.minFreeDisk = 1
+		assert.NoError(db.Update(func(tx *bolt.Tx) error {
+			return tx.DeleteBucket([]byte("Alerts"))
+		}))
+		dto = readiness(503)
+		assert.Equal(checkDTO{Status: "failed", Message: "missing Alerts"}, dto.Checks["buckets"])
+
+		req, _ = http.NewRequest("GET", "/version", nil)
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(200, res.Code)
+		var info buildInfoDTO
+		assert.NoError(json.Unmarshal(res.Body.Bytes(), &info))
+		assert.Equal("dev", info.Version)
+		assert.NotEmpty(info.GoVersion)
+	})
+}
+
+func TestReadinessWhileShuttingDown(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		health := newHealthChecker(db, configHealth{}, nil)
+		assert.Equal("ok", health.check(time.Now()).Status)
+
+		health.ShuttingDown()
+		assert.Equal(checkDTO{Status: "failed", Message: "shutting down"}, health.check(time.Now()).Checks["server"])
+	})
+}
+
+func TestWorkersMissingBeats(t *testing.T) {
+	assert := assert.New(t)
+
+	w := newWorkers()
+	w.start("snooze", time.Minute)
+	assert.Empty(w.problems(time.Now().Add(time.Minute)))
+	assert.Contains(w.problems(time.Now().Add(3*time.Minute)), "snooze")
+
+	w.beat("snooze")
+	assert.Empty(w.problems(time.Now().Add(time.Minute)))
+}
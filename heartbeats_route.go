@@ -3,100 +3,105 @@ package main
 import (
 	"github.com/boltdb/bolt"
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
+	"github.com/joakim666/wip_alerts/logging"
 	"time"
 	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
 	"net/http"
 )
 
 type createHeartbeatDTO struct {
 	ExecutedAt	time.Time		`json:"executed_at" binding:"required"`
+	Status		model.HeartbeatStatus	`json:"status" binding:"omitempty,oneof=started succeeded"`
 }
 
 type heartbeatDTO struct {
 	ID               string                `json:"id"`
+	Status           model.HeartbeatStatus `json:"status,omitempty"`
 	ExecutedAt       time.Time             `json:"executed_at"`
 	CreatedAt        time.Time             `json:"created_at"`
 }
 
 
 // CreateHeartbeatRoute creates and saves a new heartbeat
-func CreateHeartbeatRoute(db *bolt.DB) gin.HandlerFunc {
+func CreateHeartbeatRoute(db *bolt.DB, stream *eventStream, limits configValidation) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		glog.Infof("CreateHeartbeatRoute")
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("CreateHeartbeatRoute")
 
 		accountIDInterface, exists := c.Get("accountID")
 		if exists == false {
-			glog.Infof("No accountID set")
-			c.Status(http.StatusUnauthorized) // => Unauthorized
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 		apiKeyID, exists := c.Get("apiKeyID")
 		if exists == false {
-			glog.Infof("No apiKeyID set")
-			c.Status(http.StatusUnauthorized) // => Unauthorized
+			logger.Infof("No apiKeyID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
 		accountID, ok := accountIDInterface.(string)
 		if ok == false {
-			glog.Infof("AccountID in context is not a string")
-			c.Status(http.StatusUnauthorized) // => Unauthorized
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
 		var json createHeartbeatDTO
 
-		err := c.BindJSON(&json)
-		if err != nil {
-			glog.Infof("Binding failed: %s", err)
-			c.Status(http.StatusBadRequest) // => Bad Request
+		p := bindPayload(c, &json)
+		if p == nil {
+			p = validateHeartbeat(&json, limits, time.Now())
+		}
+		if p != nil {
+			logger.Infof("Invalid heartbeat: %s", p)
+			problem.Abort(c, p)
 			return
 		}
 
-		glog.Infof("Json: %s", json)
+		hb := newHeartbeatFromPayload(apiKeyID.(string), &json)
 
-		hb := model.NewHeartbeat(apiKeyID.(string))
-		hb.ExecutedAt = json.ExecutedAt
-
-		err = hb.Save(db, accountID)
+		err := ingestHeartbeat(db, stream, accountID, hb)
 		if err != nil {
-			glog.Errorf("Failed to save created heartbeat: %s", err)
-			c.Status(http.StatusInternalServerError) // => Internal Server error
+			logger.Errorf("Failed to save created heartbeat: %s", err)
+			problem.Abort(c, problem.Internal())
 			return
 		}
 
-		dto := makeHeartbeatDTO(hb)
-
-		c.JSON(http.StatusCreated, dto)
+		c.JSON(http.StatusCreated, makeHeartbeatDTO(hb))
 	}
 }
 
 // LatestHeartbeats returns the last heartbeat for each api key for the identified account
 func LatestHeartbeatsRoute(db *bolt.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		glog.Infof("LatestHeartbeats")
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("LatestHeartbeats")
 
 		accountIDInterface, exists := c.Get("accountID")
 		if exists == false {
-			glog.Infof("No accountID set")
-			c.Status(http.StatusUnauthorized) // => Unauthorized
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
 		accountID, ok := accountIDInterface.(string)
 		if ok == false {
-			glog.Infof("AccountID in context is not a string")
-			c.Status(http.StatusUnauthorized) // => Unauthorized
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
 			return
 		}
 
-		glog.Infof("Listing latest heartbeat for account id: %s", accountID)
+		logger.Infof("Listing latest heartbeat for account id: %s", accountID)
 
 		heartbeats, err := model.LatestHeartbeatPerApiKey(db, accountID)
 		if err != nil {
-			glog.Infof("No account for account id=%s", accountID)
-			c.Status(http.StatusBadRequest) // => Bad Request
+			logger.Errorf("Failed to list heartbeats of account %s: %s", accountID, err)
+			problem.Abort(c, problem.Internal())
 			return
 		}
 
@@ -115,6 +120,7 @@ func makeHeartbeatDTO(hb *model.Heartbeat) heartbeatDTO {
 	var dto heartbeatDTO
 
 	dto.ID = hb.ID
+	dto.Status = hb.Status
 	dto.ExecutedAt = hb.ExecutedAt
 	dto.CreatedAt = hb.CreatedAt
 
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/assert"
 	"github.com/gin-gonic/gin"
@@ -13,10 +12,10 @@ import (
 	"testing"
 	"net/http"
 	"encoding/json"
+	"github.com/joakim666/wip_alerts/problem"
 )
 
 func TestCreateHeartbeatRouteWithMissingAccountID(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -24,7 +23,7 @@ func TestCreateHeartbeatRouteWithMissingAccountID(t *testing.T) {
 		gin.SetMode(gin.TestMode)
 		router := gin.New()
 
-		router.POST("/heartbeats", CreateHeartbeatRoute(db))
+		router.POST("/heartbeats", CreateHeartbeatRoute(db, nil, defaultConfig().Validation))
 
 		req, _ := http.NewRequest("POST", "/heartbeats", nil)
 		res := httptest.NewRecorder()
@@ -35,7 +34,6 @@ func TestCreateHeartbeatRouteWithMissingAccountID(t *testing.T) {
 }
 
 func TestCreateHeartbeatRouteWithMissingAPIKeyID(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -47,7 +45,7 @@ func TestCreateHeartbeatRouteWithMissingAPIKeyID(t *testing.T) {
 			c.Set("accountID", "55")
 		})
 
-		router.POST("/heartbeats", CreateHeartbeatRoute(db))
+		router.POST("/heartbeats", CreateHeartbeatRoute(db, nil, defaultConfig().Validation))
 
 		req, _ := http.NewRequest("POST", "/heartbeats", nil)
 		res := httptest.NewRecorder()
@@ -58,7 +56,6 @@ func TestCreateHeartbeatRouteWithMissingAPIKeyID(t *testing.T) {
 }
 
 func TestCreateHeartbeatRouteWithMissingData(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -71,7 +68,7 @@ func TestCreateHeartbeatRouteWithMissingData(t *testing.T) {
 			c.Set("apiKeyID", "55")
 		})
 
-		router.POST("/heartbeats", CreateHeartbeatRoute(db))
+		router.POST("/heartbeats", CreateHeartbeatRoute(db, nil, defaultConfig().Validation))
 
 		var bodies []string
 
@@ -85,6 +82,14 @@ func TestCreateHeartbeatRouteWithMissingData(t *testing.T) {
 			}
 		`)
 
+		// 3. unknown status
+		bodies = append(bodies, `
+			{
+				"executed_at": "2012-04-23T18:25:43.511Z",
+				"status": "failed"
+			}
+		`)
+
 		for _, v := range bodies {
 			req, _ := http.NewRequest("POST", "/heartbeats", strings.NewReader(v))
 			res := httptest.NewRecorder()
@@ -96,7 +101,6 @@ func TestCreateHeartbeatRouteWithMissingData(t *testing.T) {
 }
 
 func TestCreateHeartbeatRouteWithValidData(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -109,11 +113,12 @@ func TestCreateHeartbeatRouteWithValidData(t *testing.T) {
 			c.Set("apiKeyID", "55")
 		})
 
-		router.POST("/heartbeats", CreateHeartbeatRoute(db))
+		router.POST("/heartbeats", CreateHeartbeatRoute(db, nil, defaultConfig().Validation))
 
 		body := `
 			{
-				"executed_at": "2012-04-23T18:25:43.511Z"
+				"executed_at": "2012-04-23T18:25:43.511Z",
+				"status": "started"
 			}
 		`
 
@@ -134,11 +139,11 @@ func TestCreateHeartbeatRouteWithValidData(t *testing.T) {
 		assert.NotEmpty(resMap["id"])
 		assert.NotEmpty(resMap["created_at"])
 		assert.Equal("2012-04-23T18:25:43.511Z", resMap["executed_at"])
+		assert.Equal("started", resMap["status"])
 	})
 }
 
 func TestLatestHeartbeatsWithoutAccountID(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -156,8 +161,29 @@ func TestLatestHeartbeatsWithoutAccountID(t *testing.T) {
 	})
 }
 
+func TestLatestHeartbeatsWithUnreadableHeartbeat(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.GET("/heartbeats", LatestHeartbeatsRoute(db))
+
+		putGarbage(t, db, "Heartbeats", "55")
+
+		req, _ := http.NewRequest("GET", "/heartbeats", nil)
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assertProblem(t, res, http.StatusInternalServerError, problem.InternalError)
+	})
+}
+
 func TestLatestHeartbeats(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -278,3 +304,48 @@ func TestLatestHeartbeats(t *testing.T) {
 		assert.NotEmpty(r2["executed_at"])
 	})
 }
+
+func TestCreateHeartbeatRouteWithTimeOutsideWindow(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", "55")
+		})
+
+		limits := defaultConfig().Validation
+		limits.MaxAge = time.Hour
+
+		router.POST("/heartbeats", CreateHeartbeatRoute(db, nil, limits))
+
+		now := time.Now().UTC()
+
+		for executedAt, reason := range map[time.Time]string{
+			now.Add(time.Minute):      "",
+			now.Add(-time.Minute):     "",
+			now.Add(10 * time.Minute): "in_future",
+			now.Add(-2 * time.Hour):   "too_old",
+		} {
+			body := `{"executed_at": "` + executedAt.Format(time.RFC3339) + `"}`
+			req, _ := http.NewRequest("POST", "/heartbeats", strings.NewReader(body))
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+			if reason == "" {
+				assert.Equal(http.StatusCreated, res.Code)
+				continue
+			}
+
+			p := assertProblem(t, res, http.StatusBadRequest, problem.ValidationFailed)
+			if assert.Len(p.Errors, 1) {
+				assert.Equal("executed_at", p.Errors[0].Field)
+				assert.Equal(reason, p.Errors[0].Reason)
+			}
+		}
+	})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+)
+
+const (
+	// idempotencyKeyHeader carries a key chosen by the client that identifies a request across its retries
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotentReplayedHeader is set on responses replayed for a repeated request
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotent makes POST requests with an Idempotency-Key header safe to retry. The first response to a key is
+// stored for 'ttl' and replayed for repeats of the request, while a different request with the same key is refused
+// with 422. The keys are scoped by api key, so the middleware must come after validateApiKey. Responses with 5xx
+// status are not stored so that the request can be retried. Requests without the header are served as usual, as are
+// all requests when 'ttl' is 0.
+func idempotent(db *bolt.DB, ttl time.Duration) gin.HandlerFunc {
+	return idempotency(db, ttl, func(c *gin.Context, body []byte) string {
+		return c.GetString("apiKeyID")
+	}, false)
+}
+
+// idempotentTokens is idempotent for /tokens, which has no api key. The keys are scoped by the account or renewal
+// the tokens are requested for. The responses hold the tokens, so they are stored sealed with a key derived from the
+// request, which holds the account or renewal id, and only a repeat of the request can open them.
+func idempotentTokens(db *bolt.DB, ttl time.Duration) gin.HandlerFunc {
+	return idempotency(db, ttl, func(c *gin.Context, body []byte) string {
+		var req NewTokenDTO
+		if json.Unmarshal(body, &req) != nil {
+			return ""
+		}
+
+		switch {
+		case req.GrantType == "account" && req.AccountID != nil:
+			return model.TokenIdempotencyScope(req.GrantType, *req.AccountID)
+		case req.GrantType == "renewal" && req.RenewalID != nil:
+			return model.TokenIdempotencyScope(req.GrantType, *req.RenewalID)
+		}
+		return ""
+	}, true)
+}
+
+// idempotency stores the responses to the keys within the scope returned by 'scopeOf' for the request, requests
+// without a scope are served as usual. If 'seal' is set the responses are stored encrypted, see sealResponse.
+func idempotency(db *bolt.DB, ttl time.Duration, scopeOf func(c *gin.Context, body []byte) string, seal bool) gin.HandlerFunc {
+	locks := newKeyLocks()
+
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" || ttl == 0 {
+			return
+		}
+
+		logger := logging.FromContext(c.Request.Context())
+
+		if !validIdempotencyKey(key) {
+			logger.Infof("Invalid idempotency key")
+			problem.Abort(c, problem.New(http.StatusBadRequest, problem.InvalidParameter, "The %s header must be 1 to %d visible ASCII characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			logger.Infof("Failed to read body: %s", err)
+			problem.Abort(c, problem.Binding(err))
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		scope := scopeOf(c, body)
+		if scope == "" {
+			return
+		}
+		hash := requestHash(c, body)
+
+		// repeats of a request in progress wait for it and are then answered with its response
+		unlock := locks.lock(scope + " " + key)
+		defer unlock()
+
+		stored, err := model.GetIdempotentResponse(db, scope, key, time.Now())
+		if err != nil {
+			logger.Errorf("Failed to get idempotent response: %s", err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		if stored != nil {
+			if stored.RequestHash != hash {
+				logger.Infof("Idempotency key reused for another request")
+				problem.Abort(c, problem.New(http.StatusUnprocessableEntity, problem.IdempotencyConflict, "The %s was used for another request", idempotencyKeyHeader))
+				return
+			}
+
+			responseBody := stored.Body
+			if stored.Sealed {
+				responseBody, err = openResponse(key, body, stored.Body)
+				if err != nil {
+					logger.Errorf("Failed to open idempotent response: %s", err)
+					problem.Abort(c, problem.Internal())
+					return
+				}
+			}
+
+			logger.Infof("Replaying the response to the idempotency key")
+			idempotentReplays.Inc()
+			c.Header(idempotentReplayedHeader, "true")
+			c.Data(stored.Status, stored.ContentType, responseBody)
+			c.Abort()
+			return
+		}
+
+		w := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+
+		c.Next()
+
+		if w.Status() >= 500 {
+			return
+		}
+
+		now := time.Now()
+		r := &model.IdempotentResponse{
+			RequestHash: hash,
+			Status:      w.Status(),
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.Bytes(),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(ttl),
+		}
+		if seal {
+			r.Body, err = sealResponse(key, body, r.Body)
+			if err != nil {
+				// the request is served but a repeat of it will not be recognized
+				logger.Errorf("Failed to seal idempotent response: %s", err)
+				return
+			}
+			r.Sealed = true
+		}
+		err = model.SaveIdempotentResponse(db, scope, key, r)
+		if err != nil {
+			// the request is served but a repeat of it will not be recognized
+			logger.Errorf("Failed to save idempotent response: %s", err)
+		}
+	}
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHash identifies the request by its method, route and body
+func requestHash(c *gin.Context, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(c.Request.Method + " " + c.FullPath() + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseKey derives the key sealing the response to a request from its idempotency key and body. It differs from
+// the stored requestHash, so the database alone does not open the response.
+func responseKey(idempotencyKey string, requestBody []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("idempotent response\n" + idempotencyKey + "\n"))
+	h.Write(requestBody)
+	return h.Sum(nil)
+}
+
+// sealResponse encrypts the body of a response with AES-GCM under responseKey, the nonce is put first
+func sealResponse(idempotencyKey string, requestBody []byte, responseBody []byte) ([]byte, error) {
+	gcm, err := responseCipher(idempotencyKey, requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, responseBody, nil), nil
+}
+
+// openResponse decrypts a body sealed by sealResponse for the same request
+func openResponse(idempotencyKey string, requestBody []byte, sealed []byte) ([]byte, error) {
+	gcm, err := responseCipher(idempotencyKey, requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("The sealed response is too short")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func responseCipher(idempotencyKey string, requestBody []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(responseKey(idempotencyKey, requestBody))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// recordingWriter keeps a copy of the body written to the response
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// keyLocks are mutexes by key, kept only while locked or waited for
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	users int // holding or waiting for the lock
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[string]*keyLock)}
+}
+
+// lock locks the key and returns the function unlocking it
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.users++
+	l.mu.Unlock()
+
+	kl.Lock()
+
+	return func() {
+		kl.Unlock()
+
+		l.mu.Lock()
+		kl.users--
+		if kl.users == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// purgeIdempotentResponses deletes the expired idempotent responses every 'interval'
+func purgeIdempotentResponses(db *bolt.DB, interval time.Duration, workers *workers) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		deleted, err := model.DeleteExpiredIdempotentResponses(db, now)
+		if err != nil {
+			logging.Errorf("Failed to purge idempotent responses: %s", err)
+			continue
+		}
+		workers.beat("idempotency")
+
+		if deleted > 0 {
+			logging.Debugf("Purged %d expired idempotent responses", deleted)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentCreateAlert(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", c.GetHeader("APIKey"))
+		}, idempotent(db, time.Hour))
+
+		router.POST("/alerts", CreateAlertRoute(db, nil, defaultConfig().Validation))
+
+		post := func(apiKey string, idempotencyKey string, title string) *httptest.ResponseRecorder {
+			body := `{"title": "` + title + `", "short_description": "s", "long_description": "l", "priority": "high", "triggered_at": "2016-01-01T10:00:00Z"}`
+			req, _ := http.NewRequest("POST", "/alerts", strings.NewReader(body))
+			req.Header.Set("APIKey", apiKey)
+			if idempotencyKey != "" {
+				req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+			}
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			return res
+		}
+
+		countAlerts := func() int {
+			alerts, err := model.ListNonArchivedAlerts(db, "55")
+			assert.NoError(err)
+			return len(*alerts)
+		}
+
+		res1 := post("key1", "idem1", "title1")
+		assert.Equal(201, res1.Code)
+		assert.Empty(res1.Header().Get(idempotentReplayedHeader))
+
+		// the repeat is answered with the first response without creating another alert
+		res2 := post("key1", "idem1", "title1")
+		assert.Equal(201, res2.Code)
+		assert.Equal("true", res2.Header().Get(idempotentReplayedHeader))
+		assert.Equal(res1.Body.String(), res2.Body.String())
+		assert.Equal(res1.Header().Get("Content-Type"), res2.Header().Get("Content-Type"))
+		assert.Equal(1, countAlerts())
+
+		// another request with the same key is refused
+		res3 := post("key1", "idem1", "title2")
+		assertProblem(t, res3, http.StatusUnprocessableEntity, problem.IdempotencyConflict)
+		assert.Equal(1, countAlerts())
+
+		// the keys are per api key
+		res4 := post("key2", "idem1", "title1")
+		assert.Equal(201, res4.Code)
+		assert.Empty(res4.Header().Get(idempotentReplayedHeader))
+		assert.Equal(2, countAlerts())
+
+		// requests without a key are not deduplicated
+		assert.Equal(201, post("key1", "", "title1").Code)
+		assert.Equal(201, post("key1", "", "title1").Code)
+		assert.Equal(4, countAlerts())
+
+		// problems are replayed as well
+		res5 := post("key1", "idem2", "")
+		assertProblem(t, res5, http.StatusBadRequest, problem.ValidationFailed)
+		res6 := post("key1", "idem2", "")
+		assertProblem(t, res6, http.StatusBadRequest, problem.ValidationFailed)
+		assert.Equal("true", res6.Header().Get(idempotentReplayedHeader))
+
+		res7 := post("key1", "not a valid key", "title1")
+		assertProblem(t, res7, http.StatusBadRequest, problem.InvalidParameter)
+		assert.Equal(4, countAlerts())
+	})
+}
+
+func TestIdempotentDoesNotStoreServerErrors(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		calls := 0
+		router.Use(func(c *gin.Context) { c.Set("apiKeyID", "key1") })
+		router.POST("/fail", idempotent(db, time.Hour), func(c *gin.Context) {
+			calls++
+			if calls == 1 {
+				problem.Abort(c, problem.Internal())
+				return
+			}
+			c.JSON(http.StatusCreated, gin.H{"calls": calls})
+		})
+
+		for _, status := range []int{500, 201, 201} {
+			req, _ := http.NewRequest("POST", "/fail", strings.NewReader("{}"))
+			req.Header.Set(idempotencyKeyHeader, "idem1")
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			assert.Equal(status, res.Code)
+		}
+		assert.Equal(2, calls)
+	})
+}
+
+func TestIdempotentConcurrentRepeats(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		var mu sync.Mutex
+		calls := 0
+		router.Use(func(c *gin.Context) { c.Set("apiKeyID", "key1") })
+		router.POST("/slow", idempotent(db, time.Hour), func(c *gin.Context) {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			c.JSON(http.StatusCreated, gin.H{})
+		})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("POST", "/slow", strings.NewReader("{}"))
+				req.Header.Set(idempotencyKeyHeader, "idem1")
+				res := httptest.NewRecorder()
+				router.ServeHTTP(res, req)
+				assert.Equal(201, res.Code)
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(1, calls)
+	})
+}
+
+func TestIdempotentTokens(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		calls := 0
+		router.POST("/tokens", idempotentTokens(db, time.Hour), func(c *gin.Context) {
+			calls++
+			if strings.Contains(c.GetHeader(idempotencyKeyHeader), "bad") {
+				problem.Abort(c, problem.New(http.StatusBadRequest, problem.NotFound, "No account"))
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"access_token": "secret"})
+		})
+
+		post := func(body string, idempotencyKey string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("POST", "/tokens", strings.NewReader(body))
+			req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			return res
+		}
+
+		account1 := `{"grant_type": "account", "account_id": "1"}`
+		assert.Equal(200, post(account1, "idem1").Code)
+
+		// the repeat gets the same tokens
+		res := post(account1, "idem1")
+		assert.Equal(200, res.Code)
+		assert.Equal("true", res.Header().Get(idempotentReplayedHeader))
+		assert.Contains(res.Body.String(), "secret")
+		assert.Equal(1, calls)
+
+		// which are stored sealed, the stored response can only be opened with the request
+		stored, err := model.GetIdempotentResponse(db, model.TokenIdempotencyScope("account", "1"), "idem1", time.Now())
+		assert.NoError(err)
+		assert.True(stored.Sealed)
+		assert.NotContains(string(stored.Body), "secret")
+		_, err = openResponse("idem2", []byte(account1), stored.Body)
+		assert.Error(err)
+		_, err = openResponse("idem1", []byte(`{"grant_type": "account", "account_id": "2"}`), stored.Body)
+		assert.Error(err)
+
+		// the keys are per account and renewal
+		assert.Equal(200, post(`{"grant_type": "account", "account_id": "2"}`, "idem1").Code)
+		assert.Equal(200, post(`{"grant_type": "renewal", "renewal_id": "1"}`, "idem1").Code)
+		assert.Equal(3, calls)
+
+		// another request with the same key is refused
+		assertProblem(t, post(`{"grant_type": "account", "account_id": "1", "other": 1}`, "idem1"), http.StatusUnprocessableEntity, problem.IdempotencyConflict)
+
+		// problems are replayed
+		assertProblem(t, post(account1, "bad1"), http.StatusBadRequest, problem.NotFound)
+		res = post(account1, "bad1")
+		assertProblem(t, res, http.StatusBadRequest, problem.NotFound)
+		assert.Equal("true", res.Header().Get(idempotentReplayedHeader))
+		assert.Equal(4, calls)
+
+		// requests without an account or renewal are not deduplicated
+		assert.Equal(200, post(`{"grant_type": "account"}`, "idem1").Code)
+		assert.Equal(200, post(`{"grant_type": "account"}`, "idem1").Code)
+		assert.Equal(6, calls)
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/model"
+)
+
+// ingestAction tells what was done with an alert received from an integration
+type ingestAction string
+
+const (
+	ingestCreated  ingestAction = "created"  // a new alert was created
+	ingestUpdated  ingestAction = "updated"  // an open alert with the same fingerprint was updated
+	ingestResolved ingestAction = "resolved" // an open alert with the same fingerprint was resolved
+	ingestIgnored  ingestAction = "ignored"  // nothing was done, e.g. resolving an alert that is not open
+	ingestRejected ingestAction = "rejected" // the alert is not valid, see the error of the result
+)
+
+// apiKeyDefaultLabels returns the default labels of the api key, or nil if there is no such api key
+func apiKeyDefaultLabels(db *bolt.DB, apiKeyID string) (map[string]string, error) {
+	apiKey, _, err := model.GetAPIKey(db, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == nil {
+		return nil, nil
+	}
+
+	return apiKey.DefaultLabels, nil
+}
+
+// newAlertFromPayload returns a new alert of the api key as described by the validated payload. The labels of the
+// payload are added on top of the default labels of the api key.
+func newAlertFromPayload(apiKeyID string, defaultLabels map[string]string, payload *createAlertDTO) *model.Alert {
+	alert := model.NewAlert(apiKeyID)
+	alert.Title = payload.Title
+	alert.ShortDescription = payload.ShortDescription
+	alert.LongDescription = payload.LongDescription
+	alert.Priority = payload.Priority
+	alert.TriggeredAt = payload.TriggeredAt
+	alert.Labels = model.MergeLabels(defaultLabels, payload.Labels)
+	return alert
+}
+
+// newHeartbeatFromPayload returns a new heartbeat of the api key as described by the validated payload
+func newHeartbeatFromPayload(apiKeyID string, payload *createHeartbeatDTO) *model.Heartbeat {
+	hb := model.NewHeartbeat(apiKeyID)
+	hb.ExecutedAt = payload.ExecutedAt
+	hb.Status = payload.Status
+	return hb
+}
+
+// ingestHeartbeat saves a new heartbeat and notifies the clients of the account
+func ingestHeartbeat(db *bolt.DB, stream *eventStream, accountID string, hb *model.Heartbeat) error {
+	err := hb.Save(db, accountID)
+	if err != nil {
+		return err
+	}
+
+	heartbeatsReceived.Inc()
+
+	stream.Notify(accountID)
+
+	return nil
+}
+
+// ingestAlert saves an alert received from an integration. If the alert has a fingerprint and the account already
+// has an open alert with the same fingerprint, that alert is updated with the content of the new one instead of
+// creating a duplicate. Returns the saved alert.
+func ingestAlert(db *bolt.DB, stream *eventStream, accountID string, actor model.Actor, alert *model.Alert) (*model.Alert, ingestAction, error) {
+	saved, created, err := model.SaveFingerprintedAlert(db, accountID, alert, actor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stream.Notify(accountID)
+
+	if !created {
+		return saved, ingestUpdated, nil
+	}
+
+	alertsCreated.WithLabelValues(string(saved.Priority)).Inc()
+
+	return saved, ingestCreated, nil
+}
+
+// resolveIngestedAlert resolves the open alert of the account with the given fingerprint. Returns nil and
+// ingestIgnored if there is no such alert.
+func resolveIngestedAlert(db *bolt.DB, stream *eventStream, accountID string, actor model.Actor, fingerprint string) (*model.Alert, ingestAction, error) {
+	alert, err := model.ResolveFingerprintedAlert(db, accountID, fingerprint, actor, time.Now())
+	if err != nil {
+		return nil, "", err
+	}
+	if alert == nil {
+		return nil, ingestIgnored, nil
+	}
+
+	stream.Notify(accountID)
+
+	return alert, ingestResolved, nil
+}
+
+// addrIP returns the ip of a TCP or UDP address, or nil for other addresses
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,5 @@
+// Package ingestpb holds the protobuf messages and the gRPC service of the gRPC ingest api, generated from
+// ingest.proto
+package ingestpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ingest.proto
@@ -0,0 +1,217 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: ingest.proto
+
+package ingestpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Ingest_SendAlert_FullMethodName     = "/wip_alerts.ingest.v1.Ingest/SendAlert"
+	Ingest_SendHeartbeat_FullMethodName = "/wip_alerts.ingest.v1.Ingest/SendHeartbeat"
+	Ingest_Ingest_FullMethodName        = "/wip_alerts.ingest.v1.Ingest/Ingest"
+)
+
+// IngestClient is the client API for Ingest service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Ingest is the gRPC ingest api, for reporters that speak gRPC rather than JSON. Every call must carry an active api
+// key in the "api-key" metadata. Alerts and heartbeats are validated as when posted to the REST api. Failed calls
+// carry the problem code of the REST api as the reason of a google.rpc.ErrorInfo detail.
+type IngestClient interface {
+	// SendAlert reports an alert. Invalid alerts fail with INVALID_ARGUMENT and a google.rpc.BadRequest detail with a
+	// violation per invalid field.
+	SendAlert(ctx context.Context, in *Alert, opts ...grpc.CallOption) (*AlertResult, error)
+	// SendHeartbeat reports a heartbeat
+	SendHeartbeat(ctx context.Context, in *Heartbeat, opts ...grpc.CallOption) (*HeartbeatResult, error)
+	// Ingest reports a stream of alerts and heartbeats. The valid items are saved in batches of at most the maximum
+	// batch size of the server, each in a single transaction, and the result of every item is returned when the client
+	// closes the stream. A stream may send at most the maximum stream items of the server, 10000 by default: at the
+	// next item the items taken are saved and the results returned, the next item failing with "body_too_large" and
+	// the items sent after it having no result. If the call fails, e.g. when the stream breaks, the batches saved
+	// before stay saved without the client learning which they were.
+	Ingest(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[IngestItem, IngestResult], error)
+}
+
+type ingestClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIngestClient(cc grpc.ClientConnInterface) IngestClient {
+	return &ingestClient{cc}
+}
+
+func (c *ingestClient) SendAlert(ctx context.Context, in *Alert, opts ...grpc.CallOption) (*AlertResult, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AlertResult)
+	err := c.cc.Invoke(ctx, Ingest_SendAlert_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ingestClient) SendHeartbeat(ctx context.Context, in *Heartbeat, opts ...grpc.CallOption) (*HeartbeatResult, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HeartbeatResult)
+	err := c.cc.Invoke(ctx, Ingest_SendHeartbeat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ingestClient) Ingest(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[IngestItem, IngestResult], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Ingest_ServiceDesc.Streams[0], Ingest_Ingest_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[IngestItem, IngestResult]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Ingest_IngestClient = grpc.ClientStreamingClient[IngestItem, IngestResult]
+
+// IngestServer is the server API for Ingest service.
+// All implementations must embed UnimplementedIngestServer
+// for forward compatibility.
+//
+// Ingest is the gRPC ingest api, for reporters that speak gRPC rather than JSON. Every call must carry an active api
+// key in the "api-key" metadata. Alerts and heartbeats are validated as when posted to the REST api. Failed calls
+// carry the problem code of the REST api as the reason of a google.rpc.ErrorInfo detail.
+type IngestServer interface {
+	// SendAlert reports an alert. Invalid alerts fail with INVALID_ARGUMENT and a google.rpc.BadRequest detail with a
+	// violation per invalid field.
+	SendAlert(context.Context, *Alert) (*AlertResult, error)
+	// SendHeartbeat reports a heartbeat
+	SendHeartbeat(context.Context, *Heartbeat) (*HeartbeatResult, error)
+	// Ingest reports a stream of alerts and heartbeats. The valid items are saved in batches of at most the maximum
+	// batch size of the server, each in a single transaction, and the result of every item is returned when the client
+	// closes the stream. A stream may send at most the maximum stream items of the server, 10000 by default: at the
+	// next item the items taken are saved and the results returned, the next item failing with "body_too_large" and
+	// the items sent after it having no result. If the call fails, e.g. when the stream breaks, the batches saved
+	// before stay saved without the client learning which they were.
+	Ingest(grpc.ClientStreamingServer[IngestItem, IngestResult]) error
+	mustEmbedUnimplementedIngestServer()
+}
+
+// UnimplementedIngestServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedIngestServer struct{}
+
+func (UnimplementedIngestServer) SendAlert(context.Context, *Alert) (*AlertResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendAlert not implemented")
+}
+func (UnimplementedIngestServer) SendHeartbeat(context.Context, *Heartbeat) (*HeartbeatResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendHeartbeat not implemented")
+}
+func (UnimplementedIngestServer) Ingest(grpc.ClientStreamingServer[IngestItem, IngestResult]) error {
+	return status.Errorf(codes.Unimplemented, "method Ingest not implemented")
+}
+func (UnimplementedIngestServer) mustEmbedUnimplementedIngestServer() {}
+func (UnimplementedIngestServer) testEmbeddedByValue()                {}
+
+// UnsafeIngestServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IngestServer will
+// result in compilation errors.
+type UnsafeIngestServer interface {
+	mustEmbedUnimplementedIngestServer()
+}
+
+func RegisterIngestServer(s grpc.ServiceRegistrar, srv IngestServer) {
+	// If the following call pancis, it indicates UnimplementedIngestServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Ingest_ServiceDesc, srv)
+}
+
+func _Ingest_SendAlert_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Alert)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IngestServer).SendAlert(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Ingest_SendAlert_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IngestServer).SendAlert(ctx, req.(*Alert))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Ingest_SendHeartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Heartbeat)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IngestServer).SendHeartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Ingest_SendHeartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IngestServer).SendHeartbeat(ctx, req.(*Heartbeat))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Ingest_Ingest_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(IngestServer).Ingest(&grpc.GenericServerStream[IngestItem, IngestResult]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Ingest_IngestServer = grpc.ClientStreamingServer[IngestItem, IngestResult]
+
+// Ingest_ServiceDesc is the grpc.ServiceDesc for Ingest service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Ingest_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "wip_alerts.ingest.v1.Ingest",
+	HandlerType: (*IngestServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SendAlert",
+			Handler:    _Ingest_SendAlert_Handler,
+		},
+		{
+			MethodName: "SendHeartbeat",
+			Handler:    _Ingest_SendHeartbeat_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Ingest",
+			Handler:       _Ingest_Ingest_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "ingest.proto",
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+)
+
+type integrationMappingDTO struct {
+	Title            string            `json:"title" binding:"required"`
+	ShortDescription string            `json:"short_description"`
+	LongDescription  string            `json:"long_description"`
+	Priority         string            `json:"priority"`
+	Fingerprint      string            `json:"fingerprint"`
+	Resolved         string            `json:"resolved"`
+	Labels           map[string]string `json:"labels"`
+}
+
+type createIntegrationDTO struct {
+	Name    string                `json:"name" binding:"required"`
+	Mapping integrationMappingDTO `json:"mapping" binding:"required"`
+}
+
+type integrationDTO struct {
+	ID        string                `json:"id"`
+	Name      string                `json:"name"`
+	Mapping   integrationMappingDTO `json:"mapping"`
+	CreatedAt time.Time             `json:"created_at"`
+}
+
+type dryRunIntegrationDTO struct {
+	Mapping integrationMappingDTO `json:"mapping" binding:"required"`
+	Payload json.RawMessage       `json:"payload" binding:"required"`
+}
+
+type mappedAlertDTO struct {
+	Title            string              `json:"title"`
+	ShortDescription string              `json:"short_description"`
+	LongDescription  string              `json:"long_description"`
+	Priority         model.AlertPriority `json:"priority"`
+	Fingerprint      string              `json:"fingerprint"`
+	Resolved         bool                `json:"resolved"`
+	Labels           map[string]string   `json:"labels"`
+}
+
+// CreateIntegrationRoute creates a new integration with a mapping from its payloads to alerts
+func CreateIntegrationRoute(db *bolt.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("CreateIntegrationRoute")
+
+		accountIDInterface, exists := c.Get("accountID")
+		if exists == false {
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		accountID, ok := accountIDInterface.(string)
+		if ok == false {
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		var json createIntegrationDTO
+
+		err := c.ShouldBindJSON(&json)
+		if err != nil {
+			logger.Infof("Binding failed: %s", err)
+			problem.Abort(c, problem.Binding(err))
+			return
+		}
+
+		mapping := makeIntegrationMapping(json.Mapping)
+		err = validateIntegrationMapping(mapping)
+		if err != nil {
+			logger.Infof("Invalid mapping: %s", err)
+			problem.Abort(c, problem.Invalid("mapping", "invalid", "%s", err))
+			return
+		}
+
+		integration := model.NewIntegration(json.Name, mapping)
+
+		err = integration.Save(db, accountID)
+		if err != nil {
+			logger.Errorf("Failed to save created integration: %s", err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		c.JSON(http.StatusCreated, makeIntegrationDTO(integration))
+	}
+}
+
+// ListIntegrationsRoute lists all integrations of the account
+func ListIntegrationsRoute(db *bolt.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("ListIntegrationsRoute")
+
+		accountIDInterface, exists := c.Get("accountID")
+		if exists == false {
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		accountID, ok := accountIDInterface.(string)
+		if ok == false {
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		integrations, err := model.ListIntegrations(db, accountID)
+		if err != nil {
+			logger.Errorf("Failed to list integrations for account %s: %s", accountID, err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		dtos := make(map[string]integrationDTO)
+		for _, v := range *integrations {
+			dtos[v.ID] = makeIntegrationDTO(&v)
+		}
+
+		c.JSON(http.StatusOK, dtos)
+	}
+}
+
+// DryRunIntegrationRoute applies a mapping to a sample payload and returns the resulting alert without saving
+// anything
+func DryRunIntegrationRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("DryRunIntegrationRoute")
+
+		var json dryRunIntegrationDTO
+
+		err := c.ShouldBindJSON(&json)
+		if err != nil {
+			logger.Infof("Binding failed: %s", err)
+			problem.Abort(c, problem.Binding(err))
+			return
+		}
+
+		mapping := makeIntegrationMapping(json.Mapping)
+		err = validateIntegrationMapping(mapping)
+		if err != nil {
+			logger.Infof("Invalid mapping: %s", err)
+			problem.Abort(c, problem.Invalid("mapping", "invalid", "%s", err))
+			return
+		}
+
+		payload, err := decodePayload(json.Payload)
+		if err != nil {
+			logger.Infof("Invalid payload: %s", err)
+			problem.Abort(c, problem.Invalid("payload", "invalid", "%s", err))
+			return
+		}
+
+		mapped, err := mapping.Apply(payload)
+		if err != nil {
+			logger.Infof("Mapping failed: %s", err)
+			problem.Abort(c, problem.New(http.StatusUnprocessableEntity, problem.InvalidMapping, "%s", err))
+			return
+		}
+
+		c.JSON(http.StatusOK, makeMappedAlertDTO(mapped))
+	}
+}
+
+// IntegrationWebhookRoute receives a payload for an integration of the account and creates, updates or resolves an
+// alert according to the mapping of the integration. A mapped alert is validated against the limits like a posted
+// alert.
+func IntegrationWebhookRoute(db *bolt.DB, stream *eventStream, limits configValidation) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("IntegrationWebhookRoute")
+
+		accountIDInterface, exists := c.Get("accountID")
+		if exists == false {
+			logger.Infof("No accountID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+		apiKeyID, exists := c.Get("apiKeyID")
+		if exists == false {
+			logger.Infof("No apiKeyID set")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		accountID, ok := accountIDInterface.(string)
+		if ok == false {
+			logger.Infof("AccountID in context is not a string")
+			problem.Abort(c, errUnauthenticated)
+			return
+		}
+
+		integration, integrationAccountID, err := model.GetIntegration(db, c.Param("id"))
+		if err != nil {
+			logger.Errorf("Failed to get integration %s: %s", c.Param("id"), err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+		if integration == nil || *integrationAccountID != accountID {
+			logger.Infof("No integration %s for account %s", c.Param("id"), accountID)
+			problem.Abort(c, problem.New(http.StatusNotFound, problem.NotFound, "No integration with id %s", c.Param("id")))
+			return
+		}
+
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			logger.Infof("Failed to read body: %s", err)
+			problem.Abort(c, problem.Binding(err))
+			return
+		}
+
+		payload, err := decodePayload(body)
+		if err != nil {
+			logger.Infof("Invalid payload: %s", err)
+			problem.Abort(c, problem.New(http.StatusBadRequest, problem.InvalidBody, "%s", err))
+			return
+		}
+
+		mapped, err := integration.Mapping.Apply(payload)
+		if err != nil {
+			logger.Infof("Mapping of payload for integration %s failed: %s", integration.ID, err)
+			problem.Abort(c, problem.New(http.StatusUnprocessableEntity, problem.InvalidMapping, "%s", err))
+			return
+		}
+
+		actor := actorFromContext(c, accountID)
+
+		var alert *model.Alert
+		var action ingestAction
+
+		if mapped.Resolved {
+			if mapped.Fingerprint == "" {
+				action = ingestIgnored // nothing to match the alert to resolve with
+			} else {
+				alert, action, err = resolveIngestedAlert(db, stream, accountID, actor, mapped.Fingerprint)
+			}
+		} else {
+			var defaultLabels map[string]string
+			defaultLabels, err = apiKeyDefaultLabels(db, apiKeyID.(string))
+			if err != nil {
+				logger.Errorf("Failed to get api key: %s", err)
+				problem.Abort(c, problem.Internal())
+				return
+			}
+
+			alert = model.NewAlert(apiKeyID.(string))
+			alert.Title = mapped.Title
+			alert.ShortDescription = mapped.ShortDescription
+			alert.LongDescription = mapped.LongDescription
+			alert.Priority = mapped.Priority
+			alert.Fingerprint = mapped.Fingerprint
+			alert.TriggeredAt = alert.CreatedAt
+
+			p := validateIngestedAlert(alert, mapped.Labels, limits, time.Now())
+			if p != nil {
+				logger.Infof("Invalid mapped alert of integration %s: %s", integration.ID, p)
+				problem.Abort(c, p)
+				return
+			}
+			alert.Labels = model.MergeLabels(defaultLabels, mapped.Labels)
+
+			alert, action, err = ingestAlert(db, stream, accountID, actor, alert)
+		}
+		if err != nil {
+			logger.Errorf("Failed to ingest alert for integration %s: %s", integration.ID, err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
+
+		res := ingestResultDTO{Fingerprint: mapped.Fingerprint, Action: action}
+		if alert != nil {
+			res.ID = alert.ID
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// validateIntegrationMapping validates the templates of the mapping and the names of its labels
+func validateIntegrationMapping(mapping model.IntegrationMapping) error {
+	err := mapping.Validate()
+	if err != nil {
+		return err
+	}
+
+	return model.ValidateLabels(mapping.Labels)
+}
+
+// decodePayload decodes a JSON payload keeping numbers as they were sent
+func decodePayload(body []byte) (interface{}, error) {
+	var payload interface{}
+
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	err := d.Decode(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+func makeIntegrationMapping(dto integrationMappingDTO) model.IntegrationMapping {
+	var m model.IntegrationMapping
+
+	m.Title = dto.Title
+	m.ShortDescription = dto.ShortDescription
+	m.LongDescription = dto.LongDescription
+	m.Priority = dto.Priority
+	m.Fingerprint = dto.Fingerprint
+	m.Resolved = dto.Resolved
+	m.Labels = dto.Labels
+
+	return m
+}
+
+func makeIntegrationDTO(integration *model.Integration) integrationDTO {
+	var dto integrationDTO
+
+	dto.ID = integration.ID
+	dto.Name = integration.Name
+	dto.Mapping.Title = integration.Mapping.Title
+	dto.Mapping.ShortDescription = integration.Mapping.ShortDescription
+	dto.Mapping.LongDescription = integration.Mapping.LongDescription
+	dto.Mapping.Priority = integration.Mapping.Priority
+	dto.Mapping.Fingerprint = integration.Mapping.Fingerprint
+	dto.Mapping.Resolved = integration.Mapping.Resolved
+	dto.Mapping.Labels = integration.Mapping.Labels
+	dto.CreatedAt = integration.CreatedAt
+
+	return dto
+}
+
+func makeMappedAlertDTO(mapped *model.MappedAlert) mappedAlertDTO {
+	var dto mappedAlertDTO
+
+	dto.Title = mapped.Title
+	dto.ShortDescription = mapped.ShortDescription
+	dto.LongDescription = mapped.LongDescription
+	dto.Priority = mapped.Priority
+	dto.Fingerprint = mapped.Fingerprint
+	dto.Resolved = mapped.Resolved
+	dto.Labels = mapped.Labels
+
+	return dto
+}
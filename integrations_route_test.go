@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+	"github.com/stretchr/testify/assert"
+)
+
+const grafanaMappingBody = `
+	{
+		"name": "grafana",
+		"mapping": {
+			"title": "{{.ruleName}}",
+			"short_description": "{{.message}}",
+			"priority": "{{if eq .state \"alerting\"}}high{{else}}normal{{end}}",
+			"fingerprint": "grafana-{{.ruleId}}",
+			"resolved": "{{eq .state \"ok\"}}",
+			"labels": {"host": "{{.tags.host}}"}
+		}
+	}
+`
+
+func TestCreateAndListIntegrations(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+		})
+
+		router.GET("/integrations", ListIntegrationsRoute(db))
+		router.POST("/integrations", CreateIntegrationRoute(db))
+
+		// 1. invalid mappings are rejected
+		bodies := []string{
+			"",
+			`{"name": "x"}`,
+			`{"name": "x", "mapping": {"title": "{{.title"}}`,
+			`{"name": "x", "mapping": {"title": "x", "labels": {"a:b": "x"}}}`,
+		}
+		for _, body := range bodies {
+			req, _ := http.NewRequest("POST", "/integrations", strings.NewReader(body))
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+			assert.Equal(http.StatusBadRequest, res.Code, body)
+		}
+
+		// 2. create
+		req, _ := http.NewRequest("POST", "/integrations", strings.NewReader(grafanaMappingBody))
+		res := httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusCreated, res.Code)
+
+		var created integrationDTO
+		err := json.Unmarshal(res.Body.Bytes(), &created)
+		assert.NoError(err)
+		assert.Equal("grafana", created.Name)
+		assert.Equal("{{.ruleName}}", created.Mapping.Title)
+
+		// 3. list
+		req, _ = http.NewRequest("GET", "/integrations", nil)
+		res = httptest.NewRecorder()
+
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var resMap map[string]integrationDTO
+		err = json.Unmarshal(res.Body.Bytes(), &resMap)
+		assert.NoError(err)
+		assert.Equal(1, len(resMap))
+		assert.Equal("grafana", resMap[created.ID].Name)
+	})
+}
+
+func TestDryRunIntegration(t *testing.T) {
+
+	assert := assert.New(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	router.POST("/integrations/dry-run", DryRunIntegrationRoute())
+
+	body := `
+		{
+			"mapping": {"title": "{{.ruleName}}", "priority": "{{.severity}}", "fingerprint": "{{.ruleId}}"},
+			"payload": {"ruleName": "CPU usage", "severity": "critical", "ruleId": 12345678901}
+		}
+	`
+	req, _ := http.NewRequest("POST", "/integrations/dry-run", strings.NewReader(body))
+	res := httptest.NewRecorder()
+
+	router.ServeHTTP(res, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var mapped mappedAlertDTO
+	err := json.Unmarshal(res.Body.Bytes(), &mapped)
+	assert.NoError(err)
+	assert.Equal("CPU usage", mapped.Title)
+	assert.Equal("CPU usage", mapped.ShortDescription)
+	assert.Equal(model.HighPriority, mapped.Priority)
+	assert.Equal("12345678901", mapped.Fingerprint) // numbers are kept as sent
+	assert.False(mapped.Resolved)
+
+	// the title is missing in the payload
+	body = `{"mapping": {"title": "{{.ruleName}}"}, "payload": {"name": "CPU usage"}}`
+	req, _ = http.NewRequest("POST", "/integrations/dry-run", strings.NewReader(body))
+	res = httptest.NewRecorder()
+
+	router.ServeHTTP(res, req)
+	p := assertProblem(t, res, http.StatusUnprocessableEntity, problem.InvalidMapping)
+	assert.Contains(p.Detail, "title")
+}
+
+func TestIntegrationWebhookRoute(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		integration := model.NewIntegration("grafana", model.IntegrationMapping{
+			Title:       "{{.ruleName}}",
+			Priority:    "{{.severity}}",
+			Fingerprint: "grafana-{{.ruleId}}",
+			Resolved:    `{{eq .state "ok"}}`,
+			Labels:      map[string]string{"host": "{{.host}}"},
+		})
+		assert.NoError(integration.Save(db, "55"))
+
+		other := model.NewIntegration("other", model.IntegrationMapping{Title: "{{.ruleName}}"})
+		assert.NoError(other.Save(db, "66"))
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+
+		router.Use(func(c *gin.Context) {
+			c.Set("accountID", "55")
+			c.Set("apiKeyID", "apiKey1")
+		})
+
+		router.POST("/hooks/:id", IntegrationWebhookRoute(db, nil, defaultConfig().Validation))
+
+		post := func(id string, body string) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("POST", "/hooks/"+id, strings.NewReader(body))
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			return res
+		}
+
+		// 1. unknown integrations and integrations of other accounts are not found
+		assert.Equal(http.StatusNotFound, post("missing", "{}").Code)
+		assert.Equal(http.StatusNotFound, post(other.ID, "{}").Code)
+
+		// 2. invalid payloads
+		assert.Equal(http.StatusBadRequest, post(integration.ID, "not json").Code)
+		assert.Equal(http.StatusUnprocessableEntity, post(integration.ID, `{"state": "alerting"}`).Code)
+
+		// a mapped alert beyond the limits
+		res := post(integration.ID, `{"ruleName": "`+strings.Repeat("x", 201)+`", "ruleId": 8, "state": "alerting"}`)
+		p := assertProblem(t, res, http.StatusBadRequest, problem.ValidationFailed)
+		if assert.Equal(1, len(p.Errors)) {
+			assert.Equal("title", p.Errors[0].Field)
+		}
+
+		// 3. alerting creates an alert
+		res = post(integration.ID, `{"ruleName": "CPU usage", "severity": "critical", "ruleId": 7, "state": "alerting", "host": "web1"}`)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var result ingestResultDTO
+		err := json.Unmarshal(res.Body.Bytes(), &result)
+		assert.NoError(err)
+		assert.Equal(ingestCreated, result.Action)
+		assert.Equal("grafana-7", result.Fingerprint)
+
+		alert, _, err := model.GetAlert(db, result.ID)
+		assert.NoError(err)
+		assert.Equal("CPU usage", alert.Title)
+		assert.Equal(model.HighPriority, alert.Priority)
+		assert.Equal("web1", alert.Labels["host"])
+		assert.Equal("apiKey1", alert.APIKeyID)
+
+		// 4. ok resolves it
+		res = post(integration.ID, `{"ruleName": "CPU usage", "ruleId": 7, "state": "ok"}`)
+		assert.Equal(http.StatusOK, res.Code)
+
+		err = json.Unmarshal(res.Body.Bytes(), &result)
+		assert.NoError(err)
+		assert.Equal(ingestResolved, result.Action)
+		assert.Equal(alert.ID, result.ID)
+
+		alert, _, err = model.GetAlert(db, result.ID)
+		assert.NoError(err)
+		assert.Equal(model.ResolvedStatus, alert.Status)
+	})
+}
@@ -0,0 +1,139 @@
+// Package logging writes structured, leveled log records as text or JSON. Loggers carry attributes, like the id of
+// the request being served, which are added to every record. Secrets and the content of alerts are redacted from the
+// records before they are written, see Redact.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Logger writes log records with the attributes given by With
+type Logger struct {
+	l *slog.Logger
+}
+
+var (
+	level          = new(slog.LevelVar)
+	defaultLogger  = newLogger(os.Stderr, "text")
+	contextKeyName = contextKey{}
+)
+
+type contextKey struct{}
+
+func newLogger(w io.Writer, format string) Logger {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	if format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+
+	return Logger{slog.New(&redactingHandler{h})}
+}
+
+// Setup sets the format, "text" or "json", and the lowest level, "debug", "info", "warn" or "error", of the records
+// written to 'w' by the default logger and all loggers created from it afterwards
+func Setup(w io.Writer, format string, lvl string) error {
+	l, err := parse(format, lvl)
+	if err != nil {
+		return err
+	}
+
+	level.Set(l)
+	defaultLogger = newLogger(w, format)
+	return nil
+}
+
+// Check returns an error if Setup would not accept the format or the level
+func Check(format string, lvl string) error {
+	_, err := parse(format, lvl)
+	return err
+}
+
+func parse(format string, lvl string) (slog.Level, error) {
+	var l slog.Level
+	if format != "text" && format != "json" {
+		return l, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+
+	err := l.UnmarshalText([]byte(lvl))
+	if err != nil {
+		return l, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", lvl)
+	}
+
+	return l, nil
+}
+
+// Default returns the logger without any attributes
+func Default() Logger {
+	return defaultLogger
+}
+
+// NewContext returns a copy of 'ctx' carrying the logger
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, contextKeyName, logger)
+}
+
+// FromContext returns the logger of the context, or the default logger if it has none
+func FromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(contextKeyName).(Logger); ok {
+		return logger
+	}
+	return Default()
+}
+
+// With returns a logger adding the attributes, given as key value pairs, to every record
+func (l Logger) With(args ...interface{}) Logger {
+	return Logger{l.l.With(args...)}
+}
+
+// Debug writes a record with the message and the attributes, given as key value pairs
+func (l Logger) Debug(msg string, args ...interface{}) { l.l.Debug(msg, args...) }
+
+// Info writes a record with the message and the attributes, given as key value pairs
+func (l Logger) Info(msg string, args ...interface{}) { l.l.Info(msg, args...) }
+
+// Warn writes a record with the message and the attributes, given as key value pairs
+func (l Logger) Warn(msg string, args ...interface{}) { l.l.Warn(msg, args...) }
+
+// Error writes a record with the message and the attributes, given as key value pairs
+func (l Logger) Error(msg string, args ...interface{}) { l.l.Error(msg, args...) }
+
+// Debugf writes a record with the formatted message
+func (l Logger) Debugf(format string, args ...interface{}) { l.l.Debug(fmt.Sprintf(format, args...)) }
+
+// Infof writes a record with the formatted message
+func (l Logger) Infof(format string, args ...interface{}) { l.l.Info(fmt.Sprintf(format, args...)) }
+
+// Warnf writes a record with the formatted message
+func (l Logger) Warnf(format string, args ...interface{}) { l.l.Warn(fmt.Sprintf(format, args...)) }
+
+// Errorf writes a record with the formatted message
+func (l Logger) Errorf(format string, args ...interface{}) { l.l.Error(fmt.Sprintf(format, args...)) }
+
+// Fatalf writes a record with the formatted message and exits with status 1
+func (l Logger) Fatalf(format string, args ...interface{}) {
+	l.l.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// Debugf writes a record with the formatted message to the default logger
+func Debugf(format string, args ...interface{}) { Default().Debugf(format, args...) }
+
+// Infof writes a record with the formatted message to the default logger
+func Infof(format string, args ...interface{}) { Default().Infof(format, args...) }
+
+// Warnf writes a record with the formatted message to the default logger
+func Warnf(format string, args ...interface{}) { Default().Warnf(format, args...) }
+
+// Errorf writes a record with the formatted message to the default logger
+func Errorf(format string, args ...interface{}) { Default().Errorf(format, args...) }
+
+// Fatalf writes a record with the formatted message to the default logger and exits with status 1
+func Fatalf(format string, args ...interface{}) { Default().Fatalf(format, args...) }
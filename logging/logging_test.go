@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	var out bytes.Buffer
+	assert.NoError(Setup(&out, "json", "info"))
+	defer Setup(os.Stderr, "text", "info")
+
+	logger := Default().With("request_id", "abc")
+	ctx := NewContext(context.Background(), logger)
+
+	FromContext(ctx).Infof("Saved alert %s", "42")
+	FromContext(ctx).Debugf("not written")
+
+	var record map[string]interface{}
+	assert.NoError(json.Unmarshal(out.Bytes(), &record))
+	assert.Equal("INFO", record["level"])
+	assert.Equal("Saved alert 42", record["msg"])
+	assert.Equal("abc", record["request_id"])
+
+	// without a logger in the context the default is used
+	out.Reset()
+	FromContext(context.Background()).Error("failed", "account", "55")
+	record = nil
+	assert.NoError(json.Unmarshal(out.Bytes(), &record))
+	assert.Equal("ERROR", record["level"])
+	assert.Equal("55", record["account"])
+	assert.Nil(record["request_id"])
+}
+
+func TestSetupErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error(Setup(os.Stderr, "xml", "info"))
+	assert.Error(Setup(os.Stderr, "text", "loud"))
+
+	assert.NoError(Check("json", "warn"))
+	assert.Error(Check("xml", "info"))
+	assert.Error(Check("text", "loud"))
+}
+
+func TestRedaction(t *testing.T) {
+	assert := assert.New(t)
+
+	var out bytes.Buffer
+	assert.NoError(Setup(&out, "json", "debug"))
+	defer Setup(os.Stderr, "text", "info")
+
+	token := "eyJhbGciOiJBMTI4S1ciLCJlbmMiOiJBMTI4Q0JDLUhTMjU2In0.abc_-1.def.ghi.jkl"
+
+	Default().With(APIKeyAttr, "3f2a9c1e-1111-2222-3333-444455556666").Info(
+		"Request with Bearer "+token,
+		"access_token", token,
+		"long_description", "the disk of db1 is full",
+		"error", errors.New("can not decrypt "+token),
+		"account", "55",
+		RenewalAttr, "9b1d2e3f-1111-2222-3333-444455556666",
+	)
+
+	var record map[string]interface{}
+	assert.NoError(json.Unmarshal(out.Bytes(), &record))
+	assert.Equal("Request with Bearer [redacted]", record["msg"])
+	assert.Equal("3f2a9c1e...", record["api_key"])
+	assert.Equal("[redacted]", record["access_token"])
+	assert.Equal("[redacted 23 bytes]", record["long_description"])
+	assert.Equal("can not decrypt [redacted token]", record["error"])
+	assert.Equal("55", record["account"])
+	assert.Equal("9b1d2e3f...", record["renewal_id"])
+	assert.NotContains(out.String(), "db1")
+	assert.NotContains(out.String(), "abc_-1")
+}
@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Attributes with these keys are secrets and never written
+var secretKeys = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"authorization": true,
+	"password":      true,
+	"secret":        true,
+	"access_key":    true,
+}
+
+// Attributes with these keys hold the content of alerts and payloads, only their size is written
+var contentKeys = map[string]bool{
+	"body":              true,
+	"payload":           true,
+	"data":              true,
+	"title":             true,
+	"short_description": true,
+	"long_description":  true,
+}
+
+// APIKeyAttr is the key of attributes holding api key ids. An api key id is enough to report as the account of the
+// key, so only its first characters are written, enough to tell keys apart.
+const APIKeyAttr = "api_key"
+
+// RenewalAttr is the key of attributes holding renewal ids. A renewal id is exchanged for an access token, so it is
+// masked as api key ids are.
+const RenewalAttr = "renewal_id"
+
+var (
+	// JWT and JWE compact serializations, i.e. the access and refresh tokens
+	tokenPattern  = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*(\.[A-Za-z0-9_-]*){2,4}`)
+	bearerPattern = regexp.MustCompile(`(?i)bearer\s+\S+`)
+)
+
+// Redact removes tokens from 's'
+func Redact(s string) string {
+	s = bearerPattern.ReplaceAllString(s, "Bearer [redacted]")
+	return tokenPattern.ReplaceAllString(s, "[redacted token]")
+}
+
+// MaskID returns the first characters of an api key or renewal id
+func MaskID(id string) string {
+	if len(id) <= 8 {
+		return "[redacted]"
+	}
+	return id[:8] + "..."
+}
+
+// redactingHandler redacts the message and the attributes of the records before passing them on
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.next.Enabled(ctx, l)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(a))
+		return true
+	})
+
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &redactingHandler{h.next.WithAttrs(redacted)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{h.next.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	v := a.Value.Resolve()
+
+	switch {
+	case secretKeys[key]:
+		return slog.String(a.Key, "[redacted]")
+	case contentKeys[key]:
+		return slog.String(a.Key, fmt.Sprintf("[redacted %d bytes]", len(v.String())))
+	case key == APIKeyAttr || key == RenewalAttr:
+		return slog.String(a.Key, MaskID(v.String()))
+	}
+
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]interface{}, len(attrs))
+		for i, ga := range attrs {
+			redacted[i] = redactAttr(ga)
+		}
+		return slog.Group(a.Key, redacted...)
+	case slog.KindAny:
+		// e.g. errors and DTOs, which are written as their string
+		return slog.String(a.Key, Redact(fmt.Sprint(v.Any())))
+	}
+
+	return slog.Attr{Key: a.Key, Value: v}
+}
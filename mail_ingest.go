@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/smtpd"
+)
+
+// mailIngester turns mail sent to <api key>@<domain> into alerts. It is the backend of the embedded SMTP server.
+type mailIngester struct {
+	db     *bolt.DB
+	stream *eventStream
+	domain string
+}
+
+var errUnknownRecipient = &smtpd.Error{Code: 550, Message: "5.1.1 Unknown recipient"}
+
+// CheckRecipient accepts recipients whose local part is an active api key that may be used from the address of the
+// sender
+func (m *mailIngester) CheckRecipient(remote net.Addr, rcpt string) error {
+	_, _, err := m.recipientAPIKey(remote, rcpt)
+	return err
+}
+
+// Deliver creates an alert for each recipient of the message. The alerts are saved in a single transaction, so that
+// a rejected message has created no alert and can be sent again.
+func (m *mailIngester) Deliver(remote net.Addr, from string, rcpts []string, data []byte) error {
+	msg, err := parseMailAlert(data)
+	if err != nil {
+		logging.Infof("Failed to parse mail from %s: %s", from, err)
+		return &smtpd.Error{Code: 554, Message: "5.6.0 Message could not be parsed"}
+	}
+
+	var alerts []model.NewAccountAlert
+	for _, rcpt := range rcpts {
+		apiKey, accountID, err := m.recipientAPIKey(remote, rcpt)
+		if err != nil {
+			return err
+		}
+
+		alert := model.NewAlert(apiKey.ID)
+		alert.Title = msg.Subject
+		alert.ShortDescription = msg.Subject
+		alert.LongDescription = msg.Body
+		alert.Priority = mailPriority(msg.Subject)
+		alert.Labels = model.MergeLabels(apiKey.DefaultLabels, nil)
+		alert.TriggeredAt = msg.Date
+		if alert.TriggeredAt.IsZero() {
+			alert.TriggeredAt = alert.CreatedAt
+		}
+
+		alerts = append(alerts, model.NewAccountAlert{AccountUUID: accountID, Alert: alert, Actor: model.Actor{Type: model.APIKeyActor, ID: apiKey.ID}})
+	}
+
+	err = model.SaveNewAlerts(m.db, alerts)
+	if err != nil {
+		logging.Errorf("Failed to save alerts from mail sent by %s: %s", from, err)
+		return err
+	}
+
+	for _, a := range alerts {
+		alertsCreated.WithLabelValues(string(a.Alert.Priority)).Inc()
+		m.stream.Notify(a.AccountUUID)
+		logging.Infof("Created alert %s from mail sent by %s", a.Alert.ID, from)
+	}
+
+	return nil
+}
+
+// recipientAPIKey returns the api key and account id of the recipient, or an *smtpd.Error if the recipient should
+// be rejected
+func (m *mailIngester) recipientAPIKey(remote net.Addr, rcpt string) (*model.APIKey, string, error) {
+	i := strings.LastIndex(rcpt, "@")
+	if i < 0 || !strings.EqualFold(rcpt[i+1:], m.domain) {
+		return nil, "", errUnknownRecipient
+	}
+
+	apiKey, accountID, err := model.GetAPIKey(m.db, rcpt[:i])
+	if err != nil {
+		logging.Default().With(logging.APIKeyAttr, rcpt[:i]).Errorf("Failed to get api key: %s", err)
+		return nil, "", &smtpd.Error{Code: 451, Message: "4.3.0 Temporary failure"}
+	}
+	if apiKey == nil || model.APIKeyActive != apiKey.Status {
+		return nil, "", errUnknownRecipient
+	}
+
+	ip := addrIP(remote)
+	if !apiKey.AllowsIP(ip) {
+		logging.Default().With(logging.APIKeyAttr, apiKey.ID).Errorf("Api key used from %s which is not in its allowlist", ip)
+
+		entry := model.NewAuditEntry(model.AuditIPRejected)
+		entry.APIKeyID = apiKey.ID
+		entry.RemoteIP = ip.String()
+		entry.Details = "SMTP RCPT " + rcpt
+		err = entry.Save(m.db, *accountID)
+		if err != nil {
+			logging.Errorf("Failed to save audit entry: %s", err)
+		}
+
+		return nil, "", &smtpd.Error{Code: 550, Message: "5.7.1 Not allowed from this address"}
+	}
+
+	return apiKey, *accountID, nil
+}
+
+// mailAlert is the content of a mail relevant for an alert
+type mailAlert struct {
+	Subject string
+	Body    string
+	Date    time.Time // zero if the mail has no valid Date header
+}
+
+// parseMailAlert parses the subject, date and plain text body of a mail
+func parseMailAlert(data []byte) (*mailAlert, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var a mailAlert
+
+	dec := new(mime.WordDecoder)
+	a.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		a.Subject = msg.Header.Get("Subject")
+	}
+	a.Subject = strings.TrimSpace(a.Subject)
+	if a.Subject == "" {
+		a.Subject = "(no subject)"
+	}
+
+	date, err := msg.Header.Date()
+	if err == nil {
+		a.Date = date
+	}
+
+	body, err := mailBody(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	a.Body = strings.TrimSpace(body)
+
+	return &a, nil
+}
+
+// mailBody returns the first text/plain part of a body with the given content type and transfer encoding
+func mailBody(contentType string, encoding string, r io.Reader) (string, error) {
+	mediaType := "text/plain"
+	var params map[string]string
+	if contentType != "" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+
+			body, err := mailBody(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", err
+			}
+			if body != "" {
+				return body, nil
+			}
+		}
+	}
+
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read body: %s", err)
+	}
+
+	return string(b), nil
+}
+
+// mailPriority decides the priority of an alert from keywords in the subject of the mail
+func mailPriority(subject string) model.AlertPriority {
+	words := strings.FieldsFunc(strings.ToLower(subject), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+
+	priority := model.NormalPriority
+	for _, w := range words {
+		switch w {
+		case "high", "urgent", "critical", "emergency", "error", "failed", "failure":
+			return model.HighPriority
+		case "low", "info", "notice":
+			priority = model.LowPriority
+		}
+	}
+
+	return priority
+}
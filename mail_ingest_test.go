@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"net/smtp"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/smtpd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailIngest(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		apiKey := model.NewAPIKey()
+		apiKey.DefaultLabels = map[string]string{"site": "office"}
+		assert.NoError(apiKey.Save(db, "55"))
+
+		inactive := model.NewAPIKey()
+		inactive.Status = model.APIKeyInactive
+		assert.NoError(inactive.Save(db, "55"))
+
+		remote := model.NewAPIKey()
+		remote.AllowedCIDRs = []string{"10.0.0.0/8"}
+		assert.NoError(remote.Save(db, "55"))
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(err)
+
+		s := &smtpd.Server{Domain: "alerts.example", Backend: &mailIngester{db: db, domain: "alerts.example"}}
+		go s.Serve(l)
+		defer s.Close()
+
+		addr := l.Addr().String()
+
+		// 1. unknown, inactive and not allowed keys and other domains are rejected
+		for _, rcpt := range []string{"missing@alerts.example", inactive.ID + "@alerts.example", remote.ID + "@alerts.example", apiKey.ID + "@other.example"} {
+			err = smtp.SendMail(addr, nil, "ups@example.com", []string{rcpt}, []byte("Subject: x\r\n\r\nx\r\n"))
+			assert.Error(err, rcpt)
+		}
+
+		alerts, err := model.ListAlerts(db, "55")
+		assert.NoError(err)
+		assert.Equal(0, len(*alerts))
+
+		// 2. a mail to a valid key creates an alert
+		msg := "From: ups@example.com\r\n" +
+			"Subject: =?UTF-8?Q?CRITICAL:_UPS_on_battery?=\r\n" +
+			"Date: Mon, 02 Jan 2017 15:04:05 +0000\r\n" +
+			"\r\n" +
+			"Power failure detected.\r\n"
+		err = smtp.SendMail(addr, nil, "ups@example.com", []string{apiKey.ID + "@ALERTS.example"}, []byte(msg))
+		assert.NoError(err)
+
+		alerts, err = model.ListAlerts(db, "55")
+		assert.NoError(err)
+		assert.Equal(1, len(*alerts))
+
+		for _, a := range *alerts {
+			assert.Equal("CRITICAL: UPS on battery", a.Title)
+			assert.Equal("CRITICAL: UPS on battery", a.ShortDescription)
+			assert.Equal("Power failure detected.", a.LongDescription)
+			assert.Equal(model.HighPriority, a.Priority)
+			assert.Equal(apiKey.ID, a.APIKeyID)
+			assert.Equal("office", a.Labels["site"])
+			assert.Equal(2017, a.TriggeredAt.Year())
+		}
+	})
+}
+
+func TestMailIngestIsAllOrNothing(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		key1 := model.NewAPIKey()
+		assert.NoError(key1.Save(db, "55"))
+
+		key2 := model.NewAPIKey()
+		assert.NoError(key2.Save(db, "66"))
+
+		m := &mailIngester{db: db, domain: "alerts.example"}
+		remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+		msg := []byte("Subject: Backup failed\r\n\r\nDetails\r\n")
+
+		// a recipient failing after RCPT, e.g. a key deactivated meanwhile, rejects the message for all recipients
+		err := m.Deliver(remote, "nas@example.com", []string{key1.ID + "@alerts.example", "missing@alerts.example"}, msg)
+		assert.Error(err)
+
+		alerts, err := model.ListAlerts(db, "55")
+		assert.NoError(err)
+		assert.Equal(0, len(*alerts))
+
+		// recipients of different accounts each get the alert
+		err = m.Deliver(remote, "nas@example.com", []string{key1.ID + "@alerts.example", key2.ID + "@alerts.example"}, msg)
+		assert.NoError(err)
+
+		for _, accountID := range []string{"55", "66"} {
+			alerts, err = model.ListAlerts(db, accountID)
+			assert.NoError(err)
+			assert.Equal(1, len(*alerts), accountID)
+		}
+	})
+}
+
+func TestParseMailAlert(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := "Subject: Backup done\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>html</p>\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Backup of /home finished =E2=9C=93\r\n" +
+		"--b1--\r\n"
+
+	a, err := parseMailAlert([]byte(msg))
+	assert.NoError(err)
+	assert.Equal("Backup done", a.Subject)
+	assert.Equal("Backup of /home finished ✓", a.Body)
+	assert.True(a.Date.IsZero())
+
+	msg = "Content-Transfer-Encoding: base64\r\n\r\naGVsbG8g\r\nd29ybGQ=\r\n"
+	a, err = parseMailAlert([]byte(msg))
+	assert.NoError(err)
+	assert.Equal("(no subject)", a.Subject)
+	assert.Equal("hello world", a.Body)
+}
+
+func TestMailPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(model.HighPriority, mailPriority("[URGENT] disk full"))
+	assert.Equal(model.HighPriority, mailPriority("Backup failed"))
+	assert.Equal(model.HighPriority, mailPriority("info: job error"))
+	assert.Equal(model.LowPriority, mailPriority("[info] backup done"))
+	assert.Equal(model.NormalPriority, mailPriority("Backup done"))
+}
@@ -1,39 +1,74 @@
 package main
 
 import (
+	"crypto/rsa"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"os"
 
 	"github.com/boltdb/bolt"
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
 	"github.com/joakim666/wip_alerts/auth"
+	"github.com/joakim666/wip_alerts/logging"
 	"errors"
+	"net"
 	"net/http"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+	"github.com/joakim666/wip_alerts/smtpd"
+	"github.com/joakim666/wip_alerts/syslogd"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
 )
 
 func main() {
-	// flag parsing (and setting through code) for glog
+	configFile := registerConfigFlags(flag.CommandLine)
+
 	flag.Parse()
-	flag.Lookup("logtostderr").Value.Set("true")
 
-	// Open the my.db data file in the your current directory.
-	// It will be created if it doesn't exist.
-	db, err := bolt.Open("my.db", 0600, nil)
+	cfg, err := loadConfig(*configFile, os.Getenv, flag.CommandLine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if flag.NArg() > 0 {
+		os.Exit(runConfigCommand(cfg, flag.Args(), os.Stdout, os.Stderr))
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	err = logging.Setup(os.Stderr, cfg.Log.Format, cfg.Log.Level)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	defer db.Close()
 
-	fmt.Println("Creating buckets")
-	glog.Infof("Creating buckets")
+	refreshKey, err := loadRSAPrivateKey(cfg.Tokens.RefreshKeyFile)
+	if err != nil {
+		logging.Fatalf("Failed to load refresh key: %s", err)
+	}
+
+	// Open the data file, it will be created if it doesn't exist.
+	db, err := bolt.Open(cfg.DBPath, 0600, nil)
+	if err != nil {
+		logging.Fatalf("Failed to open database: %s", err)
+	}
+
+	logging.Infof("Creating buckets")
 	err = db.Update(func(tx *bolt.Tx) error {
 		// create all buckets
-		buckets := []string{"Accounts", "Devices", "Renewals", "APIKeys", "Heartbeats", "Tokens", "Alerts"}
 		for _, b := range buckets {
-			glog.Infof("Creating %s bucket", b)
+			logging.Debugf("Creating %s bucket", b)
 			_, err := tx.CreateBucketIfNotExists([]byte(b))
 			if err != nil {
 				return fmt.Errorf("Failed to create %s bucket: %s", b, err)
@@ -43,112 +78,361 @@ func main() {
 		return nil
 	})
 	if err != nil {
-		glog.Errorf("Bolt failed: %s", err)
+		logging.Errorf("Bolt failed: %s", err)
 	}
 
-	r := setupRoutes(db)
+	registerMetrics(db, cfg.Metrics)
+
+	stream := newEventStream()
+	workers := newWorkers()
+	health := newHealthChecker(db, cfg.Health, workers)
+
+	// return snoozed alerts to new when their snooze expires
+	workers.start("snooze", time.Minute)
+	go wakeSnoozedAlerts(db, stream, time.Minute, workers)
 
-	r.Run() // listen and serve on 0.0.0.0:8080
+	// delete the responses to idempotency keys once they are no longer replayed
+	if cfg.HTTP.IdempotencyTTL > 0 {
+		workers.start("idempotency", time.Hour)
+		go purgeIdempotentResponses(db, time.Hour, workers)
+	}
+
+	var mailServer *smtpd.Server
+	if cfg.SMTP.Addr != "" {
+		mailServer = serveSMTP(db, stream, cfg.SMTP, workers)
+	}
+
+	var syslogServer *syslogd.Server
+	if cfg.Syslog.UDPAddr != "" || cfg.Syslog.TCPAddr != "" {
+		syslogServer = serveSyslog(db, stream, cfg.Syslog, workers)
+	}
+
+	r := setupRoutes(db, stream, cfg, refreshKey, health)
+
+	var certs *certReloader
+	if cfg.HTTP.TLSCertFile != "" {
+		certs, err = newCertReloader(cfg.HTTP.TLSCertFile, cfg.HTTP.TLSKeyFile)
+		if err != nil {
+			logging.Fatalf("Failed to load TLS certificate: %s", err)
+		}
+	}
+
+	var grpcServer *grpc.Server
+	if cfg.GRPC.Addr != "" {
+		grpcServer = serveGRPC(db, stream, cfg, certs, workers)
+	}
+
+	srv := newHTTPServer(cfg.HTTP, r, certs)
+	srv.RegisterOnShutdown(health.ShuttingDown)
+	srv.RegisterOnShutdown(stream.Close)
+
+	l, err := net.Listen("tcp", cfg.HTTP.Addr)
+	if err != nil {
+		logging.Fatalf("Failed to listen on %s: %s", cfg.HTTP.Addr, err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	logging.Infof("Serving the api on %s, tls: %t", l.Addr(), certs != nil)
+	err = serve(srv, l, certs, signals, cfg.HTTP.ShutdownTimeout)
+	if err != nil && err != http.ErrServerClosed {
+		logging.Errorf("Server stopped: %s", err)
+	}
+
+	if grpcServer != nil {
+		stopGRPC(grpcServer, cfg.HTTP.ShutdownTimeout)
+	}
+	if mailServer != nil {
+		mailServer.Close()
+	}
+	if syslogServer != nil {
+		syslogServer.Close()
+	}
+
+	// waits for running transactions, e.g. of the receivers, to finish
+	err = db.Close()
+	if err != nil {
+		logging.Errorf("Failed to close the database: %s", err)
+	}
+	logging.Infof("Database closed, exiting")
+}
+
+// runConfigCommand runs the command given on the command line instead of starting the server. Returns the exit
+// status.
+func runConfigCommand(cfg *config, args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) != 2 || args[0] != "config" || (args[1] != "print" && args[1] != "check") {
+		fmt.Fprintf(stderr, "Unknown command %s, expected \"config print\" or \"config check\"\n", strings.Join(args, " "))
+		return 2
+	}
+
+	if args[1] == "print" {
+		err := cfg.print(stdout)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+
+	err := cfg.validate()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// serveSMTP starts the embedded SMTP server turning mail into alerts
+func serveSMTP(db *bolt.DB, stream *eventStream, cfg configSMTP, workers *workers) *smtpd.Server {
+	s := &smtpd.Server{
+		Domain:         cfg.Domain,
+		MaxMessageSize: cfg.MaxSize,
+		Backend:        &mailIngester{db: db, stream: stream, domain: cfg.Domain},
+	}
+
+	logging.Infof("Receiving alerts by mail to <api key>@%s on %s", cfg.Domain, cfg.Addr)
+	workers.start("smtp", 0)
+	go func() {
+		err := s.ListenAndServe(cfg.Addr)
+		if err != nil && err != smtpd.ErrServerClosed {
+			logging.Errorf("SMTP server failed: %s", err)
+		}
+		workers.stop("smtp", err)
+	}()
+
+	return s
 }
 
-func setupRoutes(db *bolt.DB) *gin.Engine {
-	r := gin.Default()
+// serveSyslog starts the syslog receiver turning matching messages into alerts on the configured UDP and TCP
+// addresses. An empty address disables that transport.
+func serveSyslog(db *bolt.DB, stream *eventStream, cfg configSyslog, workers *workers) *syslogd.Server {
+	ingester, err := loadSyslogIngester(db, stream, cfg.RulesFile)
+	if err != nil {
+		logging.Fatalf("Failed to load syslog config: %s", err)
+	}
 
-	var sharedKey = []byte("shared key123456") // used for access tokens
-	var privateKey = []byte("fooo")            // used for refresh tokens
-	var publicKey = []byte("fooo")             // used for refresh tokens
+	s := &syslogd.Server{Handler: ingester}
+
+	if cfg.UDPAddr != "" {
+		logging.Infof("Receiving syslog messages on udp %s", cfg.UDPAddr)
+		workers.start("syslog-udp", 0)
+		go func() {
+			err := s.ListenAndServeUDP(cfg.UDPAddr)
+			if err != syslogd.ErrServerClosed {
+				logging.Errorf("Syslog UDP receiver failed: %s", err)
+			}
+			workers.stop("syslog-udp", err)
+		}()
+	}
+	if cfg.TCPAddr != "" {
+		logging.Infof("Receiving syslog messages on tcp %s", cfg.TCPAddr)
+		workers.start("syslog-tcp", 0)
+		go func() {
+			err := s.ListenAndServeTCP(cfg.TCPAddr)
+			if err != syslogd.ErrServerClosed {
+				logging.Errorf("Syslog TCP receiver failed: %s", err)
+			}
+			workers.stop("syslog-tcp", err)
+		}()
+	}
+
+	return s
+}
+
+func setupRoutes(db *bolt.DB, stream *eventStream, cfg *config, refreshKey *rsa.PrivateKey, health *healthChecker) *gin.Engine {
+	r := gin.New()
+	r.Use(requestLogging(), gin.CustomRecovery(problem.Recovery))
+	r.NoRoute(problem.NoRoute)
+
+	var sharedKey = []byte(cfg.Tokens.AccessKey) // used for access tokens
+	var privateKey = refreshKey                   // used for refresh tokens
+	var publicKey = &refreshKey.PublicKey         // used for refresh tokens
+
+	policy := auth.DefaultPolicy()
+	policy.AccountRoles = currentAccountRoles(db, cfg.Tokens.Role) // role changes apply to issued tokens at once
+
+	// proxies in front of the server that are trusted to set the X-Forwarded-For header
+	trustedProxies, err := model.ParseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		logging.Fatalf("Invalid trusted proxies: %s", err)
+	}
+
+	r.Use(httpMetrics())
+
+	/* Probes of load balancers, orchestrators and monitoring, outside of the api so that they are not versioned. */
+	r.GET("/healthz", LivenessRoute())
+	r.GET("/readyz", ReadinessRoute(health))
+	r.GET("/version", BuildInfoRoute())
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	/* Public routes are as they are named public. No form of authentication or authorization is needed. */
 	// Begin: PUBLIC routes
 	public := r.Group("/api/v1")
 	public.POST("/accounts", PostAccounts(db))
 	public.POST("/renewals", PostRenewals(db, privateKey))
-	public.POST("/tokens", PostTokens(db, publicKey, sharedKey))
+	public.POST("/tokens", limitBody(cfg.HTTP.MaxBodySize), idempotentTokens(db, cfg.HTTP.IdempotencyTTL), PostTokens(db, publicKey, sharedKey, cfg.Tokens.Role))
 	// End: PUBLIC routes
 
 	/* Api key routes require an api-key, either through a header or as a query-parameter. */
 	// Begin: APIKEY routes
 	apiKey := r.Group("/api/v1")
-	apiKey.Use(validateApiKey(db))
-	apiKey.POST("/alerts", CreateAlertRoute(db))
-	apiKey.POST("/heartbeats", CreateHeartbeatRoute(db))
+	apiKey.Use(limitBody(cfg.HTTP.MaxBodySize), validateApiKey(db, trustedProxies), idempotent(db, cfg.HTTP.IdempotencyTTL))
+	apiKey.POST("/alerts", CreateAlertRoute(db, stream, cfg.Validation))
+	apiKey.POST("/heartbeats", CreateHeartbeatRoute(db, stream, cfg.Validation))
+	apiKey.POST("/batch", CreateBatchRoute(db, stream, cfg.Validation))
+	apiKey.POST("/integrations/alertmanager", AlertmanagerWebhookRoute(db, stream, cfg.Validation))
+	apiKey.POST("/hooks/:id", IntegrationWebhookRoute(db, stream, cfg.Validation))
 	// END: APIKEY routes
 
-	/* Access token routes require an access token set as a header. */
+	/* Access token routes require an access token, set as a header, whose roles or explicit capabilities give the
+	capability the route requires. */
 	// Begin: ACCESSTOKEN routes
 	private := r.Group("/api/v1")
-	private.Use(auth.ValidateAccessToken(hasRole("role1"), sharedKey))
-	private.GET("/api-keys", ListAPIKeyRoute(db))
-	private.POST("/api-keys", CreateAPIKeyRoute(db))
-	private.GET("/ping", PingRoute())
-	private.GET("/alerts", ListAlertsRoute(db))
-	private.POST("/alerts/:id", UpdateAlertRoute(db))
-	private.GET("/heartbeats", LatestHeartbeatsRoute(db))
+	registerAccessTokenRoutes(private, accessTokenRoutes(db, stream, policy), policy, sharedKey)
 	// End: ACCESSTOKEN routes
 
-	/* Admin capability routes requires a token with admin capabilty set */
-	// Begin: Admin capability routes
-	admin := r.Group("/api/v1")
-	admin.Use(auth.ValidateAccessToken(hasCapability("admin"), sharedKey))
-	admin.GET("/accounts", ListAccounts(db))
-	admin.GET("/renwewals", ListRenewals(db))
-	admin.GET("/tokens", ListTokens(db))
-	// End: Admin capability routes
-
 	return r
 }
 
-func hasRole(role string) func(*auth.Token, *gin.Context) bool {
-	return func(token *auth.Token, ctx *gin.Context) bool {
-		if token.HasRole(role) {
-			ctx.Set("accountID", token.AccountID)
-			//ctx.Set("account", GetACcount(...)) // TODO fix
-			return true
-		}
+// accessTokenRoute is a route requiring an access token with a capability
+type accessTokenRoute struct {
+	method     string
+	path       string
+	capability auth.Capability
+	handler    gin.HandlerFunc
+}
 
-		return false
+// accessTokenRoutes returns the routes requiring an access token and the capability each requires
+func accessTokenRoutes(db *bolt.DB, stream *eventStream, policy *auth.Policy) []accessTokenRoute {
+	return []accessTokenRoute{
+		{"GET", "/ping", auth.NoCapability, PingRoute()},
+		{"GET", "/api-keys", auth.ManageAPIKeysCapability, ListAPIKeyRoute(db)},
+		{"POST", "/api-keys", auth.ManageAPIKeysCapability, CreateAPIKeyRoute(db)},
+		{"GET", "/integrations", auth.ManageIntegrationsCapability, ListIntegrationsRoute(db)},
+		{"POST", "/integrations", auth.ManageIntegrationsCapability, CreateIntegrationRoute(db)},
+		{"POST", "/integrations/dry-run", auth.ManageIntegrationsCapability, DryRunIntegrationRoute()},
+		{"GET", "/alerts", auth.ReadAlertsCapability, ListAlertsRoute(db, stream)},
+		{"GET", "/alerts/:id", auth.ReadAlertsCapability, GetAlertRoute(db)},
+		{"POST", "/alerts/:id", auth.UpdateAlertsCapability, UpdateAlertRoute(db, stream)},
+		{"GET", "/alerts/:id/history", auth.ReadAlertsCapability, AlertHistoryRoute(db)},
+		{"POST", "/alerts/:id/notified", auth.ReadAlertsCapability, NotifiedAlertRoute(db)},
+		{"POST", "/bulk/alerts", auth.UpdateAlertsCapability, BulkUpdateAlertsRoute(db, stream)},
+		{"GET", "/events", auth.ReadAlertsCapability, StreamEventsRoute(db, stream)},
+		{"GET", "/heartbeats", auth.ReadHeartbeatsCapability, LatestHeartbeatsRoute(db)},
+		{"GET", "/accounts", auth.AdminCapability, ListAccounts(db)},
+		{"PUT", "/accounts/:id/roles", auth.ManageRolesCapability, UpdateAccountRolesRoute(db, policy)},
+		{"GET", "/renewals", auth.AdminCapability, ListRenewals(db)},
+		{"GET", "/tokens", auth.AdminCapability, ListTokens(db)},
 	}
 }
 
-func hasCapability(capability string) func(*auth.Token, *gin.Context) bool {
-	return func(token *auth.Token, ctx *gin.Context) bool {
-		if token.HasCapability(capability) {
-			ctx.Set("accountID", token.AccountID)
-			return true
+// registerAccessTokenRoutes adds the routes to the group, each guarded by a check of its capability
+func registerAccessTokenRoutes(group *gin.RouterGroup, routes []accessTokenRoute, policy *auth.Policy, sharedKey []byte) {
+	for _, route := range routes {
+		group.Handle(route.method, route.path, auth.ValidateAccessToken(policy.Require(route.capability), sharedKey), route.handler)
+	}
+}
+
+// wakeSnoozedAlerts checks for alerts with an expired snooze every 'interval'. It never returns.
+func wakeSnoozedAlerts(db *bolt.DB, stream *eventStream, interval time.Duration, workers *workers) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		woken, err := model.WakeSnoozedAlerts(db, now)
+		if err != nil {
+			logging.Errorf("Failed to wake snoozed alerts: %s", err)
+			continue
 		}
+		workers.beat("snooze")
 
-		return false
+		for accountID, alerts := range woken {
+			logging.Infof("Woke %d snoozed alerts for account %s", len(alerts), accountID)
+			stream.Notify(accountID)
+		}
 	}
 }
 
-func validateApiKey(db *bolt.DB) gin.HandlerFunc {
+var (
+	// errUnauthenticated answers requests reaching a handler without the account set by the authentication
+	errUnauthenticated = problem.New(http.StatusUnauthorized, problem.Unauthenticated, "The request is not authenticated")
+
+	// errInvalidAPIKey does not tell unknown keys from inactive ones
+	errInvalidAPIKey = problem.New(http.StatusUnauthorized, problem.InvalidAPIKey, "The api key is unknown or not active")
+)
+
+// validateApiKey checks that the request has an active api key and that the request originates from a network the
+// key is allowed to be used from. 'trustedProxies' are the networks of the proxies whose X-Forwarded-For header
+// can be trusted when resolving the ip of the client.
+func validateApiKey(db *bolt.DB, trustedProxies []*net.IPNet) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		apiKeyID, err := extractApiKey(c)
-		if err != nil {
-			glog.Errorf("Can not find api key: %s", err)
-			c.AbortWithError(http.StatusUnauthorized, errors.New("API Key missing"))
-			return
-		}
+		logger := logging.FromContext(c.Request.Context())
 
-		apiKey, accountID, err := model.GetAPIKey(db, apiKeyID)
+		apiKeyID, err := extractApiKey(c)
 		if err != nil {
-			glog.Errorf("Can not find api key: %s", err)
-			c.AbortWithError(http.StatusUnauthorized, errors.New("API Key missing"))
+			logger.Errorf("Can not find api key: %s", err)
+			authFailures.WithLabelValues(missingAPIKeyFailure).Inc()
+			problem.Abort(c, problem.New(http.StatusUnauthorized, problem.MissingAPIKey, "An api key must be given in the APIKey header or the apiKey query parameter"))
 			return
 		}
+		logger = logger.With(logging.APIKeyAttr, apiKeyID)
 
-		if model.APIKeyActive != apiKey.Status {
-			glog.Errorf("Api key with id %s is not valid", apiKeyID)
-			c.AbortWithError(http.StatusUnauthorized, errors.New("API Key not valid"))
+		ip := clientIP(c.Request, trustedProxies)
+		apiKey, accountID, p := authorizeAPIKey(db, logger, apiKeyID, ip, c.Request.Method+" "+c.Request.URL.Path)
+		if p != nil {
+			problem.Abort(c, p)
 			return
 		}
 
-		glog.Infof("Granting api level access to api key with id %s", apiKey.ID)
+		logger.Infof("Granting api level access")
+		// the handlers log with the api key
+		c.Request = c.Request.WithContext(logging.NewContext(c.Request.Context(), logger))
 		c.Set("apiKeyID", apiKey.ID)
 		c.Set("accountID", accountID)
 	}
 }
 
+// authorizeAPIKey checks that the api key exists, is active and is allowed from 'ip'. 'request' describes the
+// request in the audit entry saved when the ip is not allowed. Returns the api key and the id of its account, or the
+// problem to answer.
+func authorizeAPIKey(db *bolt.DB, logger logging.Logger, apiKeyID string, ip net.IP, request string) (*model.APIKey, string, *problem.Problem) {
+	apiKey, accountID, err := model.GetAPIKey(db, apiKeyID)
+	if err != nil {
+		logger.Errorf("Can not find api key: %s", err)
+		return nil, "", problem.Internal()
+	}
+	if apiKey == nil {
+		logger.Errorf("No such api key")
+		authFailures.WithLabelValues(unknownAPIKeyFailure).Inc()
+		return nil, "", errInvalidAPIKey
+	}
+
+	if model.APIKeyActive != apiKey.Status {
+		logger.Errorf("Api key is not valid")
+		authFailures.WithLabelValues(inactiveAPIKeyFailure).Inc()
+		return nil, "", errInvalidAPIKey
+	}
+
+	if !apiKey.AllowsIP(ip) {
+		logger.Errorf("Api key used from %s which is not in its allowlist", ip)
+		authFailures.WithLabelValues(forbiddenIPFailure).Inc()
+
+		entry := model.NewAuditEntry(model.AuditIPRejected)
+		entry.APIKeyID = apiKey.ID
+		entry.RemoteIP = ip.String()
+		entry.Details = request
+		err = entry.Save(db, *accountID)
+		if err != nil {
+			logger.Errorf("Failed to save audit entry: %s", err)
+		}
+
+		return nil, "", problem.New(http.StatusForbidden, problem.ForbiddenIP, "The api key is not allowed from %s", ip)
+	}
+
+	return apiKey, *accountID, nil
+}
+
 func extractApiKey(c *gin.Context) (string, error) {
 	hdr := c.Request.Header.Get("APIKey")
 	if hdr != "" {
@@ -162,3 +446,47 @@ func extractApiKey(c *gin.Context) (string, error) {
 
 	return "", errors.New("No APIKey found as header or query parameter")
 }
+
+// clientIP resolves the ip of the client. The X-Forwarded-For header is only used if the request comes from one of
+// the trusted proxies, and then the right-most address not belonging to a trusted proxy is used.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(host))
+	if ip == nil || !isTrustedProxy(ip, trustedProxies) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, hdr := range r.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		forwarded = append(forwarded, strings.Split(hdr, ",")...)
+	}
+
+	// walk the chain from the closest hop and stop at the first address not belonging to a trusted proxy
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			// a malformed entry can not be trusted, nor anything to the left of it
+			return ip
+		}
+		ip = hop
+		if !isTrustedProxy(hop, trustedProxies) {
+			return hop
+		}
+	}
+
+	return ip
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
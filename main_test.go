@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateApiKeyWithAllowlist(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		apiKey := model.NewAPIKey()
+		apiKey.AllowedCIDRs = []string{"10.0.0.0/8"}
+		apiKey.Save(db, "55")
+
+		trustedProxies, _ := model.ParseCIDRs([]string{"127.0.0.1/32"})
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(validateApiKey(db, trustedProxies))
+		router.GET("/ping", func(c *gin.Context) {
+			accountID, _ := c.Get("accountID")
+			assert.Equal("55", accountID)
+			c.Status(http.StatusNoContent)
+		})
+
+		// directly from an allowed network
+		req, _ := http.NewRequest("GET", "/ping", nil)
+		req.Header.Set("APIKey", apiKey.ID)
+		req.RemoteAddr = "10.1.2.3:5555"
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusNoContent, res.Code)
+
+		// directly from another network
+		req, _ = http.NewRequest("GET", "/ping", nil)
+		req.Header.Set("APIKey", apiKey.ID)
+		req.RemoteAddr = "192.168.1.1:5555"
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusForbidden, res.Code)
+
+		// spoofed X-Forwarded-For from an untrusted client is ignored
+		req, _ = http.NewRequest("GET", "/ping", nil)
+		req.Header.Set("APIKey", apiKey.ID)
+		req.Header.Set("X-Forwarded-For", "10.1.2.3")
+		req.RemoteAddr = "192.168.1.1:5555"
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusForbidden, res.Code)
+
+		// through a trusted proxy
+		req, _ = http.NewRequest("GET", "/ping", nil)
+		req.Header.Set("APIKey", apiKey.ID)
+		req.Header.Set("X-Forwarded-For", "10.1.2.3")
+		req.RemoteAddr = "127.0.0.1:5555"
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(http.StatusNoContent, res.Code)
+
+		// the rejected attempts should be in the audit trail
+		entries, err := model.ListAuditEntries(db, "55")
+		assert.NoError(err)
+		assert.Equal(2, len(*entries))
+		for _, v := range *entries {
+			assert.Equal(model.AuditIPRejected, v.Event)
+			assert.Equal(apiKey.ID, v.APIKeyID)
+			assert.Equal("192.168.1.1", v.RemoteIP)
+		}
+	})
+}
+
+func TestValidateApiKeyWithUnknownKey(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(validateApiKey(db, nil))
+		router.GET("/ping", PingRoute())
+
+		req, _ := http.NewRequest("GET", "/ping", nil)
+		req.Header.Set("APIKey", "unknown")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assertProblem(t, res, http.StatusUnauthorized, problem.InvalidAPIKey)
+	})
+}
+
+func TestValidateApiKeyWithStorageFailure(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		// an api key that can not be read
+		err := db.Update(func(tx *bolt.Tx) error {
+			nb, err := tx.Bucket([]byte("APIKeys")).CreateBucketIfNotExists([]byte("55"))
+			if err != nil {
+				return err
+			}
+			return nb.Put([]byte("broken"), []byte("not gob"))
+		})
+		assert.NoError(err)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(validateApiKey(db, nil))
+		router.GET("/ping", PingRoute())
+
+		req, _ := http.NewRequest("GET", "/ping", nil)
+		req.Header.Set("APIKey", "broken")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assertProblem(t, res, http.StatusInternalServerError, problem.InternalError)
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	assert := assert.New(t)
+
+	trustedProxies, _ := model.ParseCIDRs([]string{"127.0.0.1/32", "172.16.0.0/12"})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1:5555"
+	req.Header.Set("X-Forwarded-For", "10.1.2.3")
+	assert.Equal(net.ParseIP("192.168.1.1"), clientIP(req, trustedProxies))
+
+	// the right-most untrusted address is used
+	req.RemoteAddr = "127.0.0.1:5555"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 10.1.2.3, 172.16.0.5")
+	assert.Equal(net.ParseIP("10.1.2.3"), clientIP(req, trustedProxies))
+
+	// a malformed entry stops the walk
+	req.Header.Set("X-Forwarded-For", "10.1.2.3, garbage")
+	assert.Equal(net.ParseIP("127.0.0.1"), clientIP(req, trustedProxies))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/auth"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wip_http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wip_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	alertsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wip_alerts_created_total",
+		Help: "Alerts created by priority, by all means of reporting.",
+	}, []string{"priority"})
+
+	heartbeatsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wip_heartbeats_received_total",
+		Help: "Heartbeats received.",
+	})
+
+	idempotentReplays = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wip_idempotent_replays_total",
+		Help: "Responses replayed for repeated requests with an idempotency key.",
+	})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wip_auth_failures_total",
+		Help: "Refused requests by reason.",
+	}, []string{"reason"})
+
+	boltTxDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wip_bolt_tx_duration_seconds",
+		Help:    "Duration of database transactions by type, read or write.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"type"})
+)
+
+// Reasons of auth failures of api keys, those of access tokens are given by the auth package
+const (
+	missingAPIKeyFailure  = "missing_api_key"
+	unknownAPIKeyFailure  = "unknown_api_key"
+	inactiveAPIKeyFailure = "inactive_api_key"
+	forbiddenIPFailure    = "forbidden_ip"
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpRequestDuration, alertsCreated, heartbeatsReceived, idempotentReplays, authFailures, boltTxDuration)
+}
+
+// registerMetrics starts collecting the metrics of the database and of the packages of the server
+func registerMetrics(db *bolt.DB, cfg configMetrics) {
+	prometheus.MustRegister(newStorageCollector(db, cfg))
+
+	model.TxObserver = observeTx
+	auth.FailureObserver = func(reason string) {
+		authFailures.WithLabelValues(reason).Inc()
+	}
+}
+
+func observeTx(write bool, d time.Duration) {
+	t := "read"
+	if write {
+		t = "write"
+	}
+	boltTxDuration.WithLabelValues(t).Observe(d.Seconds())
+}
+
+// httpMetrics counts the requests by the route they matched, rather than by path, so that ids do not give a metric
+// per object
+func httpMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// storageCollector reads the size of the database file when the metrics are scraped. The open alerts and the overdue
+// heartbeat checks, which take reading every alert and heartbeat, are counted at most once per cache ttl.
+type storageCollector struct {
+	db                *bolt.DB
+	cfg               configMetrics
+	fileSize          *prometheus.Desc
+	openAlerts        *prometheus.Desc
+	overdueHeartbeats *prometheus.Desc
+
+	mu        sync.Mutex // serializes the counting, so that concurrent scrapes count once
+	counts    *storageCounts
+	countedAt time.Time
+}
+
+// storageCounts are the counts of a storageCollector
+type storageCounts struct {
+	openAlerts        map[model.AlertStatus]int
+	overdueHeartbeats int
+}
+
+func newStorageCollector(db *bolt.DB, cfg configMetrics) *storageCollector {
+	return &storageCollector{
+		db:                db,
+		cfg:               cfg,
+		fileSize:          prometheus.NewDesc("wip_db_file_size_bytes", "Size of the database file.", nil, nil),
+		openAlerts:        prometheus.NewDesc("wip_open_alerts", "Alerts that are not resolved or archived, by status.", []string{"status"}, nil),
+		overdueHeartbeats: prometheus.NewDesc("wip_overdue_heartbeat_checks", "Active api keys whose latest heartbeat is overdue.", nil, nil),
+	}
+}
+
+func (s *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.fileSize
+	ch <- s.openAlerts
+	ch <- s.overdueHeartbeats
+}
+
+func (s *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	fi, err := os.Stat(s.db.Path())
+	if err != nil {
+		logging.Errorf("Failed to stat database file: %s", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(s.fileSize, prometheus.GaugeValue, float64(fi.Size()))
+	}
+
+	counts, err := s.readCounts(time.Now())
+	if err != nil {
+		logging.Errorf("Failed to count alerts and heartbeats: %s", err)
+		return
+	}
+	for status, n := range counts.openAlerts {
+		ch <- prometheus.MustNewConstMetric(s.openAlerts, prometheus.GaugeValue, float64(n), string(status))
+	}
+	ch <- prometheus.MustNewConstMetric(s.overdueHeartbeats, prometheus.GaugeValue, float64(counts.overdueHeartbeats))
+}
+
+// readCounts returns the counts, counted again when older than the cache ttl
+func (s *storageCollector) readCounts(now time.Time) (*storageCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counts != nil && now.Sub(s.countedAt) < s.cfg.CacheTTL {
+		return s.counts, nil
+	}
+
+	openAlerts, err := countOpenAlerts(s.db)
+	if err != nil {
+		return nil, err
+	}
+	overdue, err := countOverdueHeartbeats(s.db, now.Add(-s.cfg.HeartbeatOverdue))
+	if err != nil {
+		return nil, err
+	}
+
+	s.counts = &storageCounts{openAlerts: openAlerts, overdueHeartbeats: overdue}
+	s.countedAt = now
+	return s.counts, nil
+}
+
+// countOpenAlerts counts the open alerts of all accounts by status. Every open status is included, also when there
+// are no such alerts.
+func countOpenAlerts(db *bolt.DB) (map[model.AlertStatus]int, error) {
+	counts := map[model.AlertStatus]int{
+		model.NewStatus:          0,
+		model.SeenStatus:         0,
+		model.AcknowledgedStatus: 0,
+		model.SnoozedStatus:      0,
+	}
+
+	accounts, err := model.ListAccounts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, account := range *accounts {
+		alerts, err := model.ListAlerts(db, account.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range *alerts {
+			if a.IsOpen() {
+				counts[a.Status]++
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+// countOverdueHeartbeats counts the active api keys of all accounts whose latest heartbeat was executed before
+// 'since'. Api keys that have never sent a heartbeat are not heartbeat checks and are not counted.
+func countOverdueHeartbeats(db *bolt.DB, since time.Time) (int, error) {
+	accounts, err := model.ListAccounts(db)
+	if err != nil {
+		return 0, err
+	}
+
+	var overdue int
+	for _, account := range *accounts {
+		apiKeys, err := model.ListAPIKeys(db, account.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		latest, err := model.LatestHeartbeatPerApiKey(db, account.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, hb := range *latest {
+			apiKey, ok := (*apiKeys)[hb.APIKeyID]
+			if !ok || apiKey.Status != model.APIKeyActive {
+				continue
+			}
+			if hb.ExecutedAt.Before(since) {
+				overdue++
+			}
+		}
+	}
+
+	return overdue, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(httpMetrics())
+	router.GET("/alerts/:id", func(c *gin.Context) {
+		c.Status(http.StatusNotFound)
+	})
+
+	counter := httpRequests.WithLabelValues("GET", "/alerts/:id", "404")
+	before := testutil.ToFloat64(counter)
+
+	for _, id := range []string{"a", "b"} {
+		req, _ := http.NewRequest("GET", "/alerts/"+id, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// counted by route, not by path
+	assert.Equal(before+2, testutil.ToFloat64(counter))
+}
+
+func TestIngestMetrics(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		apiKey := model.NewAPIKey()
+		apiKey.Save(db, "55")
+
+		inactive := model.NewAPIKey()
+		inactive.Status = model.APIKeyInactive
+		inactive.Save(db, "55")
+
+		trustedProxies, _ := model.ParseCIDRs([]string{"127.0.0.1/32"})
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(validateApiKey(db, trustedProxies))
+		router.POST("/alerts", CreateAlertRoute(db, nil, defaultConfig().Validation))
+		router.POST("/heartbeats", CreateHeartbeatRoute(db, nil, defaultConfig().Validation))
+
+		created := testutil.ToFloat64(alertsCreated.WithLabelValues("high"))
+		heartbeats := testutil.ToFloat64(heartbeatsReceived)
+		missing := testutil.ToFloat64(authFailures.WithLabelValues(missingAPIKeyFailure))
+		inactiveFailures := testutil.ToFloat64(authFailures.WithLabelValues(inactiveAPIKeyFailure))
+
+		post := func(path string, key string, body string) int {
+			req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+			if key != "" {
+				req.Header.Set("APIKey", key)
+			}
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			return res.Code
+		}
+
+		assert.Equal(201, post("/alerts", apiKey.ID, `{"title": "Disk full", "short_description": "/var is full", "long_description": "-", "priority": "high", "triggered_at": "2016-01-01T10:00:00Z"}`))
+		assert.Equal(201, post("/heartbeats", apiKey.ID, `{"executed_at": "2016-01-01T10:00:00Z"}`))
+		assert.Equal(401, post("/heartbeats", "", `{}`))
+		assert.Equal(401, post("/heartbeats", inactive.ID, `{}`))
+
+		assert.Equal(created+1, testutil.ToFloat64(alertsCreated.WithLabelValues("high")))
+		assert.Equal(heartbeats+1, testutil.ToFloat64(heartbeatsReceived))
+		assert.Equal(missing+1, testutil.ToFloat64(authFailures.WithLabelValues(missingAPIKeyFailure)))
+		assert.Equal(inactiveFailures+1, testutil.ToFloat64(authFailures.WithLabelValues(inactiveAPIKeyFailure)))
+	})
+}
+
+func TestStorageCollector(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		account := model.NewAccount()
+		assert.NoError(account.Save(db))
+
+		for _, status := range []model.AlertStatus{model.NewStatus, model.NewStatus, model.AcknowledgedStatus, model.ResolvedStatus} {
+			a := model.NewAlert("key")
+			a.Status = status
+			assert.NoError(a.Save(db, account.ID))
+		}
+
+		// a key heard from lately, an overdue key, an overdue inactive key and a key without heartbeats
+		recent := model.NewAPIKey()
+		overdue := model.NewAPIKey()
+		inactive := model.NewAPIKey()
+		inactive.Status = model.APIKeyInactive
+		for _, k := range []*model.APIKey{recent, overdue, inactive, model.NewAPIKey()} {
+			assert.NoError(k.Save(db, account.ID))
+		}
+		for key, age := range map[*model.APIKey]time.Duration{recent: time.Minute, overdue: 2 * time.Hour, inactive: 2 * time.Hour} {
+			hb := model.NewHeartbeat(key.ID)
+			hb.ExecutedAt = time.Now().Add(-age)
+			assert.NoError(hb.Save(db, account.ID))
+		}
+		old := model.NewHeartbeat(recent.ID)
+		old.ExecutedAt = time.Now().Add(-3 * time.Hour)
+		assert.NoError(old.Save(db, account.ID))
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(newStorageCollector(db, configMetrics{HeartbeatOverdue: time.Hour, CacheTTL: time.Hour}))
+
+		gather := func() (map[string]float64, float64, float64) {
+			families, err := reg.Gather()
+			assert.NoError(err)
+
+			open := map[string]float64{}
+			var size, overdue float64
+			for _, f := range families {
+				for _, m := range f.GetMetric() {
+					switch f.GetName() {
+					case "wip_open_alerts":
+						open[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+					case "wip_db_file_size_bytes":
+						size = m.GetGauge().GetValue()
+					case "wip_overdue_heartbeat_checks":
+						overdue = m.GetGauge().GetValue()
+					}
+				}
+			}
+			return open, size, overdue
+		}
+
+		open, size, overdueChecks := gather()
+		assert.Equal(map[string]float64{"new": 2, "seen": 0, "acknowledged": 1, "snoozed": 0}, open)
+		assert.True(size > 0)
+		assert.Equal(float64(1), overdueChecks)
+
+		// the counts are reused within the cache ttl
+		a := model.NewAlert("key")
+		assert.NoError(a.Save(db, account.ID))
+		open, _, _ = gather()
+		assert.Equal(float64(2), open["new"])
+	})
+}
@@ -5,12 +5,13 @@ import (
 	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/golang/glog"
+	"github.com/joakim666/wip_alerts/logging"
 	"github.com/twinj/uuid"
 )
 
 type Account struct {
 	ID        string             // uuid
+	Roles     []string           // roles granted to the account, the default role is used when empty
 	CreatedAt time.Time
 }
 
@@ -22,12 +23,18 @@ func NewAccount() *Account {
 	return &a
 }
 
+// GetAccount returns the account with the uuid, or nil if there is none
 func GetAccount(db *bolt.DB, uuid string) (*Account, error) {
 	var account Account
+	var found bool
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := boltView(db, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("Accounts"))
 		v := b.Get([]byte(uuid))
+		if v == nil {
+			return nil
+		}
+		found = true
 
 		err := deserialize(&v, &account)
 		if err != nil {
@@ -39,6 +46,9 @@ func GetAccount(db *bolt.DB, uuid string) (*Account, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to deserialize object: %s", err)
 	}
+	if !found {
+		return nil, nil
+	}
 
 	return &account, nil
 }
@@ -47,7 +57,7 @@ func GetAccount(db *bolt.DB, uuid string) (*Account, error) {
 func ListAccounts(db *bolt.DB) (*map[string]Account, error) {
 	accounts := make(map[string]Account)
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := boltView(db, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("Accounts"))
 
 		return b.ForEach(func(k, v []byte) error {
@@ -59,7 +69,6 @@ func ListAccounts(db *bolt.DB) (*map[string]Account, error) {
 			var a Account
 			err := deserialize(&v, &a)
 			if err != nil {
-				glog.Errorf("Failed to deserialize account: %s", err)
 				return fmt.Errorf("Failed to deserialize account: %s", err)
 			}
 			accounts[a.ID] = a
@@ -68,7 +77,6 @@ func ListAccounts(db *bolt.DB) (*map[string]Account, error) {
 		})
 	})
 	if err != nil {
-		glog.Errorf("Failed to get accounts: %s", err)
 		return nil, fmt.Errorf("Failed to get accounts: %s", err)
 	}
 
@@ -77,10 +85,9 @@ func ListAccounts(db *bolt.DB) (*map[string]Account, error) {
 
 // Save saves the account
 func (account *Account) Save(db *bolt.DB) error {
-	return db.Update(func(tx *bolt.Tx) error {
+	return boltUpdate(db, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("Accounts"))
 
-		glog.Infof("Saving account %s", account.ID)
 		err := BoltSaveObject(b, account.ID, account)
 		if err != nil {
 			return fmt.Errorf("Failed to save account: %s", err)
@@ -90,6 +97,30 @@ func (account *Account) Save(db *bolt.DB) error {
 	})
 }
 
+// GrantRole adds the role to the account. Returns false if the account already has the role.
+func (account *Account) GrantRole(role string) bool {
+	for _, r := range account.Roles {
+		if r == role {
+			return false
+		}
+	}
+
+	account.Roles = append(account.Roles, role)
+	return true
+}
+
+// RevokeRole removes the role from the account. Returns false if the account does not have the role.
+func (account *Account) RevokeRole(role string) bool {
+	for i, r := range account.Roles {
+		if r == role {
+			account.Roles = append(account.Roles[:i], account.Roles[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
 // Alerts returns the alerts for the account
 func (account *Account) Alerts(db *bolt.DB) (*map[string]Alert, error) {
 	return ListAlerts(db, account.ID)
@@ -99,3 +130,81 @@ func (account *Account) Alerts(db *bolt.DB) (*map[string]Alert, error) {
 func (account *Account) APIKeys(db *bolt.DB) (*map[string]APIKey, error) {
 	return ListAPIKeys(db, account.ID)
 }
+
+// AccountBuckets are the buckets holding objects of an account in a nested bucket named by the account uuid
+var AccountBuckets = []string{"Devices", "Renewals", "APIKeys", "Heartbeats", "Tokens", "Alerts", "Audit", "StreamEvents", "Integrations"}
+
+// DeleteAccount deletes the account and everything belonging to it, including the history of its alerts, in a single
+// transaction
+func DeleteAccount(db *bolt.DB, accountUUID string) error {
+	alerts, err := ListAlerts(db, accountUUID)
+	if err != nil {
+		return err
+	}
+
+	// the idempotency keys are scoped by the api keys of the account and by the account and its renewals for /tokens
+	scopes := []string{TokenIdempotencyScope("account", accountUUID)}
+	apiKeys, err := ListAPIKeys(db, accountUUID)
+	if err != nil {
+		return err
+	}
+	for id := range *apiKeys {
+		scopes = append(scopes, id)
+	}
+	renewals, err := ListRenewals(db, accountUUID)
+	if err != nil {
+		return err
+	}
+	for id := range *renewals {
+		scopes = append(scopes, TokenIdempotencyScope("renewal", id))
+	}
+
+	err = boltUpdate(db, func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("Accounts")).Get([]byte(accountUUID)) == nil {
+			return fmt.Errorf("No such account")
+		}
+
+		err := tx.Bucket([]byte("Accounts")).Delete([]byte(accountUUID))
+		if err != nil {
+			return err
+		}
+
+		for _, name := range AccountBuckets {
+			err := deleteNestedBucket(tx.Bucket([]byte(name)), accountUUID)
+			if err != nil {
+				return fmt.Errorf("Failed to delete %s: %s", name, err)
+			}
+		}
+
+		for id := range *alerts {
+			err := deleteNestedBucket(tx.Bucket([]byte("AlertEvents")), id)
+			if err != nil {
+				return fmt.Errorf("Failed to delete events of alert %s: %s", id, err)
+			}
+		}
+
+		for _, scope := range scopes {
+			err := deleteNestedBucket(tx.Bucket([]byte("IdempotencyKeys")), scope)
+			if err != nil {
+				return fmt.Errorf("Failed to delete idempotency keys: %s", err)
+			}
+		}
+
+		return tx.Bucket([]byte("AlertVersions")).Delete([]byte(accountUUID))
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to delete account %s: %s", accountUUID, err)
+	}
+
+	logging.Infof("Deleted account %s", accountUUID)
+
+	return nil
+}
+
+// deleteNestedBucket deletes the nested bucket if it exists
+func deleteNestedBucket(b *bolt.Bucket, name string) error {
+	if b.Bucket([]byte(name)) == nil {
+		return nil
+	}
+	return b.DeleteBucket([]byte(name))
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
 
@@ -64,3 +65,84 @@ func TestAccounts(t *testing.T) {
 		assert.Equal(*b, (*accounts)[b.ID])
 	})
 }
+
+func TestDeleteAccount(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		a := NewAccount()
+		assert.NoError(a.Save(db))
+		b := NewAccount()
+		assert.NoError(b.Save(db))
+
+		apiKey := NewAPIKey()
+		assert.NoError(apiKey.Save(db, a.ID))
+		otherKey := NewAPIKey()
+		assert.NoError(otherKey.Save(db, b.ID))
+		renewal := NewRenewal()
+		assert.NoError(renewal.Save(db, a.ID))
+
+		now := time.Now()
+		scopes := []string{apiKey.ID, TokenIdempotencyScope("account", a.ID), TokenIdempotencyScope("renewal", renewal.ID), otherKey.ID}
+		for _, scope := range scopes {
+			assert.NoError(SaveIdempotentResponse(db, scope, "idem1", &IdempotentResponse{Status: 201, ExpiresAt: now.Add(time.Hour)}))
+		}
+
+		alert := NewAlert(apiKey.ID)
+		assert.NoError(alert.Save(db, a.ID))
+		assert.NoError(NewAlertEvent(alert, AlertCreatedEvent, Actor{Type: APIKeyActor, ID: apiKey.ID}).Save(db))
+
+		assert.NoError(DeleteAccount(db, a.ID))
+
+		deleted, err := GetAccount(db, a.ID)
+		assert.NoError(err)
+		assert.Nil(deleted)
+
+		accounts, err := ListAccounts(db)
+		assert.NoError(err)
+		assert.Len(*accounts, 1)
+		assert.Contains(*accounts, b.ID)
+
+		keys, err := ListAPIKeys(db, a.ID)
+		assert.NoError(err)
+		assert.Empty(*keys)
+		alerts, err := ListAlerts(db, a.ID)
+		assert.NoError(err)
+		assert.Empty(*alerts)
+		events, err := ListAlertEvents(db, alert.ID)
+		assert.NoError(err)
+		assert.Empty(events)
+		version, err := AlertVersion(db, a.ID)
+		assert.NoError(err)
+		assert.Equal(uint64(0), version)
+		for _, scope := range scopes[:3] {
+			r, err := GetIdempotentResponse(db, scope, "idem1", now)
+			assert.NoError(err)
+			assert.Nil(r, scope)
+		}
+
+		// the other account is untouched
+		keys, err = ListAPIKeys(db, b.ID)
+		assert.NoError(err)
+		assert.Len(*keys, 1)
+		r, err := GetIdempotentResponse(db, otherKey.ID, "idem1", now)
+		assert.NoError(err)
+		assert.NotNil(r)
+
+		assert.Error(DeleteAccount(db, a.ID))
+	})
+}
+
+func TestAccountRoles(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAccount()
+	assert.True(a.GrantRole("admin"))
+	assert.False(a.GrantRole("admin"))
+	assert.True(a.GrantRole("user"))
+	assert.Equal([]string{"admin", "user"}, a.Roles)
+
+	assert.True(a.RevokeRole("admin"))
+	assert.False(a.RevokeRole("admin"))
+	assert.Equal([]string{"user"}, a.Roles)
+}
@@ -1,7 +1,9 @@
 package model
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -21,6 +23,9 @@ const (
 
 	NewStatus AlertStatus = "new"
 	SeenStatus AlertStatus = "seen"
+	AcknowledgedStatus AlertStatus = "acknowledged"
+	SnoozedStatus AlertStatus = "snoozed"
+	ResolvedStatus AlertStatus = "resolved"
 	ArchivedStatus AlertStatus = "archived"
 )
 
@@ -32,6 +37,9 @@ type Alert struct {
 	LongDescription  string
 	Priority         AlertPriority
 	Status		 AlertStatus
+	Labels           map[string]string // free-form key/value context like host, environment and team
+	Fingerprint      string // identifies the alert at its source, e.g. the Alertmanager fingerprint. Optional
+	SnoozedUntil     *time.Time // set when the status is SnoozedStatus
 	TriggeredAt      time.Time
 	CreatedAt        time.Time
 	UpdatedAt	 time.Time
@@ -41,9 +49,120 @@ func (a Alert) PersistanceID() string {
 	return a.ID
 }
 
-// Save the alert attached to the given accountUUID
+// Save the alert attached to the given accountUUID. The alert version of the account is increased in the same
+// transaction.
 func (a Alert) Save(db *bolt.DB, accountUUID string) error {
-	return BoltSaveAccountObjects(db, ParentID(accountUUID), "Alerts", BoltSingle(&a))
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		err := BoltSaveAccountObjectsTx(tx, ParentID(accountUUID), "Alerts", BoltSingle(&a))
+		if err != nil {
+			return err
+		}
+
+		return incrementAlertVersionTx(tx, accountUUID)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save alert for account %s: %s", accountUUID, err)
+	}
+
+	return nil
+}
+
+// SaveWithEvent saves the alert and the event of what happened to it in a single transaction, so that the history of
+// the alert is neither lost nor left without the alert. A stream event, AlertCreatedStreamEvent for an
+// AlertCreatedEvent and AlertUpdatedStreamEvent otherwise, is saved in the same transaction.
+func (a Alert) SaveWithEvent(db *bolt.DB, accountUUID string, event *AlertEvent) error {
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		return saveAlertWithEventTx(tx, accountUUID, &a, event)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save alert for account %s: %s", accountUUID, err)
+	}
+
+	return nil
+}
+
+// saveAlertWithEventTx is SaveWithEvent within the given transaction
+func saveAlertWithEventTx(tx *bolt.Tx, accountUUID string, a *Alert, event *AlertEvent) error {
+	err := BoltSaveAccountObjectsTx(tx, ParentID(accountUUID), "Alerts", BoltSingle(a))
+	if err != nil {
+		return err
+	}
+
+	err = BoltSaveAccountObjectsTx(tx, ParentID(event.AlertID), "AlertEvents", BoltSingle(event))
+	if err != nil {
+		return err
+	}
+
+	streamEventType := AlertUpdatedStreamEvent
+	if event.Type == AlertCreatedEvent {
+		streamEventType = AlertCreatedStreamEvent
+	}
+	err = appendAlertStreamEventTx(tx, accountUUID, streamEventType, a)
+	if err != nil {
+		return err
+	}
+
+	return incrementAlertVersionTx(tx, accountUUID)
+}
+
+// NewAccountAlert is a new alert of an account, created by 'Actor'
+type NewAccountAlert struct {
+	AccountUUID string
+	Alert       *Alert
+	Actor       Actor
+}
+
+// SaveNewAlerts saves new alerts of possibly different accounts in a single transaction, so that either all or none
+// of them are saved. An AlertCreatedEvent is saved for each alert and the alert version of each account is increased.
+func SaveNewAlerts(db *bolt.DB, alerts []NewAccountAlert) error {
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		for _, a := range alerts {
+			err := saveNewAlertsTx(tx, a.AccountUUID, []*Alert{a.Alert}, a.Actor)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save %d alerts: %s", len(alerts), err)
+	}
+
+	return nil
+}
+
+// saveNewAlertsTx saves new alerts of the account with an AlertCreatedEvent by 'actor' and an AlertCreatedStreamEvent
+// each, and increases the alert version of the account once
+func saveNewAlertsTx(tx *bolt.Tx, accountUUID string, alerts []*Alert, actor Actor) error {
+	nb, err := tx.Bucket([]byte("Alerts")).CreateBucketIfNotExists([]byte(accountUUID))
+	if err != nil {
+		return fmt.Errorf("Failed to create nested Alerts bucket for account %s: %s", accountUUID, err)
+	}
+	eb := tx.Bucket([]byte("AlertEvents"))
+
+	for _, a := range alerts {
+		err := BoltSaveObject(nb, a.ID, a)
+		if err != nil {
+			return err
+		}
+
+		event := NewAlertEvent(a, AlertCreatedEvent, actor)
+		aeb, err := eb.CreateBucketIfNotExists([]byte(a.ID))
+		if err != nil {
+			return fmt.Errorf("Failed to create nested AlertEvents bucket for alert %s: %s", a.ID, err)
+		}
+		err = BoltSaveObject(aeb, event.ID, event)
+		if err != nil {
+			return err
+		}
+
+		err = appendAlertStreamEventTx(tx, accountUUID, AlertCreatedStreamEvent, a)
+		if err != nil {
+			return err
+		}
+	}
+
+	return incrementAlertVersionTx(tx, accountUUID)
 }
 
 // NewAlert creates a new Alert. APIKeyID is mandatory
@@ -58,6 +177,65 @@ func NewAlert(apiKeyID string) *Alert {
 	return &a
 }
 
+// PriorityFromSeverity maps a priority or one of the commonly used severity names, like those of syslog and of the
+// severity label in Prometheus, to a priority. Unknown or empty severities give NormalPriority.
+func PriorityFromSeverity(severity string) AlertPriority {
+	switch strings.ToLower(strings.TrimSpace(severity)) {
+	case "high", "critical", "crit", "page", "error", "err", "emergency", "emerg", "alert", "fatal":
+		return HighPriority
+	case "low", "info", "informational", "notice", "debug", "none", "ok":
+		return LowPriority
+	default:
+		return NormalPriority
+	}
+}
+
+// IsOpen checks if the alert is neither resolved nor archived
+func (a Alert) IsOpen() bool {
+	return a.Status != ResolvedStatus && a.Status != ArchivedStatus
+}
+
+// HasLabels checks if the alert has all the given labels with matching values
+func (a Alert) HasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		l, ok := a.Labels[k]
+		if !ok || l != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ValidateLabels checks that all label keys are non-empty and do not contain ':' which is used as separator when
+// filtering on labels
+func ValidateLabels(labels map[string]string) error {
+	for k := range labels {
+		if k == "" {
+			return fmt.Errorf("Label key can not be empty")
+		}
+		if strings.Contains(k, ":") {
+			return fmt.Errorf("Label key %s can not contain ':'", k)
+		}
+	}
+
+	return nil
+}
+
+// MergeLabels returns a new map with the default labels overridden by the given labels
+func MergeLabels(defaults map[string]string, labels map[string]string) map[string]string {
+	m := make(map[string]string)
+
+	for k, v := range defaults {
+		m[k] = v
+	}
+	for k, v := range labels {
+		m[k] = v
+	}
+
+	return m
+}
+
 // GetAlert returns the alert with the given id and the account id it belongs to
 func GetAlert(db *bolt.DB, alertID string) (*Alert, *string, error) {
 	o, parentID, err := BoltGetObject(db, "Alerts", alertID, reflect.TypeOf(Alert{}))
@@ -111,3 +289,119 @@ func ListNonArchivedAlerts(db *bolt.DB, accountUUID string) (*map[string]Alert,
 
 	return &m2, nil
 }
+
+// FindOpenAlertByFingerprint returns the most recently created open alert of the account with the given fingerprint,
+// or nil if there is none
+func FindOpenAlertByFingerprint(db *bolt.DB, accountUUID string, fingerprint string) (*Alert, error) {
+	var found *Alert
+
+	err := boltView(db, func(tx *bolt.Tx) error {
+		var err error
+		found, err = findOpenAlertByFingerprintTx(tx, accountUUID, fingerprint)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find alert of account %s: %s", accountUUID, err)
+	}
+
+	return found, nil
+}
+
+// findOpenAlertByFingerprintTx is FindOpenAlertByFingerprint within the given transaction
+func findOpenAlertByFingerprintTx(tx *bolt.Tx, accountUUID string, fingerprint string) (*Alert, error) {
+	nb := tx.Bucket([]byte("Alerts")).Bucket([]byte(accountUUID)) // nested bucket
+	if nb == nil {
+		return nil, nil
+	}
+
+	var found *Alert
+	err := nb.ForEach(func(k, v []byte) error {
+		var a Alert
+		err := deserialize(&v, &a)
+		if err != nil {
+			return fmt.Errorf("Failed to deserialize alert: %s", err)
+		}
+		if a.Fingerprint != fingerprint || !a.IsOpen() {
+			return nil
+		}
+		if found == nil || a.CreatedAt.After(found.CreatedAt) {
+			found = &a
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// SaveFingerprintedAlert saves a new alert of the account with an AlertCreatedEvent by 'actor'. If the alert has a
+// fingerprint and the account has an open alert with the same fingerprint, that alert is instead updated with the
+// content of the new one and an AlertRetriggeredEvent is saved. The lookup and the save are done in a single
+// transaction, so that concurrent reports of the same fingerprint do not both create an alert. Returns the saved alert
+// and whether it was created.
+func SaveFingerprintedAlert(db *bolt.DB, accountUUID string, alert *Alert, actor Actor) (*Alert, bool, error) {
+	var saved *Alert
+	var created bool
+
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		var existing *Alert
+		if alert.Fingerprint != "" {
+			var err error
+			existing, err = findOpenAlertByFingerprintTx(tx, accountUUID, alert.Fingerprint)
+			if err != nil {
+				return err
+			}
+		}
+
+		if existing == nil {
+			saved, created = alert, true
+			return saveNewAlertsTx(tx, accountUUID, []*Alert{alert}, actor)
+		}
+
+		existing.Title = alert.Title
+		existing.ShortDescription = alert.ShortDescription
+		existing.LongDescription = alert.LongDescription
+		existing.Priority = alert.Priority
+		existing.Labels = alert.Labels
+		existing.TriggeredAt = alert.TriggeredAt
+		existing.UpdatedAt = time.Now()
+		saved, created = existing, false
+
+		return saveAlertWithEventTx(tx, accountUUID, existing, NewAlertEvent(existing, AlertRetriggeredEvent, actor))
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to save alert for account %s: %s", accountUUID, err)
+	}
+
+	return saved, created, nil
+}
+
+// ResolveFingerprintedAlert resolves the open alert of the account with the given fingerprint and saves its status
+// event by 'actor', in a single transaction. Returns nil if there is no such alert.
+func ResolveFingerprintedAlert(db *bolt.DB, accountUUID string, fingerprint string, actor Actor, now time.Time) (*Alert, error) {
+	var resolved *Alert
+
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		a, err := findOpenAlertByFingerprintTx(tx, accountUUID, fingerprint)
+		if err != nil || a == nil {
+			resolved = nil
+			return err
+		}
+
+		from := a.Status
+		err = a.Transition(ResolvedStatus, nil, now)
+		if err != nil {
+			return err
+		}
+		resolved = a
+
+		return saveAlertWithEventTx(tx, accountUUID, a, NewStatusEvent(a, from, actor))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve alert of account %s: %s", accountUUID, err)
+	}
+
+	return resolved, nil
+}
@@ -1,7 +1,9 @@
 package model
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/assert"
@@ -53,3 +55,182 @@ func TestAlerts(t *testing.T) {
 		assert.Equal(*a2, (*alerts)[a2.ID])
 	})
 }
+
+func TestAlertHasLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAlert("apiid")
+	assert.True(a.HasLabels(nil))
+	assert.False(a.HasLabels(map[string]string{"env": "prod"}))
+
+	a.Labels = map[string]string{"env": "prod", "host": "web1"}
+	assert.True(a.HasLabels(map[string]string{"env": "prod"}))
+	assert.True(a.HasLabels(map[string]string{"env": "prod", "host": "web1"}))
+	assert.False(a.HasLabels(map[string]string{"env": "test"}))
+	assert.False(a.HasLabels(map[string]string{"env": "prod", "team": "ops"}))
+}
+
+func TestMergeLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	m := MergeLabels(map[string]string{"env": "prod", "team": "ops"}, map[string]string{"env": "test", "host": "web1"})
+	assert.Equal(map[string]string{"env": "test", "team": "ops", "host": "web1"}, m)
+
+	assert.Equal(map[string]string{}, MergeLabels(nil, nil))
+}
+
+func TestValidateLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateLabels(nil))
+	assert.NoError(ValidateLabels(map[string]string{"env": ""}))
+	assert.Error(ValidateLabels(map[string]string{"": "prod"}))
+	assert.Error(ValidateLabels(map[string]string{"env:x": "prod"}))
+}
+
+func TestFindOpenAlertByFingerprint(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		a, err := FindOpenAlertByFingerprint(db, "foo", "fp1")
+		assert.NoError(err)
+		assert.Nil(a)
+
+		a1 := NewAlert("APIKeyID1")
+		a1.Fingerprint = "fp1"
+		a1.Status = ResolvedStatus
+		assert.NoError(a1.Save(db, "foo"))
+
+		a2 := NewAlert("APIKeyID1")
+		a2.Fingerprint = "fp1"
+		assert.NoError(a2.Save(db, "foo"))
+
+		a3 := NewAlert("APIKeyID1")
+		a3.Fingerprint = "fp2"
+		assert.NoError(a3.Save(db, "foo"))
+
+		// resolved alerts are not open
+		a, err = FindOpenAlertByFingerprint(db, "foo", "fp1")
+		assert.NoError(err)
+		assert.NotNil(a)
+		assert.Equal(a2.ID, a.ID)
+
+		// other accounts are not searched
+		a, err = FindOpenAlertByFingerprint(db, "bar", "fp1")
+		assert.NoError(err)
+		assert.Nil(a)
+	})
+}
+
+func TestPriorityFromSeverity(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(HighPriority, PriorityFromSeverity("high"))
+	assert.Equal(HighPriority, PriorityFromSeverity("critical"))
+	assert.Equal(HighPriority, PriorityFromSeverity(" Page "))
+	assert.Equal(HighPriority, PriorityFromSeverity("error"))
+	assert.Equal(HighPriority, PriorityFromSeverity("alert"))
+	assert.Equal(NormalPriority, PriorityFromSeverity("normal"))
+	assert.Equal(NormalPriority, PriorityFromSeverity("warning"))
+	assert.Equal(NormalPriority, PriorityFromSeverity(""))
+	assert.Equal(LowPriority, PriorityFromSeverity("low"))
+	assert.Equal(LowPriority, PriorityFromSeverity("info"))
+	assert.Equal(LowPriority, PriorityFromSeverity("none"))
+}
+
+func TestSaveNewAlerts(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		a1 := NewAlert("APIKeyID1")
+		a2 := NewAlert("APIKeyID2")
+
+		assert.NoError(SaveNewAlerts(db, []NewAccountAlert{
+			{AccountUUID: "foo", Alert: a1, Actor: Actor{Type: APIKeyActor, ID: "APIKeyID1"}},
+			{AccountUUID: "bar", Alert: a2, Actor: Actor{Type: APIKeyActor, ID: "APIKeyID2"}},
+		}))
+
+		alerts, err := ListAlerts(db, "foo")
+		assert.NoError(err)
+		assert.Equal(1, len(*alerts))
+		assert.Contains(*alerts, a1.ID)
+
+		alerts, err = ListAlerts(db, "bar")
+		assert.NoError(err)
+		assert.Equal(1, len(*alerts))
+		assert.Contains(*alerts, a2.ID)
+
+		events, err := ListAlertEvents(db, a2.ID)
+		assert.NoError(err)
+		if assert.Equal(1, len(events)) {
+			assert.Equal(Actor{Type: APIKeyActor, ID: "APIKeyID2"}, events[0].Actor)
+		}
+
+		version, err := AlertVersion(db, "bar")
+		assert.NoError(err)
+		assert.Equal(uint64(1), version)
+	})
+}
+
+func TestSaveFingerprintedAlert(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		actor := Actor{Type: APIKeyActor, ID: "APIKeyID1"}
+
+		// concurrent reports of the same fingerprint create a single alert
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		creates := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a := NewAlert("APIKeyID1")
+				a.Fingerprint = "fp1"
+				_, created, err := SaveFingerprintedAlert(db, "foo", a, actor)
+				assert.NoError(err)
+				if created {
+					mu.Lock()
+					creates++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(1, creates)
+
+		alerts, err := ListAlerts(db, "foo")
+		assert.NoError(err)
+		assert.Equal(1, len(*alerts))
+
+		a := NewAlert("APIKeyID1")
+		a.Fingerprint = "fp1"
+		a.Title = "again"
+		saved, created, err := SaveFingerprintedAlert(db, "foo", a, actor)
+		assert.NoError(err)
+		assert.False(created)
+		assert.NotEqual(a.ID, saved.ID)
+		assert.Equal("again", saved.Title)
+
+		events, err := ListAlertEvents(db, saved.ID)
+		assert.NoError(err)
+		assert.Equal(11, len(events))
+
+		// the resolved alert is no longer updated
+		resolved, err := ResolveFingerprintedAlert(db, "foo", "fp1", actor, time.Now())
+		assert.NoError(err)
+		if assert.NotNil(resolved) {
+			assert.Equal(saved.ID, resolved.ID)
+			assert.Equal(ResolvedStatus, resolved.Status)
+		}
+
+		resolved, err = ResolveFingerprintedAlert(db, "foo", "fp1", actor, time.Now())
+		assert.NoError(err)
+		assert.Nil(resolved)
+
+		_, created, err = SaveFingerprintedAlert(db, "foo", a, actor)
+		assert.NoError(err)
+		assert.True(created)
+	})
+}
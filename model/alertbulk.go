@@ -0,0 +1,156 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/logging"
+)
+
+// AlertFilter selects alerts in bulk operations. Empty fields are not used in the matching.
+type AlertFilter struct {
+	Priority  AlertPriority
+	APIKeyID  string
+	Labels    map[string]string
+	OlderThan *time.Time // only alerts created before this time
+}
+
+// Matches checks if the alert matches all fields set in the filter
+func (f AlertFilter) Matches(a *Alert) bool {
+	if f.Priority != "" && f.Priority != a.Priority {
+		return false
+	}
+	if f.APIKeyID != "" && f.APIKeyID != a.APIKeyID {
+		return false
+	}
+	if f.OlderThan != nil && !a.CreatedAt.Before(*f.OlderThan) {
+		return false
+	}
+
+	return a.HasLabels(f.Labels)
+}
+
+// BulkResult is the outcome of a bulk operation for a single alert
+type BulkResult struct {
+	AlertID string
+	Alert   *Alert // the updated alert, nil if the operation failed
+	Err     error
+}
+
+// BulkTransitionAlerts changes the status of several alerts of an account in a single transaction, using the same
+// transition rules as Alert.Transition. The alerts are either given by 'alertIDs' or, if 'filter' is not nil, all
+// alerts matching the filter that do not already have the status 'to'. A failing alert does not stop the others. A
+// status event and a stream event are saved for each changed alert. The transition is logged with the logger of
+// 'ctx'.
+func BulkTransitionAlerts(ctx context.Context, db *bolt.DB, accountUUID string, alertIDs []string, filter *AlertFilter, to AlertStatus, snoozedUntil *time.Time, actor Actor) ([]BulkResult, error) {
+	var results []BulkResult
+	now := time.Now()
+
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		results = nil // in case the transaction is retried
+		changed := false
+
+		nb := tx.Bucket([]byte("Alerts")).Bucket([]byte(accountUUID)) // nested bucket
+		eb := tx.Bucket([]byte("AlertEvents"))
+
+		// the alerts to change, nil for ids without a matching alert
+		var ids []string
+		var alerts []*Alert
+		if filter != nil {
+			if nb != nil {
+				err := nb.ForEach(func(k, v []byte) error {
+					var a Alert
+					err := deserialize(&v, &a)
+					if err != nil {
+						return fmt.Errorf("Failed to deserialize alert: %s", err)
+					}
+					if a.Status != to && filter.Matches(&a) {
+						ids = append(ids, a.ID)
+						alerts = append(alerts, &a)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			seen := make(map[string]bool)
+			for _, id := range alertIDs {
+				// an alert given twice is changed once
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+
+				var v []byte
+				if nb != nil {
+					v = nb.Get([]byte(id))
+				}
+
+				var a *Alert
+				if v != nil {
+					a = &Alert{}
+					err := deserialize(&v, a)
+					if err != nil {
+						return fmt.Errorf("Failed to deserialize alert: %s", err)
+					}
+				}
+				ids = append(ids, id)
+				alerts = append(alerts, a)
+			}
+		}
+
+		for i, a := range alerts {
+			if a == nil {
+				results = append(results, BulkResult{AlertID: ids[i], Err: fmt.Errorf("No alert with id %s", ids[i])})
+				continue
+			}
+
+			from := a.Status
+			err := a.Transition(to, snoozedUntil, now)
+			if err != nil {
+				results = append(results, BulkResult{AlertID: a.ID, Err: err})
+				continue
+			}
+
+			err = BoltSaveObject(nb, a.ID, a)
+			if err != nil {
+				return err
+			}
+
+			event := NewStatusEvent(a, from, actor)
+			aeb, err := eb.CreateBucketIfNotExists([]byte(a.ID))
+			if err != nil {
+				return fmt.Errorf("Failed to create nested AlertEvents bucket for alert %s: %s", a.ID, err)
+			}
+			err = BoltSaveObject(aeb, event.ID, event)
+			if err != nil {
+				return err
+			}
+
+			err = appendAlertStreamEventTx(tx, accountUUID, AlertUpdatedStreamEvent, a)
+			if err != nil {
+				return err
+			}
+
+			results = append(results, BulkResult{AlertID: a.ID, Alert: a})
+			changed = true
+		}
+
+		if changed {
+			return incrementAlertVersionTx(tx, accountUUID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to update alerts for account %s: %s", accountUUID, err)
+	}
+
+	logging.FromContext(ctx).Infof("Bulk transition to %s of %d alerts for account %s", to, len(results), accountUUID)
+
+	return results, nil
+}
@@ -0,0 +1,101 @@
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertFilterMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAlert("APIKeyID1")
+	a.Priority = HighPriority
+	a.Labels = map[string]string{"env": "prod"}
+
+	later := a.CreatedAt.Add(time.Minute)
+	earlier := a.CreatedAt.Add(-time.Minute)
+
+	assert.True(AlertFilter{}.Matches(a))
+	assert.True(AlertFilter{Priority: HighPriority, APIKeyID: "APIKeyID1"}.Matches(a))
+	assert.True(AlertFilter{Labels: map[string]string{"env": "prod"}, OlderThan: &later}.Matches(a))
+	assert.False(AlertFilter{Priority: LowPriority}.Matches(a))
+	assert.False(AlertFilter{APIKeyID: "APIKeyID2"}.Matches(a))
+	assert.False(AlertFilter{Labels: map[string]string{"env": "test"}}.Matches(a))
+	assert.False(AlertFilter{OlderThan: &earlier}.Matches(a))
+}
+
+func TestBulkTransitionAlerts(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		actor := Actor{Type: AccountActor, ID: "foo"}
+
+		a1 := NewAlert("APIKeyID1")
+		a1.Priority = HighPriority
+		a1.Save(db, "foo")
+
+		a2 := NewAlert("APIKeyID1")
+		a2.Priority = LowPriority
+		a2.Status = ArchivedStatus
+		a2.Save(db, "foo")
+
+		a3 := NewAlert("APIKeyID2")
+		a3.Priority = HighPriority
+		a3.Save(db, "bar")
+
+		// by ids, including one belonging to another account
+		results, err := BulkTransitionAlerts(context.Background(), db, "foo", []string{a1.ID, a2.ID, a3.ID}, nil, SeenStatus, nil, actor)
+		assert.NoError(err)
+		assert.Equal(3, len(results))
+
+		assert.Equal(a1.ID, results[0].AlertID)
+		assert.NoError(results[0].Err)
+		assert.Equal(SeenStatus, results[0].Alert.Status)
+
+		assert.Equal(a2.ID, results[1].AlertID)
+		assert.Error(results[1].Err) // archived -> seen is not allowed
+
+		assert.Equal(a3.ID, results[2].AlertID)
+		assert.Error(results[2].Err)
+
+		a, _, err := GetAlert(db, a1.ID)
+		assert.NoError(err)
+		assert.Equal(SeenStatus, a.Status)
+
+		a, _, err = GetAlert(db, a3.ID)
+		assert.NoError(err)
+		assert.Equal(NewStatus, a.Status)
+
+		events, err := ListAlertEvents(db, a1.ID)
+		assert.NoError(err)
+		assert.Equal(1, len(events))
+		assert.Equal(AlertSeenEvent, events[0].Type)
+		assert.Equal(actor, events[0].Actor)
+
+		// by filter, already archived alerts are left alone
+		results, err = BulkTransitionAlerts(context.Background(), db, "foo", nil, &AlertFilter{}, ArchivedStatus, nil, actor)
+		assert.NoError(err)
+		assert.Equal(1, len(results))
+		assert.Equal(a1.ID, results[0].AlertID)
+		assert.NoError(results[0].Err)
+
+		// by filter for an account without alerts
+		results, err = BulkTransitionAlerts(context.Background(), db, "baz", nil, &AlertFilter{}, ArchivedStatus, nil, actor)
+		assert.NoError(err)
+		assert.Equal(0, len(results))
+
+		// an alert given twice is changed once
+		results, err = BulkTransitionAlerts(context.Background(), db, "foo", []string{a1.ID, a1.ID}, nil, NewStatus, nil, actor)
+		assert.NoError(err)
+		if assert.Equal(1, len(results)) {
+			assert.NoError(results[0].Err)
+		}
+		events, err = ListAlertEvents(db, a1.ID)
+		assert.NoError(err)
+		assert.Equal(3, len(events))
+	})
+}
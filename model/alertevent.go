@@ -0,0 +1,122 @@
+package model
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/twinj/uuid"
+)
+
+// AlertEventType describes what happened to an alert
+type AlertEventType string
+
+// ActorType describes who caused an alert event
+type ActorType string
+
+const (
+	AlertCreatedEvent      AlertEventType = "created"
+	AlertSeenEvent         AlertEventType = "seen"
+	AlertAcknowledgedEvent AlertEventType = "acknowledged"
+	AlertSnoozedEvent      AlertEventType = "snoozed"
+	AlertResolvedEvent     AlertEventType = "resolved"
+	AlertArchivedEvent     AlertEventType = "archived"
+	AlertReopenedEvent     AlertEventType = "reopened"
+	AlertRetriggeredEvent  AlertEventType = "retriggered" // the alert was reported again by its source
+	AlertNotifiedEvent     AlertEventType = "notified"    // a device notified its user about the alert
+
+	AccountActor ActorType = "account"
+	DeviceActor  ActorType = "device"
+	APIKeyActor  ActorType = "api_key"
+	SystemActor  ActorType = "system" // e.g. background jobs
+)
+
+// Actor identifies who caused an alert event
+type Actor struct {
+	Type ActorType
+	ID   string // uuid of the account, device or api key. Empty for SystemActor
+}
+
+// AlertEvent is an entry in the append-only history of an alert
+type AlertEvent struct {
+	ID         string // uuid
+	AlertID    string // uuid of the alert this event belongs to
+	Type       AlertEventType
+	FromStatus AlertStatus // the status before the event, empty for AlertCreatedEvent
+	ToStatus   AlertStatus // the status after the event
+	Actor      Actor
+	CreatedAt  time.Time
+}
+
+// PersistanceID is used by the persistance layer
+func (e AlertEvent) PersistanceID() string {
+	return e.ID
+}
+
+// Save the event. Events are stored per alert and are never changed once saved.
+func (e AlertEvent) Save(db *bolt.DB) error {
+	return BoltSaveAccountObjects(db, ParentID(e.AlertID), "AlertEvents", BoltSingle(&e))
+}
+
+// NewAlertEvent creates a new event of the given type for the alert
+func NewAlertEvent(alert *Alert, eventType AlertEventType, actor Actor) *AlertEvent {
+	var e AlertEvent
+	uuid := uuid.NewV4()
+	e.ID = uuid.String()
+	e.AlertID = alert.ID
+	e.Type = eventType
+	e.ToStatus = alert.Status
+	e.Actor = actor
+	e.CreatedAt = time.Now()
+	return &e
+}
+
+// NewStatusEvent creates an event for a status transition of the alert from the status 'from' to its current status
+func NewStatusEvent(alert *Alert, from AlertStatus, actor Actor) *AlertEvent {
+	e := NewAlertEvent(alert, StatusEventType(alert.Status), actor)
+	e.FromStatus = from
+	return e
+}
+
+// StatusEventType returns the event type recorded when an alert changes into the given status
+func StatusEventType(to AlertStatus) AlertEventType {
+	switch to {
+	case SeenStatus:
+		return AlertSeenEvent
+	case AcknowledgedStatus:
+		return AlertAcknowledgedEvent
+	case SnoozedStatus:
+		return AlertSnoozedEvent
+	case ResolvedStatus:
+		return AlertResolvedEvent
+	case ArchivedStatus:
+		return AlertArchivedEvent
+	default:
+		return AlertReopenedEvent
+	}
+}
+
+// ListAlertEvents returns the history of the alert ordered from oldest to newest
+func ListAlertEvents(db *bolt.DB, alertID string) ([]AlertEvent, error) {
+	m, err := BoltGetAccountObjects(db, ParentID(alertID), "AlertEvents", reflect.TypeOf(AlertEvent{}))
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]AlertEvent, 0, len(*m))
+	for _, v := range *m {
+		e := v.(*AlertEvent)
+		events = append(events, *e)
+	}
+
+	sort.Sort(alertEventsByTime(events))
+
+	return events, nil
+}
+
+type alertEventsByTime []AlertEvent
+
+func (a alertEventsByTime) Len() int           { return len(a) }
+func (a alertEventsByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a alertEventsByTime) Less(i, j int) bool { return a[i].CreatedAt.Before(a[j].CreatedAt) }
@@ -0,0 +1,83 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertEvents(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		a := NewAlert("APIKeyID1")
+
+		// should be empty
+		events, err := ListAlertEvents(db, a.ID)
+		assert.NoError(err)
+		assert.Equal(0, len(events))
+
+		e1 := NewAlertEvent(a, AlertCreatedEvent, Actor{Type: APIKeyActor, ID: "APIKeyID1"})
+		assert.NoError(e1.Save(db))
+
+		assert.NoError(a.Transition(ArchivedStatus, nil, time.Now()))
+		e2 := NewStatusEvent(a, NewStatus, Actor{Type: AccountActor, ID: "foo"})
+		e2.CreatedAt = e1.CreatedAt.Add(time.Second)
+		assert.NoError(e2.Save(db))
+
+		// events of other alerts should not be included
+		assert.NoError(NewAlertEvent(NewAlert("APIKeyID1"), AlertCreatedEvent, Actor{Type: SystemActor}).Save(db))
+
+		events, err = ListAlertEvents(db, a.ID)
+		assert.NoError(err)
+		assert.Equal(2, len(events))
+
+		assert.Equal(e1.ID, events[0].ID)
+		assert.Equal(AlertCreatedEvent, events[0].Type)
+		assert.Equal(AlertStatus(""), events[0].FromStatus)
+		assert.Equal(NewStatus, events[0].ToStatus)
+		assert.Equal(Actor{Type: APIKeyActor, ID: "APIKeyID1"}, events[0].Actor)
+
+		assert.Equal(e2.ID, events[1].ID)
+		assert.Equal(AlertArchivedEvent, events[1].Type)
+		assert.Equal(NewStatus, events[1].FromStatus)
+		assert.Equal(ArchivedStatus, events[1].ToStatus)
+		assert.Equal(Actor{Type: AccountActor, ID: "foo"}, events[1].Actor)
+	})
+}
+
+func TestSaveAlertWithEvent(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		a := NewAlert("APIKeyID1")
+		e := NewAlertEvent(a, AlertCreatedEvent, Actor{Type: APIKeyActor, ID: "APIKeyID1"})
+		assert.NoError(a.SaveWithEvent(db, "55", e))
+
+		alert, accountID, err := GetAlert(db, a.ID)
+		assert.NoError(err)
+		assert.NotNil(alert)
+		assert.Equal("55", *accountID)
+
+		events, err := ListAlertEvents(db, a.ID)
+		assert.NoError(err)
+		if assert.Equal(1, len(events)) {
+			assert.Equal(e.ID, events[0].ID)
+		}
+
+		version, err := AlertVersion(db, "55")
+		assert.NoError(err)
+		assert.Equal(uint64(1), version)
+	})
+}
+
+func TestStatusEventType(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(AlertSeenEvent, StatusEventType(SeenStatus))
+	assert.Equal(AlertSnoozedEvent, StatusEventType(SnoozedStatus))
+	assert.Equal(AlertArchivedEvent, StatusEventType(ArchivedStatus))
+	assert.Equal(AlertReopenedEvent, StatusEventType(NewStatus))
+}
@@ -0,0 +1,187 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/logging"
+)
+
+// ErrInvalidTransition is returned when trying to do a status transition that is not allowed
+var ErrInvalidTransition = errors.New("Status transition not allowed")
+
+// alertTransitions maps each status to the statuses an alert with that status may be changed into
+var alertTransitions = map[AlertStatus][]AlertStatus{
+	NewStatus:          {SeenStatus, AcknowledgedStatus, SnoozedStatus, ResolvedStatus, ArchivedStatus},
+	SeenStatus:         {AcknowledgedStatus, SnoozedStatus, ResolvedStatus, ArchivedStatus},
+	AcknowledgedStatus: {SnoozedStatus, ResolvedStatus, ArchivedStatus},
+	SnoozedStatus:      {NewStatus, AcknowledgedStatus, ResolvedStatus, ArchivedStatus},
+	ResolvedStatus:     {NewStatus, ArchivedStatus},
+	ArchivedStatus:     {NewStatus},
+}
+
+// AllowedTransitions returns the statuses an alert with the given status may be changed into
+func AllowedTransitions(from AlertStatus) []AlertStatus {
+	allowed := alertTransitions[from]
+	res := make([]AlertStatus, len(allowed))
+	copy(res, allowed)
+	return res
+}
+
+// CanTransition checks if an alert may change status from 'from' to 'to'
+func CanTransition(from AlertStatus, to AlertStatus) bool {
+	for _, s := range alertTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Transition changes the status of the alert if the transition is allowed. 'snoozedUntil' is mandatory and must be in
+// the future when changing into SnoozedStatus, and is ignored otherwise.
+func (a *Alert) Transition(to AlertStatus, snoozedUntil *time.Time, now time.Time) error {
+	if !CanTransition(a.Status, to) {
+		return fmt.Errorf("%s: from %s to %s", ErrInvalidTransition, a.Status, to)
+	}
+
+	if to == SnoozedStatus {
+		if snoozedUntil == nil || !snoozedUntil.After(now) {
+			return fmt.Errorf("%s: snoozing requires a time in the future", ErrInvalidTransition)
+		}
+		t := *snoozedUntil
+		a.SnoozedUntil = &t
+	} else {
+		a.SnoozedUntil = nil
+	}
+
+	a.Status = to
+	a.UpdatedAt = now
+
+	return nil
+}
+
+// SnoozeExpired checks if the alert is snoozed and the snooze has expired at the given time
+func (a Alert) SnoozeExpired(now time.Time) bool {
+	return a.Status == SnoozedStatus && a.SnoozedUntil != nil && !a.SnoozedUntil.After(now)
+}
+
+// WakeSnoozedAlerts returns all snoozed alerts, for all accounts, whose snooze has expired at the given time to
+// NewStatus. The status and stream events of the alerts are saved and the alert versions of the accounts are increased in the
+// same transaction. The alerts are looked for in a read-only transaction so that writers are only blocked when there
+// are alerts to wake. Returns the woken alerts per account id.
+func WakeSnoozedAlerts(db *bolt.DB, now time.Time) (map[string][]Alert, error) {
+	due, err := findExpiredSnoozes(db, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(due) == 0 {
+		return map[string][]Alert{}, nil
+	}
+
+	var woken map[string][]Alert
+
+	err = boltUpdate(db, func(tx *bolt.Tx) error {
+		woken = make(map[string][]Alert) // in case the transaction is retried
+
+		for accountID, ids := range due {
+			nb := tx.Bucket([]byte("Alerts")).Bucket([]byte(accountID)) // nested bucket
+			if nb == nil {
+				continue
+			}
+
+			for _, id := range ids {
+				// the alert may have changed since it was found
+				v := nb.Get([]byte(id))
+				if v == nil {
+					continue
+				}
+				var a Alert
+				err := deserialize(&v, &a)
+				if err != nil {
+					return fmt.Errorf("Failed to deserialize alert: %s", err)
+				}
+				if !a.SnoozeExpired(now) {
+					continue
+				}
+
+				err = a.Transition(NewStatus, nil, now)
+				if err != nil {
+					return err
+				}
+				err = BoltSaveObject(nb, a.ID, &a)
+				if err != nil {
+					return err
+				}
+				woken[accountID] = append(woken[accountID], a)
+			}
+		}
+
+		for accountID, alerts := range woken {
+			for i := range alerts {
+				event := NewStatusEvent(&alerts[i], SnoozedStatus, Actor{Type: SystemActor})
+				err := BoltSaveAccountObjectsTx(tx, ParentID(event.AlertID), "AlertEvents", BoltSingle(event))
+				if err != nil {
+					return fmt.Errorf("Failed to save event for alert %s: %s", event.AlertID, err)
+				}
+
+				err = appendAlertStreamEventTx(tx, accountID, AlertUpdatedStreamEvent, &alerts[i])
+				if err != nil {
+					return err
+				}
+			}
+
+			err := incrementAlertVersionTx(tx, accountID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to update snoozed alerts: %s", err)
+	}
+
+	for accountID, alerts := range woken {
+		for _, a := range alerts {
+			logging.Infof("Snooze of alert %s for account %s expired", a.ID, accountID)
+		}
+	}
+
+	return woken, nil
+}
+
+// findExpiredSnoozes returns the ids of the snoozed alerts whose snooze has expired at the given time per account id
+func findExpiredSnoozes(db *bolt.DB, now time.Time) (map[string][]string, error) {
+	due := make(map[string][]string)
+
+	err := boltView(db, func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Alerts")).ForEach(func(accountID, v []byte) error {
+			nb := tx.Bucket([]byte("Alerts")).Bucket(accountID) // nested bucket
+			if nb == nil {
+				return nil
+			}
+
+			return nb.ForEach(func(k, v []byte) error {
+				var a Alert
+				err := deserialize(&v, &a)
+				if err != nil {
+					return fmt.Errorf("Failed to deserialize alert: %s", err)
+				}
+				if a.SnoozeExpired(now) {
+					due[string(accountID)] = append(due[string(accountID)], a.ID)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find snoozed alerts: %s", err)
+	}
+
+	return due, nil
+}
@@ -0,0 +1,122 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanTransition(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(CanTransition(NewStatus, SeenStatus))
+	assert.True(CanTransition(NewStatus, ArchivedStatus))
+	assert.True(CanTransition(SeenStatus, ArchivedStatus))
+	assert.True(CanTransition(ArchivedStatus, NewStatus))
+	assert.True(CanTransition(SnoozedStatus, NewStatus))
+	assert.False(CanTransition(SeenStatus, NewStatus))
+	assert.False(CanTransition(ArchivedStatus, SeenStatus))
+	assert.False(CanTransition(NewStatus, NewStatus))
+	assert.False(CanTransition("apa", NewStatus))
+	assert.False(CanTransition(NewStatus, "apa"))
+
+	assert.Equal([]AlertStatus{NewStatus}, AllowedTransitions(ArchivedStatus))
+	assert.Equal([]AlertStatus{}, AllowedTransitions("apa"))
+}
+
+func TestAlertTransition(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	a := NewAlert("apiid")
+
+	// snoozing requires a time in the future
+	assert.Error(a.Transition(SnoozedStatus, nil, now))
+	past := now.Add(-time.Minute)
+	assert.Error(a.Transition(SnoozedStatus, &past, now))
+	assert.Equal(NewStatus, a.Status)
+
+	until := now.Add(time.Hour)
+	assert.NoError(a.Transition(SnoozedStatus, &until, now))
+	assert.Equal(SnoozedStatus, a.Status)
+	assert.Equal(until, *a.SnoozedUntil)
+	assert.Equal(now, a.UpdatedAt)
+	assert.False(a.SnoozeExpired(now))
+	assert.True(a.SnoozeExpired(until))
+
+	assert.NoError(a.Transition(AcknowledgedStatus, nil, now))
+	assert.Nil(a.SnoozedUntil)
+
+	err := a.Transition(NewStatus, nil, now)
+	assert.Error(err)
+	assert.Contains(err.Error(), ErrInvalidTransition.Error())
+	assert.Equal(AcknowledgedStatus, a.Status)
+}
+
+func TestWakeSnoozedAlerts(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		now := time.Now()
+
+		soon := now.Add(time.Minute)
+		later := now.Add(time.Hour)
+
+		a1 := NewAlert("APIKeyID1")
+		assert.NoError(a1.Transition(SnoozedStatus, &soon, now))
+		a1.Save(db, "foo")
+
+		a2 := NewAlert("APIKeyID1")
+		assert.NoError(a2.Transition(SnoozedStatus, &later, now))
+		a2.Save(db, "bar")
+
+		a3 := NewAlert("APIKeyID1")
+		a3.Save(db, "bar")
+
+		// without expired snoozes the alerts are only read
+		writes := 0
+		TxObserver = func(write bool, d time.Duration) {
+			if write {
+				writes++
+			}
+		}
+		woken, err := WakeSnoozedAlerts(db, now)
+		TxObserver = nil
+		assert.NoError(err)
+		assert.Equal(0, len(woken))
+		assert.Equal(0, writes)
+
+		woken, err = WakeSnoozedAlerts(db, now.Add(2*time.Minute))
+		assert.NoError(err)
+		assert.Equal(1, len(woken))
+		assert.Equal(1, len(woken["foo"]))
+		assert.Equal(a1.ID, woken["foo"][0].ID)
+
+		a, _, err := GetAlert(db, a1.ID)
+		assert.NoError(err)
+		assert.Equal(NewStatus, a.Status)
+		assert.Nil(a.SnoozedUntil)
+
+		// the event and the new alert version are saved with the alert
+		events, err := ListAlertEvents(db, a1.ID)
+		assert.NoError(err)
+		if assert.Len(events, 1) {
+			assert.Equal(SnoozedStatus, events[0].FromStatus)
+			assert.Equal(NewStatus, events[0].ToStatus)
+			assert.Equal(Actor{Type: SystemActor}, events[0].Actor)
+		}
+		version, err := AlertVersion(db, "foo")
+		assert.NoError(err)
+		assert.Equal(uint64(2), version)
+
+		a, _, err = GetAlert(db, a2.ID)
+		assert.NoError(err)
+		assert.Equal(SnoozedStatus, a.Status)
+
+		woken, err = WakeSnoozedAlerts(db, now.Add(2*time.Hour))
+		assert.NoError(err)
+		assert.Equal(1, len(woken["bar"]))
+	})
+}
@@ -0,0 +1,54 @@
+package model
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// AlertVersion returns the change counter of the alerts of the account. The counter is increased every time an alert
+// of the account is saved, so clients can use it to check if anything has changed.
+func AlertVersion(db *bolt.DB, accountUUID string) (uint64, error) {
+	var version uint64
+
+	err := boltView(db, func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("AlertVersions")).Get([]byte(accountUUID))
+		if v != nil {
+			version = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get alert version for account %s: %s", accountUUID, err)
+	}
+
+	return version, nil
+}
+
+// IncrementAlertVersion increases the change counter of the alerts of the account
+func IncrementAlertVersion(db *bolt.DB, accountUUID string) error {
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		return incrementAlertVersionTx(tx, accountUUID)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to increment alert version for account %s: %s", accountUUID, err)
+	}
+
+	return nil
+}
+
+func incrementAlertVersionTx(tx *bolt.Tx, accountUUID string) error {
+	b := tx.Bucket([]byte("AlertVersions"))
+
+	var version uint64
+	v := b.Get([]byte(accountUUID))
+	if v != nil {
+		version = binary.BigEndian.Uint64(v)
+	}
+
+	nv := make([]byte, 8)
+	binary.BigEndian.PutUint64(nv, version+1)
+
+	return b.Put([]byte(accountUUID), nv)
+}
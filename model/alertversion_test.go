@@ -0,0 +1,46 @@
+package model
+
+import (
+	"context"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertVersion(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		version, err := AlertVersion(db, "foo")
+		assert.NoError(err)
+		assert.Equal(uint64(0), version)
+
+		a1 := NewAlert("APIKeyID1")
+		assert.NoError(a1.Save(db, "foo"))
+
+		version, err = AlertVersion(db, "foo")
+		assert.NoError(err)
+		assert.Equal(uint64(1), version)
+
+		a1.Status = SeenStatus
+		assert.NoError(a1.Save(db, "foo"))
+
+		version, err = AlertVersion(db, "foo")
+		assert.NoError(err)
+		assert.Equal(uint64(2), version)
+
+		// bulk updates increase the version once
+		_, err = BulkTransitionAlerts(context.Background(), db, "foo", nil, &AlertFilter{}, ArchivedStatus, nil, Actor{Type: SystemActor})
+		assert.NoError(err)
+
+		version, err = AlertVersion(db, "foo")
+		assert.NoError(err)
+		assert.Equal(uint64(3), version)
+
+		// the version is per account
+		version, err = AlertVersion(db, "bar")
+		assert.NoError(err)
+		assert.Equal(uint64(0), version)
+	})
+}
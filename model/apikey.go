@@ -1,6 +1,8 @@
 package model
 
 import (
+	"fmt"
+	"net"
 	"reflect"
 	"time"
 
@@ -20,10 +22,12 @@ const (
 
 // APIKey contains information about a created API key
 type APIKey struct {
-	ID          string // uuid
-	Description string // the user's description of the key
-	Status      APIKeyStatus
-	CreatedAt   time.Time
+	ID            string // uuid
+	Description   string // the user's description of the key
+	Status        APIKeyStatus
+	AllowedCIDRs  []string          // if not empty the key may only be used from these networks
+	DefaultLabels map[string]string // labels added to all alerts sent with this key
+	CreatedAt     time.Time
 }
 
 // PersistanceID is used by the persistance layer
@@ -35,6 +39,45 @@ func (a APIKey) Save(db *bolt.DB, accountUUID string) error {
 	return BoltSaveAccountObjects(db, ParentID(accountUUID), "APIKeys", BoltSingle(&a))
 }
 
+// AllowsIP checks if the API key may be used from the given ip. A key without any allowed networks may be used
+// from anywhere.
+func (a APIKey) AllowsIP(ip net.IP) bool {
+	if len(a.AllowedCIDRs) == 0 {
+		return true
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	for _, c := range a.AllowedCIDRs {
+		_, network, err := net.ParseCIDR(c)
+		if err != nil {
+			continue // should not happen as the networks are validated on creation
+		}
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseCIDRs parses the given networks in CIDR notation and returns an error for the first invalid one
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, c := range cidrs {
+		_, network, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %s: %s", c, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
 // NewAPIKey creates a new API key
 func NewAPIKey() *APIKey {
 	var a APIKey
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"net"
 	"testing"
 
 	"github.com/boltdb/bolt"
@@ -53,3 +54,27 @@ func TestAPIKey(t *testing.T) {
 
 	})
 }
+
+func TestAPIKeyAllowsIP(t *testing.T) {
+	assert := assert.New(t)
+
+	a := NewAPIKey()
+	assert.True(a.AllowsIP(net.ParseIP("10.1.2.3"))) // no allowlist => allowed from anywhere
+
+	a.AllowedCIDRs = []string{"10.0.0.0/8", "2001:db8::/32"}
+	assert.True(a.AllowsIP(net.ParseIP("10.1.2.3")))
+	assert.True(a.AllowsIP(net.ParseIP("2001:db8::1")))
+	assert.False(a.AllowsIP(net.ParseIP("192.168.1.1")))
+	assert.False(a.AllowsIP(nil))
+}
+
+func TestParseCIDRs(t *testing.T) {
+	assert := assert.New(t)
+
+	networks, err := ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.0/24"})
+	assert.NoError(err)
+	assert.Equal(2, len(networks))
+
+	_, err = ParseCIDRs([]string{"10.0.0.0/8", "10.0.0.1"})
+	assert.Error(err)
+}
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/twinj/uuid"
+)
+
+// AuditEvent describes what happened in an audit entry
+type AuditEvent string
+
+const (
+	// AuditIPRejected indicates that an API key was used from a network that is not in its allowlist
+	AuditIPRejected AuditEvent = "ip_rejected"
+)
+
+// AuditEntry is an entry in the audit trail of an account
+type AuditEntry struct {
+	ID        string // uuid
+	Event     AuditEvent
+	APIKeyID  string // uuid of the api key involved, if any
+	RemoteIP  string // the resolved ip of the client
+	Details   string
+	CreatedAt time.Time
+}
+
+// PersistanceID is used by the persistance layer
+func (a AuditEntry) PersistanceID() string {
+	return a.ID
+}
+
+// Save the audit entry attached to the given accountUUID
+func (a AuditEntry) Save(db *bolt.DB, accountUUID string) error {
+	return BoltSaveAccountObjects(db, ParentID(accountUUID), "Audit", BoltSingle(&a))
+}
+
+// NewAuditEntry creates a new audit entry for the given event
+func NewAuditEntry(event AuditEvent) *AuditEntry {
+	var a AuditEntry
+	uuid := uuid.NewV4()
+	a.ID = uuid.String()
+	a.Event = event
+	a.CreatedAt = time.Now()
+	return &a
+}
+
+// ListAuditEntries returns the audit trail for the given account
+func ListAuditEntries(db *bolt.DB, accountUUID string) (*map[string]AuditEntry, error) {
+	m, err := BoltGetAccountObjects(db, ParentID(accountUUID), "Audit", reflect.TypeOf(AuditEntry{}))
+	if err != nil {
+		return nil, err
+	}
+
+	// convert to map containing AuditEntry
+	m2 := make(map[string]AuditEntry)
+	for _, v := range *m {
+		a := v.(*AuditEntry)
+		m2[v.PersistanceID()] = *a
+	}
+
+	return &m2, nil
+}
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/logging"
+)
+
+// SaveBatch saves new alerts and heartbeats of an account in a single transaction, so that either all or none of
+// them are saved. An AlertCreatedEvent by 'actor' is saved for each alert and the alert version of the account is
+// increased once if there are any alerts. A stream event is saved for each alert and heartbeat. The batch is logged with the logger of 'ctx'.
+func SaveBatch(ctx context.Context, db *bolt.DB, accountUUID string, alerts []*Alert, heartbeats []*Heartbeat, actor Actor) error {
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		if len(alerts) > 0 {
+			err := saveNewAlertsTx(tx, accountUUID, alerts, actor)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(heartbeats) > 0 {
+			nb, err := tx.Bucket([]byte("Heartbeats")).CreateBucketIfNotExists([]byte(accountUUID))
+			if err != nil {
+				return fmt.Errorf("Failed to create nested Heartbeats bucket for account %s: %s", accountUUID, err)
+			}
+
+			for _, hb := range heartbeats {
+				err := BoltSaveObject(nb, hb.ID, hb)
+				if err != nil {
+					return err
+				}
+
+				err = appendHeartbeatStreamEventTx(tx, accountUUID, hb)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save batch for account %s: %s", accountUUID, err)
+	}
+
+	logging.FromContext(ctx).Infof("Saved a batch of %d alerts and %d heartbeats for account %s", len(alerts), len(heartbeats), accountUUID)
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveBatch(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		actor := Actor{Type: APIKeyActor, ID: "APIKeyID1"}
+
+		a1 := NewAlert("APIKeyID1")
+		a2 := NewAlert("APIKeyID1")
+		hb1 := NewHeartbeat("APIKeyID1")
+
+		assert.NoError(SaveBatch(context.Background(), db, "foo", []*Alert{a1, a2}, []*Heartbeat{hb1}, actor))
+
+		alerts, err := ListAlerts(db, "foo")
+		assert.NoError(err)
+		assert.Equal(2, len(*alerts))
+		assert.Contains(*alerts, a1.ID)
+		assert.Contains(*alerts, a2.ID)
+
+		heartbeats, err := ListHeartbeats(db, "foo")
+		assert.NoError(err)
+		assert.Equal(1, len(*heartbeats))
+		assert.Contains(*heartbeats, hb1.ID)
+
+		events, err := ListAlertEvents(db, a1.ID)
+		assert.NoError(err)
+		if assert.Equal(1, len(events)) {
+			assert.Equal(AlertCreatedEvent, events[0].Type)
+			assert.Equal(actor, events[0].Actor)
+		}
+
+		// the version is increased once for the whole batch
+		version, err := AlertVersion(db, "foo")
+		assert.NoError(err)
+		assert.Equal(uint64(1), version)
+
+		// a batch of only heartbeats does not change the version
+		assert.NoError(SaveBatch(context.Background(), db, "foo", nil, []*Heartbeat{NewHeartbeat("APIKeyID1")}, actor))
+		version, err = AlertVersion(db, "foo")
+		assert.NoError(err)
+		assert.Equal(uint64(1), version)
+
+		// the batch is logged with the logger of the request
+		var out bytes.Buffer
+		assert.NoError(logging.Setup(&out, "json", "info"))
+		defer logging.Setup(os.Stderr, "text", "info")
+
+		ctx := logging.NewContext(context.Background(), logging.Default().With("request_id", "req-1"))
+		assert.NoError(SaveBatch(ctx, db, "foo", nil, []*Heartbeat{NewHeartbeat("APIKeyID1")}, actor))
+		assert.Contains(out.String(), `"request_id":"req-1"`)
+	})
+}
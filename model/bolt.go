@@ -3,11 +3,35 @@ package model
 import (
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/golang/glog"
 )
 
+// TxObserver, if set, is called after each transaction of the model with its duration. 'write' tells if it was a
+// read-write transaction.
+var TxObserver func(write bool, d time.Duration)
+
+// boltView runs a read-only transaction, observed by TxObserver
+func boltView(db *bolt.DB, fn func(*bolt.Tx) error) error {
+	start := time.Now()
+	err := db.View(fn)
+	if TxObserver != nil {
+		TxObserver(false, time.Since(start))
+	}
+	return err
+}
+
+// boltUpdate runs a read-write transaction, observed by TxObserver
+func boltUpdate(db *bolt.DB, fn func(*bolt.Tx) error) error {
+	start := time.Now()
+	err := db.Update(fn)
+	if TxObserver != nil {
+		TxObserver(true, time.Since(start))
+	}
+	return err
+}
+
 type ChildID string
 type ParentID string
 
@@ -27,28 +51,30 @@ func BoltSaveObject(bucket *bolt.Bucket, key string, obj interface{}) error {
 
 // TODO rename to SaveChildObjects
 func BoltSaveAccountObjects(db *bolt.DB, accountUUID ParentID, bucketName string, objs *map[string]PersistanceID) error {
-	glog.Infof("Saving %s for account %s", bucketName, accountUUID)
-
-	err := db.Update(func(tx *bolt.Tx) error {
-		mb := tx.Bucket([]byte(bucketName)) // main bucket
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		return BoltSaveAccountObjectsTx(tx, accountUUID, bucketName, objs)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save %s for account %s: %s", bucketName, accountUUID, err)
+	}
 
-		nb, err := mb.CreateBucketIfNotExists([]byte(accountUUID)) // nested bucket
-		if err != nil {
-			return fmt.Errorf("Failed to create nested %s bucket for account %s: %s", bucketName, accountUUID, err)
-		}
+	return nil
+}
 
-		for _, v := range *objs {
-			glog.Infof("Saving object %s", v.PersistanceID())
-			err := BoltSaveObject(nb, v.PersistanceID(), v)
-			if err != nil {
-				return fmt.Errorf("Failed to save object: %s", err)
-			}
-		}
+// BoltSaveAccountObjectsTx is BoltSaveAccountObjects within an already started transaction
+func BoltSaveAccountObjectsTx(tx *bolt.Tx, accountUUID ParentID, bucketName string, objs *map[string]PersistanceID) error {
+	mb := tx.Bucket([]byte(bucketName)) // main bucket
 
-		return nil
-	})
+	nb, err := mb.CreateBucketIfNotExists([]byte(accountUUID)) // nested bucket
 	if err != nil {
-		return fmt.Errorf("Failed to save %s for account %s: %s", bucketName, accountUUID, err)
+		return fmt.Errorf("Failed to create nested %s bucket for account %s: %s", bucketName, accountUUID, err)
+	}
+
+	for _, v := range *objs {
+		err := BoltSaveObject(nb, v.PersistanceID(), v)
+		if err != nil {
+			return fmt.Errorf("Failed to save object: %s", err)
+		}
 	}
 
 	return nil
@@ -58,12 +84,11 @@ func BoltSaveAccountObjects(db *bolt.DB, accountUUID ParentID, bucketName string
 func BoltGetAccountObjects(db *bolt.DB, accountUUID ParentID, bucketName string, t reflect.Type) (*map[string]PersistanceID, error) {
 	objs := make(map[string]PersistanceID)
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := boltView(db, func(tx *bolt.Tx) error {
 		mb := tx.Bucket([]byte(bucketName))  // main bucket
 		nb := mb.Bucket([]byte(accountUUID)) // nested bucket
 		if nb == nil {
 			// no nested bucket => no objects => return nil
-			glog.Infof("Account %s is missing nested bucket for %s", accountUUID, bucketName)
 			return nil
 		}
 
@@ -95,7 +120,7 @@ func BoltGetObject(db *bolt.DB, bucketName string, objID string, t reflect.Type)
 	var obj *PersistanceID
 	var accountID ParentID // TODO rename
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := boltView(db, func(tx *bolt.Tx) error {
 		mb := tx.Bucket([]byte(bucketName)) // main bucket
 
 		err := mb.ForEach(func(k, v []byte) error {
@@ -139,7 +164,7 @@ func BoltGetObject(db *bolt.DB, bucketName string, objID string, t reflect.Type)
 func BoltGetObjects(db *bolt.DB, bucketName string, t reflect.Type) (*map[string][]PersistanceID, error) {
 	objs := make(map[string][]PersistanceID)
 
-	err := db.View(func(tx *bolt.Tx) error {
+	err := boltView(db, func(tx *bolt.Tx) error {
 		mb := tx.Bucket([]byte(bucketName)) // main bucket
 
 		err := mb.ForEach(func(k, v []byte) error {
@@ -177,6 +202,71 @@ func BoltGetObjects(db *bolt.DB, bucketName string, t reflect.Type) (*map[string
 	return &objs, nil
 }
 
+// BoltUpdateObjects calls 'update' for every object in all nested buckets of the given bucket within a single
+// transaction. Objects for which 'update' returns true are saved back. An error aborts the whole transaction.
+func BoltUpdateObjects(db *bolt.DB, bucketName string, t reflect.Type, update func(parentID ParentID, obj PersistanceID) (bool, error)) error {
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		mb := tx.Bucket([]byte(bucketName)) // main bucket
+
+		// collect the nested buckets first as buckets must not be modified while iterating over them
+		var parents [][]byte
+		err := mb.ForEach(func(k, v []byte) error {
+			if v == nil {
+				parents = append(parents, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range parents {
+			nb := mb.Bucket(k) // nested bucket
+			if nb == nil {
+				return fmt.Errorf("Failed to open nested bucket")
+			}
+
+			var changed []PersistanceID
+			err := nb.ForEach(func(kk, vv []byte) error {
+				o := reflect.New(t).Interface() // make new instance to deserialize into
+				err := deserialize(&vv, o)
+				if err != nil {
+					return fmt.Errorf("Failed to deserialize object: %s", err)
+				}
+
+				p, _ := reflect.ValueOf(o).Interface().(PersistanceID)
+
+				save, err := update(ParentID(string(k)), p)
+				if err != nil {
+					return err
+				}
+				if save {
+					changed = append(changed, p)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, p := range changed {
+				err := BoltSaveObject(nb, p.PersistanceID(), p)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to update %s objects: %s", bucketName, err)
+	}
+
+	return nil
+}
+
 func BoltMap(objs interface{}) *map[string]PersistanceID {
 	res := make(map[string]PersistanceID)
 
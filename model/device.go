@@ -47,3 +47,19 @@ func ListDevices(db *bolt.DB, accountUUID string) (*map[string]Device, error) {
 
 	return &m2, nil
 }
+
+// FindDevice returns the device of the account with the given device id, or nil if there is none
+func FindDevice(db *bolt.DB, accountUUID string, deviceID string) (*Device, error) {
+	devices, err := ListDevices(db, accountUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range *devices {
+		if d.DeviceID == deviceID {
+			return &d, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -1,17 +1,27 @@
 package model
 
 import (
+	"fmt"
 	"reflect"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/twinj/uuid"
-	"github.com/golang/glog"
+)
+
+// HeartbeatStatus tells what a heartbeat reports, possible values StartedHeartbeat and SucceededHeartbeat. It is
+// empty for heartbeats that don't say.
+type HeartbeatStatus string
+
+const (
+	StartedHeartbeat   HeartbeatStatus = "started"
+	SucceededHeartbeat HeartbeatStatus = "succeeded"
 )
 
 type Heartbeat struct {
 	ID         string // uuid
 	APIKeyID   string // uuid of api key that sent this heartbeat
+	Status     HeartbeatStatus
 	ExecutedAt time.Time
 	CreatedAt  time.Time
 }
@@ -20,8 +30,21 @@ func (h Heartbeat) PersistanceID() string {
 	return h.ID
 }
 
+// Save the heartbeat attached to the given accountUUID, with a HeartbeatStreamEvent in the same transaction
 func (h Heartbeat) Save(db *bolt.DB, accountUUID string) error {
-	return BoltSaveAccountObjects(db, ParentID(accountUUID), "Heartbeats", BoltSingle(&h))
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		err := BoltSaveAccountObjectsTx(tx, ParentID(accountUUID), "Heartbeats", BoltSingle(&h))
+		if err != nil {
+			return err
+		}
+
+		return appendHeartbeatStreamEventTx(tx, accountUUID, &h)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save heartbeat for account %s: %s", accountUUID, err)
+	}
+
+	return nil
 }
 
 func NewHeartbeat(apiKeyID string) *Heartbeat {
@@ -59,14 +82,10 @@ func LatestHeartbeatPerApiKey(db *bolt.DB, accountUUID string) (*map[string]Hear
 
 	// iterate over all heartbeats
 	for _, v := range *hbs {
-		glog.Info("FOO v: %s", v.ID)
 		h, ok := apiKeyToHeartbeat[v.APIKeyID]
 		if ok == false {
-			glog.Infof("FOO h is null")
 			apiKeyToHeartbeat[v.APIKeyID] = v
 		} else {
-			glog.Info("FOO h: %s", h.ID)
-			glog.Infof("%s after %s", v.ExecutedAt, h.ExecutedAt)
 			if v.ExecutedAt.After(h.ExecutedAt) {
 				// replace heartbeat if this heartbeat was executed later
 				apiKeyToHeartbeat[v.APIKeyID] = v
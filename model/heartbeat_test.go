@@ -6,7 +6,6 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/assert"
 	"time"
-	"flag"
 )
 
 func TestNewHeartbeat(t *testing.T) {
@@ -56,7 +55,6 @@ func TestListHeartbeats(t *testing.T) {
 }
 
 func TestLatestHeartbeats(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
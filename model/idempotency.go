@@ -0,0 +1,144 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// IdempotentResponse is the stored response to the first request with an idempotency key, replayed for repeats of
+// the request with the same key
+type IdempotentResponse struct {
+	RequestHash string // sha256 of the method, route and body of the request, to detect a key reused for another request
+	Status      int
+	ContentType string
+	Body        []byte
+	Sealed      bool // the body is encrypted with a key derived from the request, as it holds secrets
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// tokenScopePrefix starts the scopes of the idempotency keys of /tokens
+const tokenScopePrefix = "tokens:"
+
+// TokenIdempotencyScope is the scope of the idempotency keys of /tokens requests for the id of the grant type. The id
+// is hashed as a renewal id grants tokens.
+func TokenIdempotencyScope(grantType string, id string) string {
+	sum := sha256.Sum256([]byte(grantType + " " + id))
+	return tokenScopePrefix + hex.EncodeToString(sum[:])
+}
+
+// GetIdempotentResponse returns the unexpired response stored for the key within the scope, or nil if there is none
+func GetIdempotentResponse(db *bolt.DB, scope string, key string, now time.Time) (*IdempotentResponse, error) {
+	var r *IdempotentResponse
+
+	err := boltView(db, func(tx *bolt.Tx) error {
+		nb := tx.Bucket([]byte("IdempotencyKeys")).Bucket([]byte(scope)) // nested bucket
+		if nb == nil {
+			return nil
+		}
+
+		v := nb.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+
+		var stored IdempotentResponse
+		err := deserialize(&v, &stored)
+		if err != nil {
+			return fmt.Errorf("Failed to deserialize idempotent response: %s", err)
+		}
+		if now.Before(stored.ExpiresAt) {
+			r = &stored
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get idempotent response for %s: %s", scope, err)
+	}
+
+	return r, nil
+}
+
+// SaveIdempotentResponse stores the response for the key within the scope, replacing any expired one
+func SaveIdempotentResponse(db *bolt.DB, scope string, key string, r *IdempotentResponse) error {
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		mb := tx.Bucket([]byte("IdempotencyKeys")) // main bucket
+
+		nb, err := mb.CreateBucketIfNotExists([]byte(scope)) // nested bucket
+		if err != nil {
+			return fmt.Errorf("Failed to create nested IdempotencyKeys bucket for %s: %s", scope, err)
+		}
+
+		return BoltSaveObject(nb, key, r)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save idempotent response for %s: %s", scope, err)
+	}
+
+	return nil
+}
+
+// DeleteExpiredIdempotentResponses deletes the responses that have expired at 'now' and returns how many were deleted
+func DeleteExpiredIdempotentResponses(db *bolt.DB, now time.Time) (int, error) {
+	deleted := 0
+
+	err := boltUpdate(db, func(tx *bolt.Tx) error {
+		mb := tx.Bucket([]byte("IdempotencyKeys")) // main bucket
+
+		// collect the nested buckets first as buckets must not be modified while iterating over them
+		var scopes [][]byte
+		err := mb.ForEach(func(k, v []byte) error {
+			if v == nil {
+				scopes = append(scopes, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, scope := range scopes {
+			nb := mb.Bucket(scope)
+
+			var expired [][]byte
+			err := nb.ForEach(func(k, v []byte) error {
+				var r IdempotentResponse
+				err := deserialize(&v, &r)
+				if err != nil || !now.Before(r.ExpiresAt) {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, k := range expired {
+				err := nb.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+			deleted += len(expired)
+
+			if k, _ := nb.Cursor().First(); k == nil {
+				err := mb.DeleteBucket(scope)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to delete expired idempotent responses: %s", err)
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentResponses(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		now := time.Now()
+
+		// should be empty
+		r, err := GetIdempotentResponse(db, "key1", "idem1", now)
+		assert.NoError(err)
+		assert.Nil(r)
+
+		err = SaveIdempotentResponse(db, "key1", "idem1", &IdempotentResponse{
+			RequestHash: "hash1",
+			Status:      201,
+			ContentType: "application/json",
+			Body:        []byte(`{"id":"alert1"}`),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(time.Hour),
+		})
+		assert.NoError(err)
+		err = SaveIdempotentResponse(db, "key1", "idem2", &IdempotentResponse{RequestHash: "hash2", Status: 201, ExpiresAt: now.Add(2 * time.Hour)})
+		assert.NoError(err)
+
+		r, err = GetIdempotentResponse(db, "key1", "idem1", now)
+		assert.NoError(err)
+		if assert.NotNil(r) {
+			assert.Equal("hash1", r.RequestHash)
+			assert.Equal(201, r.Status)
+			assert.Equal("application/json", r.ContentType)
+			assert.Equal(`{"id":"alert1"}`, string(r.Body))
+		}
+
+		// the keys are scoped
+		r, err = GetIdempotentResponse(db, "key2", "idem1", now)
+		assert.NoError(err)
+		assert.Nil(r)
+
+		// expired responses are not returned
+		r, err = GetIdempotentResponse(db, "key1", "idem1", now.Add(time.Hour))
+		assert.NoError(err)
+		assert.Nil(r)
+
+		deleted, err := DeleteExpiredIdempotentResponses(db, now.Add(90*time.Minute))
+		assert.NoError(err)
+		assert.Equal(1, deleted)
+
+		r, err = GetIdempotentResponse(db, "key1", "idem2", now)
+		assert.NoError(err)
+		assert.NotNil(r)
+
+		// the bucket of the scope is deleted with its last response
+		deleted, err = DeleteExpiredIdempotentResponses(db, now.Add(3*time.Hour))
+		assert.NoError(err)
+		assert.Equal(1, deleted)
+
+		err = db.View(func(tx *bolt.Tx) error {
+			assert.Nil(tx.Bucket([]byte("IdempotencyKeys")).Bucket([]byte("key1")))
+			return nil
+		})
+		assert.NoError(err)
+	})
+}
@@ -0,0 +1,244 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/twinj/uuid"
+)
+
+// IntegrationMapping maps an incoming JSON payload to an alert. Each field is a Go template executed with the
+// decoded payload as data, e.g. "{{.title}}" or "{{.alert.severity | lower}}".
+type IntegrationMapping struct {
+	Title            string            // mandatory
+	ShortDescription string            // defaults to the title when empty
+	LongDescription  string            // defaults to the short description when empty
+	Priority         string            // high, normal, low or a severity name, see PriorityFromSeverity
+	Fingerprint      string            // optional. Identifies the alert at the source for updates and resolving
+	Resolved         string            // optional. The alert is resolved when this evaluates to "true"
+	Labels           map[string]string // optional. Templates for the values of the labels
+}
+
+// Integration receives alerts as JSON from an external system, e.g. Grafana or GitHub Actions, and maps them into
+// alerts using its mapping
+type Integration struct {
+	ID        string // uuid
+	Name      string
+	Mapping   IntegrationMapping
+	CreatedAt time.Time
+}
+
+// MappedAlert is the result of applying an IntegrationMapping to a payload
+type MappedAlert struct {
+	Title            string
+	ShortDescription string
+	LongDescription  string
+	Priority         AlertPriority
+	Fingerprint      string
+	Resolved         bool
+	Labels           map[string]string
+}
+
+// PersistanceID is used by the persistance layer
+func (i Integration) PersistanceID() string {
+	return i.ID
+}
+
+// Save the integration attached to the given accountUUID
+func (i Integration) Save(db *bolt.DB, accountUUID string) error {
+	return BoltSaveAccountObjects(db, ParentID(accountUUID), "Integrations", BoltSingle(&i))
+}
+
+// NewIntegration creates a new integration
+func NewIntegration(name string, mapping IntegrationMapping) *Integration {
+	var i Integration
+	uuid := uuid.NewV4()
+	i.ID = uuid.String()
+	i.Name = name
+	i.Mapping = mapping
+	i.CreatedAt = time.Now()
+	return &i
+}
+
+// GetIntegration returns the integration with the given id and the account id it belongs to
+func GetIntegration(db *bolt.DB, integrationID string) (*Integration, *string, error) {
+	o, parentID, err := BoltGetObject(db, "Integrations", integrationID, reflect.TypeOf(Integration{}))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if o == nil {
+		return nil, nil, nil
+	}
+
+	var integration *Integration
+	integration = (*o).(*Integration)
+	s := string(*parentID)
+
+	return integration, &s, nil
+}
+
+// ListIntegrations returns all integrations for the given account
+func ListIntegrations(db *bolt.DB, accountUUID string) (*map[string]Integration, error) {
+	m, err := BoltGetAccountObjects(db, ParentID(accountUUID), "Integrations", reflect.TypeOf(Integration{}))
+	if err != nil {
+		return nil, err
+	}
+
+	// convert to map containing Integration
+	m2 := make(map[string]Integration)
+	for _, v := range *m {
+		i := v.(*Integration)
+		m2[v.PersistanceID()] = *i
+	}
+
+	return &m2, nil
+}
+
+// mappingFuncs are the functions available in the templates of a mapping besides the built-in ones
+var mappingFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"default": func(def string, v interface{}) string {
+		s := valueString(v)
+		if s == "" {
+			return def
+		}
+		return s
+	},
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"text": valueString,
+}
+
+// Validate checks that the mapping has a title and that all templates can be parsed
+func (m IntegrationMapping) Validate() error {
+	if strings.TrimSpace(m.Title) == "" {
+		return fmt.Errorf("The mapping must have a title")
+	}
+
+	_, err := m.parse()
+	return err
+}
+
+// Apply executes the mapping with the decoded JSON payload as data
+func (m IntegrationMapping) Apply(payload interface{}) (*MappedAlert, error) {
+	templates, err := m.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for name, t := range templates {
+		var buf bytes.Buffer
+		err := t.Execute(&buf, payload)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to execute %s: %s", name, err)
+		}
+		values[name] = strings.TrimSpace(buf.String())
+	}
+
+	var a MappedAlert
+	a.Title = values["title"]
+	if a.Title == "" {
+		return nil, fmt.Errorf("The title is empty for this payload")
+	}
+	a.ShortDescription = values["short_description"]
+	if a.ShortDescription == "" {
+		a.ShortDescription = a.Title
+	}
+	a.LongDescription = values["long_description"]
+	if a.LongDescription == "" {
+		a.LongDescription = a.ShortDescription
+	}
+	a.Priority = PriorityFromSeverity(values["priority"])
+	a.Fingerprint = values["fingerprint"]
+	a.Resolved = strings.ToLower(values["resolved"]) == "true"
+
+	a.Labels = make(map[string]string)
+	for k := range m.Labels {
+		if v := values["labels."+k]; v != "" {
+			a.Labels[k] = v
+		}
+	}
+
+	return &a, nil
+}
+
+// parse parses all non-empty templates of the mapping into a map by field name
+func (m IntegrationMapping) parse() (map[string]*template.Template, error) {
+	fields := map[string]string{
+		"title":             m.Title,
+		"short_description": m.ShortDescription,
+		"long_description":  m.LongDescription,
+		"priority":          m.Priority,
+		"fingerprint":       m.Fingerprint,
+		"resolved":          m.Resolved,
+	}
+	for k, v := range m.Labels {
+		fields["labels."+k] = v
+	}
+
+	templates := make(map[string]*template.Template)
+	for name, text := range fields {
+		if text == "" {
+			continue
+		}
+
+		t, err := template.New(name).Funcs(mappingFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template for %s: %s", name, err)
+		}
+		printText(t.Tree, t.Tree.Root)
+		templates[name] = t
+	}
+
+	return templates, nil
+}
+
+// printText pipes the value of every action printing a value to the "text" function, so that keys missing from the
+// payload print as the empty string rather than as "<no value>"
+func printText(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			printText(tree, c)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			return // assignments print nothing
+		}
+		text := parse.NewIdentifier("text").SetTree(tree).SetPos(n.Pos)
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{text}})
+	case *parse.IfNode:
+		printText(tree, n.List)
+		printText(tree, n.ElseList)
+	case *parse.RangeNode:
+		printText(tree, n.List)
+		printText(tree, n.ElseList)
+	case *parse.WithNode:
+		printText(tree, n.List)
+		printText(tree, n.ElseList)
+	}
+}
+
+// valueString formats a value of a decoded JSON payload, with nil as the empty string
+func valueString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntegration(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		i1 := NewIntegration("grafana", IntegrationMapping{Title: "{{.title}}"})
+		assert.NoError(i1.Save(db, "foo"))
+
+		i2 := NewIntegration("github", IntegrationMapping{Title: "{{.workflow}}"})
+		assert.NoError(i2.Save(db, "bar"))
+
+		i, accountID, err := GetIntegration(db, i1.ID)
+		assert.NoError(err)
+		assert.NotNil(i)
+		assert.Equal("foo", *accountID)
+		assert.Equal("grafana", i.Name)
+		assert.Equal("{{.title}}", i.Mapping.Title)
+
+		i, _, err = GetIntegration(db, "missing")
+		assert.NoError(err)
+		assert.Nil(i)
+
+		integrations, err := ListIntegrations(db, "foo")
+		assert.NoError(err)
+		assert.Equal(1, len(*integrations))
+		assert.Equal(i1.ID, (*integrations)[i1.ID].ID)
+	})
+}
+
+func TestIntegrationMappingValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(IntegrationMapping{Title: "{{.title}}"}.Validate())
+	assert.Error(IntegrationMapping{}.Validate())
+	assert.Error(IntegrationMapping{Title: "{{.title"}.Validate())
+	assert.Error(IntegrationMapping{Title: "x", Priority: "{{unknownfunc .x}}"}.Validate())
+	assert.Error(IntegrationMapping{Title: "x", Labels: map[string]string{"env": "{{"}}.Validate())
+}
+
+func TestIntegrationMappingApply(t *testing.T) {
+	assert := assert.New(t)
+
+	var payload interface{}
+	err := json.Unmarshal([]byte(`
+		{
+			"title": "[Alerting] CPU usage",
+			"ruleName": "CPU usage",
+			"ruleId": 7,
+			"state": "alerting",
+			"message": "CPU above 90%",
+			"tags": {"host": "web1"}
+		}
+	`), &payload)
+	assert.NoError(err)
+
+	m := IntegrationMapping{
+		Title:            "{{.ruleName}}",
+		ShortDescription: "{{.message}}",
+		Priority:         `{{if eq .state "alerting"}}high{{else}}low{{end}}`,
+		Fingerprint:      "grafana-{{.ruleId}}",
+		Resolved:         `{{eq .state "ok"}}`,
+		Labels:           map[string]string{"host": "{{.tags.host}}", "team": "{{.tags.team}}", "source": "{{.source | default \"grafana\"}}"},
+	}
+
+	a, err := m.Apply(payload)
+	assert.NoError(err)
+	assert.Equal("CPU usage", a.Title)
+	assert.Equal("CPU above 90%", a.ShortDescription)
+	assert.Equal("CPU above 90%", a.LongDescription)
+	assert.Equal(HighPriority, a.Priority)
+	assert.Equal("grafana-7", a.Fingerprint)
+	assert.False(a.Resolved)
+	assert.Equal(map[string]string{"host": "web1", "source": "grafana"}, a.Labels)
+
+	payload.(map[string]interface{})["state"] = "ok"
+	a, err = m.Apply(payload)
+	assert.NoError(err)
+	assert.True(a.Resolved)
+	assert.Equal(LowPriority, a.Priority)
+
+	// a missing title is an error
+	_, err = IntegrationMapping{Title: "{{.missing}}"}.Apply(payload)
+	assert.Error(err)
+
+	// missing keys print as empty, also inside blocks, while the text "<no value>" of the payload is kept
+	payload.(map[string]interface{})["message"] = "got <no value> from sensor"
+	a, err = IntegrationMapping{
+		Title:            "{{.ruleName}}{{.missing}}",
+		ShortDescription: `{{.message}}{{with .tags}} on {{.host}}{{.missing}}{{end}}`,
+		LongDescription:  `{{$m := .missing}}[{{$m}}]{{range .missing}}x{{else}}{{.tags.team}}{{end}}`,
+	}.Apply(payload)
+	assert.NoError(err)
+	assert.Equal("CPU usage", a.Title)
+	assert.Equal("got <no value> from sensor on web1", a.ShortDescription)
+	assert.Equal("[]", a.LongDescription)
+}
@@ -4,12 +4,9 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
-
-	"github.com/golang/glog"
 )
 
 func serialize(obj interface{}) ([]byte, error) {
-	glog.Infof("Serialization")
 	var buf bytes.Buffer
 
 	enc := gob.NewEncoder(&buf)
@@ -23,8 +20,6 @@ func serialize(obj interface{}) ([]byte, error) {
 
 // copy the bytes and deserialize the object
 func deserialize(src *[]byte, obj interface{}) error {
-	glog.Infof("Deserialization")
-
 	// make a copy of the bytes as this comes from bolt and the object will be used outside
 	// of the transaction
 	b := make([]byte, len(*src))
@@ -35,7 +30,6 @@ func deserialize(src *[]byte, obj interface{}) error {
 
 	err := dec.Decode(obj)
 	if err != nil {
-		glog.Infof("Failed to deserialize object: %s", err)
 		return err
 	}
 
@@ -0,0 +1,121 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// StreamEventType describes what a stream event is about
+type StreamEventType string
+
+const (
+	AlertCreatedStreamEvent StreamEventType = "alert_created"
+	AlertUpdatedStreamEvent StreamEventType = "alert_updated"
+	HeartbeatStreamEvent    StreamEventType = "heartbeat"
+)
+
+// maxStreamEvents is the number of stream events kept per account for clients resuming a stream
+var maxStreamEvents uint64 = 1000
+
+// StreamEvent is a change streamed to the clients of an account. The events are numbered with a per account
+// sequence so that clients can resume from the last event they received. The event is saved in the transaction of
+// the change, with a copy of the object as it was after the change.
+type StreamEvent struct {
+	Seq       uint64
+	Type      StreamEventType
+	ObjectID  string     // uuid of the alert or heartbeat
+	Alert     *Alert     // set for the alert events
+	Heartbeat *Heartbeat // set for the heartbeat events
+	CreatedAt time.Time
+}
+
+// appendAlertStreamEventTx saves a stream event of the alert within the given transaction
+func appendAlertStreamEventTx(tx *bolt.Tx, accountUUID string, eventType StreamEventType, a *Alert) error {
+	alert := *a // the event keeps the alert as it is now
+	return appendStreamEventTx(tx, accountUUID, &StreamEvent{Type: eventType, ObjectID: a.ID, Alert: &alert})
+}
+
+// appendHeartbeatStreamEventTx saves a stream event of the heartbeat within the given transaction
+func appendHeartbeatStreamEventTx(tx *bolt.Tx, accountUUID string, hb *Heartbeat) error {
+	heartbeat := *hb
+	return appendStreamEventTx(tx, accountUUID, &StreamEvent{Type: HeartbeatStreamEvent, ObjectID: hb.ID, Heartbeat: &heartbeat})
+}
+
+// appendStreamEventTx saves a new stream event for the account within the given transaction and assigns it the next
+// sequence number. Only the latest maxStreamEvents events are kept.
+func appendStreamEventTx(tx *bolt.Tx, accountUUID string, e *StreamEvent) error {
+	e.CreatedAt = time.Now()
+
+	mb := tx.Bucket([]byte("StreamEvents")) // main bucket
+
+	nb, err := mb.CreateBucketIfNotExists([]byte(accountUUID)) // nested bucket
+	if err != nil {
+		return fmt.Errorf("Failed to create nested StreamEvents bucket for account %s: %s", accountUUID, err)
+	}
+
+	e.Seq, err = nb.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	err = BoltSaveObject(nb, string(seqKey(e.Seq)), e)
+	if err != nil {
+		return fmt.Errorf("Failed to save stream event for account %s: %s", accountUUID, err)
+	}
+
+	// only keep the latest events
+	if e.Seq > maxStreamEvents {
+		cur := nb.Cursor()
+		limit := seqKey(e.Seq - maxStreamEvents)
+		// restart from the first key after each delete as deleting moves the cursor
+		for k, _ := cur.First(); k != nil && bytes.Compare(k, limit) <= 0; k, _ = cur.First() {
+			err := cur.Delete()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ListStreamEventsSince returns the kept stream events of the account with a sequence number larger than 'seq',
+// ordered by sequence number
+func ListStreamEventsSince(db *bolt.DB, accountUUID string, seq uint64) ([]StreamEvent, error) {
+	events := make([]StreamEvent, 0)
+
+	err := boltView(db, func(tx *bolt.Tx) error {
+		nb := tx.Bucket([]byte("StreamEvents")).Bucket([]byte(accountUUID)) // nested bucket
+		if nb == nil {
+			return nil
+		}
+
+		cur := nb.Cursor()
+		for k, v := cur.Seek(seqKey(seq + 1)); k != nil; k, v = cur.Next() {
+			var e StreamEvent
+			err := deserialize(&v, &e)
+			if err != nil {
+				return fmt.Errorf("Failed to deserialize stream event: %s", err)
+			}
+			events = append(events, e)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get stream events for account %s: %s", accountUUID, err)
+	}
+
+	return events, nil
+}
+
+// seqKey makes a key that sorts in sequence order
+func seqKey(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
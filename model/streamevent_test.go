@@ -0,0 +1,88 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamEvents(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		// should be empty
+		events, err := ListStreamEventsSince(db, "foo", 0)
+		assert.NoError(err)
+		assert.Equal(0, len(events))
+
+		// the events are saved with the changes
+		alert1 := NewAlert("apiKey1")
+		alert1.Title = "created"
+		err = SaveNewAlerts(db, []NewAccountAlert{{AccountUUID: "foo", Alert: alert1, Actor: Actor{Type: SystemActor}}})
+		assert.NoError(err)
+
+		hb1 := NewHeartbeat("apiKey1")
+		err = hb1.Save(db, "foo")
+		assert.NoError(err)
+
+		// the sequence is per account
+		alert2 := NewAlert("apiKey1")
+		err = SaveNewAlerts(db, []NewAccountAlert{{AccountUUID: "bar", Alert: alert2, Actor: Actor{Type: SystemActor}}})
+		assert.NoError(err)
+
+		alert1.Title = "updated"
+		err = alert1.SaveWithEvent(db, "foo", NewAlertEvent(alert1, AlertRetriggeredEvent, Actor{Type: SystemActor}))
+		assert.NoError(err)
+
+		events, err = ListStreamEventsSince(db, "foo", 0)
+		assert.NoError(err)
+		assert.Equal(3, len(events))
+		assert.Equal(uint64(1), events[0].Seq)
+		assert.Equal(AlertCreatedStreamEvent, events[0].Type)
+		assert.Equal(alert1.ID, events[0].ObjectID)
+		assert.Equal("created", events[0].Alert.Title) // as it was when the event happened
+		assert.Nil(events[0].Heartbeat)
+		assert.Equal(uint64(2), events[1].Seq)
+		assert.Equal(HeartbeatStreamEvent, events[1].Type)
+		assert.Equal(hb1.ID, events[1].Heartbeat.ID)
+		assert.Nil(events[1].Alert)
+		assert.Equal(AlertUpdatedStreamEvent, events[2].Type)
+		assert.Equal("updated", events[2].Alert.Title)
+
+		events, err = ListStreamEventsSince(db, "bar", 0)
+		assert.NoError(err)
+		assert.Equal(1, len(events))
+		assert.Equal(uint64(1), events[0].Seq)
+		assert.Equal(alert2.ID, events[0].ObjectID)
+
+		events, err = ListStreamEventsSince(db, "foo", 1)
+		assert.NoError(err)
+		assert.Equal(2, len(events))
+		assert.Equal(uint64(2), events[0].Seq)
+
+		events, err = ListStreamEventsSince(db, "foo", 3)
+		assert.NoError(err)
+		assert.Equal(0, len(events))
+	})
+}
+
+func TestStreamEventsAreTrimmed(t *testing.T) {
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		defer func(max uint64) { maxStreamEvents = max }(maxStreamEvents)
+		maxStreamEvents = 3
+
+		for i := 0; i < 5; i++ {
+			err := NewHeartbeat("apiKey1").Save(db, "foo")
+			assert.NoError(err)
+		}
+
+		events, err := ListStreamEventsSince(db, "foo", 0)
+		assert.NoError(err)
+		assert.Equal(3, len(events))
+		assert.Equal(uint64(3), events[0].Seq)
+		assert.Equal(uint64(5), events[2].Seq)
+	})
+}
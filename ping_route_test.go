@@ -2,7 +2,6 @@ package main
 
 import (
 	"testing"
-	"flag"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"net/http"
@@ -12,7 +11,6 @@ import (
 // TestPing verifies that the ping route returns a 204 status code.
 func TestPing(t *testing.T) {
 	assert := assert.New(t)
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
@@ -0,0 +1,207 @@
+// Package problem answers failed requests with RFC 7807 problem details, application/problem+json, so that clients
+// can tell the failures apart by the stable "code" of the problem rather than by the status alone.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// ContentType is the media type of problem responses
+const ContentType = "application/problem+json"
+
+// Code identifies the kind of problem. Codes are never changed once released, clients may depend on them.
+type Code string
+
+const (
+	InvalidBody         Code = "invalid_body"         // the body is not valid JSON or not of the expected form
+	ValidationFailed    Code = "validation_failed"    // fields of the body are missing or invalid, see errors
+	InvalidParameter    Code = "invalid_parameter"    // a query parameter is invalid
+	BodyTooLarge        Code = "body_too_large"       // the body is larger than allowed
+	MissingAPIKey       Code = "missing_api_key"      // no api key was given
+	InvalidAPIKey       Code = "invalid_api_key"      // the api key is unknown or not active
+	ForbiddenIP         Code = "forbidden_ip"         // the api key is not allowed from the address of the client
+	MissingToken        Code = "missing_token"        // no access token was given
+	InvalidToken        Code = "invalid_token"        // the access token can not be decrypted or has expired
+	Unauthenticated     Code = "unauthenticated"      // the request is not authenticated as any account
+	Forbidden           Code = "forbidden"            // the account lacks the capability or does not own the object
+	NotFound            Code = "not_found"            // the route or the object does not exist
+	Conflict            Code = "conflict"             // the request conflicts with the current state of the object
+	InvalidTransition   Code = "invalid_transition"   // the alert can not change to the requested status
+	InvalidMapping      Code = "invalid_mapping"      // the mapping of an integration fails on the payload
+	IdempotencyConflict Code = "idempotency_conflict" // the idempotency key was used for another request
+	InternalError       Code = "internal_error"       // the server failed, see the server log for the request id
+)
+
+// FieldError tells what is wrong with one field of the body
+type FieldError struct {
+	Field  string `json:"field"`  // JSON path of the field, e.g. "mapping.title"
+	Reason string `json:"reason"` // e.g. "required" or "invalid_type"
+	Detail string `json:"detail,omitempty"`
+}
+
+// Problem is an RFC 7807 problem with the extension members code, request_id and errors
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Code      Code         `json:"code"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`   // path of the request
+	RequestID string       `json:"request_id,omitempty"` // id of the request in the server log
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return string(p.Code)
+	}
+	return string(p.Code) + ": " + p.Detail
+}
+
+// New returns a problem with the status, code and formatted detail
+func New(status int, code Code, format string, args ...interface{}) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: fmt.Sprintf(format, args...),
+	}
+}
+
+// Invalid returns a 400 Bad Request problem with a field error for the field
+func Invalid(field string, reason string, format string, args ...interface{}) *Problem {
+	return Fields([]FieldError{{Field: field, Reason: reason, Detail: fmt.Sprintf(format, args...)}})
+}
+
+// Fields returns a 400 Bad Request problem with the field errors
+func Fields(errs []FieldError) *Problem {
+	p := New(http.StatusBadRequest, ValidationFailed, "The body has invalid fields")
+	p.Errors = errs
+	return p
+}
+
+// Internal returns a 500 Internal Server Error problem. The cause is logged rather than answered.
+func Internal() *Problem {
+	return New(http.StatusInternalServerError, InternalError, "The request failed, see the server log")
+}
+
+// Binding returns a 400 Bad Request problem, or 413 for a too large body, describing why binding the body failed,
+// with a field error for each invalid field
+func Binding(err error) *Problem {
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		p := New(http.StatusBadRequest, ValidationFailed, "The body has invalid fields")
+		for _, fe := range verrs {
+			p.Errors = append(p.Errors, FieldError{
+				Field:  fieldPath(fe.Namespace()),
+				Reason: fe.Tag(),
+				Detail: validationDetail(fe),
+			})
+		}
+		return p
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return Invalid(typeErr.Field, "invalid_type", "must be %s, not %s", jsonType(typeErr.Type), typeErr.Value)
+	}
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return New(http.StatusRequestEntityTooLarge, BodyTooLarge, "The body is larger than %d bytes", maxErr.Limit)
+	}
+
+	if errors.Is(err, io.EOF) {
+		return New(http.StatusBadRequest, InvalidBody, "The body is empty")
+	}
+
+	return New(http.StatusBadRequest, InvalidBody, "The body is not valid: %s", err)
+}
+
+// Abort answers the request with the problem and stops the handlers after the current
+func Abort(c *gin.Context, p *Problem) {
+	answered := *p
+	answered.Instance = c.Request.URL.Path
+	answered.RequestID = c.Writer.Header().Get("X-Request-ID")
+
+	c.Header("Content-Type", ContentType)
+	c.AbortWithStatusJSON(answered.Status, &answered)
+}
+
+// NoRoute answers requests to unknown routes
+func NoRoute(c *gin.Context) {
+	Abort(c, New(http.StatusNotFound, NotFound, "There is no %s %s", c.Request.Method, c.Request.URL.Path))
+}
+
+// Recovery answers requests whose handler panicked, after gin.CustomRecovery has logged the panic
+func Recovery(c *gin.Context, err interface{}) {
+	Abort(c, Internal())
+}
+
+func init() {
+	// name the fields of validation errors by their JSON names, as sent by the clients
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return f.Name
+			}
+			return name
+		})
+	}
+}
+
+// fieldPath drops the name of the bound struct from the namespace of a validation error,
+// e.g. "createAlertDTO.title" becomes "title"
+func fieldPath(namespace string) string {
+	if i := strings.Index(namespace, "."); i >= 0 {
+		return namespace[i+1:]
+	}
+	return namespace
+}
+
+func validationDetail(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "oneof":
+		return "must be one of " + fe.Param()
+	case "max":
+		return "must be at most " + fe.Param()
+	case "min":
+		return "must be at least " + fe.Param()
+	}
+	return fmt.Sprintf("fails %s %s", fe.Tag(), fe.Param())
+}
+
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return t.String()
+}
@@ -0,0 +1,109 @@
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type labelsDTO struct {
+	Labels map[string]string `json:"labels"`
+}
+
+type bindDTO struct {
+	Title    string    `json:"title" binding:"required"`
+	Priority string    `json:"priority" binding:"required,oneof=low medium high"`
+	Count    int       `json:"count"`
+	Nested   labelsDTO `json:"nested"`
+}
+
+func bind(t *testing.T, body string) *Problem {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("POST", "/", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	var dto bindDTO
+	err := c.ShouldBindJSON(&dto)
+	assert.Error(t, err)
+	return Binding(err)
+}
+
+func TestBinding(t *testing.T) {
+	assert := assert.New(t)
+
+	p := bind(t, `{"priority": "urgent"}`)
+	assert.Equal(http.StatusBadRequest, p.Status)
+	assert.Equal(ValidationFailed, p.Code)
+	assert.Equal([]FieldError{
+		{Field: "title", Reason: "required", Detail: "is required"},
+		{Field: "priority", Reason: "oneof", Detail: "must be one of low medium high"},
+	}, p.Errors)
+
+	p = bind(t, `{"title": "t", "priority": "low", "count": "many"}`)
+	assert.Equal(ValidationFailed, p.Code)
+	assert.Equal([]FieldError{{Field: "count", Reason: "invalid_type", Detail: "must be a number, not string"}}, p.Errors)
+
+	p = bind(t, `{"title": "t", "priority": "low", "nested": {"labels": []}}`)
+	assert.Equal("nested.labels", p.Errors[0].Field)
+
+	p = bind(t, ``)
+	assert.Equal(InvalidBody, p.Code)
+	assert.Equal("The body is empty", p.Detail)
+
+	p = bind(t, `{"title": `)
+	assert.Equal(InvalidBody, p.Code)
+	assert.Empty(p.Errors)
+
+	p = Binding(&http.MaxBytesError{Limit: 10})
+	assert.Equal(http.StatusRequestEntityTooLarge, p.Status)
+	assert.Equal(BodyTooLarge, p.Code)
+
+	p = Binding(errors.New("something else"))
+	assert.Equal(InvalidBody, p.Code)
+}
+
+func TestAbort(t *testing.T) {
+	assert := assert.New(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Header("X-Request-ID", "abc")
+	})
+	router.GET("/alerts/:id", func(c *gin.Context) {
+		Abort(c, New(http.StatusNotFound, NotFound, "No alert with id %s", c.Param("id")))
+	})
+	router.NoRoute(NoRoute)
+
+	req, _ := http.NewRequest("GET", "/alerts/42", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(http.StatusNotFound, res.Code)
+	assert.Equal(ContentType, res.Header().Get("Content-Type"))
+
+	var body map[string]interface{}
+	assert.NoError(json.Unmarshal(res.Body.Bytes(), &body))
+	assert.Equal(map[string]interface{}{
+		"type":       "about:blank",
+		"title":      "Not Found",
+		"status":     float64(404),
+		"code":       "not_found",
+		"detail":     "No alert with id 42",
+		"instance":   "/alerts/42",
+		"request_id": "abc",
+	}, body)
+
+	req, _ = http.NewRequest("DELETE", "/nothing", nil)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+	assert.Contains(res.Body.String(), "There is no DELETE /nothing")
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"net/http"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
 	"github.com/joakim666/wip_alerts/auth"
+	"github.com/joakim666/wip_alerts/logging"
 	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
 )
 
 type NewRenewalDTO struct {
@@ -24,20 +26,22 @@ type RenewalDTO struct {
 }
 
 func ListRenewals(db *bolt.DB) gin.HandlerFunc {
-	glog.Infof("listRenewals")
+	logging.Debugf("listRenewals")
 
 	var renewalDTOs []RenewalDTO
 
 	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
 		accounts, err := model.ListAccounts(db)
 		if err != nil {
-			glog.Errorf("ListRenewals failed: %s", err)
-			c.Status(500)
+			logger.Errorf("ListRenewals failed: %s", err)
+			problem.Abort(c, problem.Internal())
 		} else {
 			for _, v := range *accounts {
 				renewals, err := model.ListRenewals(db, v.ID)
 				if err != nil {
-					glog.Errorf("Failed to get renewals for account %s: %s", v.ID, err)
+					logger.Errorf("Failed to get renewals for account %s: %s", v.ID, err)
 				} else {
 					dtos := makeRenewalDTOs(db, v.ID, renewals)
 					renewalDTOs = append(renewalDTOs, *dtos...)
@@ -51,47 +55,54 @@ func ListRenewals(db *bolt.DB) gin.HandlerFunc {
 
 func PostRenewals(db *bolt.DB, privateKey interface{}) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
 		var json NewRenewalDTO
 
-		if c.BindJSON(&json) == nil {
-			token, err := auth.DecryptRefreshToken(json.RefreshToken, privateKey)
-			if err != nil {
-				glog.Errorf("Failed to decrypt refresh token: %s", err)
-				c.Status(500)
-				return
-			}
+		err := c.ShouldBindJSON(&json)
+		if err != nil {
+			logger.Infof("Binding failed: %s", err)
+			problem.Abort(c, problem.Binding(err))
+			return
+		}
 
-			renewal := model.NewRenewal()
-			renewal.RefreshTokenID = token.ID
+		token, err := auth.DecryptRefreshToken(json.RefreshToken, privateKey)
+		if err != nil {
+			logger.Errorf("Failed to decrypt refresh token: %s", err)
+			problem.Abort(c, problem.New(http.StatusUnauthorized, problem.InvalidToken, "The refresh token is not valid"))
+			return
+		}
 
-			// get existing renewals
-			renewals, err := model.ListRenewals(db, token.AccountID)
-			if err != nil {
-				glog.Errorf("Failed to get renewals: %s", err)
-				c.Status(500)
-				return
-			}
+		renewal := model.NewRenewal()
+		renewal.RefreshTokenID = token.ID
 
-			// add new renewal
-			(*renewals)[renewal.ID] = *renewal
+		// get existing renewals
+		renewals, err := model.ListRenewals(db, token.AccountID)
+		if err != nil {
+			logger.Errorf("Failed to get renewals: %s", err)
+			problem.Abort(c, problem.Internal())
+			return
+		}
 
-			// save the renewals
-			err = model.SaveRenewals(db, token.ID, renewals)
-			if err != nil {
-				glog.Errorf("Failed to save renewal in db: %s", err)
-				c.Status(500)
-				return
-			}
+		// add new renewal
+		(*renewals)[renewal.ID] = *renewal
 
-			c.JSON(201, gin.H{
-				"renewal_id": renewal.ID,
-			})
+		// save the renewals
+		err = model.SaveRenewals(db, token.AccountID, renewals)
+		if err != nil {
+			logger.Errorf("Failed to save renewal in db: %s", err)
+			problem.Abort(c, problem.Internal())
+			return
 		}
+
+		c.JSON(201, gin.H{
+			"renewal_id": renewal.ID,
+		})
 	}
 }
 
 func makeRenewalDTOs(db *bolt.DB, accountId string, renewals *map[string]model.Renewal) *[]RenewalDTO {
-	glog.Infof("makeRenewalDTOs. Size=%d", len(*renewals))
+	logging.Infof("makeRenewalDTOs. Size=%d", len(*renewals))
 	dtos := make([]RenewalDTO, 0)
 
 	if len(*renewals) > 0 {
@@ -105,7 +116,7 @@ func makeRenewalDTOs(db *bolt.DB, accountId string, renewals *map[string]model.R
 }
 
 func makeRenewalDTO(accountId string, renewal model.Renewal) RenewalDTO { // TODO pointers?
-	glog.Infof("makeRenewalDTO")
+	logging.Debugf("makeRenewalDTO")
 	var dto RenewalDTO
 
 	dto.ID = renewal.ID
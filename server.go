@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/problem"
+	"github.com/twinj/uuid"
+)
+
+// certReloader holds the TLS certificate of the api, which is reloaded from its files on SIGHUP so that renewed
+// certificates are used without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the certificate files again. The current certificate is kept if they can not be loaded.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// newHTTPServer creates the server of the api. 'certs' is nil when not using TLS.
+func newHTTPServer(cfg configHTTP, handler http.Handler, certs *certReloader) *http.Server {
+	srv := &http.Server{
+		Addr:         cfg.Addr,
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+
+	if certs != nil {
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+
+	return srv
+}
+
+// serve runs the server on the listener until SIGTERM or SIGINT is received on 'signals', and then gives the
+// in-flight requests up to 'timeout' to finish. SIGHUP reloads the TLS certificate. Returns when the
+// server is stopped, with an error if it failed or the requests did not finish in time.
+func serve(srv *http.Server, l net.Listener, certs *certReloader, signals <-chan os.Signal, timeout time.Duration) error {
+	if srv.TLSConfig != nil {
+		l = tls.NewListener(l, srv.TLSConfig)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(l)
+	}()
+
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if certs == nil {
+					continue
+				}
+				err := certs.reload()
+				if err != nil {
+					logging.Errorf("Failed to reload the TLS certificate, keeping the current one: %s", err)
+				} else {
+					logging.Infof("Reloaded the TLS certificate from %s", certs.certFile)
+				}
+				continue
+			}
+
+			logging.Infof("Received %s, waiting for in-flight requests to finish", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			return srv.Shutdown(ctx)
+		}
+	}
+}
+
+// limitBody answers requests with bodies larger than 'max' bytes with 413 Request Entity Too Large. Bodies without a
+// known length fail to be read beyond 'max' bytes.
+func limitBody(max int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
+		if c.Request.ContentLength > max {
+			logger.Errorf("Request body of %d bytes is larger than %d bytes", c.Request.ContentLength, max)
+			problem.Abort(c, problem.New(http.StatusRequestEntityTooLarge, problem.BodyTooLarge, "The body is larger than %d bytes", max))
+			return
+		}
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max)
+	}
+}
+
+// requestIDHeader carries the id of a request, given by the client or a proxy in front of the server, or generated
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// requestLogging gives every request an id, which is returned in the X-Request-ID header and added to everything
+// logged while serving the request, and logs the request when it is done. The query is left out of the log as it may
+// hold an api key.
+func requestLogging() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.Request.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.NewV4().String()
+		}
+		c.Header(requestIDHeader, id)
+
+		logger := logging.Default().With("request_id", id)
+		c.Request = c.Request.WithContext(logging.NewContext(c.Request.Context(), logger))
+
+		c.Next()
+
+		logger.Info("Request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+		)
+	}
+}
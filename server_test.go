@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert writes a self signed certificate for 127.0.0.1 with the common name to dir/cert.pem and
+// dir/key.pem
+func writeTestCert(t *testing.T, dir string, commonName string) {
+	assert := assert.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.NoError(err)
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "cert.pem"), cert, 0600))
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "key.pem"), b, 0600))
+}
+
+// peerCommonName connects to the server and returns the common name of its certificate
+func peerCommonName(t *testing.T, addr string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestServeReloadsCertificateOnSIGHUP(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "certs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	writeTestCert(t, dir, "first")
+	certs, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	assert.NoError(err)
+
+	cfg := defaultConfig().HTTP
+	srv := newHTTPServer(cfg, http.NotFoundHandler(), certs)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+
+	signals := make(chan os.Signal)
+	done := make(chan error)
+	go func() {
+		done <- serve(srv, l, certs, signals, time.Second)
+	}()
+
+	assert.Equal("first", peerCommonName(t, l.Addr().String()))
+
+	writeTestCert(t, dir, "second")
+	signals <- syscall.SIGHUP
+	signals <- syscall.SIGHUP // the first has been handled when the second is received
+	assert.Equal("second", peerCommonName(t, l.Addr().String()))
+
+	// a broken certificate is not loaded
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte("broken"), 0600))
+	signals <- syscall.SIGHUP
+	signals <- syscall.SIGHUP
+	assert.Equal("second", peerCommonName(t, l.Addr().String()))
+
+	signals <- syscall.SIGTERM
+	assert.NoError(<-done)
+}
+
+func TestServeDrainsRequestsOnSIGTERM(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	stream := newEventStream()
+	srv := newHTTPServer(defaultConfig().HTTP, handler, nil)
+	srv.RegisterOnShutdown(stream.Close)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+
+	signals := make(chan os.Signal)
+	done := make(chan error)
+	go func() {
+		done <- serve(srv, l, nil, signals, 5*time.Second)
+	}()
+
+	responses := make(chan string)
+	go func() {
+		res, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		responses <- string(b)
+	}()
+
+	<-started
+	signals <- syscall.SIGTERM
+
+	// the in-flight request is finished before serve returns
+	assert.Equal("done", <-responses)
+	assert.NoError(<-done)
+
+	// and the event streams are told to close
+	select {
+	case <-stream.Done():
+	default:
+		assert.Fail("event stream not closed")
+	}
+
+	_, err = http.Get("http://" + l.Addr().String() + "/")
+	assert.Error(err)
+}
+
+func TestLimitBody(t *testing.T) {
+	assert := assert.New(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(limitBody(10))
+	router.POST("/alerts", func(c *gin.Context) {
+		_, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	req, _ := http.NewRequest("POST", "/alerts", strings.NewReader("0123456789"))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(http.StatusNoContent, res.Code)
+
+	req, _ = http.NewRequest("POST", "/alerts", strings.NewReader("0123456789a"))
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(http.StatusRequestEntityTooLarge, res.Code)
+
+	// without a known length the body can not be read beyond the limit
+	req, _ = http.NewRequest("POST", "/alerts", ioutil.NopCloser(strings.NewReader("0123456789a")))
+	req.ContentLength = -1
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+}
+
+func TestRequestLogging(t *testing.T) {
+	assert := assert.New(t)
+
+	var out bytes.Buffer
+	assert.NoError(logging.Setup(&out, "json", "info"))
+	defer logging.Setup(os.Stderr, "text", "info")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(requestLogging())
+	router.GET("/alerts", func(c *gin.Context) {
+		logging.FromContext(c.Request.Context()).Infof("Listing alerts")
+		c.Status(http.StatusOK)
+	})
+
+	readRecords := func() []map[string]interface{} {
+		var records []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var record map[string]interface{}
+			assert.NoError(json.Unmarshal([]byte(line), &record))
+			records = append(records, record)
+		}
+		out.Reset()
+		return records
+	}
+
+	// the id of the client is used and added to everything logged while serving the request
+	req, _ := http.NewRequest("GET", "/alerts?apikey=3f2a9c1e-1111-2222-3333-444455556666", nil)
+	req.Header.Set("X-Request-ID", "client-42")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal("client-42", res.Header().Get("X-Request-ID"))
+
+	records := readRecords()
+	assert.Len(records, 2)
+	assert.Equal("Listing alerts", records[0]["msg"])
+	assert.Equal("client-42", records[0]["request_id"])
+	assert.Equal("client-42", records[1]["request_id"])
+	assert.Equal("GET", records[1]["method"])
+	assert.Equal("/alerts", records[1]["path"])
+	assert.Equal(float64(http.StatusOK), records[1]["status"])
+
+	// invalid ids are replaced
+	req, _ = http.NewRequest("GET", "/alerts", nil)
+	req.Header.Set("X-Request-ID", "not valid\nid")
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	id := res.Header().Get("X-Request-ID")
+	assert.Len(id, 36)
+
+	records = readRecords()
+	assert.Equal(id, records[0]["request_id"])
+	assert.Equal(id, records[1]["request_id"])
+}
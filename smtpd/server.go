@@ -0,0 +1,444 @@
+// Package smtpd implements a minimal SMTP server for receiving mail, enough for systems that can only report by
+// email. It does not relay mail and supports neither authentication nor TLS.
+package smtpd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joakim666/wip_alerts/logging"
+)
+
+// Backend decides which recipients are accepted and receives the accepted messages
+type Backend interface {
+	// CheckRecipient is called for each RCPT TO command. Returning an error rejects the recipient.
+	CheckRecipient(remote net.Addr, rcpt string) error
+	// Deliver is called with the raw message once it has been received. Returning an error rejects the message for
+	// all recipients, so the message must then not have been delivered to any of them.
+	Deliver(remote net.Addr, from string, rcpts []string, data []byte) error
+}
+
+// Error is an error with the SMTP reply code to answer with. Errors of other types returned by the Backend are
+// answered with 550 for recipients and 451 for messages.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// ErrServerClosed is returned by Serve after Close has been called
+var ErrServerClosed = errors.New("smtpd: Server closed")
+
+// maxLineLength is the longest command line accepted, including the CRLF, as the text lines of RFC 5321 4.5.3.1.6
+const maxLineLength = 1000
+
+var errLineTooLong = errors.New("smtpd: line too long")
+
+// Server is an SMTP server. The zero values of the limits give the defaults.
+type Server struct {
+	Domain         string        // the domain the server greets with
+	MaxMessageSize int64         // in bytes, defaults to 1 MB
+	MaxRecipients  int           // per message, defaults to 100
+	Timeout        time.Duration // for reading each command, defaults to 5 minutes
+	Backend        Backend
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections until Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, nil) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l, nil)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logging.Errorf("smtpd: accept failed: %s", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !s.track(nil, conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		go func() {
+			defer s.untrack(nil, conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops all listeners and closes all open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+
+	return nil
+}
+
+func (s *Server) track(l net.Listener, c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]bool)
+		s.conns = make(map[net.Conn]bool)
+	}
+	if l != nil {
+		s.listeners[l] = true
+	}
+	if c != nil {
+		s.conns[c] = true
+	}
+
+	return true
+}
+
+func (s *Server) untrack(l net.Listener, c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l != nil {
+		delete(s.listeners, l)
+	}
+	if c != nil {
+		delete(s.conns, c)
+		c.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) maxMessageSize() int64 {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+	return 1 << 20
+}
+
+func (s *Server) maxRecipients() int {
+	if s.MaxRecipients > 0 {
+		return s.MaxRecipients
+	}
+	return 100
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 5 * time.Minute
+}
+
+// session is the state of one connection
+type session struct {
+	server *Server
+	conn   net.Conn
+	text   *textproto.Conn
+
+	helo  string
+	from  *string
+	rcpts []string
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	sess := &session{
+		server: s,
+		conn:   conn,
+		text:   textproto.NewConn(conn),
+	}
+
+	sess.reply(220, fmt.Sprintf("%s ESMTP ready", s.Domain))
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.timeout()))
+
+		line, err := readLine(sess.text.R, maxLineLength)
+		if err == errLineTooLong {
+			sess.reply(500, "5.5.2 Line too long")
+			continue
+		}
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				logging.Infof("smtpd: connection from %s failed: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		cmd, arg := parseCommand(line)
+		if !sess.handle(cmd, arg) {
+			return
+		}
+	}
+}
+
+// readLine reads a line of at most 'max' bytes including the line break, without keeping more than that in memory.
+// A longer line is read to its end and discarded, and errLineTooLong is returned.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	tooLong := false
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong && len(line)+len(chunk) <= max {
+			line = append(line, chunk...)
+		} else {
+			tooLong = true
+			line = nil
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// handle handles a command and returns false when the connection should be closed
+func (sess *session) handle(cmd string, arg string) bool {
+	switch cmd {
+	case "HELO":
+		sess.helo = arg
+		sess.reset()
+		sess.reply(250, sess.server.Domain)
+	case "EHLO":
+		sess.helo = arg
+		sess.reset()
+		sess.reply(250, sess.server.Domain, "8BITMIME", fmt.Sprintf("SIZE %d", sess.server.maxMessageSize()))
+	case "MAIL":
+		sess.handleMail(arg)
+	case "RCPT":
+		sess.handleRcpt(arg)
+	case "DATA":
+		return sess.handleData()
+	case "RSET":
+		sess.reset()
+		sess.reply(250, "2.0.0 OK")
+	case "NOOP":
+		sess.reply(250, "2.0.0 OK")
+	case "VRFY":
+		sess.reply(252, "2.5.0 Cannot VRFY user")
+	case "QUIT":
+		sess.reply(221, "2.0.0 Bye")
+		return false
+	default:
+		sess.reply(502, "5.5.2 Command not implemented")
+	}
+
+	return true
+}
+
+func (sess *session) handleMail(arg string) {
+	if sess.helo == "" {
+		sess.reply(503, "5.5.1 Send HELO or EHLO first")
+		return
+	}
+	if sess.from != nil {
+		sess.reply(503, "5.5.1 Sender already given")
+		return
+	}
+
+	addr, params, err := parsePath(arg, "FROM:")
+	if err != nil {
+		sess.reply(501, "5.5.4 "+err.Error())
+		return
+	}
+
+	for _, p := range params {
+		if strings.HasPrefix(strings.ToUpper(p), "SIZE=") {
+			size, err := strconv.ParseInt(p[5:], 10, 64)
+			if err != nil {
+				sess.reply(501, "5.5.4 Invalid SIZE")
+				return
+			}
+			if size > sess.server.maxMessageSize() {
+				sess.reply(552, "5.3.4 Message too big")
+				return
+			}
+		}
+	}
+
+	sess.from = &addr
+	sess.reply(250, "2.1.0 OK")
+}
+
+func (sess *session) handleRcpt(arg string) {
+	if sess.from == nil {
+		sess.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+	if len(sess.rcpts) >= sess.server.maxRecipients() {
+		sess.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+
+	addr, _, err := parsePath(arg, "TO:")
+	if err != nil {
+		sess.reply(501, "5.5.4 "+err.Error())
+		return
+	}
+
+	err = sess.server.Backend.CheckRecipient(sess.conn.RemoteAddr(), addr)
+	if err != nil {
+		// the local part of the recipient may be a secret, e.g. an api key, and is not logged
+		logging.Infof("smtpd: rejected recipient from %s: %s", sess.conn.RemoteAddr(), err)
+		sess.replyError(err, 550, "5.1.1 Recipient rejected")
+		return
+	}
+
+	sess.rcpts = append(sess.rcpts, addr)
+	sess.reply(250, "2.1.5 OK")
+}
+
+// handleData reads the message and returns false when the connection should be closed
+func (sess *session) handleData() bool {
+	if sess.from == nil || len(sess.rcpts) == 0 {
+		sess.reply(503, "5.5.1 Send MAIL and RCPT first")
+		return true
+	}
+
+	sess.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+
+	max := sess.server.maxMessageSize()
+	sess.conn.SetReadDeadline(time.Now().Add(sess.server.timeout()))
+
+	r := sess.text.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		logging.Infof("smtpd: failed to read message from %s: %s", sess.conn.RemoteAddr(), err)
+		return false
+	}
+	if int64(len(data)) > max {
+		// read the rest of the message so the connection is usable again
+		_, err = io.Copy(ioutil.Discard, r)
+		if err != nil {
+			return false
+		}
+		sess.reset()
+		sess.reply(552, "5.3.4 Message too big")
+		return true
+	}
+
+	err = sess.server.Backend.Deliver(sess.conn.RemoteAddr(), *sess.from, sess.rcpts, data)
+	sess.reset()
+	if err != nil {
+		logging.Infof("smtpd: rejected message from %s: %s", sess.conn.RemoteAddr(), err)
+		sess.replyError(err, 451, "4.3.0 Message not accepted")
+		return true
+	}
+
+	sess.reply(250, "2.0.0 OK")
+	return true
+}
+
+func (sess *session) reset() {
+	sess.from = nil
+	sess.rcpts = nil
+}
+
+// reply sends a possibly multi-line reply
+func (sess *session) reply(code int, lines ...string) {
+	w := bufio.NewWriter(sess.conn)
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(w, "%d%s%s\r\n", code, sep, l)
+	}
+	w.Flush()
+}
+
+// replyError replies with the code and message of err if it is an *Error, otherwise with the given default
+func (sess *session) replyError(err error, code int, message string) {
+	if e, ok := err.(*Error); ok {
+		sess.reply(e.Code, e.Message)
+		return
+	}
+	sess.reply(code, message)
+}
+
+// parseCommand splits a command line into the upper cased command and its argument
+func parseCommand(line string) (string, string) {
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return strings.ToUpper(line), ""
+	}
+	return strings.ToUpper(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// parsePath parses the argument of MAIL and RCPT, e.g. "FROM:<a@b.c> SIZE=100", into the address and the parameters
+func parsePath(arg string, prefix string) (string, []string, error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, fmt.Errorf("Syntax error, expected %s<address>", prefix)
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, fmt.Errorf("Syntax error, address must be enclosed in <>")
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", nil, fmt.Errorf("Syntax error, address must be enclosed in <>")
+	}
+
+	return arg[1:end], strings.Fields(arg[end+1:]), nil
+}
@@ -0,0 +1,170 @@
+package smtpd
+
+import (
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testBackend struct {
+	mu       sync.Mutex
+	messages []string
+	rcpts    [][]string
+}
+
+func (b *testBackend) CheckRecipient(remote net.Addr, rcpt string) error {
+	if !strings.HasSuffix(rcpt, "@alerts.example") {
+		return &Error{Code: 550, Message: "5.1.1 Unknown recipient"}
+	}
+	return nil
+}
+
+func (b *testBackend) Deliver(remote net.Addr, from string, rcpts []string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.messages = append(b.messages, string(data))
+	b.rcpts = append(b.rcpts, rcpts)
+	return nil
+}
+
+func runTestServer(t *testing.T, maxSize int64, f func(addr string, backend *testBackend)) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &testBackend{}
+	s := &Server{Domain: "alerts.example", MaxMessageSize: maxSize, Backend: backend}
+
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	f(l.Addr().String(), backend)
+
+	s.Close()
+	assert.Equal(t, ErrServerClosed, <-done)
+}
+
+func TestSendMail(t *testing.T) {
+	runTestServer(t, 0, func(addr string, backend *testBackend) {
+		assert := assert.New(t)
+
+		msg := "Subject: Disk full\r\n\r\nThe disk is full\r\n.leading dot\r\n"
+		err := smtp.SendMail(addr, nil, "nas@example.com", []string{"key1@alerts.example", "key2@alerts.example"}, []byte(msg))
+		assert.NoError(err)
+
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+
+		assert.Equal(1, len(backend.messages))
+		assert.Equal("Subject: Disk full\n\nThe disk is full\n.leading dot\n", backend.messages[0])
+		assert.Equal([]string{"key1@alerts.example", "key2@alerts.example"}, backend.rcpts[0])
+	})
+}
+
+func TestSendMailToUnknownRecipient(t *testing.T) {
+	runTestServer(t, 0, func(addr string, backend *testBackend) {
+		assert := assert.New(t)
+
+		err := smtp.SendMail(addr, nil, "nas@example.com", []string{"key1@other.example"}, []byte("Subject: x\r\n\r\nx\r\n"))
+		assert.Error(err)
+		assert.Contains(err.Error(), "550")
+		assert.Equal(0, len(backend.messages))
+	})
+}
+
+func TestSendTooBigMail(t *testing.T) {
+	runTestServer(t, 100, func(addr string, backend *testBackend) {
+		assert := assert.New(t)
+
+		c, err := smtp.Dial(addr)
+		assert.NoError(err)
+		defer c.Close()
+
+		assert.NoError(c.Hello("localhost"))
+		assert.NoError(c.Mail("nas@example.com"))
+		assert.NoError(c.Rcpt("key1@alerts.example"))
+
+		w, err := c.Data()
+		assert.NoError(err)
+		w.Write([]byte("Subject: x\r\n\r\n" + strings.Repeat("x", 200) + "\r\n"))
+		err = w.Close()
+		assert.Error(err)
+		assert.Contains(err.Error(), "552")
+
+		// the connection can still be used
+		assert.NoError(c.Reset())
+		assert.NoError(c.Mail("nas@example.com"))
+		assert.NoError(c.Rcpt("key1@alerts.example"))
+		w, err = c.Data()
+		assert.NoError(err)
+		w.Write([]byte("Subject: x\r\n\r\nsmall\r\n"))
+		assert.NoError(w.Close())
+		assert.NoError(c.Quit())
+
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		assert.Equal(1, len(backend.messages))
+	})
+}
+
+func TestTooLongLine(t *testing.T) {
+	runTestServer(t, 0, func(addr string, backend *testBackend) {
+		assert := assert.New(t)
+
+		c, err := smtp.Dial(addr)
+		assert.NoError(err)
+		defer c.Close()
+
+		assert.NoError(c.Hello("localhost"))
+		err = c.Mail("nas@example.com" + strings.Repeat("x", 2*maxLineLength))
+		assert.Error(err)
+		assert.Contains(err.Error(), "500")
+
+		// the connection can still be used
+		assert.NoError(c.Mail("nas@example.com"))
+		assert.NoError(c.Quit())
+	})
+}
+
+func TestCommandOrder(t *testing.T) {
+	runTestServer(t, 0, func(addr string, backend *testBackend) {
+		assert := assert.New(t)
+
+		c, err := smtp.Dial(addr)
+		assert.NoError(err)
+		defer c.Close()
+
+		// RCPT before MAIL
+		assert.NoError(c.Hello("localhost"))
+		err = c.Rcpt("key1@alerts.example")
+		assert.Error(err)
+		assert.Contains(err.Error(), "503")
+	})
+}
+
+func TestParsePath(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, params, err := parsePath("FROM:<a@b.c> SIZE=100", "FROM:")
+	assert.NoError(err)
+	assert.Equal("a@b.c", addr)
+	assert.Equal([]string{"SIZE=100"}, params)
+
+	addr, _, err = parsePath("to: <a@b.c>", "TO:")
+	assert.NoError(err)
+	assert.Equal("a@b.c", addr)
+
+	_, _, err = parsePath("TO:a@b.c", "TO:")
+	assert.Error(err)
+
+	_, _, err = parsePath("FROM:<a@b.c>", "TO:")
+	assert.Error(err)
+}
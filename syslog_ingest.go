@@ -0,0 +1,289 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/logging"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/syslogd"
+)
+
+// syslogConfigDTO is the format of the syslog rules file
+type syslogConfigDTO struct {
+	APIKey      string                `json:"api_key"`      // the api key the alerts are created with
+	DedupWindow string                `json:"dedup_window"` // e.g. "10m", defaults to 10 minutes
+	Rules       []syslogRuleConfigDTO `json:"rules"`
+}
+
+type syslogRuleConfigDTO struct {
+	Source   string `json:"source"`   // network in CIDR notation or hostname of the sender, empty matches all
+	Severity string `json:"severity"` // the least severe severity matching, e.g. "err". Empty matches all
+	Match    string `json:"match"`    // regular expression the text must match, empty matches all
+	Priority string `json:"priority"` // the priority of the alerts, defaults to a priority from the severity
+	Ignore   bool   `json:"ignore"`   // drop matching messages instead of alerting
+}
+
+// syslogRule decides if and with which priority a message gives an alert
+type syslogRule struct {
+	network  *net.IPNet
+	hostname string
+	severity int
+	match    *regexp.Regexp
+	priority model.AlertPriority
+	ignore   bool
+}
+
+// matches checks if the rule applies to the message received from the ip
+func (r syslogRule) matches(ip net.IP, msg *syslogd.Message) bool {
+	if r.network != nil && (ip == nil || !r.network.Contains(ip)) {
+		return false
+	}
+	if r.hostname != "" && !strings.EqualFold(r.hostname, msg.Hostname) {
+		return false
+	}
+	if msg.Severity > r.severity {
+		return false
+	}
+	if r.match != nil && !r.match.MatchString(msg.Text) {
+		return false
+	}
+
+	return true
+}
+
+// syslogIngester turns syslog messages into alerts of the account of the configured api key. The first matching
+// rule decides what to do with a message, messages not matching any rule are dropped. Repeated messages within the
+// dedup window are dropped too, and after that update the still open alert instead of creating a new one.
+type syslogIngester struct {
+	db          *bolt.DB
+	stream      *eventStream
+	apiKeyID    string
+	rules       []syslogRule
+	dedupWindow time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]*list.Element // fingerprint => element of 'order'
+	order *list.List               // of *seenFingerprint, the most recently alerted first
+}
+
+// maxSeenFingerprints bounds the fingerprints remembered for the dedup window. When there are more, the oldest are
+// forgotten even if they are still within the window.
+const maxSeenFingerprints = 10000
+
+// seenFingerprint is when a message with the fingerprint was last alerted
+type seenFingerprint struct {
+	fingerprint string
+	at          time.Time
+}
+
+// loadSyslogIngester reads the rules file and validates it
+func loadSyslogIngester(db *bolt.DB, stream *eventStream, path string) (*syslogIngester, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config syslogConfigDTO
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid syslog config %s: %s", path, err)
+	}
+
+	return newSyslogIngester(db, stream, config)
+}
+
+func newSyslogIngester(db *bolt.DB, stream *eventStream, config syslogConfigDTO) (*syslogIngester, error) {
+	if config.APIKey == "" {
+		return nil, fmt.Errorf("The syslog config must have an api_key")
+	}
+
+	s := &syslogIngester{
+		db:          db,
+		stream:      stream,
+		apiKeyID:    config.APIKey,
+		dedupWindow: 10 * time.Minute,
+		seen:        make(map[string]*list.Element),
+		order:       list.New(),
+	}
+
+	if config.DedupWindow != "" {
+		d, err := time.ParseDuration(config.DedupWindow)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid dedup_window %s: %s", config.DedupWindow, err)
+		}
+		s.dedupWindow = d
+	}
+
+	for i, rc := range config.Rules {
+		r := syslogRule{severity: syslogd.Debug, ignore: rc.Ignore}
+
+		if rc.Source != "" {
+			if strings.Contains(rc.Source, "/") {
+				_, network, err := net.ParseCIDR(rc.Source)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid source of rule %d: %s", i+1, err)
+				}
+				r.network = network
+			} else {
+				r.hostname = rc.Source
+			}
+		}
+
+		if rc.Severity != "" {
+			severity, err := syslogd.ParseSeverity(rc.Severity)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid severity of rule %d: %s", i+1, err)
+			}
+			r.severity = severity
+		}
+
+		if rc.Match != "" {
+			re, err := regexp.Compile(rc.Match)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid match of rule %d: %s", i+1, err)
+			}
+			r.match = re
+		}
+
+		if rc.Priority != "" {
+			r.priority = model.AlertPriority(rc.Priority)
+			if r.priority != model.HighPriority && r.priority != model.NormalPriority && r.priority != model.LowPriority {
+				return nil, fmt.Errorf("Invalid priority of rule %d: %s", i+1, rc.Priority)
+			}
+		}
+
+		s.rules = append(s.rules, r)
+	}
+
+	return s, nil
+}
+
+// HandleMessage creates an alert for the message if a rule says so
+func (s *syslogIngester) HandleMessage(remote net.Addr, msg *syslogd.Message) {
+	ip := addrIP(remote)
+
+	var rule *syslogRule
+	for i := range s.rules {
+		if s.rules[i].matches(ip, msg) {
+			rule = &s.rules[i]
+			break
+		}
+	}
+	if rule == nil || rule.ignore {
+		return
+	}
+
+	hostname := msg.Hostname
+	if hostname == "" && ip != nil {
+		hostname = ip.String()
+	}
+
+	fingerprint := syslogFingerprint(hostname, msg)
+	if !s.firstSeen(fingerprint, time.Now()) {
+		logging.Infof("Dropping repeated syslog message from %s", hostname)
+		return
+	}
+
+	apiKey, accountID, err := model.GetAPIKey(s.db, s.apiKeyID)
+	if err != nil {
+		logging.Default().With(logging.APIKeyAttr, s.apiKeyID).Errorf("Failed to get api key: %s", err)
+		return
+	}
+	if apiKey == nil || model.APIKeyActive != apiKey.Status {
+		logging.Default().With(logging.APIKeyAttr, s.apiKeyID).Errorf("Dropping syslog message as the api key is not active")
+		return
+	}
+
+	alert := model.NewAlert(apiKey.ID)
+	alert.Title = truncate(msg.Text, 100)
+	alert.ShortDescription = fmt.Sprintf("%s on %s: %s", msg.SeverityName(), hostname, truncate(msg.Text, 200))
+	alert.LongDescription = msg.Text
+	alert.Priority = rule.priority
+	if alert.Priority == "" {
+		alert.Priority = model.PriorityFromSeverity(msg.SeverityName())
+	}
+	alert.Fingerprint = fingerprint
+	alert.TriggeredAt = msg.Timestamp
+	if alert.TriggeredAt.IsZero() {
+		alert.TriggeredAt = alert.CreatedAt
+	}
+
+	labels := map[string]string{"host": hostname, "severity": msg.SeverityName()}
+	if msg.AppName != "" {
+		labels["app"] = msg.AppName
+	}
+	alert.Labels = model.MergeLabels(apiKey.DefaultLabels, labels)
+
+	_, action, err := ingestAlert(s.db, s.stream, *accountID, model.Actor{Type: model.APIKeyActor, ID: apiKey.ID}, alert)
+	if err != nil {
+		logging.Errorf("Failed to save alert from syslog for account %s: %s", *accountID, err)
+		return
+	}
+
+	logging.Infof("Syslog message from %s %s alert with fingerprint %s", hostname, action, fingerprint)
+}
+
+// firstSeen records that a message with the fingerprint was seen and checks that it was not already seen within the
+// dedup window
+func (s *syslogIngester) firstSeen(fingerprint string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.seen[fingerprint]
+	if ok && now.Sub(e.Value.(*seenFingerprint).at) < s.dedupWindow {
+		return false
+	}
+	if ok {
+		e.Value.(*seenFingerprint).at = now
+		s.order.MoveToFront(e)
+	} else {
+		s.seen[fingerprint] = s.order.PushFront(&seenFingerprint{fingerprint: fingerprint, at: now})
+	}
+
+	// forget the fingerprints outside of the window, oldest first, and any beyond the maximum
+	for e := s.order.Back(); e != nil; e = s.order.Back() {
+		sf := e.Value.(*seenFingerprint)
+		if now.Sub(sf.at) < s.dedupWindow && s.order.Len() <= maxSeenFingerprints {
+			break
+		}
+		s.order.Remove(e)
+		delete(s.seen, sf.fingerprint)
+	}
+
+	return true
+}
+
+var digits = regexp.MustCompile("[0-9]+")
+
+// syslogFingerprint identifies repetitions of a message. Numbers are ignored since they often are counters, ids or
+// times that differ between otherwise identical messages.
+func syslogFingerprint(hostname string, msg *syslogd.Message) string {
+	h := sha256.New()
+	h.Write([]byte(strings.ToLower(hostname)))
+	h.Write([]byte{0})
+	h.Write([]byte(msg.AppName))
+	h.Write([]byte{0})
+	h.Write([]byte(digits.ReplaceAllString(msg.Text, "#")))
+
+	return "syslog-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// truncate shortens s to at most max runes
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max-3]) + "..."
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/syslogd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSyslogIngesterWithInvalidConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	configs := []syslogConfigDTO{
+		{},
+		{APIKey: "k", DedupWindow: "often"},
+		{APIKey: "k", Rules: []syslogRuleConfigDTO{{Source: "10.0.0.0/33"}}},
+		{APIKey: "k", Rules: []syslogRuleConfigDTO{{Severity: "bad"}}},
+		{APIKey: "k", Rules: []syslogRuleConfigDTO{{Match: "("}}},
+		{APIKey: "k", Rules: []syslogRuleConfigDTO{{Priority: "urgent"}}},
+	}
+	for _, c := range configs {
+		_, err := newSyslogIngester(nil, nil, c)
+		assert.Error(err, "%v", c)
+	}
+}
+
+func TestSyslogIngester(t *testing.T) {
+
+	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
+		assert := assert.New(t)
+
+		apiKey := model.NewAPIKey()
+		apiKey.DefaultLabels = map[string]string{"site": "dc1"}
+		assert.NoError(apiKey.Save(db, "55"))
+
+		s, err := newSyslogIngester(db, nil, syslogConfigDTO{
+			APIKey: apiKey.ID,
+			Rules: []syslogRuleConfigDTO{
+				{Match: "flapping", Ignore: true},
+				{Source: "10.1.0.0/16", Severity: "warning", Priority: "high"},
+				{Source: "switch1", Match: "changed state to down"},
+				{Severity: "crit"},
+			},
+		})
+		assert.NoError(err)
+
+		switchAddr := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 514}
+		otherAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 514}
+
+		countAlerts := func() int {
+			alerts, err := model.ListNonArchivedAlerts(db, "55")
+			assert.NoError(err)
+			return len(*alerts)
+		}
+
+		// 1. ignored and not matching messages give no alerts
+		s.HandleMessage(switchAddr, &syslogd.Message{Severity: syslogd.Error, Hostname: "r1", Text: "link flapping"})
+		s.HandleMessage(switchAddr, &syslogd.Message{Severity: syslogd.Notice, Hostname: "r1", Text: "config saved"})
+		s.HandleMessage(otherAddr, &syslogd.Message{Severity: syslogd.Error, Hostname: "web1", Text: "disk error"})
+		assert.Equal(0, countAlerts())
+
+		// 2. matching a rule on network and severity
+		s.HandleMessage(switchAddr, &syslogd.Message{Severity: syslogd.Warning, Hostname: "r1", AppName: "ospf", Text: "neighbor 10.1.0.1 down"})
+		assert.Equal(1, countAlerts())
+
+		alerts, err := model.ListNonArchivedAlerts(db, "55")
+		assert.NoError(err)
+		for _, a := range *alerts {
+			assert.Equal("neighbor 10.1.0.1 down", a.Title)
+			assert.Equal("warning on r1: neighbor 10.1.0.1 down", a.ShortDescription)
+			assert.Equal(model.HighPriority, a.Priority)
+			assert.Equal(map[string]string{"site": "dc1", "host": "r1", "app": "ospf", "severity": "warning"}, a.Labels)
+		}
+
+		// 3. repeated messages, also with other numbers, are deduplicated
+		for i := 0; i < 5; i++ {
+			s.HandleMessage(switchAddr, &syslogd.Message{Severity: syslogd.Warning, Hostname: "r1", AppName: "ospf", Text: "neighbor 10.1.0.2 down"})
+		}
+		assert.Equal(1, countAlerts())
+
+		// 4. matching a rule on hostname and text, the priority comes from the severity
+		s.HandleMessage(otherAddr, &syslogd.Message{Severity: syslogd.Notice, Hostname: "switch1", Text: "Gi0/1 changed state to down"})
+		assert.Equal(2, countAlerts())
+
+		// 5. after the dedup window the open alert is updated instead of creating a new one
+		s.dedupWindow = 0
+		s.HandleMessage(switchAddr, &syslogd.Message{Severity: syslogd.Warning, Hostname: "r1", AppName: "ospf", Text: "neighbor 10.1.0.1 down"})
+		assert.Equal(2, countAlerts())
+
+		// 6. the catch all rule on severity
+		s.HandleMessage(otherAddr, &syslogd.Message{Severity: syslogd.Critical, Text: "kernel panic"})
+		assert.Equal(3, countAlerts())
+
+		alerts, err = model.ListNonArchivedAlerts(db, "55")
+		assert.NoError(err)
+		found := false
+		for _, a := range *alerts {
+			if a.Title == "kernel panic" {
+				found = true
+				assert.Equal(model.HighPriority, a.Priority)
+				assert.Equal("192.168.1.1", a.Labels["host"])
+			}
+		}
+		assert.True(found)
+	})
+}
+
+func TestSyslogIngesterFirstSeen(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := newSyslogIngester(nil, nil, syslogConfigDTO{APIKey: "k", DedupWindow: "1m"})
+	assert.NoError(err)
+
+	now := time.Now()
+	assert.True(s.firstSeen("a", now))
+	assert.False(s.firstSeen("a", now.Add(30*time.Second)))
+	assert.True(s.firstSeen("b", now.Add(30*time.Second)))
+	assert.True(s.firstSeen("a", now.Add(2*time.Minute)))
+
+	// "b" is outside of the window by now and forgotten
+	assert.Equal(1, len(s.seen))
+
+	// the number of remembered fingerprints is bounded, the oldest are forgotten first
+	for i := 0; i < maxSeenFingerprints; i++ {
+		assert.True(s.firstSeen(fmt.Sprint(i), now.Add(2*time.Minute)))
+	}
+	assert.Equal(maxSeenFingerprints, len(s.seen))
+	assert.Equal(maxSeenFingerprints, s.order.Len())
+	assert.True(s.firstSeen("a", now.Add(2*time.Minute)))
+	assert.False(s.firstSeen(fmt.Sprint(maxSeenFingerprints-1), now.Add(2*time.Minute)))
+}
+
+func TestSyslogFingerprint(t *testing.T) {
+	assert := assert.New(t)
+
+	fp := syslogFingerprint("host1", &syslogd.Message{AppName: "app", Text: "job 123 failed"})
+	assert.Equal(fp, syslogFingerprint("HOST1", &syslogd.Message{AppName: "app", Text: "job 4567 failed"}))
+	assert.NotEqual(fp, syslogFingerprint("host2", &syslogd.Message{AppName: "app", Text: "job 123 failed"}))
+	assert.NotEqual(fp, syslogFingerprint("host1", &syslogd.Message{AppName: "app", Text: "job 123 done"}))
+}
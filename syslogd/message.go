@@ -0,0 +1,223 @@
+package syslogd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Severities as defined by RFC 5424, a lower value is more severe
+const (
+	Emergency = iota
+	Alert
+	Critical
+	Error
+	Warning
+	Notice
+	Informational
+	Debug
+)
+
+var severityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Message is a parsed syslog message. Fields not present in the message are empty.
+type Message struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time // zero if the message has no valid timestamp
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string // only RFC 5424
+	Text      string
+}
+
+// SeverityName returns the keyword of the severity of the message, e.g. "err"
+func (m Message) SeverityName() string {
+	return SeverityName(m.Severity)
+}
+
+// SeverityName returns the keyword of a severity, e.g. "err" for Error
+func SeverityName(severity int) string {
+	if severity < 0 || severity >= len(severityNames) {
+		return strconv.Itoa(severity)
+	}
+	return severityNames[severity]
+}
+
+// ParseSeverity parses a severity given as its keyword, e.g. "warning", or its number
+func ParseSeverity(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	for i, n := range severityNames {
+		if s == n {
+			return i, nil
+		}
+	}
+	// common aliases
+	switch s {
+	case "emergency", "panic":
+		return Emergency, nil
+	case "critical":
+		return Critical, nil
+	case "error":
+		return Error, nil
+	case "warn":
+		return Warning, nil
+	case "informational":
+		return Informational, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < Emergency || n > Debug {
+		return 0, fmt.Errorf("Invalid severity %s", s)
+	}
+	return n, nil
+}
+
+// Parse parses a message in either the RFC 5424 or the RFC 3164 (BSD) format. 'now' is used to give the RFC 3164
+// timestamps, which lack the year, a year.
+func Parse(b []byte, now time.Time) (*Message, error) {
+	s := strings.TrimRight(string(b), "\r\n\x00")
+
+	if !strings.HasPrefix(s, "<") {
+		return nil, fmt.Errorf("Missing priority")
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return nil, fmt.Errorf("Invalid priority")
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, fmt.Errorf("Invalid priority %s", s[1:end])
+	}
+
+	m := &Message{Facility: pri / 8, Severity: pri % 8}
+	s = s[end+1:]
+
+	if strings.HasPrefix(s, "1 ") {
+		err = parseRFC5424(m, s[2:])
+	} else {
+		parseRFC3164(m, s, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// parseRFC5424 parses what follows the version: TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(m *Message, s string) error {
+	fields := make([]string, 5)
+	for i := range fields {
+		var f string
+		f, s = nextField(s)
+		if f == "" {
+			return fmt.Errorf("Truncated RFC 5424 header")
+		}
+		if f != "-" {
+			fields[i] = f
+		}
+	}
+
+	if fields[0] != "" {
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("Invalid timestamp %s", fields[0])
+		}
+		m.Timestamp = t
+	}
+	m.Hostname = fields[1]
+	m.AppName = fields[2]
+	m.ProcID = fields[3]
+	m.MsgID = fields[4]
+
+	rest, err := skipStructuredData(s)
+	if err != nil {
+		return err
+	}
+	m.Text = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\xef\xbb\xbf")
+
+	return nil
+}
+
+// skipStructuredData skips the structured data element(s), or the nil value "-", at the start of s
+func skipStructuredData(s string) (string, error) {
+	if strings.HasPrefix(s, "-") {
+		return s[1:], nil
+	}
+	if !strings.HasPrefix(s, "[") {
+		return "", fmt.Errorf("Invalid structured data")
+	}
+
+	inElement, inQuotes := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inQuotes && c == '\\':
+			i++ // escaped character
+		case c == '"' && inElement:
+			inQuotes = !inQuotes
+		case c == '[' && !inQuotes:
+			inElement = true
+		case c == ']' && !inQuotes:
+			inElement = false
+			if i+1 == len(s) || s[i+1] != '[' {
+				return s[i+1:], nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("Unterminated structured data")
+}
+
+// parseRFC3164 parses what follows the priority: TIMESTAMP HOSTNAME TAG: MSG. Messages that do not follow the format
+// are kept as they are as the text.
+func parseRFC3164(m *Message, s string, now time.Time) {
+	const stampLen = len(time.Stamp)
+
+	if len(s) > stampLen {
+		t, err := time.ParseInLocation(time.Stamp, s[:stampLen], now.Location())
+		if err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0) // sent in december, received in january
+			}
+			m.Timestamp = t
+			s = strings.TrimPrefix(s[stampLen:], " ")
+
+			m.Hostname, s = nextField(s)
+		}
+	}
+
+	// the tag is alphanumeric and ends with ':' or '[pid]:'
+	tagEnd := strings.IndexAny(s, ":[ ")
+	if tagEnd > 0 && tagEnd <= 48 && s[tagEnd] != ' ' {
+		tag := s[:tagEnd]
+		rest := s[tagEnd:]
+		if rest[0] == '[' {
+			pidEnd := strings.Index(rest, "]:")
+			if pidEnd > 0 {
+				m.AppName = tag
+				m.ProcID = rest[1:pidEnd]
+				s = rest[pidEnd+2:]
+			}
+		} else {
+			m.AppName = tag
+			s = rest[1:]
+		}
+	}
+
+	m.Text = strings.TrimPrefix(s, " ")
+}
+
+// nextField returns the space separated field at the start of s and the rest after the space
+func nextField(s string) (string, string) {
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
@@ -0,0 +1,102 @@
+package syslogd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRFC5424(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2017, 1, 2, 15, 0, 0, 0, time.UTC)
+
+	m, err := Parse([]byte(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="App\]lication"] An application event`+"\n"), now)
+	assert.NoError(err)
+	assert.Equal(20, m.Facility)
+	assert.Equal(Notice, m.Severity)
+	assert.Equal(time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC), m.Timestamp.UTC())
+	assert.Equal("mymachine.example.com", m.Hostname)
+	assert.Equal("evntslog", m.AppName)
+	assert.Equal("", m.ProcID)
+	assert.Equal("ID47", m.MsgID)
+	assert.Equal("An application event", m.Text)
+
+	m, err = Parse([]byte("<34>1 - - su 123 - - \xef\xbb\xbf'su root' failed"), now)
+	assert.NoError(err)
+	assert.Equal(Critical, m.Severity)
+	assert.True(m.Timestamp.IsZero())
+	assert.Equal("", m.Hostname)
+	assert.Equal("su", m.AppName)
+	assert.Equal("123", m.ProcID)
+	assert.Equal("'su root' failed", m.Text)
+
+	_, err = Parse([]byte("<34>1 - - su"), now)
+	assert.Error(err)
+
+	_, err = Parse([]byte("<34>1 yesterday host app - - - text"), now)
+	assert.Error(err)
+}
+
+func TestParseRFC3164(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2017, 10, 12, 15, 0, 0, 0, time.UTC)
+
+	m, err := Parse([]byte("<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed for lonvick on /dev/pts/8"), now)
+	assert.NoError(err)
+	assert.Equal(4, m.Facility)
+	assert.Equal(Critical, m.Severity)
+	assert.Equal(time.Date(2017, 10, 11, 22, 14, 15, 0, time.UTC), m.Timestamp)
+	assert.Equal("mymachine", m.Hostname)
+	assert.Equal("su", m.AppName)
+	assert.Equal("230", m.ProcID)
+	assert.Equal("'su root' failed for lonvick on /dev/pts/8", m.Text)
+
+	m, err = Parse([]byte("<13>Oct  1 09:00:00 switch1 %LINK-3-UPDOWN: Interface Gi0/1, changed state to down"), now)
+	assert.NoError(err)
+	assert.Equal("switch1", m.Hostname)
+	assert.Equal("%LINK-3-UPDOWN", m.AppName)
+	assert.Equal("Interface Gi0/1, changed state to down", m.Text)
+
+	// from last year
+	m, err = Parse([]byte("<13>Dec 31 23:59:59 host app: text"), time.Date(2017, 1, 1, 0, 0, 10, 0, time.UTC))
+	assert.NoError(err)
+	assert.Equal(2016, m.Timestamp.Year())
+
+	// no header at all
+	m, err = Parse([]byte("<13>just some text"), now)
+	assert.NoError(err)
+	assert.True(m.Timestamp.IsZero())
+	assert.Equal("", m.Hostname)
+	assert.Equal("just some text", m.Text)
+
+	for _, s := range []string{"", "no priority", "<>x", "<192>x", "<abc>x"} {
+		_, err = Parse([]byte(s), now)
+		assert.Error(err, s)
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := ParseSeverity("err")
+	assert.NoError(err)
+	assert.Equal(Error, s)
+
+	s, err = ParseSeverity("Warning")
+	assert.NoError(err)
+	assert.Equal(Warning, s)
+
+	s, err = ParseSeverity("2")
+	assert.NoError(err)
+	assert.Equal(Critical, s)
+
+	_, err = ParseSeverity("8")
+	assert.Error(err)
+	_, err = ParseSeverity("bad")
+	assert.Error(err)
+
+	assert.Equal("crit", SeverityName(Critical))
+}
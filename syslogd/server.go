@@ -0,0 +1,289 @@
+// Package syslogd implements a syslog receiver for messages in the RFC 5424 and RFC 3164 formats sent over UDP, or
+// over TCP framed as described in RFC 6587.
+package syslogd
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joakim666/wip_alerts/logging"
+)
+
+// Handler receives the parsed messages
+type Handler interface {
+	HandleMessage(remote net.Addr, msg *Message)
+}
+
+// ErrServerClosed is returned by the Serve methods after Close has been called
+var ErrServerClosed = errors.New("syslogd: Server closed")
+
+// Server receives syslog messages. Messages that can not be parsed are logged and dropped.
+type Server struct {
+	Handler        Handler
+	MaxMessageSize int           // in bytes, defaults to 8 kB. Longer TCP messages are dropped, UDP messages truncated
+	Timeout        time.Duration // idle timeout of TCP connections, defaults to 10 minutes
+
+	mu      sync.Mutex
+	closers map[io.Closer]bool
+	closed  bool
+}
+
+// ListenAndServeUDP listens on the UDP address addr and handles messages until Close is called
+func (s *Server) ListenAndServeUDP(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.ServeUDP(conn)
+}
+
+// ListenAndServeTCP listens on the TCP address addr and handles messages until Close is called
+func (s *Server) ListenAndServeTCP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.ServeTCP(l)
+}
+
+// ServeUDP handles the messages received on conn, one message per packet, until Close is called
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	if !s.track(conn) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(conn)
+
+	buf := make([]byte, s.maxMessageSize())
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.handle(remote, buf[:n])
+	}
+}
+
+// ServeTCP accepts connections on the listener until Close is called
+func (s *Server) ServeTCP(l net.Listener) error {
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logging.Errorf("syslogd: accept failed: %s", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		go func() {
+			defer s.untrack(conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops all listeners and closes all open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for c := range s.closers {
+		c.Close()
+	}
+
+	return nil
+}
+
+// serveConn reads messages from a TCP connection. Each message is either prefixed with its length and a space
+// (octet counting) or terminated by a newline (non-transparent framing).
+func (s *Server) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	max := s.maxMessageSize()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.timeout()))
+
+		first, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+
+		var msg []byte
+		if first[0] >= '0' && first[0] <= '9' {
+			n, err := readFrameLength(r)
+			if err == errInvalidFrameLength {
+				logging.Infof("syslogd: invalid frame length from %s", conn.RemoteAddr())
+				return
+			}
+			if err != nil {
+				return
+			}
+			if n > max {
+				logging.Infof("syslogd: dropping message of %d bytes from %s", n, conn.RemoteAddr())
+				_, err = io.CopyN(ioutil.Discard, r, int64(n))
+				if err != nil {
+					return
+				}
+				continue
+			}
+			msg = make([]byte, n)
+			_, err = io.ReadFull(r, msg)
+			if err != nil {
+				return
+			}
+		} else {
+			msg, err = readLine(r, max)
+			if err == errLineTooLong {
+				logging.Infof("syslogd: dropping too long message from %s", conn.RemoteAddr())
+				continue
+			}
+			if err != nil && len(msg) == 0 {
+				return
+			}
+		}
+
+		s.handle(conn.RemoteAddr(), msg)
+	}
+}
+
+// maxFrameLengthDigits is the most digits accepted in the length prefix of octet counting framing
+const maxFrameLengthDigits = 10
+
+var errInvalidFrameLength = errors.New("Invalid frame length")
+
+// readFrameLength reads the length prefix of an octet counted message and the space following it. A prefix that is
+// not a positive number of at most maxFrameLengthDigits digits gives errInvalidFrameLength.
+func readFrameLength(r *bufio.Reader) (int, error) {
+	var digits []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b == ' ' {
+			break
+		}
+		if b < '0' || b > '9' || len(digits) == maxFrameLengthDigits {
+			return 0, errInvalidFrameLength
+		}
+		digits = append(digits, b)
+	}
+
+	n, err := strconv.Atoi(string(digits))
+	if err != nil || n < 1 {
+		return 0, errInvalidFrameLength
+	}
+	return n, nil
+}
+
+var errLineTooLong = errors.New("Line too long")
+
+// readLine reads up to and including the next newline. Lines longer than max are skipped and errLineTooLong
+// returned.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if len(line) > max+1 {
+				tooLong = true
+				line = nil
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong {
+			if err != nil {
+				return nil, err
+			}
+			return nil, errLineTooLong
+		}
+		return line, err
+	}
+}
+
+func (s *Server) handle(remote net.Addr, b []byte) {
+	msg, err := Parse(b, time.Now())
+	if err != nil {
+		logging.Infof("syslogd: dropping invalid message from %s: %s", remote, err)
+		return
+	}
+
+	s.Handler.HandleMessage(remote, msg)
+}
+
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.closers == nil {
+		s.closers = make(map[io.Closer]bool)
+	}
+	s.closers[c] = true
+
+	return true
+}
+
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.closers, c)
+	c.Close()
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) maxMessageSize() int {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+	return 8192
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 10 * time.Minute
+}
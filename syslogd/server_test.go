@@ -0,0 +1,124 @@
+package syslogd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testHandler struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+func (h *testHandler) HandleMessage(remote net.Addr, msg *Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, msg)
+}
+
+// waitFor waits until the handler has received n messages and returns them
+func (h *testHandler) waitFor(n int) []*Message {
+	for i := 0; i < 100; i++ {
+		h.mu.Lock()
+		if len(h.messages) >= n {
+			m := h.messages
+			h.mu.Unlock()
+			return m
+		}
+		h.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.messages
+}
+
+func TestServeUDP(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(err)
+
+	h := &testHandler{}
+	s := &Server{Handler: h}
+
+	done := make(chan error)
+	go func() {
+		done <- s.ServeUDP(conn)
+	}()
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	assert.NoError(err)
+	defer c.Close()
+
+	c.Write([]byte("<11>Oct 11 22:14:15 host1 app: first"))
+	c.Write([]byte("invalid"))
+	c.Write([]byte("<11>1 - host2 app - - - second"))
+
+	messages := h.waitFor(2)
+	assert.Equal(2, len(messages))
+	assert.Equal("first", messages[0].Text)
+	assert.Equal("second", messages[1].Text)
+
+	s.Close()
+	assert.Equal(ErrServerClosed, <-done)
+}
+
+func TestServeTCP(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+
+	h := &testHandler{}
+	s := &Server{Handler: h, MaxMessageSize: 100}
+
+	done := make(chan error)
+	go func() {
+		done <- s.ServeTCP(l)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(err)
+	defer c.Close()
+
+	framed := "<11>1 - host app - - - octet counted"
+	fmt.Fprintf(c, "%d %s", len(framed), framed)
+	fmt.Fprintf(c, "<11>Oct 11 22:14:15 host app: newline terminated\n")
+	fmt.Fprintf(c, "<11>Oct 11 22:14:15 host app: %s\n", strings.Repeat("x", 200)) // too long, dropped
+	fmt.Fprintf(c, "<11>Oct 11 22:14:15 host app: after long\n")
+
+	messages := h.waitFor(3)
+	assert.Equal(3, len(messages))
+	assert.Equal("octet counted", messages[0].Text)
+	assert.Equal("newline terminated", messages[1].Text)
+	assert.Equal("after long", messages[2].Text)
+
+	s.Close()
+	assert.Equal(ErrServerClosed, <-done)
+}
+
+func TestReadFrameLength(t *testing.T) {
+	assert := assert.New(t)
+
+	n, err := readFrameLength(bufio.NewReader(strings.NewReader("42 <11>")))
+	assert.NoError(err)
+	assert.Equal(42, n)
+
+	for _, prefix := range []string{"0 ", "12a ", "12345678901 ", strings.Repeat("9", 1000)} {
+		_, err = readFrameLength(bufio.NewReader(strings.NewReader(prefix)))
+		assert.Equal(errInvalidFrameLength, err, prefix)
+	}
+
+	_, err = readFrameLength(bufio.NewReader(strings.NewReader("12")))
+	assert.Equal(io.EOF, err)
+}
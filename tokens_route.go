@@ -1,13 +1,15 @@
 package main
 
 import (
+	"net/http"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/gin-gonic/gin"
-	"github.com/golang/glog"
 	"github.com/joakim666/wip_alerts/auth"
+	"github.com/joakim666/wip_alerts/logging"
 	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
 )
 
 type NewTokenDTO struct {
@@ -32,14 +34,16 @@ type TokenDTO struct {
 }
 
 func ListTokens(db *bolt.DB) gin.HandlerFunc {
-	glog.Infof("ListTokens")
+	logging.Debugf("ListTokens")
 
 	tokenDTOs := make(map[string]TokenDTO) // key = tokenID
 
 	return func(c *gin.Context) {
+		logger := logging.FromContext(c.Request.Context())
+
 		tokens, err := model.ListAllTokens(db)
 		if err != nil {
-			glog.Errorf("Failed to get tokens: %s", err)
+			logger.Errorf("Failed to get tokens: %s", err)
 		} else {
 			dtos := makeTokenDTOs(db, tokens)
 			for _, v := range *dtos {
@@ -51,56 +55,63 @@ func ListTokens(db *bolt.DB) gin.HandlerFunc {
 	}
 }
 
-// PostTokens creates a new token. 'publicKey' is the public part of the private-key used to sign and encrypt the refresh tokens. 'encryptionKey' is the shared key used to sign, encrypt, validate and decrypt the access tokens.
-func PostTokens(db *bolt.DB, publicKey interface{}, encryptionKey interface{}) gin.HandlerFunc {
+// PostTokens creates a new token. 'publicKey' is the public part of the private-key used to sign and encrypt the refresh tokens. 'encryptionKey' is the shared key used to sign, encrypt, validate and decrypt the access tokens. 'role' is the role given to the tokens of accounts without any granted roles.
+func PostTokens(db *bolt.DB, publicKey interface{}, encryptionKey interface{}, role string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		glog.Infof("PostTokens")
+		logger := logging.FromContext(c.Request.Context())
+
+		logger.Debugf("PostTokens")
 		var json NewTokenDTO
 
-		err := c.BindJSON(&json)
+		err := c.ShouldBindJSON(&json)
 		if err != nil {
-			glog.Infof("Binding failed: %s", err)
-			c.Status(400) // => Bad Request
+			logger.Infof("Binding failed: %s", err)
+			problem.Abort(c, problem.Binding(err))
 			return
 		}
 
-		glog.Infof("Json: %s", json)
-
 		switch json.GrantType {
 		case "account":
-			handleAccountRequest(c, &json, db, publicKey, encryptionKey)
+			handleAccountRequest(c, &json, db, publicKey, encryptionKey, role)
 			return
 		case "renewal":
-			handleRenewalRequest(c, &json, db, encryptionKey)
+			handleRenewalRequest(c, &json, db, encryptionKey, role)
 			return
 		default:
-			// bad request
-			c.Status(400)
+			problem.Abort(c, problem.Invalid("grant_type", "oneof", "must be one of account, renewal"))
 		}
 	}
 }
 
-func handleAccountRequest(c *gin.Context, json *NewTokenDTO, db *bolt.DB, publicKey interface{}, encryptionKey interface{}) {
-	glog.Infof("handleAccountRequest")
+func handleAccountRequest(c *gin.Context, json *NewTokenDTO, db *bolt.DB, publicKey interface{}, encryptionKey interface{}, role string) {
+	logger := logging.FromContext(c.Request.Context())
+
+	logger.Debugf("handleAccountRequest")
 	// AccountID is mandatory
 	if json.AccountID == nil {
-		c.Status(400)
+		problem.Abort(c, problem.Invalid("account_id", "required", "is required"))
 		return
 	}
 
 	// look up account
 	account, err := model.GetAccount(db, *json.AccountID)
 	if err != nil {
-		glog.Errorf("Failed to find matching account for id=%s: %s", *json.AccountID, err)
-		c.Status(400) // => Bad Request
+		logger.Errorf("Failed to get account %s: %s", *json.AccountID, err)
+		problem.Abort(c, problem.Internal())
+		return
+	}
+
+	if account == nil {
+		logger.Errorf("Failed to find matching account for id=%s", *json.AccountID)
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.NotFound, "No account with id %s", *json.AccountID))
 		return
 	}
 
 	// get already created tokens for this account
 	oldTokens, err := model.ListTokens(db, account.ID)
 	if err != nil {
-		glog.Errorf("Failed to find existing tokens for account with id=%s: %s", account.ID, err)
-		c.Status(400) // => Bad Request
+		logger.Errorf("Failed to find existing tokens for account with id=%s: %s", account.ID, err)
+		problem.Abort(c, problem.Internal())
 		return
 	}
 
@@ -108,34 +119,29 @@ func handleAccountRequest(c *gin.Context, json *NewTokenDTO, db *bolt.DB, public
 	for _, v := range *oldTokens {
 		if v.Type == "refresh_token" {
 			// this account id already has a created refresh token
-			glog.Errorf("Account %s already has a refresh token", account.ID)
-			c.Status(400) // => Bad Request
+			logger.Errorf("Account %s already has a refresh token", account.ID)
+			problem.Abort(c, problem.New(http.StatusBadRequest, problem.Conflict, "The account already has a refresh token, renew the access token with it"))
 			return
 		}
 	}
 
-	if account == nil {
-		glog.Errorf("Failed to find matching account for id=%s: %s", *json.AccountID, err)
-		c.Status(400) // => Bad Request
-		return
-	}
-
 	now := time.Now()
+	roles := accountRoles(account, role)
 
 	// begin - create refresh token
-	refreshTokenStr, err := createRefreshToken(now, *json.AccountID, db, publicKey)
+	refreshTokenStr, err := createRefreshToken(now, *json.AccountID, db, publicKey, roles)
 	if err != nil {
-		glog.Errorf("Failed to create refresh token: %s", err)
-		c.Status(500)
+		logger.Errorf("Failed to create refresh token: %s", err)
+		problem.Abort(c, problem.Internal())
 		return
 	}
 	// end - create refresh token
 
 	// begin - create access token
-	accessTokenStr, err := createAccessToken(now, *json.AccountID, db, encryptionKey)
+	accessTokenStr, err := createAccessToken(now, *json.AccountID, db, encryptionKey, roles)
 	if err != nil {
-		glog.Errorf("Failed to create access token: %s", err)
-		c.Status(500)
+		logger.Errorf("Failed to create access token: %s", err)
+		problem.Abort(c, problem.Internal())
 		return
 	}
 	// end - create access token
@@ -146,41 +152,60 @@ func handleAccountRequest(c *gin.Context, json *NewTokenDTO, db *bolt.DB, public
 	})
 }
 
-func handleRenewalRequest(c *gin.Context, json *NewTokenDTO, db *bolt.DB, encryptionKey interface{}) {
+func handleRenewalRequest(c *gin.Context, json *NewTokenDTO, db *bolt.DB, encryptionKey interface{}, role string) {
+	logger := logging.FromContext(c.Request.Context())
+
 	// RenewalID is mandatory
 	if json.RenewalID == nil {
-		c.Status(400)
+		problem.Abort(c, problem.Invalid("renewal_id", "required", "is required"))
 		return
 	}
 
+	// the renewal id gives an access token, so it is only logged masked
+	logger = logger.With(logging.RenewalAttr, *json.RenewalID)
+
 	// look up account from RenewalID
 	renewal, accountID, err := model.GetRenewal(db, *json.RenewalID)
 	if err != nil {
-		glog.Errorf("Failed to find matching renewal for id=%s: %s", *json.RenewalID, err)
-		c.Status(400) // => Bad Request
+		logger.Errorf("Failed to get renewal: %s", err)
+		problem.Abort(c, problem.Internal())
 		return
 	}
 
 	if renewal == nil {
-		glog.Errorf("Failed to find matching renewal for id=%s: %s", *json.RenewalID, err)
-		c.Status(400) // => Bad Request
+		logger.Errorf("Failed to find matching renewal")
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.NotFound, "No renewal with id %s", *json.RenewalID))
 		return
 	}
 
 	if renewal.UsedAt != nil {
 		// this renewal has already been used
-		glog.Errorf("Renewal %s has already been used", *json.RenewalID)
-		c.Status(400) // => Bad Request
+		logger.Errorf("Renewal has already been used")
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.Conflict, "The renewal has already been used"))
+		return
+	}
+
+	// the roles may have changed since the refresh token was created
+	account, err := model.GetAccount(db, *accountID)
+	if err != nil {
+		logger.Errorf("Failed to get account %s of renewal: %s", *accountID, err)
+		problem.Abort(c, problem.Internal())
+		return
+	}
+
+	if account == nil {
+		logger.Errorf("Failed to find account %s of renewal", *accountID)
+		problem.Abort(c, problem.New(http.StatusBadRequest, problem.NotFound, "No account with id %s", *accountID))
 		return
 	}
 
 	now := time.Now()
 
 	// begin - create access token
-	accessTokenStr, err := createAccessToken(now, *accountID, db, encryptionKey)
+	accessTokenStr, err := createAccessToken(now, *accountID, db, encryptionKey, accountRoles(account, role))
 	if err != nil {
-		glog.Errorf("Failed to create access token: %s", err)
-		c.Status(500)
+		logger.Errorf("Failed to create access token: %s", err)
+		problem.Abort(c, problem.Internal())
 		return
 	}
 	// end - create access token
@@ -189,8 +214,8 @@ func handleRenewalRequest(c *gin.Context, json *NewTokenDTO, db *bolt.DB, encryp
 	renewal.UsedAt = &now
 	err = renewal.Save(db, *accountID)
 	if err != nil {
-		glog.Errorf("Failed to saved renewal: %s", err)
-		c.Status(500)
+		logger.Errorf("Failed to saved renewal: %s", err)
+		problem.Abort(c, problem.Internal())
 		return
 	}
 
@@ -200,8 +225,28 @@ func handleRenewalRequest(c *gin.Context, json *NewTokenDTO, db *bolt.DB, encryp
 
 }
 
-func createRefreshToken(creationTime time.Time, accountID string, db *bolt.DB, publicKey interface{}) (string, error) {
-	glog.Infof("createRefreshToken")
+// currentAccountRoles returns a lookup of the roles accounts have now, for auth.Policy. Accounts that no longer exist
+// have no roles.
+func currentAccountRoles(db *bolt.DB, defaultRole string) func(accountID string) ([]string, error) {
+	return func(accountID string) ([]string, error) {
+		account, err := model.GetAccount(db, accountID)
+		if err != nil || account == nil {
+			return nil, err
+		}
+		return accountRoles(account, defaultRole), nil
+	}
+}
+
+// accountRoles returns the roles granted to the account, or the default role if none are granted
+func accountRoles(account *model.Account, defaultRole string) []string {
+	if len(account.Roles) > 0 {
+		return account.Roles
+	}
+	return []string{defaultRole}
+}
+
+func createRefreshToken(creationTime time.Time, accountID string, db *bolt.DB, publicKey interface{}, roles []string) (string, error) {
+	logging.Debugf("createRefreshToken")
 
 	dbRefreshToken := model.NewToken()
 
@@ -211,7 +256,7 @@ func createRefreshToken(creationTime time.Time, accountID string, db *bolt.DB, p
 	refreshToken.AccountID = accountID
 	refreshToken.Type = "refresh_token" // TODO enum
 	refreshToken.Scope = auth.Scope{
-		Roles:        []string{"user"},
+		Roles:        roles,
 		Capabilities: []string{"refresh_token"}}
 
 	dbRefreshToken.IssueTime = creationTime
@@ -236,7 +281,7 @@ func createRefreshToken(creationTime time.Time, accountID string, db *bolt.DB, p
 	return res, nil
 }
 
-func createAccessToken(creationTime time.Time, accountID string, db *bolt.DB, encryptionKey interface{}) (string, error) {
+func createAccessToken(creationTime time.Time, accountID string, db *bolt.DB, encryptionKey interface{}, roles []string) (string, error) {
 	dbAccessToken := model.NewToken()
 
 	accessToken := auth.Token{}
@@ -245,7 +290,7 @@ func createAccessToken(creationTime time.Time, accountID string, db *bolt.DB, en
 	accessToken.AccountID = accountID
 	accessToken.Type = "access_token" // TODO enum
 	accessToken.Scope = auth.Scope{
-		Roles:        []string{"user"},
+		Roles:        roles,
 		Capabilities: []string{"access_token"}}
 
 	dbAccessToken.IssueTime = creationTime
@@ -271,7 +316,7 @@ func createAccessToken(creationTime time.Time, accountID string, db *bolt.DB, en
 }
 
 func makeTokenDTOs(db *bolt.DB, tokens *map[string][]model.Token) *[]TokenDTO {
-	glog.Infof("makeTokenDTOs. Size=%d", len(*tokens))
+	logging.Infof("makeTokenDTOs. Size=%d", len(*tokens))
 	dtos := make([]TokenDTO, 0)
 
 	if len(*tokens) > 0 {
@@ -287,7 +332,7 @@ func makeTokenDTOs(db *bolt.DB, tokens *map[string][]model.Token) *[]TokenDTO {
 }
 
 func makeTokenDTO(accountId string, token model.Token) TokenDTO { // TODO pointers?
-	glog.Infof("makeTokenDTO")
+	logging.Debugf("makeTokenDTO")
 	var dto TokenDTO
 
 	dto.ID = token.ID
@@ -301,7 +346,7 @@ func makeTokenDTO(accountId string, token model.Token) TokenDTO { // TODO pointe
 }
 
 func makeScopeDTO(scope model.Scope) ScopeDTO {
-	glog.Infof("makeScopeDTO")
+	logging.Debugf("makeScopeDTO")
 	var dto ScopeDTO
 
 	dto.Roles = scope.Roles
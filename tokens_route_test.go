@@ -1,14 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -16,7 +17,9 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/gin-gonic/gin"
 	"github.com/joakim666/wip_alerts/auth"
+	"github.com/joakim666/wip_alerts/logging"
 	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -292,7 +295,7 @@ func TestPostTokensWithoutData(t *testing.T) {
 		gin.SetMode(gin.TestMode)
 		router := gin.New()
 
-		router.POST("/tokens", PostTokens(db, publicKey, sharedKey))
+		router.POST("/tokens", PostTokens(db, publicKey, sharedKey, "user"))
 
 		req, _ := http.NewRequest("POST", "/tokens", strings.NewReader(""))
 		res := httptest.NewRecorder()
@@ -314,7 +317,7 @@ func TestPostTokensWithInvalidData(t *testing.T) {
 		gin.SetMode(gin.TestMode)
 		router := gin.New()
 
-		router.POST("/tokens", PostTokens(db, publicKey, sharedKey))
+		router.POST("/tokens", PostTokens(db, publicKey, sharedKey, "user"))
 
 		var bodies []string
 
@@ -371,7 +374,6 @@ func TestPostTokensWithInvalidData(t *testing.T) {
 }
 
 func TestPostTokensWithAccountId(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -386,7 +388,7 @@ func TestPostTokensWithAccountId(t *testing.T) {
 		gin.SetMode(gin.TestMode)
 		router := gin.New()
 
-		router.POST("/tokens", PostTokens(db, &privateKey.PublicKey, sharedKey))
+		router.POST("/tokens", PostTokens(db, &privateKey.PublicKey, sharedKey, "user"))
 
 		// create and save account
 		account := model.NewAccount()
@@ -417,7 +419,6 @@ func TestPostTokensWithAccountId(t *testing.T) {
 
 		resMap := resJson.(map[string]interface{})
 
-		//glog.Info("Res: %s", resJson)
 		assert.NotEmpty(resMap["refresh_token"])
 		assert.NotEmpty(resMap["access_token"])
 
@@ -428,16 +429,11 @@ func TestPostTokensWithAccountId(t *testing.T) {
 
 		router.ServeHTTP(res, req)
 
-		assert.Equal(400, res.Code)
-
-		resBody, err = ioutil.ReadAll(res.Body)
-		assert.NoError(err)
-		assert.Empty(resBody)
+		assertProblem(t, res, 400, problem.Conflict)
 	})
 }
 
 func TestPostTokensWithRenewalId(t *testing.T) {
-	flag.Lookup("logtostderr").Value.Set("true")
 
 	RunInTestDb(t, func(t *testing.T, db *bolt.DB) {
 		assert := assert.New(t)
@@ -452,7 +448,7 @@ func TestPostTokensWithRenewalId(t *testing.T) {
 		gin.SetMode(gin.TestMode)
 		router := gin.New()
 
-		router.POST("/tokens", PostTokens(db, &privateKey.PublicKey, sharedKey))
+		router.POST("/tokens", PostTokens(db, &privateKey.PublicKey, sharedKey, "user"))
 
 		// create and save account
 		account := model.NewAccount()
@@ -493,16 +489,20 @@ func TestPostTokensWithRenewalId(t *testing.T) {
 		assert.NotEmpty(resMap["access_token"])
 
 		// Test: Using the same renewal id again should result in 400 Bad Request
+		var out bytes.Buffer
+		assert.NoError(logging.Setup(&out, "json", "info"))
+		defer logging.Setup(os.Stderr, "text", "info")
+
 		req, _ = http.NewRequest("POST", "/tokens", strings.NewReader(body))
 		res = httptest.NewRecorder()
 
 		router.ServeHTTP(res, req)
 
-		assert.Equal(400, res.Code)
-
-		resBody, err = ioutil.ReadAll(res.Body)
-		assert.NoError(err)
-		assert.Empty(resBody)
+		assertProblem(t, res, 400, problem.Conflict)
 
+		// the renewal id is only logged masked
+		assert.Contains(out.String(), "Renewal has already been used")
+		assert.Contains(out.String(), logging.MaskID(renewal.ID))
+		assert.NotContains(out.String(), renewal.ID)
 	})
 }
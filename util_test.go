@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"testing"
 
 	"github.com/boltdb/bolt"
+	"github.com/joakim666/wip_alerts/problem"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -38,7 +41,6 @@ func newTestDB() (*bolt.DB, error) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		buckets := []string{"Accounts", "Devices", "Renewals", "APIKeys", "Heartbeats", "Tokens", "Alerts"}
 		for _, b := range buckets {
 			_, err := tx.CreateBucketIfNotExists([]byte(b))
 			if err != nil {
@@ -58,3 +60,18 @@ func closeTestDB(db *bolt.DB) {
 	defer os.Remove(db.Path())
 	db.Close()
 }
+
+// assertProblem checks that the response is a problem with the status and code, and returns the problem
+func assertProblem(t *testing.T, res *httptest.ResponseRecorder, status int, code problem.Code) *problem.Problem {
+	assert := assert.New(t)
+
+	assert.Equal(status, res.Code)
+	assert.Equal(problem.ContentType, res.Header().Get("Content-Type"))
+
+	var p problem.Problem
+	assert.NoError(json.Unmarshal(res.Body.Bytes(), &p))
+	assert.Equal(status, p.Status)
+	assert.Equal(code, p.Code)
+
+	return &p
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/joakim666/wip_alerts/model"
+	"github.com/joakim666/wip_alerts/problem"
+)
+
+// bindPayload binds the JSON body of the request to obj. Unlike ShouldBindJSON it rejects a body that is not valid
+// UTF-8, which the JSON decoder would otherwise silently replace with U+FFFD.
+func bindPayload(c *gin.Context, obj interface{}) *problem.Problem {
+	body, p := readPayload(c)
+	if p != nil {
+		return p
+	}
+	err := binding.JSON.BindBody(body, obj)
+	if err != nil {
+		return problem.Binding(err)
+	}
+	return nil
+}
+
+// readPayload reads the body of the request, which must be valid UTF-8
+func readPayload(c *gin.Context) ([]byte, *problem.Problem) {
+	body, err := c.GetRawData()
+	if err != nil {
+		return nil, problem.Binding(err)
+	}
+	if !utf8.Valid(body) {
+		return nil, problem.New(http.StatusBadRequest, problem.InvalidBody, "The body is not valid UTF-8")
+	}
+	return body, nil
+}
+
+// fieldErrors collects the errors of the fields of a payload
+type fieldErrors []problem.FieldError
+
+func (e *fieldErrors) add(field string, reason string, format string, args ...interface{}) {
+	*e = append(*e, problem.FieldError{Field: field, Reason: reason, Detail: fmt.Sprintf(format, args...)})
+}
+
+// text checks the length and the characters of a text field. Line breaks and tabs are only allowed if multiline.
+func (e *fieldErrors) text(field string, s string, max int64, multiline bool) {
+	if n := utf8.RuneCountInString(s); int64(n) > max {
+		e.add(field, "max", "must be at most %d characters, it is %d", max, n)
+	}
+	for _, r := range s {
+		if multiline && (r == '\n' || r == '\r' || r == '\t') {
+			continue
+		}
+		if unicode.IsControl(r) {
+			e.add(field, "control_character", "must not contain the control character %U", r)
+			return
+		}
+	}
+}
+
+// time checks that t is within the window around the server time now
+func (e *fieldErrors) time(field string, t time.Time, limits configValidation, now time.Time) {
+	if t.After(now.Add(limits.MaxClockSkew)) {
+		e.add(field, "in_future", "must not be more than %s after the server time", limits.MaxClockSkew)
+	}
+	if limits.MaxAge > 0 && t.Before(now.Add(-limits.MaxAge)) {
+		e.add(field, "too_old", "must not be more than %s before the server time", limits.MaxAge)
+	}
+}
+
+func (e fieldErrors) problem() *problem.Problem {
+	if len(e) == 0 {
+		return nil
+	}
+	return problem.Fields(e)
+}
+
+// validateAlert checks the alert against the limits, beyond what the binding tags check, and returns a problem
+// with an error for each invalid field or nil if the alert is valid
+func validateAlert(a *createAlertDTO, limits configValidation, now time.Time) *problem.Problem {
+	var errs fieldErrors
+
+	errs.text("title", a.Title, limits.MaxTitleLength, false)
+	errs.text("short_description", a.ShortDescription, limits.MaxShortDescriptionLength, true)
+	errs.text("long_description", a.LongDescription, limits.MaxLongDescriptionLength, true)
+	errs.time("triggered_at", a.TriggeredAt, limits, now)
+
+	if int64(len(a.Labels)) > limits.MaxLabels {
+		errs.add("labels", "max", "must have at most %d labels, it has %d", limits.MaxLabels, len(a.Labels))
+	}
+	if err := model.ValidateLabels(a.Labels); err != nil {
+		errs.add("labels", "invalid", "%s", err)
+	}
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // for errors in a stable order
+	for _, k := range keys {
+		if n := utf8.RuneCountInString(k); int64(n) > limits.MaxLabelLength {
+			errs.add("labels", "max", "keys must be at most %d characters, one is %d", limits.MaxLabelLength, n)
+			continue
+		}
+		if strings.IndexFunc(k, unicode.IsControl) >= 0 {
+			errs.add("labels", "control_character", "keys must not contain control characters, %q does", k)
+			continue
+		}
+		errs.text("labels."+k, a.Labels[k], limits.MaxLabelLength, false)
+	}
+
+	return errs.problem()
+}
+
+// validateIngestedAlert checks an alert mapped from the payload of an integration or of the Alertmanager against the
+// limits, like validateAlert. MaxAge does not apply as the sources keep sending alerts that started long ago.
+func validateIngestedAlert(a *model.Alert, labels map[string]string, limits configValidation, now time.Time) *problem.Problem {
+	limits.MaxAge = 0
+
+	return validateAlert(&createAlertDTO{
+		Title:            a.Title,
+		ShortDescription: a.ShortDescription,
+		LongDescription:  a.LongDescription,
+		Priority:         a.Priority,
+		TriggeredAt:      a.TriggeredAt,
+		Labels:           labels,
+	}, limits, now)
+}
+
+// validateHeartbeat checks the heartbeat against the limits and returns a problem with an error for each invalid
+// field or nil if the heartbeat is valid
+func validateHeartbeat(hb *createHeartbeatDTO, limits configValidation, now time.Time) *problem.Problem {
+	var errs fieldErrors
+
+	errs.time("executed_at", hb.ExecutedAt, limits, now)
+
+	return errs.problem()
+}